@@ -0,0 +1,101 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/antbern/z80-emulator/asm"
+	"github.com/antbern/z80-emulator/core"
+	"github.com/antbern/z80-emulator/symbols"
+)
+
+// runAsm implements the asm subcommand, which assembles a source file into a binary, an Intel HEX file
+// and a listing
+func runAsm(args []string) int {
+	fs := flag.NewFlagSet("asm", flag.ExitOnError)
+	out := fs.String("o", "", "The base name of the output files, defaults to the source file without its extension")
+	outputs := fs.String("outputs", "bin,hex,lst", "The outputs to write: bin, hex and lst")
+	fill := fs.Uint("fill", 0, "The value of the gaps between the segments of the binary")
+	var includeDirs, defines listFlags
+	fs.Var(&includeDirs, "I", "A directory to search for included files (repeatable)")
+	fs.Var(&defines, "D", "Define a symbol as name or name=value (repeatable)")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s asm [flags] file.asm\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+	source := fs.Arg(0)
+	base := *out
+	if base == "" {
+		base = strings.TrimSuffix(source, filepath.Ext(source))
+	}
+
+	syms := symbols.NewTable()
+	for _, def := range defines {
+		parts := strings.SplitN(def, "=", 2)
+		value := uint16(1)
+		if len(parts) == 2 {
+			v, err := symbols.ParseNumber(parts[1])
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return 2
+			}
+			value = uint16(v)
+		}
+		syms.Add(symbols.Symbol{Name: parts[0], Value: value, Kind: symbols.Constant})
+	}
+
+	a := &asm.Assembler{IncludeDirs: includeDirs, Symbols: syms}
+	p, err := a.AssembleFile(source)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	writers := map[string]func(w io.Writer) error{
+		"bin": func(w io.Writer) error {
+			_, data := p.Binary(uint8(*fill))
+			_, err := w.Write(data)
+			return err
+		},
+		"hex": func(w io.Writer) error { return core.WriteIntelHex(w, p.Image) },
+		"lst": p.WriteListing,
+	}
+	kinds := strings.Split(*outputs, ",")
+	for i, kind := range kinds {
+		kinds[i] = strings.TrimSpace(kind)
+		if writers[kinds[i]] == nil {
+			fmt.Fprintf(os.Stderr, "Unknown output %q\n", kinds[i])
+			return 2
+		}
+	}
+	for _, kind := range kinds {
+		write := writers[kind]
+		path := base + "." + kind
+		f, err := os.Create(path)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		err = write(f)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+	_, data := p.Binary(0)
+	fmt.Fprintf(os.Stderr, "Assembled %v: %d bytes, %d symbols\n", source, len(data), p.Symbols.Len())
+	return 0
+}
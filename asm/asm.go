@@ -0,0 +1,169 @@
+// Package asm is a Z80 assembler for single instructions and short programs, using the names and
+// syntax of the disassembler.
+package asm
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/antbern/z80-emulator/symbols"
+)
+
+// Resolver looks up the value of a symbol, such as a symbols.Table
+type Resolver interface {
+	Lookup(name string) (uint16, bool)
+}
+
+// statement is a line split into its parts
+type statement struct {
+	label    string
+	mnemonic string // upper case
+	operands string
+}
+
+// word returns the identifier at the start of s, which can start with . or # as used by directives
+func word(s string) string {
+	i := 0
+	if i < len(s) && (s[i] == '.' || s[i] == '#') {
+		i++
+	}
+	for i < len(s) && symbols.IsIdentChar(s[i]) {
+		i++
+	}
+	return s[:i]
+}
+
+// parseStatement splits a line into a label, a mnemonic and the operands, and removes the comment.
+// A label ends with ':', or starts in the first column and is not a keyword. A label without ':' can
+// also be indented if it is followed by a directive that defines it, such as EQU.
+func parseStatement(line string, keyword func(string) bool) statement {
+	var s statement
+	text := strings.TrimRight(stripComment(line), " \t\r")
+	indented := text != "" && (text[0] == ' ' || text[0] == '\t')
+	text = strings.TrimSpace(text)
+
+	first := word(text)
+	after := text[len(first):]
+	switch {
+	case first == "" || first[0] == '#':
+	case strings.HasPrefix(after, ":"):
+		s.label, text = first, strings.TrimSpace(after[1:])
+	case !indented && !keyword(first):
+		s.label, text = first, strings.TrimSpace(after)
+	case indented && !keyword(first):
+		after = strings.TrimSpace(after)
+		if next := word(after); definesLabel(next) || strings.HasPrefix(after, "=") {
+			s.label, text = first, after
+		}
+	}
+
+	s.mnemonic = word(text)
+	if s.mnemonic == "" && strings.HasPrefix(text, "=") {
+		s.mnemonic = "="
+	}
+	s.operands = strings.TrimSpace(text[len(s.mnemonic):])
+	s.mnemonic = strings.ToUpper(s.mnemonic)
+	return s
+}
+
+// definesLabel returns true for the directives that define the label in front of them
+func definesLabel(mnemonic string) bool {
+	switch directiveName(mnemonic) {
+	case "EQU", "=", "SET", "DEFL", "MACRO":
+		return true
+	}
+	return false
+}
+
+// isMnemonic returns true for the names of instructions
+func isMnemonic(name string) bool {
+	return mnemonics[strings.ToUpper(name)]
+}
+
+// lookupFunc returns a Lookup for a resolver, which can be nil
+func lookupFunc(syms Resolver) Lookup {
+	return func(name string) (int, bool) {
+		if syms == nil {
+			return 0, false
+		}
+		v, ok := syms.Lookup(name)
+		return int(v), ok
+	}
+}
+
+// encodeStatement encodes the instruction of a statement at pc. If a symbol is undefined the bytes are
+// returned with 0 for it together with an error wrapping ErrUndefined.
+func encodeStatement(s statement, pc uint16, lookup Lookup) ([]uint8, error) {
+	var ops []operand
+	for _, o := range splitOperands(s.operands) {
+		ops = append(ops, parseOperand(o))
+	}
+	e := &encoder{pc: pc, lookup: lookup}
+	if err := e.encode(s.mnemonic, ops); err != nil {
+		if err == errOperands {
+			return nil, fmt.Errorf("%v for %v: %q", err, s.mnemonic, s.operands)
+		}
+		return nil, err
+	}
+	return e.bytes, e.undefined
+}
+
+// Assemble assembles a single instruction located at pc, such as "LD A,(IX+5)". Symbols are looked up
+// in syms, which can be nil.
+func Assemble(line string, pc uint16, syms Resolver) ([]uint8, error) {
+	s := parseStatement("\t"+line, isMnemonic)
+	if s.label != "" {
+		return nil, fmt.Errorf("unexpected label %q", s.label)
+	}
+	if s.mnemonic == "" {
+		return nil, fmt.Errorf("missing instruction")
+	}
+	return encodeStatement(s, pc, lookupFunc(syms))
+}
+
+// AssembleLines assembles instructions starting at org. Lines can define labels as "name:", which are
+// used before the symbols in syms, which can be nil. Directives are not supported, see Assembler.
+func AssembleLines(org uint16, syms Resolver, lines ...string) ([]uint8, error) {
+	labels := make(map[string]int)
+	lookup := func(name string) (int, bool) {
+		if v, ok := labels[name]; ok {
+			return v, true
+		}
+		return lookupFunc(syms)(name)
+	}
+
+	// the first pass finds the addresses of the labels, and the second pass encodes with them
+	var out []uint8
+	for pass := 1; pass <= 2; pass++ {
+		out = out[:0]
+		for i, line := range lines {
+			s := parseStatement("\t"+line, isMnemonic)
+			pc := org + uint16(len(out))
+			if s.label != "" {
+				if _, ok := labels[s.label]; ok && pass == 1 {
+					return nil, fmt.Errorf("line %d: duplicate label %q", i+1, s.label)
+				}
+				labels[s.label] = int(pc)
+			}
+			if s.mnemonic == "" {
+				continue
+			}
+			b, err := encodeStatement(s, pc, lookup)
+			if err != nil && (pass == 2 || b == nil) {
+				return nil, fmt.Errorf("line %d: %w", i+1, err)
+			}
+			out = append(out, b...)
+		}
+	}
+	return out, nil
+}
+
+// MustAssemble is like AssembleLines without symbols, but panics on errors. It is meant for building
+// test programs.
+func MustAssemble(org uint16, lines ...string) []uint8 {
+	b, err := AssembleLines(org, nil, lines...)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
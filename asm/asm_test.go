@@ -0,0 +1,211 @@
+package asm
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/antbern/z80-emulator/disasm"
+	"github.com/antbern/z80-emulator/symbols"
+)
+
+func TestEval(t *testing.T) {
+	syms := map[string]int{"buf": 0x8000, "len": 16}
+	lookup := func(name string) (int, bool) {
+		v, ok := syms[name]
+		return v, ok
+	}
+	tables := []struct {
+		expr  string
+		value int
+	}{
+		{"42", 42},
+		{"$2A", 42},
+		{"2AH", 42},
+		{"0x2a", 42},
+		{"%101010", 42},
+		{"'*'", 42},
+		{"1+2*3", 7},
+		{"(1+2)*3", 9},
+		{"-1", -1},
+		{"~0 & $FF", 0xFF},
+		{"1 << 4 | 1", 17},
+		{"10 % 4", 2},
+		{"buf+len-1", 0x800F},
+		{"HIGH(buf) + LOW(len)", 0x90},
+		{"$", 0x1234},
+		{"$+3", 0x1237},
+		{"len == 16 && buf > 1", 1},
+		{"len != 16 || 0", 0},
+	}
+	for _, table := range tables {
+		v, err := Eval(table.expr, 0x1234, lookup)
+		if err != nil {
+			t.Errorf("Eval(%q) failed: %v", table.expr, err)
+		} else if v != table.value {
+			t.Errorf("Eval(%q) was %#x, expected %#x", table.expr, v, table.value)
+		}
+	}
+
+	if _, err := Eval("missing+1", 0, lookup); !errors.Is(err, ErrUndefined) {
+		t.Errorf("Eval of an undefined symbol returned %v", err)
+	}
+	for _, expr := range []string{"", "1+", "(1", "1)", "1/0"} {
+		if _, err := Eval(expr, 0, lookup); err == nil {
+			t.Errorf("Eval(%q) did not fail", expr)
+		}
+	}
+}
+
+func TestParseExpr(t *testing.T) {
+	mem := map[uint16]uint8{0x8000: 0x34, 0x8001: 0x12, 0x1234: 7}
+	read := func(addr uint16) uint8 { return mem[addr] }
+	regs := map[string]int{"HL": 0x8000, "AF'": 0x0D}
+	lookup := func(name string) (int, bool) {
+		v, ok := regs[name]
+		return v, ok
+	}
+	for expr, value := range map[string]int{
+		"(HL)":             0x34,
+		"(HL+1) + 1":       0x13,
+		"word(HL)":         0x1234,
+		"(word(HL))":       7,
+		"BYTE($8001)":      0x12,
+		"[1+2]*3":          9,
+		"(HL) == $34":      1,
+		"[AF' & $0F] = 13": 1,
+	} {
+		x, err := ParseExpr(expr, true)
+		if err != nil {
+			t.Errorf("ParseExpr(%q) failed: %v", expr, err)
+			continue
+		}
+		// the expression is evaluated again with new values
+		for i := 0; i < 2; i++ {
+			if v, err := x.Eval(0, lookup, read); err != nil || v != value {
+				t.Errorf("Eval of %q was %#x, %v, expected %#x", expr, v, err, value)
+			}
+		}
+	}
+
+	// without memory the parentheses group
+	if v, err := Eval("(HL)", 0, lookup); err != nil || v != 0x8000 {
+		t.Errorf("Eval of (HL) without memory was %#x, %v", v, err)
+	}
+	x, _ := ParseExpr("1/(HL)", true)
+	if _, err := x.Eval(0, lookup, read); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+	mem[0x8000] = 0
+	if _, err := x.Eval(0, lookup, read); err == nil {
+		t.Errorf("Expected a division by zero")
+	}
+}
+
+func TestAssemble(t *testing.T) {
+	syms := symbols.NewTable()
+	syms.Add(symbols.Symbol{Name: "putc", Value: 0x04E9})
+	tables := []struct {
+		line string
+		code []uint8
+	}{
+		{"nop", []uint8{0x00}},
+		{"LD A,(IX+5)", []uint8{0xDD, 0x7E, 0x05}},
+		{"ld (iy-2),$42", []uint8{0xFD, 0x36, 0xFE, 0x42}},
+		{"LD (IX),B", []uint8{0xDD, 0x70, 0x00}},
+		{"LD IXH,C", []uint8{0xDD, 0x61}},
+		{"LD A,(5)", []uint8{0x3A, 0x05, 0x00}},
+		{"LD A,(2+3)*2", []uint8{0x3E, 0x0A}},
+		{"LD HL,putc+3", []uint8{0x21, 0xEC, 0x04}},
+		{"LD DE,(putc)", []uint8{0xED, 0x5B, 0xE9, 0x04}},
+		{"LD (1234H),IY", []uint8{0xFD, 0x22, 0x34, 0x12}},
+		{"LD A,','", []uint8{0x3E, 0x2C}},
+		{"CALL putc ; print", []uint8{0xCD, 0xE9, 0x04}},
+		{"CALL NZ,putc", []uint8{0xC4, 0xE9, 0x04}},
+		{"JP (IY)", []uint8{0xFD, 0xE9}},
+		{"JR $", []uint8{0x18, 0xFE}},
+		{"JR C,$+4", []uint8{0x38, 0x02}},
+		{"DJNZ $-0x10", []uint8{0x10, 0xEE}},
+		{"EX AF,AF'", []uint8{0x08}},
+		{"ADD A,'0'", []uint8{0xC6, 0x30}},
+		{"SUB A,B", []uint8{0x90}},
+		{"CP (IX+1)", []uint8{0xDD, 0xBE, 0x01}},
+		{"ADD IY,SP", []uint8{0xFD, 0x39}},
+		{"SBC HL,BC", []uint8{0xED, 0x42}},
+		{"RES 3,(IX+4),A", []uint8{0xDD, 0xCB, 0x04, 0x9F}},
+		{"SLL D", []uint8{0xCB, 0x32}},
+		{"OUT (C),0", []uint8{0xED, 0x71}},
+		{"IN F,(C)", []uint8{0xED, 0x70}},
+		{"RST 38h", []uint8{0xFF}},
+		{"IM 1", []uint8{0xED, 0x56}},
+		{"LDIR", []uint8{0xED, 0xB0}},
+	}
+	for _, table := range tables {
+		code, err := Assemble(table.line, 0x1000, syms)
+		if err != nil {
+			t.Errorf("Assemble(%q) failed: %v", table.line, err)
+		} else if !bytes.Equal(code, table.code) {
+			t.Errorf("Assemble(%q) was % X, expected % X", table.line, code, table.code)
+		}
+	}
+
+	for _, line := range []string{
+		"LD (HL),(HL)", "LD IXH,H", "LD IXH,IYL", "LD H,IXL", "ADD IX,HL", "ADC IX,BC", "JR PO,$",
+		"JR $+200", "LD A,(IX+128)", "LD A,256", "RST 1", "IM 3", "BIT 8,A", "FOO", "LD A", "RET Q",
+		"RLC B,A", "PUSH SP", "LD A,missing",
+	} {
+		if code, err := Assemble(line, 0x1000, syms); err == nil {
+			t.Errorf("Assemble(%q) did not fail, got % X", line, code)
+		}
+	}
+}
+
+// TestRoundTrip assembles the disassembly of all instructions and checks that it disassembles to the
+// same text, since some instructions have several encodings
+func TestRoundTrip(t *testing.T) {
+	const pc = 0x1000
+	var prefixes = [][]uint8{{}, {0xCB}, {0xED}, {0xDD}, {0xFD}, {0xDD, 0xCB, 0x05}, {0xFD, 0xCB, 0xFB}}
+	for _, prefix := range prefixes {
+		for op := 0; op < 0x100; op++ {
+			code := append(append([]uint8{}, prefix...), uint8(op), 0x34, 0x12, 0x56)
+			in := disasm.Decode(disasm.Bytes{Origin: pc, Data: code}, pc)
+			if in.Mnemonic == "DB" {
+				continue
+			}
+			assembled, err := Assemble(in.String(), pc, nil)
+			if err != nil {
+				t.Errorf("Assemble(%q) of % X failed: %v", in.String(), in.Bytes, err)
+				continue
+			}
+			again := disasm.Decode(disasm.Bytes{Origin: pc, Data: assembled}, pc)
+			if again.String() != in.String() || again.Len() != len(assembled) {
+				t.Errorf("%q assembled to % X which is %q", in.String(), assembled, again.String())
+			}
+		}
+	}
+}
+
+func TestAssembleLines(t *testing.T) {
+	code, err := AssembleLines(0x100, nil,
+		"start: LD B,3",
+		"loop:",
+		"  CALL print ; forward reference",
+		"  DJNZ loop",
+		"  JP start",
+		"print: RET",
+	)
+	expected := []uint8{0x06, 0x03, 0xCD, 0x0A, 0x01, 0x10, 0xFB, 0xC3, 0x00, 0x01, 0xC9}
+	if err != nil {
+		t.Fatalf("AssembleLines failed: %v", err)
+	}
+	if !bytes.Equal(code, expected) {
+		t.Errorf("AssembleLines was % X, expected % X", code, expected)
+	}
+
+	if _, err := AssembleLines(0, nil, "a: NOP", "a: NOP"); err == nil {
+		t.Error("AssembleLines did not fail for a duplicate label")
+	}
+	if _, err := AssembleLines(0, nil, "JP nowhere"); !errors.Is(err, ErrUndefined) {
+		t.Errorf("AssembleLines of an undefined label returned %v", err)
+	}
+}
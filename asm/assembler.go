@@ -0,0 +1,657 @@
+package asm
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/antbern/z80-emulator/core"
+	"github.com/antbern/z80-emulator/symbols"
+)
+
+// Assembler is a two-pass assembler for source files with directives, macros and included files.
+// Directives can be written with or without a leading . or # as in ORG, .org and #include:
+//
+//	ORG expr                   set the address
+//	name EQU expr              define a constant, also name = expr and DEFC name = expr
+//	name SET expr              define a constant that can be redefined, also DEFL
+//	DB expr|"text",...         bytes and strings, also DEFB, DEFM, BYTE and TEXT
+//	DW expr,...                little-endian words, also DEFW and WORD
+//	DS size[,fill]             reserve or fill bytes, also DEFS and BLOCK
+//	INCLUDE "file"             assemble another file
+//	IF expr, IFDEF name, IFNDEF name, ELSE, ENDIF
+//	DEFINE name [expr]         define a constant with the value 1 by default
+//	name MACRO params ... ENDM define a macro, also MACRO name params
+//	END [start]                stop assembling, with an optional start address
+//
+// Labels starting with . are local to the previous label, and to each expansion inside macros.
+type Assembler struct {
+	// ReadFile reads source files, ioutil.ReadFile if nil. Included files are found relative to the
+	// including file and then in IncludeDirs.
+	ReadFile    func(name string) ([]byte, error)
+	IncludeDirs []string
+
+	// Symbols are predefined symbols, which can be nil
+	Symbols Resolver
+}
+
+// Program is an assembled program
+type Program struct {
+	Image   *core.Image
+	Symbols *symbols.Table
+	Listing *symbols.Listing
+}
+
+// Error is an error in a line of a source file
+type Error struct {
+	File string
+	Line int
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%v:%d: %v", e.File, e.Line, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// ErrorList are the errors of all lines of a program
+type ErrorList []*Error
+
+func (l ErrorList) Error() string {
+	var lines []string
+	for _, e := range l {
+		lines = append(lines, e.Error())
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Is reports whether any of the errors matches target
+func (l ErrorList) Is(target error) bool {
+	for _, e := range l {
+		if errors.Is(e, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// limits for nesting of included files and macros
+const (
+	maxIncludeDepth = 16
+	maxMacroDepth   = 32
+)
+
+// directives are the names of the directives without a leading . or #
+var directives = map[string]bool{
+	"ORG": true, "EQU": true, "=": true, "SET": true, "DEFL": true, "DEFC": true, "DB": true, "DEFB": true,
+	"DEFM": true, "BYTE": true, "TEXT": true, "DW": true, "DEFW": true, "WORD": true, "DS": true, "DEFS": true,
+	"BLOCK": true, "INCLUDE": true, "IF": true, "IFDEF": true, "IFNDEF": true, "ELSE": true, "ENDIF": true,
+	"DEFINE": true, "MACRO": true, "ENDM": true, "ENDMACRO": true, "END": true,
+}
+
+// directiveName returns the upper case name of a directive, or an empty string for other names
+func directiveName(name string) string {
+	name = strings.ToUpper(strings.TrimLeft(name, ".#"))
+	if directives[name] {
+		return name
+	}
+	return ""
+}
+
+// macro is a macro definition
+type macro struct {
+	name   string
+	params []string
+	body   []string
+}
+
+// conditional is an IF block
+type conditional struct {
+	active bool // lines are assembled
+	taken  bool // a branch has been active, so ELSE is not
+	inElse bool
+}
+
+// assembly is the state of assembling a program
+type assembly struct {
+	a    *Assembler
+	pass int
+	pc   uint16
+
+	values  map[string]int          // the symbols from all passes
+	defined map[string]symbols.Kind // the symbols defined in this pass
+	order   []string                // the symbols in the order they were defined
+	scope   string                  // the last label, which local labels belong to
+
+	macros     map[string]*macro // macros by upper case name
+	defining   *macro            // the macro being defined
+	expansions int
+	macroDepth int
+
+	conds []conditional
+	ended bool
+
+	img     *core.Image
+	listing *symbols.Listing
+	current int // the listing line of the statement being assembled
+	errs    ErrorList
+}
+
+// AssembleFile assembles a source file
+func (a *Assembler) AssembleFile(path string) (*Program, error) {
+	text, err := a.readFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return a.Assemble(path, text)
+}
+
+// Assemble assembles the source of a file. The name is used to find included files and in the listing
+// and errors. The errors of all lines are returned as an ErrorList.
+func (a *Assembler) Assemble(name string, src []byte) (*Program, error) {
+	s := &assembly{a: a, values: make(map[string]int)}
+	for s.pass = 1; s.pass <= 2; s.pass++ {
+		s.pc = 0
+		s.defined = make(map[string]symbols.Kind)
+		s.order, s.scope = nil, ""
+		s.macros = make(map[string]*macro)
+		s.conds, s.ended, s.expansions = nil, false, 0
+		s.img = &core.Image{}
+		s.listing = &symbols.Listing{Name: name}
+
+		s.source(name, src, 0)
+		if s.defining != nil {
+			s.fail(name, 0, fmt.Errorf("missing ENDM for macro %v", s.defining.name))
+			s.defining = nil
+		}
+		if len(s.conds) > 0 {
+			s.fail(name, 0, errors.New("missing ENDIF"))
+		}
+		if len(s.errs) > 0 {
+			return nil, s.errs
+		}
+	}
+
+	p := &Program{Image: s.img, Symbols: symbols.NewTable(), Listing: s.listing}
+	for _, name := range s.order {
+		p.Symbols.Add(symbols.Symbol{Name: name, Value: uint16(s.values[name]), Kind: s.defined[name]})
+	}
+	return p, nil
+}
+
+// readFile reads a file with ReadFile
+func (a *Assembler) readFile(name string) ([]byte, error) {
+	if a.ReadFile != nil {
+		return a.ReadFile(name)
+	}
+	return ioutil.ReadFile(name)
+}
+
+// fail records an error in a line
+func (s *assembly) fail(file string, line int, err error) {
+	s.errs = append(s.errs, &Error{File: file, Line: line, Err: err})
+}
+
+// source assembles the lines of a file
+func (s *assembly) source(name string, src []byte, depth int) {
+	lines := strings.Split(string(src), "\n")
+	if len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	for i, text := range lines {
+		if s.ended {
+			return
+		}
+		text = strings.TrimRight(text, "\r")
+		s.listing.Lines = append(s.listing.Lines, symbols.Line{File: name, Number: i + 1, Depth: depth, Addr: s.pc, Source: text})
+		s.current = len(s.listing.Lines) - 1
+		if err := s.line(text, name, depth); err != nil {
+			s.fail(name, i+1, err)
+		}
+	}
+}
+
+// active returns true if lines are assembled, and not skipped by a conditional
+func (s *assembly) active() bool {
+	return len(s.conds) == 0 || s.conds[len(s.conds)-1].active
+}
+
+// keyword returns true for instructions, directives and macros, which are not labels
+func (s *assembly) keyword(name string) bool {
+	return isMnemonic(name) || directiveName(name) != "" || s.macros[strings.ToUpper(name)] != nil
+}
+
+// line assembles a line of source, from a file or a macro expansion
+func (s *assembly) line(text, file string, depth int) error {
+	st := parseStatement(text, s.keyword)
+	directive := directiveName(st.mnemonic)
+
+	if s.defining != nil {
+		if directive == "ENDM" || directive == "ENDMACRO" {
+			s.defining = nil
+		} else {
+			s.defining.body = append(s.defining.body, text)
+		}
+		return nil
+	}
+
+	switch directive {
+	case "IF", "IFDEF", "IFNDEF", "ELSE", "ENDIF":
+		err := s.conditional(directive, st.operands)
+		// like TASM, the line starting a skipped block is marked as skipped
+		s.listing.Lines[s.current].Skipped = directive != "ENDIF" && !s.active()
+		return err
+	}
+	if !s.active() {
+		s.listing.Lines[s.current].Skipped = true
+		return nil
+	}
+
+	// SET is an instruction unless it defines a label
+	if directive == "SET" && st.label == "" {
+		directive = ""
+	}
+
+	switch directive {
+	case "EQU", "=", "SET", "DEFL":
+		if st.label == "" {
+			return fmt.Errorf("%v without a name", st.mnemonic)
+		}
+		return s.constant(st.label, st.operands, directive == "SET" || directive == "DEFL")
+	case "MACRO":
+		return s.defineMacro(st.label, st.operands)
+	}
+
+	// a label on ORG gets the new address, as in TASM
+	if directive == "ORG" {
+		if err := s.directive(directive, st.operands, file, depth); err != nil {
+			return err
+		}
+	}
+	if st.label != "" {
+		if err := s.define(st.label, int(s.pc), symbols.Label, false); err != nil {
+			return err
+		}
+	}
+	if st.mnemonic == "" || directive == "ORG" {
+		return nil
+	}
+	if directive != "" {
+		return s.directive(directive, st.operands, file, depth)
+	}
+	if m := s.macros[st.mnemonic]; m != nil {
+		return s.expand(m, st.operands, file, depth)
+	}
+
+	b, err := encodeStatement(st, s.pc, s.lookup)
+	if errors.Is(err, ErrUndefined) && s.pass == 1 && b != nil {
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+	return s.emit(b)
+}
+
+// qualify returns the full name of a local label
+func (s *assembly) qualify(name string) string {
+	if strings.HasPrefix(name, ".") {
+		return s.scope + name
+	}
+	return name
+}
+
+// lookup returns the value of a symbol, ignoring case if there is no exact match
+func (s *assembly) lookup(name string) (int, bool) {
+	name = s.qualify(name)
+	if v, ok := s.values[name]; ok {
+		return v, true
+	}
+	if s.a.Symbols != nil {
+		if v, ok := s.a.Symbols.Lookup(name); ok {
+			return int(v), true
+		}
+	}
+	for n, v := range s.values {
+		if strings.EqualFold(n, name) {
+			return v, true
+		}
+	}
+	return 0, false
+}
+
+// isDefined returns true if a symbol has been defined in this pass or is predefined
+func (s *assembly) isDefined(name string) bool {
+	if _, ok := s.defined[s.qualify(name)]; ok {
+		return true
+	}
+	if s.a.Symbols != nil {
+		_, ok := s.a.Symbols.Lookup(name)
+		return ok
+	}
+	return false
+}
+
+// define defines a symbol in this pass
+func (s *assembly) define(name string, value int, kind symbols.Kind, redefine bool) error {
+	if !symbols.IsIdentifier(name) {
+		return fmt.Errorf("invalid symbol name %q", name)
+	}
+	if kind == symbols.Label && !strings.HasPrefix(name, ".") {
+		s.scope = name
+	}
+	name = s.qualify(name)
+	if _, ok := s.defined[name]; ok {
+		if !redefine {
+			return fmt.Errorf("duplicate symbol %q", name)
+		}
+	} else {
+		s.order = append(s.order, name)
+	}
+	s.defined[name] = kind
+	s.values[name] = value
+	return nil
+}
+
+// eval evaluates an expression. Undefined symbols are allowed in the first pass, unless the value is
+// needed to lay out the program.
+func (s *assembly) eval(expr string, layout bool) (int, error) {
+	v, err := Eval(expr, s.pc, s.lookup)
+	if errors.Is(err, ErrUndefined) && s.pass == 1 && !layout {
+		return v, nil
+	}
+	return v, err
+}
+
+// constant defines a constant with EQU or SET
+func (s *assembly) constant(name, expr string, redefine bool) error {
+	v, err := Eval(expr, s.pc, s.lookup)
+	if errors.Is(err, ErrUndefined) && s.pass == 1 {
+		// forward references are resolved in the second pass
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return s.define(name, v, symbols.Constant, redefine)
+}
+
+// emit appends bytes to the program at the current address
+func (s *assembly) emit(b []uint8) error {
+	if int(s.pc)+len(b) > 0x10000 {
+		return errors.New("program does not fit in 64K")
+	}
+	segments := s.img.Segments
+	if n := len(segments); n > 0 && segments[n-1].Addr+uint32(len(segments[n-1].Data)) == uint32(s.pc) {
+		segments[n-1].Data = append(segments[n-1].Data, b...)
+	} else if len(b) > 0 {
+		s.img.Segments = append(segments, core.Segment{Addr: uint32(s.pc), Data: append([]uint8{}, b...)})
+	}
+	line := &s.listing.Lines[s.current]
+	line.Bytes = append(line.Bytes, b...)
+	s.pc += uint16(len(b))
+	return nil
+}
+
+// conditional handles IF, IFDEF, IFNDEF, ELSE and ENDIF
+func (s *assembly) conditional(directive, operands string) error {
+	switch directive {
+	case "ELSE":
+		if len(s.conds) == 0 || s.conds[len(s.conds)-1].inElse {
+			return errors.New("ELSE without IF")
+		}
+		c := &s.conds[len(s.conds)-1]
+		parent := len(s.conds) == 1 || s.conds[len(s.conds)-2].active
+		c.active, c.taken, c.inElse = parent && !c.taken, true, true
+		return nil
+	case "ENDIF":
+		if len(s.conds) == 0 {
+			return errors.New("ENDIF without IF")
+		}
+		s.conds = s.conds[:len(s.conds)-1]
+		return nil
+	}
+
+	if !s.active() {
+		// the whole block is skipped, including its ELSE
+		s.conds = append(s.conds, conditional{taken: true})
+		return nil
+	}
+	var cond bool
+	switch directive {
+	case "IF":
+		v, err := s.eval(operands, true)
+		if err != nil {
+			// skip the block to keep the nesting
+			s.conds = append(s.conds, conditional{taken: true})
+			return err
+		}
+		cond = v != 0
+	default:
+		name := strings.TrimSpace(operands)
+		if !symbols.IsIdentifier(name) {
+			return fmt.Errorf("invalid symbol name %q", name)
+		}
+		cond = s.isDefined(name) == (directive == "IFDEF")
+	}
+	s.conds = append(s.conds, conditional{active: cond, taken: cond})
+	return nil
+}
+
+// directive assembles the directives that do not define their label
+func (s *assembly) directive(directive, operands, file string, depth int) error {
+	args := splitOperands(operands)
+	switch directive {
+	case "ORG":
+		if len(args) != 1 {
+			return errors.New("ORG needs an address")
+		}
+		v, err := s.eval(args[0], true)
+		if err != nil {
+			return err
+		}
+		s.pc = uint16(v)
+		// the listing shows the address after ORG
+		s.listing.Lines[s.current].Addr = s.pc
+	case "DEFC":
+		def := strings.SplitN(operands, "=", 2)
+		if len(def) != 2 {
+			return errors.New("expected DEFC name = value")
+		}
+		return s.constant(strings.TrimSpace(def[0]), def[1], false)
+	case "DEFINE":
+		fields := strings.Fields(operands)
+		if len(fields) == 0 {
+			return errors.New("DEFINE needs a name")
+		}
+		if len(fields) == 1 {
+			return s.define(fields[0], 1, symbols.Constant, true)
+		}
+		return s.constant(fields[0], strings.Join(fields[1:], " "), true)
+	case "DB", "DEFB", "DEFM", "BYTE", "TEXT":
+		return s.data(args, 1)
+	case "DW", "DEFW", "WORD":
+		return s.data(args, 2)
+	case "DS", "DEFS", "BLOCK":
+		if len(args) < 1 || len(args) > 2 {
+			return fmt.Errorf("%v needs a size and an optional fill value", directive)
+		}
+		size, err := s.eval(args[0], true)
+		if err != nil {
+			return err
+		}
+		if size < 0 || int(s.pc)+size > 0x10000 {
+			return fmt.Errorf("invalid size %v", size)
+		}
+		if len(args) == 1 {
+			s.pc += uint16(size)
+			return nil
+		}
+		fill, err := s.eval(args[1], false)
+		if err != nil {
+			return err
+		}
+		b := make([]uint8, size)
+		for i := range b {
+			b[i] = uint8(fill)
+		}
+		return s.emit(b)
+	case "INCLUDE":
+		return s.include(strings.Trim(strings.TrimSpace(operands), "\"'<>"), file, depth)
+	case "END":
+		s.ended = true
+		if len(args) == 1 {
+			v, err := s.eval(args[0], false)
+			if err != nil {
+				return err
+			}
+			s.img.Start, s.img.HasStart = uint32(uint16(v)), true
+		}
+	case "ENDM", "ENDMACRO":
+		return fmt.Errorf("%v without MACRO", directive)
+	}
+	return nil
+}
+
+// data assembles the bytes or words of DB and DW. DB also accepts strings.
+func (s *assembly) data(args []string, size int) error {
+	if len(args) == 0 {
+		return errors.New("missing data")
+	}
+	var b []uint8
+	for _, arg := range args {
+		if size == 1 && len(arg) >= 2 && (arg[0] == '"' || arg[0] == '\'') && skipQuoted(arg, 0) == len(arg)-1 {
+			b = append(b, arg[1:len(arg)-1]...)
+			continue
+		}
+		v, err := s.eval(arg, false)
+		if err != nil {
+			return err
+		}
+		if size == 1 && (v < -128 || v > 255) || v < -32768 || v > 65535 {
+			return fmt.Errorf("value %v of %q is out of range", v, arg)
+		}
+		b = append(b, uint8(v))
+		if size == 2 {
+			b = append(b, uint8(v>>8))
+		}
+	}
+	return s.emit(b)
+}
+
+// include assembles a file, found relative to the including file or in the include directories
+func (s *assembly) include(name, from string, depth int) error {
+	if name == "" {
+		return errors.New("INCLUDE needs a file name")
+	}
+	if depth >= maxIncludeDepth {
+		return fmt.Errorf("files are included too deep at %q", name)
+	}
+	candidates := []string{name}
+	if !filepath.IsAbs(name) {
+		candidates = []string{filepath.Join(filepath.Dir(from), name)}
+		for _, dir := range s.a.IncludeDirs {
+			candidates = append(candidates, filepath.Join(dir, name))
+		}
+	}
+	var err error
+	for _, path := range candidates {
+		var text []byte
+		if text, err = s.a.readFile(path); err == nil {
+			s.source(path, text, depth+1)
+			return nil
+		}
+	}
+	return fmt.Errorf("including %q: %w", name, err)
+}
+
+// defineMacro starts the definition of a macro, as "name MACRO params" or "MACRO name params"
+func (s *assembly) defineMacro(name, operands string) error {
+	if name == "" {
+		name = word(operands)
+		operands = operands[len(name):]
+	}
+	if !symbols.IsIdentifier(name) || isMnemonic(name) || directiveName(name) != "" {
+		return fmt.Errorf("invalid macro name %q", name)
+	}
+	m := &macro{name: name}
+	for _, p := range splitOperands(operands) {
+		if !symbols.IsIdentifier(p) {
+			return fmt.Errorf("invalid macro parameter %q", p)
+		}
+		m.params = append(m.params, p)
+	}
+	if s.macros[strings.ToUpper(name)] != nil {
+		return fmt.Errorf("duplicate macro %q", name)
+	}
+	s.macros[strings.ToUpper(name)] = m
+	s.defining = m
+	return nil
+}
+
+// substitute replaces the identifiers in text that are keys of args
+func substitute(text string, args map[string]string) string {
+	var sb strings.Builder
+	for i := 0; i < len(text); {
+		c := text[i]
+		if !symbols.IsIdentStart(c) || i > 0 && symbols.IsIdentChar(text[i-1]) {
+			sb.WriteByte(c)
+			i++
+			continue
+		}
+		j := i + 1
+		for j < len(text) && symbols.IsIdentChar(text[j]) {
+			j++
+		}
+		if v, ok := args[text[i:j]]; ok {
+			sb.WriteString(v)
+		} else {
+			sb.WriteString(text[i:j])
+		}
+		i = j
+	}
+	return sb.String()
+}
+
+// expand assembles the body of a macro with its parameters replaced by the arguments. The bytes are
+// listed on the line that uses the macro.
+func (s *assembly) expand(m *macro, operands, file string, depth int) error {
+	values := splitOperands(operands)
+	if len(values) > len(m.params) {
+		return fmt.Errorf("macro %v takes %d arguments", m.name, len(m.params))
+	}
+	if s.macroDepth >= maxMacroDepth {
+		return fmt.Errorf("macro %v is expanded too deep", m.name)
+	}
+	args := make(map[string]string)
+	for i, p := range m.params {
+		args[p] = ""
+		if i < len(values) {
+			args[p] = values[i]
+		}
+	}
+
+	// local labels belong to the expansion
+	s.expansions++
+	scope := s.scope
+	s.scope = fmt.Sprintf("%v@%d", m.name, s.expansions)
+	s.macroDepth++
+	defer func() {
+		s.scope = scope
+		s.macroDepth--
+	}()
+	for _, text := range m.body {
+		if err := s.line(substitute(text, args), file, depth); err != nil {
+			return fmt.Errorf("in macro %v: %w", m.name, err)
+		}
+		if s.ended {
+			break
+		}
+	}
+	return nil
+}
@@ -0,0 +1,228 @@
+package asm
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/antbern/z80-emulator/symbols"
+)
+
+// memFiles returns a ReadFile function for files in memory
+func memFiles(files map[string]string) func(string) ([]byte, error) {
+	return func(name string) ([]byte, error) {
+		if text, ok := files[filepath.ToSlash(filepath.Clean(name))]; ok {
+			return []byte(text), nil
+		}
+		return nil, os.ErrNotExist
+	}
+}
+
+// sourcesOf recreates the source files of a listing from the source column of its lines
+func sourcesOf(l *symbols.Listing) map[string]string {
+	lines := make(map[string][]string)
+	for _, line := range l.Lines {
+		src := lines[line.File]
+		if line.Number <= len(src) {
+			continue // a continuation line, or a file included again
+		}
+		for len(src) < line.Number-1 {
+			src = append(src, "")
+		}
+		lines[line.File] = append(src, line.Source)
+	}
+	files := make(map[string]string)
+	for name, src := range lines {
+		files[name] = strings.Join(src, "\n") + "\n"
+	}
+	return files
+}
+
+// TestAssembleInputs assembles the sources of the listings in input and compares the result with the
+// binaries, which were built by TASM and z80asm
+func TestAssembleInputs(t *testing.T) {
+	for _, name := range []string{"monitor", "count", "sum_test", "waitbtn"} {
+		f, err := os.Open(filepath.Join("..", "input", name+".lst"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		original, err := symbols.ReadListing(f, name+".asm")
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected, err := ioutil.ReadFile(filepath.Join("..", "input", name+".bin"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		a := &Assembler{ReadFile: memFiles(sourcesOf(original))}
+		p, err := a.AssembleFile(name + ".asm")
+		if err != nil {
+			t.Errorf("Assembling %v failed:\n%v", name, err)
+			continue
+		}
+		if addr, code := p.Binary(0); addr != 0 || !bytes.Equal(code, expected) {
+			for i := range code {
+				if i < len(expected) && code[i] != expected[i] {
+					t.Logf("First difference at %#04x: %#02x instead of %#02x", i, code[i], expected[i])
+					break
+				}
+			}
+			t.Errorf("Assembled %v with %d bytes differs from %v.bin with %d bytes", name, len(code), name, len(expected))
+			continue
+		}
+
+		// the listing has the same lines, addresses and bytes as the original
+		var sb strings.Builder
+		if err := p.WriteListing(&sb); err != nil {
+			t.Fatal(err)
+		}
+		listing, err := symbols.ReadListing(strings.NewReader(sb.String()), name+".asm")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(listing.Lines) != len(original.Lines) {
+			t.Errorf("Listing of %v has %d lines, expected %d", name, len(listing.Lines), len(original.Lines))
+			continue
+		}
+		for i, line := range listing.Lines {
+			o := original.Lines[i]
+			if line.File != o.File || line.Number != o.Number || line.Addr != o.Addr || !bytes.Equal(line.Bytes, o.Bytes) || line.Skipped != o.Skipped {
+				t.Errorf("Listing line %d of %v is %+v, expected %+v", i, name, line, o)
+				break
+			}
+		}
+
+		// the labels are the same as in the original listing
+		for _, sym := range original.Symbols().Symbols() {
+			if v, ok := p.Symbols.Lookup(sym.Name); !ok || v != sym.Value {
+				t.Errorf("Symbol %v of %v is %#04x, expected %#04x", sym.Name, name, v, sym.Value)
+			}
+		}
+	}
+}
+
+func TestAssembler(t *testing.T) {
+	files := map[string]string{
+		"main.asm": `; test program
+COUNT	EQU	LAST-FIRST+1	; forward reference
+	ORG	$100
+start:	LD	B,COUNT
+.loop:	CALL	print
+	DJNZ	.loop
+	INCLUDE	"lib/defs.asm"
+	IFDEF	DEBUG
+	HALT
+	ELSE
+	OUTC	'!'
+	OUTC	CR
+	ENDIF
+	IF	CR < 10
+	DB	"too long"
+	ENDIF
+	JR	start
+print:	RET
+.loop:	DW	start, .loop, $
+FIRST	DB	"ab;c", 0
+LAST	DS	2
+	DS	2, $FF
+	END	start
+	NOP
+`,
+		"lib/defs.asm": `CR = 13
+OUTC	MACRO	char
+.wait:	IN	A,(1)
+	AND	1
+	JR	Z,.wait
+	LD	A,char
+	OUT	(0),A
+	ENDM
+`,
+	}
+	a := &Assembler{ReadFile: memFiles(files)}
+	p, err := a.AssembleFile("main.asm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []uint8{
+		0x06, 0x06, // LD B,COUNT
+		0xCD, 0x1D, 0x01, // CALL print
+		0x10, 0xFB, // DJNZ .loop
+		0xDB, 0x01, 0xE6, 0x01, 0x28, 0xFA, 0x3E, 0x21, 0xD3, 0x00, // OUTC '!'
+		0xDB, 0x01, 0xE6, 0x01, 0x28, 0xFA, 0x3E, 0x0D, 0xD3, 0x00, // OUTC CR
+		0x18, 0xE3, // JR start
+		0xC9,                               // RET
+		0x00, 0x01, 0x1E, 0x01, 0x1E, 0x01, // DW
+		0x61, 0x62, 0x3B, 0x63, 0x00, // DB
+		0x00, 0x00, 0xFF, 0xFF, // DS
+	}
+	addr, code := p.Binary(0)
+	if addr != 0x100 || !bytes.Equal(code, expected) {
+		t.Errorf("Assembled at %#04x to\n% X, expected\n% X", addr, code, expected)
+	}
+	if len(p.Image.Segments) != 2 {
+		t.Errorf("Expected the reserved bytes to split the image in 2 segments, got %d", len(p.Image.Segments))
+	}
+	if !p.Image.HasStart || p.Image.Start != 0x100 {
+		t.Errorf("Expected start address 0x100, got %#x", p.Image.Start)
+	}
+	for name, value := range map[string]uint16{"start": 0x100, "start.loop": 0x102, "print": 0x11D, "print.loop": 0x11E, "CR": 13, "COUNT": 6} {
+		if v, ok := p.Symbols.Lookup(name); !ok || v != value {
+			t.Errorf("Symbol %v is %#04x (%v), expected %#04x", name, v, ok, value)
+		}
+	}
+
+	// the macro expansion is listed on the line using it, and the included file is marked
+	var sb strings.Builder
+	p.WriteListing(&sb)
+	listing := sb.String()
+	for _, line := range []string{
+		"0011   0107 DB 01 E6 01 \tOUTC\t'!'\n0011   010B 28 FA 3E 21 \n0011   010F D3 00       \n",
+		"0001+  0107             CR = 13\n",
+		"0009   0107~            \tHALT\n",
+		"0003   0100             \tORG\t$100\n",
+	} {
+		if !strings.Contains(listing, line) {
+			t.Errorf("Listing does not contain %q:\n%v", line, listing)
+		}
+	}
+}
+
+func TestAssemblerErrors(t *testing.T) {
+	a := &Assembler{}
+	_, err := a.Assemble("bad.asm", []byte(`	LD	A,B
+	LD	A,missing
+	FOO
+	DS	later
+later:	JR	$+1000
+start:	NOP
+start:	NOP
+	ELSE
+	INCLUDE	"nothing.asm"
+	IF 1
+`))
+	var list ErrorList
+	if !errors.As(err, &list) {
+		t.Fatalf("Expected an ErrorList, got %v", err)
+	}
+	lines := make(map[int]bool)
+	for _, e := range list {
+		lines[e.Line] = true
+	}
+	// the first pass stops at the layout errors
+	for _, line := range []int{3, 4, 7, 8, 9} {
+		if !lines[line] {
+			t.Errorf("Expected an error in line %d, got\n%v", line, err)
+		}
+	}
+
+	_, err = a.Assemble("bad.asm", []byte("\tNOP\n\tLD A,missing\n"))
+	if !errors.Is(err, ErrUndefined) || !strings.Contains(err.Error(), "bad.asm:2: ") {
+		t.Errorf("Expected an undefined symbol error, got\n%v", err)
+	}
+}
@@ -0,0 +1,652 @@
+package asm
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/antbern/z80-emulator/core"
+)
+
+// the index prefixes
+const (
+	prefixIX = 0xDD
+	prefixIY = 0xFD
+)
+
+var condNames = core.CondNames[:]
+
+// implied are the instructions without operands
+var implied = map[string][]uint8{
+	"NOP":  {0x00},
+	"HALT": {0x76},
+	"DI":   {0xF3},
+	"EI":   {0xFB},
+	"EXX":  {0xD9},
+	"NEG":  {0xED, 0x44},
+	"RETI": {0xED, 0x4D},
+	"RETN": {0xED, 0x45},
+	"RRD":  {0xED, 0x67},
+	"RLD":  {0xED, 0x6F},
+}
+
+// mnemonics are the names of all instructions
+var mnemonics = map[string]bool{
+	"LD": true, "ADD": true, "ADC": true, "SUB": true, "SBC": true, "AND": true, "XOR": true, "OR": true,
+	"CP": true, "INC": true, "DEC": true, "PUSH": true, "POP": true, "EX": true, "JP": true, "CALL": true,
+	"JR": true, "DJNZ": true, "RET": true, "RST": true, "IM": true, "IN": true, "OUT": true, "RLC": true,
+	"RRC": true, "RL": true, "RR": true, "SLA": true, "SRA": true, "SLL": true, "SL1": true, "SLI": true,
+	"SRL": true, "BIT": true, "RES": true, "SET": true,
+}
+
+func init() {
+	defer func() {
+		for name := range implied {
+			mnemonics[name] = true
+		}
+	}()
+	for y, name := range core.AccNames {
+		implied[name] = []uint8{uint8(y<<3 | 7)}
+	}
+	for y, names := range core.BlockNames {
+		for z, name := range names {
+			implied[name] = []uint8{0xED, uint8(0x80 | (y+4)<<3 | z)}
+		}
+	}
+}
+
+// encoder encodes a single instruction
+type encoder struct {
+	pc     uint16
+	lookup Lookup
+	bytes  []uint8
+
+	// undefined is the first error for an undefined symbol. The instruction is still encoded with the
+	// value 0 for the symbol so that its size is known.
+	undefined error
+}
+
+// errOperands is returned for operands that the instruction does not accept
+var errOperands = errors.New("invalid operands")
+
+// emit appends bytes to the instruction
+func (e *encoder) emit(b ...uint8) {
+	e.bytes = append(e.bytes, b...)
+}
+
+// eval evaluates an expression, remembering undefined symbols
+func (e *encoder) eval(expr string) (int, error) {
+	v, err := Eval(expr, e.pc, e.lookup)
+	if errors.Is(err, ErrUndefined) {
+		if e.undefined == nil {
+			e.undefined = err
+		}
+		return v, nil
+	}
+	return v, err
+}
+
+// imm8 emits an 8 bit value
+func (e *encoder) imm8(expr string) error {
+	v, err := e.eval(expr)
+	if err != nil {
+		return err
+	}
+	if v < -128 || v > 255 {
+		return fmt.Errorf("value %v of %q does not fit in a byte", v, expr)
+	}
+	e.emit(uint8(v))
+	return nil
+}
+
+// imm16 emits a 16 bit little-endian value
+func (e *encoder) imm16(expr string) error {
+	v, err := e.eval(expr)
+	if err != nil {
+		return err
+	}
+	if v < -32768 || v > 65535 {
+		return fmt.Errorf("value %v of %q does not fit in a word", v, expr)
+	}
+	e.emit(uint8(v), uint8(v>>8))
+	return nil
+}
+
+// relative emits the displacement of a relative jump from the end of a two byte instruction
+func (e *encoder) relative(expr string) error {
+	v, err := e.eval(expr)
+	if err != nil {
+		return err
+	}
+	d := v - int(e.pc) - 2
+	if (d < -128 || d > 127) && e.undefined == nil {
+		return fmt.Errorf("relative jump to %q is out of range (%d)", expr, d)
+	}
+	e.emit(uint8(d))
+	return nil
+}
+
+// reg8 is an operand from the r table
+type reg8 struct {
+	index   uint8
+	prefix  uint8  // prefixIX or prefixIY for index registers, or 0
+	disp    string // the displacement of (IX+d), or "" for registers
+	memory  bool   // (HL) or (IX+d)
+	indexed bool   // IXH, IXL, IYH or IYL
+}
+
+// reg8Of returns the r table entry of an operand
+func reg8Of(o operand) (reg8, bool) {
+	switch o.kind {
+	case opReg:
+		for i, name := range core.RegNames {
+			if name == o.name && i != 6 {
+				return reg8{index: uint8(i)}, true
+			}
+		}
+		if len(o.name) == 3 && o.name[0] == 'I' {
+			r := reg8{index: 4, prefix: prefixIX, indexed: true}
+			if o.name[1] == 'Y' {
+				r.prefix = prefixIY
+			}
+			if o.name[2] == 'L' {
+				r.index = 5
+			}
+			return r, true
+		}
+	case opRegInd:
+		switch o.name {
+		case "HL":
+			return reg8{index: 6, memory: true}, true
+		case "IX":
+			return reg8{index: 6, prefix: prefixIX, disp: "0", memory: true}, true
+		case "IY":
+			return reg8{index: 6, prefix: prefixIY, disp: "0", memory: true}, true
+		}
+	case opIndexed:
+		r := reg8{index: 6, prefix: prefixIX, disp: o.expr, memory: true}
+		if o.name == "IY" {
+			r.prefix = prefixIY
+		}
+		return r, true
+	}
+	return reg8{}, false
+}
+
+// regPair returns the p field and prefix of a register pair from the rp table, or the rp2 table if af is
+// set. HL can be replaced by IX or IY.
+func regPair(o operand, af bool) (uint8, uint8, bool) {
+	if o.kind != opReg {
+		return 0, 0, false
+	}
+	switch o.name {
+	case "IX":
+		return 2, prefixIX, true
+	case "IY":
+		return 2, prefixIY, true
+	}
+	names := core.RegPairNames
+	if af {
+		names = core.RegPairNamesAF
+	}
+	for i, name := range names {
+		if name == o.name {
+			return uint8(i), 0, true
+		}
+	}
+	return 0, 0, false
+}
+
+// isHL returns the prefix if the operand is HL, IX or IY
+func isHL(o operand) (uint8, bool) {
+	p, prefix, ok := regPair(o, false)
+	return prefix, ok && p == 2
+}
+
+// withR emits an instruction with an r operand: the prefix, the op code and the displacement
+func (e *encoder) withR(r reg8, opCode uint8) error {
+	if r.prefix != 0 {
+		e.emit(r.prefix)
+	}
+	e.emit(opCode)
+	if r.disp != "" {
+		return e.displacement(r.disp)
+	}
+	return nil
+}
+
+// displacement emits the displacement of an indexed address
+func (e *encoder) displacement(expr string) error {
+	v, err := e.eval(expr)
+	if err != nil {
+		return err
+	}
+	if v < -128 || v > 127 {
+		return fmt.Errorf("index displacement %v is out of range", v)
+	}
+	e.emit(uint8(v))
+	return nil
+}
+
+// encode encodes an instruction with upper case mnemonic
+func (e *encoder) encode(mnemonic string, ops []operand) error {
+	if b, ok := implied[mnemonic]; ok {
+		if len(ops) != 0 {
+			return errOperands
+		}
+		e.emit(b...)
+		return nil
+	}
+
+	switch mnemonic {
+	case "LD":
+		if len(ops) != 2 {
+			return errOperands
+		}
+		return e.ld(ops[0], ops[1])
+	case "ADD", "ADC", "SUB", "SBC", "AND", "XOR", "OR", "CP":
+		return e.alu(mnemonic, ops)
+	case "INC", "DEC":
+		if len(ops) != 1 {
+			return errOperands
+		}
+		dec := uint8(0)
+		if mnemonic == "DEC" {
+			dec = 1
+		}
+		if r, ok := reg8Of(ops[0]); ok {
+			return e.withR(r, r.index<<3|0x04|dec)
+		}
+		if p, prefix, ok := regPair(ops[0], false); ok {
+			e.prefix(prefix)
+			e.emit(p<<4 | 0x03 | dec<<3)
+			return nil
+		}
+	case "PUSH", "POP":
+		if len(ops) != 1 {
+			return errOperands
+		}
+		if p, prefix, ok := regPair(ops[0], true); ok {
+			e.prefix(prefix)
+			if mnemonic == "PUSH" {
+				e.emit(0xC5 | p<<4)
+			} else {
+				e.emit(0xC1 | p<<4)
+			}
+			return nil
+		}
+	case "EX":
+		if len(ops) != 2 {
+			return errOperands
+		}
+		switch {
+		case ops[0].is("AF") && ops[1].is("AF'"):
+			e.emit(0x08)
+			return nil
+		case ops[0].is("DE") && ops[1].is("HL"):
+			e.emit(0xEB)
+			return nil
+		case ops[0].kind == opRegInd && ops[0].name == "SP":
+			if prefix, ok := isHL(ops[1]); ok {
+				e.prefix(prefix)
+				e.emit(0xE3)
+				return nil
+			}
+		}
+	case "JP":
+		if len(ops) == 1 && (ops[0].kind == opRegInd || ops[0].kind == opReg) {
+			if prefix, ok := isHL(operand{kind: opReg, name: ops[0].name}); ok {
+				e.prefix(prefix)
+				e.emit(0xE9)
+				return nil
+			}
+			return errOperands
+		}
+		return e.jump(ops, 0xC3, 0xC2, 8)
+	case "CALL":
+		return e.jump(ops, 0xCD, 0xC4, 8)
+	case "JR":
+		switch len(ops) {
+		case 1:
+			e.emit(0x18)
+			return e.relative(ops[0].expr)
+		case 2:
+			if cc, ok := ops[0].condition(4); ok {
+				e.emit(0x20 | cc<<3)
+				return e.relative(ops[1].expr)
+			}
+		}
+	case "DJNZ":
+		if len(ops) == 1 {
+			e.emit(0x10)
+			return e.relative(ops[0].expr)
+		}
+	case "RET":
+		switch len(ops) {
+		case 0:
+			e.emit(0xC9)
+			return nil
+		case 1:
+			if cc, ok := ops[0].condition(8); ok {
+				e.emit(0xC0 | cc<<3)
+				return nil
+			}
+		}
+	case "RST":
+		if len(ops) != 1 || ops[0].kind != opImm {
+			return errOperands
+		}
+		v, err := e.eval(ops[0].expr)
+		if err != nil {
+			return err
+		}
+		if v < 0 || v > 0x38 || v%8 != 0 {
+			return fmt.Errorf("invalid restart address %#02x", v)
+		}
+		e.emit(0xC7 | uint8(v))
+		return nil
+	case "IM":
+		if len(ops) != 1 || ops[0].kind != opImm {
+			return errOperands
+		}
+		v, err := e.eval(ops[0].expr)
+		if err != nil {
+			return err
+		}
+		if v < 0 || v > 2 {
+			return fmt.Errorf("invalid interrupt mode %v", v)
+		}
+		e.emit(0xED, [3]uint8{0x46, 0x56, 0x5E}[v])
+		return nil
+	case "IN":
+		return e.in(ops)
+	case "OUT":
+		return e.out(ops)
+	case "RLC", "RRC", "RL", "RR", "SLA", "SRA", "SLL", "SL1", "SLI", "SRL":
+		if mnemonic == "SL1" || mnemonic == "SLI" {
+			mnemonic = "SLL"
+		}
+		for y, name := range core.RotNames {
+			if name == mnemonic {
+				return e.cb(uint8(y)<<3, ops)
+			}
+		}
+	case "BIT", "RES", "SET":
+		if len(ops) < 2 || ops[0].kind != opImm {
+			return errOperands
+		}
+		bit, err := e.eval(ops[0].expr)
+		if err != nil {
+			return err
+		}
+		if bit < 0 || bit > 7 {
+			return fmt.Errorf("invalid bit number %v", bit)
+		}
+		x := map[string]uint8{"BIT": 1, "RES": 2, "SET": 3}[mnemonic]
+		if x == 1 && len(ops) > 2 {
+			return errOperands
+		}
+		return e.cb(x<<6|uint8(bit)<<3, ops[1:])
+	default:
+		return fmt.Errorf("unknown instruction %q", mnemonic)
+	}
+	return errOperands
+}
+
+// prefix emits an index prefix if there is one
+func (e *encoder) prefix(prefix uint8) {
+	if prefix != 0 {
+		e.emit(prefix)
+	}
+}
+
+// jump encodes JP and CALL with an optional condition
+func (e *encoder) jump(ops []operand, opCode, condOpCode uint8, conds int) error {
+	switch len(ops) {
+	case 1:
+		if ops[0].kind != opImm {
+			return errOperands
+		}
+		e.emit(opCode)
+		return e.imm16(ops[0].expr)
+	case 2:
+		if cc, ok := ops[0].condition(conds); ok && ops[1].kind == opImm {
+			e.emit(condOpCode | cc<<3)
+			return e.imm16(ops[1].expr)
+		}
+	}
+	return errOperands
+}
+
+// ld encodes the LD instructions
+func (e *encoder) ld(dst, src operand) error {
+	// the special registers and addressing modes of A
+	switch {
+	case dst.is("A") && src.kind == opRegInd && (src.name == "BC" || src.name == "DE"):
+		e.emit(map[string]uint8{"BC": 0x0A, "DE": 0x1A}[src.name])
+		return nil
+	case src.is("A") && dst.kind == opRegInd && (dst.name == "BC" || dst.name == "DE"):
+		e.emit(map[string]uint8{"BC": 0x02, "DE": 0x12}[dst.name])
+		return nil
+	case dst.is("A") && src.kind == opMem:
+		e.emit(0x3A)
+		return e.imm16(src.expr)
+	case dst.kind == opMem && src.is("A"):
+		e.emit(0x32)
+		return e.imm16(dst.expr)
+	case dst.is("I") && src.is("A"):
+		e.emit(0xED, 0x47)
+		return nil
+	case dst.is("R") && src.is("A"):
+		e.emit(0xED, 0x4F)
+		return nil
+	case dst.is("A") && src.is("I"):
+		e.emit(0xED, 0x57)
+		return nil
+	case dst.is("A") && src.is("R"):
+		e.emit(0xED, 0x5F)
+		return nil
+	}
+
+	// 8 bit loads
+	if d, ok := reg8Of(dst); ok {
+		if s, ok := reg8Of(src); ok {
+			return e.ld8(d, s)
+		}
+		if src.kind == opImm {
+			if err := e.withR(d, d.index<<3|0x06); err != nil {
+				return err
+			}
+			return e.imm8(src.expr)
+		}
+		return errOperands
+	}
+
+	// 16 bit loads
+	if dst.is("SP") {
+		if prefix, ok := isHL(src); ok {
+			e.prefix(prefix)
+			e.emit(0xF9)
+			return nil
+		}
+	}
+	if p, prefix, ok := regPair(dst, false); ok {
+		switch src.kind {
+		case opImm:
+			e.prefix(prefix)
+			e.emit(0x01 | p<<4)
+			return e.imm16(src.expr)
+		case opMem:
+			if p == 2 {
+				e.prefix(prefix)
+				e.emit(0x2A)
+			} else {
+				e.emit(0xED, 0x4B|p<<4)
+			}
+			return e.imm16(src.expr)
+		}
+		return errOperands
+	}
+	if dst.kind == opMem {
+		if p, prefix, ok := regPair(src, false); ok {
+			if p == 2 {
+				e.prefix(prefix)
+				e.emit(0x22)
+			} else {
+				e.emit(0xED, 0x43|p<<4)
+			}
+			return e.imm16(dst.expr)
+		}
+	}
+	return errOperands
+}
+
+// ld8 encodes LD r,r'. An index register can only be combined with registers that are not H, L or a
+// memory operand, since the prefix applies to all of them.
+func (e *encoder) ld8(d, s reg8) error {
+	if d.memory && s.memory {
+		return errOperands
+	}
+	if d.prefix != 0 && s.prefix != 0 && (d.prefix != s.prefix || d.memory || s.memory) {
+		return errOperands
+	}
+	for _, pair := range [][2]reg8{{d, s}, {s, d}} {
+		if pair[0].indexed && pair[1].prefix == 0 && (pair[1].index == 4 || pair[1].index == 5) {
+			return errOperands
+		}
+	}
+	r := d
+	if s.prefix != 0 {
+		r.prefix, r.disp = s.prefix, s.disp
+	}
+	return e.withR(r, 0x40|d.index<<3|s.index)
+}
+
+// alu encodes the arithmetic and logic instructions
+func (e *encoder) alu(mnemonic string, ops []operand) error {
+	// 16 bit arithmetic
+	if len(ops) == 2 {
+		if dstPrefix, ok := isHL(ops[0]); ok {
+			p, prefix, ok := regPair(ops[1], false)
+			if !ok || (p == 2 && prefix != dstPrefix) {
+				return errOperands
+			}
+			switch {
+			case mnemonic == "ADD":
+				e.prefix(dstPrefix)
+				e.emit(0x09 | p<<4)
+				return nil
+			case dstPrefix == 0 && mnemonic == "ADC":
+				e.emit(0xED, 0x4A|p<<4)
+				return nil
+			case dstPrefix == 0 && mnemonic == "SBC":
+				e.emit(0xED, 0x42|p<<4)
+				return nil
+			}
+			return errOperands
+		}
+		// A is optional for all operations
+		if !ops[0].is("A") {
+			return errOperands
+		}
+		ops = ops[1:]
+	}
+	if len(ops) != 1 {
+		return errOperands
+	}
+
+	var y uint8
+	for i, name := range core.ALUNames {
+		if name == mnemonic {
+			y = uint8(i)
+		}
+	}
+	if r, ok := reg8Of(ops[0]); ok {
+		return e.withR(r, 0x80|y<<3|r.index)
+	}
+	if ops[0].kind == opImm {
+		e.emit(0xC6 | y<<3)
+		return e.imm8(ops[0].expr)
+	}
+	return errOperands
+}
+
+// cb encodes a CB prefixed instruction with the op code without the r field. Indexed instructions can
+// copy the result to a register given as an extra operand.
+func (e *encoder) cb(opCode uint8, ops []operand) error {
+	if len(ops) < 1 || len(ops) > 2 {
+		return errOperands
+	}
+	r, ok := reg8Of(ops[0])
+	if !ok || r.indexed {
+		return errOperands
+	}
+	if r.prefix == 0 {
+		if len(ops) == 2 {
+			return errOperands
+		}
+		e.emit(0xCB, opCode|r.index)
+		return nil
+	}
+
+	// DD CB d op
+	z := uint8(6)
+	if len(ops) == 2 {
+		c, ok := reg8Of(ops[1])
+		if !ok || c.prefix != 0 || c.memory {
+			return errOperands
+		}
+		z = c.index
+	}
+	e.emit(r.prefix, 0xCB)
+	if err := e.displacement(r.disp); err != nil {
+		return err
+	}
+	e.emit(opCode | z)
+	return nil
+}
+
+// in encodes the IN instructions
+func (e *encoder) in(ops []operand) error {
+	switch {
+	case len(ops) == 1 && ops[0].kind == opRegInd && ops[0].name == "C":
+		e.emit(0xED, 0x70)
+		return nil
+	case len(ops) != 2:
+		return errOperands
+	case ops[0].is("A") && ops[1].kind == opMem:
+		e.emit(0xDB)
+		return e.imm8(ops[1].expr)
+	case ops[1].kind == opRegInd && ops[1].name == "C":
+		if ops[0].is("F") {
+			e.emit(0xED, 0x70)
+			return nil
+		}
+		if r, ok := reg8Of(ops[0]); ok && r.prefix == 0 && !r.memory {
+			e.emit(0xED, 0x40|r.index<<3)
+			return nil
+		}
+	}
+	return errOperands
+}
+
+// out encodes the OUT instructions
+func (e *encoder) out(ops []operand) error {
+	switch {
+	case len(ops) != 2:
+		return errOperands
+	case ops[0].kind == opMem && ops[1].is("A"):
+		e.emit(0xD3)
+		return e.imm8(ops[0].expr)
+	case ops[0].kind == opRegInd && ops[0].name == "C":
+		if ops[1].kind == opImm && strings.TrimSpace(ops[1].expr) == "0" {
+			e.emit(0xED, 0x71)
+			return nil
+		}
+		if r, ok := reg8Of(ops[1]); ok && r.prefix == 0 && !r.memory {
+			e.emit(0xED, 0x41|r.index<<3)
+			return nil
+		}
+	}
+	return errOperands
+}
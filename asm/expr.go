@@ -0,0 +1,392 @@
+package asm
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/antbern/z80-emulator/symbols"
+)
+
+// ErrUndefined is returned when an expression uses a symbol that is not defined
+var ErrUndefined = errors.New("undefined symbol")
+
+// Lookup returns the value of a symbol
+type Lookup func(name string) (int, bool)
+
+// token is a part of an expression
+type token struct {
+	kind  byte // 'n' number, 'i' identifier, 'o' operator, and the brackets '(', ')', '[' and ']'
+	text  string
+	value int
+}
+
+// operators, longest first so that they are matched before their prefixes
+var operators = []string{"<<", ">>", "<=", ">=", "==", "!=", "&&", "||", "+", "-", "*", "/", "%", "&", "|", "^", "~", "!", "<", ">", "="}
+
+// binary operator precedence, higher binds tighter
+var precedence = map[string]int{
+	"||": 1, "&&": 2, "|": 3, "^": 4, "&": 5, "==": 6, "!=": 6, "=": 6,
+	"<": 7, "<=": 7, ">": 7, ">=": 7, "<<": 8, ">>": 8, "+": 9, "-": 9, "*": 10, "/": 10, "%": 10,
+}
+
+// tokenize splits an expression into tokens
+func tokenize(s string) ([]token, error) {
+	var tokens []token
+	// operand is true when the next token must be an operand, which decides whether % and $ start
+	// numbers
+	operand := true
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t':
+			i++
+			continue
+		case c == '(' || c == ')' || c == '[' || c == ']':
+			tokens = append(tokens, token{kind: c, text: string(c)})
+			operand = c == '(' || c == '['
+			i++
+			continue
+		case c == '\'' || c == '"':
+			// a character constant
+			end := strings.IndexByte(s[i+1:], c)
+			if end != 1 {
+				return nil, fmt.Errorf("invalid character constant in %q", s)
+			}
+			tokens = append(tokens, token{kind: 'n', text: s[i : i+3], value: int(s[i+1])})
+			operand = false
+			i += 3
+			continue
+		case c == '$' && (i+1 == len(s) || !symbols.IsHexDigit(s[i+1])):
+			tokens = append(tokens, token{kind: 'i', text: "$"})
+			operand = false
+			i++
+			continue
+		case c >= '0' && c <= '9' || c == '$' || c == '#' || c == '%' && operand && i+1 < len(s) && (s[i+1] == '0' || s[i+1] == '1'):
+			j := i + 1
+			for j < len(s) && symbols.IsIdentChar(s[j]) {
+				j++
+			}
+			v, err := symbols.ParseNumber(s[i:j])
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, token{kind: 'n', text: s[i:j], value: int(v)})
+			operand = false
+			i = j
+			continue
+		case symbols.IsIdentStart(c):
+			j := i + 1
+			for j < len(s) && symbols.IsIdentChar(s[j]) {
+				j++
+			}
+			// the alternate registers such as AF'
+			if j < len(s) && s[j] == '\'' {
+				j++
+			}
+			tokens = append(tokens, token{kind: 'i', text: s[i:j]})
+			operand = false
+			i = j
+			continue
+		}
+		found := false
+		for _, op := range operators {
+			if strings.HasPrefix(s[i:], op) {
+				tokens = append(tokens, token{kind: 'o', text: op})
+				operand = true
+				i += len(op)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unexpected character %q in %q", c, s)
+		}
+	}
+	return tokens, nil
+}
+
+// node evaluates a part of a parsed expression
+type node func(e *evaluation) int
+
+// evaluation is the state of evaluating an expression
+type evaluation struct {
+	pc     int
+	lookup Lookup
+	read   func(addr uint16) uint8
+
+	undefined error // the first undefined symbol, evaluation continues with 0 for it
+	failed    error // an error that makes the value invalid, such as a division by zero
+}
+
+// fail records the first error that invalidates the value
+func (e *evaluation) fail(err error) int {
+	if e.failed == nil {
+		e.failed = err
+	}
+	return 0
+}
+
+// parser parses an expression with precedence climbing
+type parser struct {
+	tokens []token
+	pos    int
+	memory bool
+}
+
+func (p *parser) peek() *token {
+	if p.pos < len(p.tokens) {
+		return &p.tokens[p.pos]
+	}
+	return nil
+}
+
+func (p *parser) binary(minPrec int) (node, error) {
+	left, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t := p.peek()
+		if t == nil || t.kind != 'o' || precedence[t.text] < minPrec || precedence[t.text] == 0 {
+			return left, nil
+		}
+		p.pos++
+		right, err := p.binary(precedence[t.text] + 1)
+		if err != nil {
+			return nil, err
+		}
+		left = binaryNode(t.text, left, right)
+	}
+}
+
+func boolValue(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// binaryNode returns a node that applies a binary operator
+func binaryNode(op string, left, right node) node {
+	return func(e *evaluation) int {
+		a, b := left(e), right(e)
+		v, err := apply(op, a, b)
+		if err != nil {
+			return e.fail(err)
+		}
+		return v
+	}
+}
+
+func apply(op string, a, b int) (int, error) {
+	switch op {
+	case "+":
+		return a + b, nil
+	case "-":
+		return a - b, nil
+	case "*":
+		return a * b, nil
+	case "/", "%":
+		if b == 0 {
+			return 0, errors.New("division by zero")
+		}
+		if op == "/" {
+			return a / b, nil
+		}
+		return a % b, nil
+	case "&":
+		return a & b, nil
+	case "|":
+		return a | b, nil
+	case "^":
+		return a ^ b, nil
+	case "<<":
+		return a << uint(b&31), nil
+	case ">>":
+		return a >> uint(b&31), nil
+	case "==", "=":
+		return boolValue(a == b), nil
+	case "!=":
+		return boolValue(a != b), nil
+	case "<":
+		return boolValue(a < b), nil
+	case "<=":
+		return boolValue(a <= b), nil
+	case ">":
+		return boolValue(a > b), nil
+	case ">=":
+		return boolValue(a >= b), nil
+	case "&&":
+		return boolValue(a != 0 && b != 0), nil
+	case "||":
+		return boolValue(a != 0 || b != 0), nil
+	}
+	return 0, fmt.Errorf("unknown operator %q", op)
+}
+
+// group parses an expression up to the closing token
+func (p *parser) group(close byte) (node, error) {
+	v, err := p.binary(1)
+	if err != nil {
+		return nil, err
+	}
+	if c := p.peek(); c == nil || c.kind != close {
+		return nil, fmt.Errorf("missing %c", close)
+	}
+	p.pos++
+	return v, nil
+}
+
+// readMemory returns a node that reads size bytes from memory at an address, little endian
+func readMemory(addr node, size int) node {
+	return func(e *evaluation) int {
+		a := addr(e)
+		if e.read == nil {
+			return e.fail(errors.New("no memory to read"))
+		}
+		v := 0
+		for i := size - 1; i >= 0; i-- {
+			v = v<<8 | int(e.read(uint16(a+i)))
+		}
+		return v
+	}
+}
+
+func (p *parser) unary() (node, error) {
+	t := p.peek()
+	if t == nil {
+		return nil, errors.New("missing operand")
+	}
+	p.pos++
+	switch t.kind {
+	case 'n':
+		v := t.value
+		return func(*evaluation) int { return v }, nil
+	case '(':
+		v, err := p.group(')')
+		if err != nil || !p.memory {
+			return v, err
+		}
+		return readMemory(v, 1), nil
+	case '[':
+		return p.group(']')
+	case 'o':
+		v, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		switch t.text {
+		case "-":
+			return func(e *evaluation) int { return -v(e) }, nil
+		case "+":
+			return v, nil
+		case "~":
+			return func(e *evaluation) int { return ^v(e) }, nil
+		case "!":
+			return func(e *evaluation) int { return boolValue(v(e) == 0) }, nil
+		}
+		return nil, fmt.Errorf("unexpected operator %q", t.text)
+	case 'i':
+		if t.text == "$" {
+			return func(e *evaluation) int { return e.pc }, nil
+		}
+		// the functions LOW and HIGH, and WORD and BYTE for memory
+		if next := p.peek(); next != nil && next.kind == '(' {
+			name := strings.ToUpper(t.text)
+			switch {
+			case name == "LOW" || name == "HIGH":
+				p.pos++
+				v, err := p.group(')')
+				if err != nil {
+					return nil, err
+				}
+				shift := uint(0)
+				if name == "HIGH" {
+					shift = 8
+				}
+				return func(e *evaluation) int { return v(e) >> shift & 0xFF }, nil
+			case p.memory && (name == "WORD" || name == "BYTE"):
+				p.pos++
+				v, err := p.group(')')
+				if err != nil {
+					return nil, err
+				}
+				if name == "WORD" {
+					return readMemory(v, 2), nil
+				}
+				return readMemory(v, 1), nil
+			}
+		}
+		name := t.text
+		return func(e *evaluation) int {
+			if e.lookup != nil {
+				if v, ok := e.lookup(name); ok {
+					return v
+				}
+			}
+			if e.undefined == nil {
+				e.undefined = fmt.Errorf("%w %q", ErrUndefined, name)
+			}
+			return 0
+		}, nil
+	}
+	return nil, fmt.Errorf("unexpected %q", t.text)
+}
+
+// Expr is a parsed expression that can be evaluated many times, such as a breakpoint condition
+type Expr struct {
+	text string
+	root node
+}
+
+// ParseExpr parses an expression. With memory set, it uses the notation of Z80 operands where a
+// parenthesized expression is the byte in memory at that address, as in (HL), WORD(expr) is the
+// 16-bit word and BYTE(expr) the byte at an address, and brackets group. Otherwise both parentheses
+// and brackets group.
+func ParseExpr(expr string, memory bool) (*Expr, error) {
+	tokens, err := tokenize(expr)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, errors.New("missing expression")
+	}
+	p := &parser{tokens: tokens, memory: memory}
+	root, err := p.binary(1)
+	if err != nil {
+		return nil, fmt.Errorf("%v in %q", err, expr)
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q in %q", p.tokens[p.pos].text, expr)
+	}
+	return &Expr{text: expr, root: root}, nil
+}
+
+// String returns the text of the expression
+func (x *Expr) String() string {
+	return x.text
+}
+
+// Eval evaluates the expression, where $ is the address pc and read reads the memory, which may be nil
+// for expressions without memory references. Symbols are looked up by each evaluation. If a symbol is
+// undefined, the error wraps ErrUndefined and the value is calculated with 0 for the symbol.
+func (x *Expr) Eval(pc uint16, lookup Lookup, read func(addr uint16) uint8) (int, error) {
+	e := &evaluation{pc: int(pc), lookup: lookup, read: read}
+	v := x.root(e)
+	if e.failed != nil {
+		return 0, fmt.Errorf("%v in %q", e.failed, x.text)
+	}
+	return v, e.undefined
+}
+
+// Eval evaluates an expression, where $ is the address pc. Numbers can be written in the notations of
+// symbols.ParseNumber, and characters as 'c'. If a symbol is undefined, the error wraps ErrUndefined
+// and the value is calculated with 0 for the symbol.
+func Eval(expr string, pc uint16, lookup Lookup) (int, error) {
+	x, err := ParseExpr(expr, false)
+	if err != nil {
+		return 0, err
+	}
+	return x.Eval(pc, lookup, nil)
+}
@@ -0,0 +1,46 @@
+package asm
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// bytes per line of a listing
+const listingBytes = 4
+
+// WriteListing writes a listing in the format of TASM: the line number with a + per include level,
+// the address, up to four bytes and the source. Lines with more bytes continue on the following lines,
+// and lines that were skipped by a conditional are marked with a ~ after the address.
+func (p *Program) WriteListing(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	for _, line := range p.Listing.Lines {
+		prefix := fmt.Sprintf("%04d%-3s", line.Number%10000, strings.Repeat("+", line.Depth))
+		mark := ' '
+		if line.Skipped {
+			mark = '~'
+		}
+		addr := line.Addr
+		for i := 0; i == 0 || i < len(line.Bytes); i += listingBytes {
+			var field strings.Builder
+			for j := i; j < i+listingBytes && j < len(line.Bytes); j++ {
+				fmt.Fprintf(&field, "%02X ", line.Bytes[j])
+			}
+			fmt.Fprintf(bw, "%s%04X%c%-12s", prefix, addr, mark, field.String())
+			if i == 0 {
+				bw.WriteString(line.Source)
+			}
+			bw.WriteByte('\n')
+			addr += listingBytes
+		}
+	}
+	return bw.Flush()
+}
+
+// Binary returns the bytes of the program from its lowest to its highest address, with the gaps
+// filled with fill, and the address of the first byte
+func (p *Program) Binary(fill uint8) (uint16, []uint8) {
+	addr, data := p.Image.Flatten(fill)
+	return uint16(addr), data
+}
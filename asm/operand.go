@@ -0,0 +1,156 @@
+package asm
+
+import (
+	"strings"
+
+	"github.com/antbern/z80-emulator/symbols"
+)
+
+// operandKind is the addressing mode of an operand
+type operandKind int
+
+const (
+	// opImm is an expression, which can also be a condition or a symbol
+	opImm operandKind = iota
+	// opMem is a memory address (nn)
+	opMem
+	// opReg is a register
+	opReg
+	// opRegInd is a register used as an address, (HL), (C) or (IX)
+	opRegInd
+	// opIndexed is an indexed address (IX+d) or (IY+d)
+	opIndexed
+)
+
+// operand is a parsed operand of an instruction
+type operand struct {
+	kind operandKind
+	name string // the upper case register of opReg, opRegInd and opIndexed
+	expr string // the expression of opImm and opMem, or the displacement of opIndexed
+}
+
+// registers are the names of registers, including the undocumented halves of the index registers
+var registers = map[string]bool{
+	"A": true, "B": true, "C": true, "D": true, "E": true, "H": true, "L": true, "I": true, "R": true, "F": true,
+	"IXH": true, "IXL": true, "IYH": true, "IYL": true,
+	"AF": true, "AF'": true, "BC": true, "DE": true, "HL": true, "SP": true, "IX": true, "IY": true,
+}
+
+// registers that can be used as an address in parentheses
+var indirectRegisters = map[string]bool{"BC": true, "DE": true, "HL": true, "SP": true, "C": true, "IX": true, "IY": true}
+
+// skipQuoted returns the index of the quote closing a string or character constant starting at i, or i
+// if there is none. The quote of AF' does not start a string.
+func skipQuoted(s string, i int) int {
+	if s[i] == '\'' && i > 0 && symbols.IsIdentChar(s[i-1]) {
+		return i
+	}
+	if end := strings.IndexByte(s[i+1:], s[i]); end >= 0 {
+		return i + 1 + end
+	}
+	return i
+}
+
+// splitOperands splits the operands of an instruction at the commas that are not in parentheses or
+// strings
+func splitOperands(s string) []string {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil
+	}
+	var parts []string
+	depth, start := 0, 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case '\'', '"':
+			i = skipQuoted(s, i)
+		case ',':
+			if depth == 0 {
+				parts = append(parts, strings.TrimSpace(s[start:i]))
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, strings.TrimSpace(s[start:]))
+}
+
+// stripComment removes a comment starting with ; that is not in a string
+func stripComment(s string) string {
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case ';':
+			return s[:i]
+		case '\'', '"':
+			i = skipQuoted(s, i)
+		}
+	}
+	return s
+}
+
+// matchingParen returns the index of the parenthesis closing the one at the start of s, or -1
+func matchingParen(s string) int {
+	depth := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		case '\'', '"':
+			i = skipQuoted(s, i)
+		}
+	}
+	return -1
+}
+
+// parseOperand classifies an operand
+func parseOperand(s string) operand {
+	upper := strings.ToUpper(s)
+	if registers[upper] {
+		return operand{kind: opReg, name: upper}
+	}
+	if strings.HasPrefix(s, "(") && matchingParen(s) == len(s)-1 {
+		inner := strings.TrimSpace(s[1 : len(s)-1])
+		upperInner := strings.ToUpper(inner)
+		if indirectRegisters[upperInner] {
+			return operand{kind: opRegInd, name: upperInner}
+		}
+		if strings.HasPrefix(upperInner, "IX") || strings.HasPrefix(upperInner, "IY") {
+			rest := strings.TrimSpace(inner[2:])
+			if strings.HasPrefix(rest, "+") || strings.HasPrefix(rest, "-") {
+				return operand{kind: opIndexed, name: upperInner[:2], expr: rest}
+			}
+		}
+		return operand{kind: opMem, expr: inner}
+	}
+	return operand{kind: opImm, expr: s}
+}
+
+// is returns true if the operand is the register name
+func (o operand) is(name string) bool {
+	return o.kind == opReg && o.name == name
+}
+
+// condition returns the index of a condition in core.CondNames, where max is the number of conditions
+// allowed by the instruction
+func (o operand) condition(max int) (uint8, bool) {
+	name := o.name
+	if o.kind == opImm {
+		name = strings.ToUpper(o.expr)
+	} else if o.kind != opReg {
+		return 0, false
+	}
+	for i, c := range condNames[:max] {
+		if c == name {
+			return uint8(i), true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/antbern/z80-emulator/cpm"
+	"github.com/antbern/z80-emulator/io"
+)
+
+// runBoot implements the boot subcommand, which boots CP/M 2.2 from disk images
+func runBoot(args []string) int {
+	fs := flag.NewFlagSet("boot", flag.ExitOnError)
+	format := fs.String("format", "", "The disk format of all images, e.g. ibm-8-sssd. Guessed from the size of raw images if empty")
+	native := fs.Bool("native", false, "Run the BIOS from the disk image using the floppy disk controller and the SIO console instead of the trapped BIOS. It runs until the BIOS polls the console after the end of the input, or Ctrl-C")
+	fdcBase := fs.String("fdc-base", "0x30", "The base port of the floppy disk controller registers in native mode")
+	clock := fs.Uint64("clock", 4000000, "The CPU clock frequency in Hz, used for device timing")
+	save := fs.Bool("save", false, "Write the disk images back when CP/M exits. Only raw images can be saved")
+	verbose := fs.Bool("v", false, "Log emulator debug output to stderr")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s boot [flags] a.img [b.img...]\n", os.Args[0])
+		fmt.Fprintln(fs.Output(), "Boots CP/M from the system tracks of the first disk image, for testing a BIOS. Writes to the disks")
+		fmt.Fprintln(fs.Output(), "are kept in memory and discarded when CP/M exits, unless -save is given. The CPU does not implement")
+		fmt.Fprintln(fs.Output(), "all instructions yet, such as RLCA, DAA, CPL, SCF and CCF and the flags of INC and DEC, so a stock")
+		fmt.Fprintln(fs.Output(), "CP/M 2.2 CCP and BDOS do not run correctly yet.")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() < 1 {
+		fs.Usage()
+		return 2
+	}
+	if !*verbose {
+		log.SetOutput(ioutil.Discard)
+	}
+
+	cfg := cpm.BootConfig{Input: os.Stdin, Output: os.Stdout, Native: *native}
+	for _, path := range fs.Args() {
+		if *save && strings.EqualFold(filepath.Ext(path), ".imd") {
+			fmt.Fprintf(os.Stderr, "Error: %v can not be saved, -save only writes raw images\n", path)
+			return 2
+		}
+		disk, err := loadBootDisk(path, *format)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error loading disk image:", err)
+			return 1
+		}
+		cfg.Disks = append(cfg.Disks, disk)
+	}
+
+	if *native {
+		base, err := strconv.ParseUint(*fdcBase, 0, 8)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error parsing floppy disk controller base port %v: %v\n", *fdcBase, err)
+			return 2
+		}
+		if *clock == 0 {
+			fmt.Fprintln(os.Stderr, "Error: the floppy disk controller needs a -clock frequency above 0")
+			return 2
+		}
+		bus := io.NewBus()
+		fdc := io.NewFDC(uint8(base), *clock)
+		for i, disk := range cfg.Disks {
+			fdc.InsertDisk(i, disk.Disk)
+		}
+		bus.Attach(uint8(base), fdc.Ports(), fdc)
+		cfg.IO = bus
+	}
+
+	m, err := cpm.Boot(cfg)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error booting:", err)
+		return 1
+	}
+	if *native {
+		// a native BIOS has no trapped exit, so Ctrl-C stops the machine
+		interrupts := make(chan os.Signal, 1)
+		signal.Notify(interrupts, os.Interrupt)
+		defer signal.Stop(interrupts)
+		go func() {
+			for range interrupts {
+				m.Stop()
+			}
+		}()
+	}
+	_, err = m.Run()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error running CP/M:", err)
+	}
+
+	if !*save {
+		log.Println("Discarding the writes to the disk images, use -save to keep them")
+	} else {
+		for i, path := range fs.Args() {
+			if err := saveBootDisk(path, cfg.Disks[i]); err != nil {
+				fmt.Fprintln(os.Stderr, "Error saving disk image:", err)
+				return 1
+			}
+		}
+	}
+	if err != nil {
+		return 1
+	}
+	return 0
+}
+
+// saveBootDisk writes a disk back to its raw image
+func saveBootDisk(path string, disk cpm.BootDisk) error {
+	var buf bytes.Buffer
+	if err := disk.Disk.WriteRaw(&buf); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, buf.Bytes(), 0644)
+}
+
+// loadBootDisk loads a disk image and finds its CP/M format. The format of ImageDisk images must be
+// named, while raw images are matched by their size.
+func loadBootDisk(path, format string) (cpm.BootDisk, error) {
+	if format == "" {
+		if strings.EqualFold(filepath.Ext(path), ".imd") {
+			return cpm.BootDisk{}, fmt.Errorf("%v: the format of ImageDisk images must be given with -format", path)
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return cpm.BootDisk{}, err
+		}
+		g, ok := io.GeometryForSize(int(info.Size()))
+		if !ok {
+			return cpm.BootDisk{}, fmt.Errorf("%v: no known disk format is %d bytes", path, info.Size())
+		}
+		format = g.Name
+	}
+
+	diskFormat, ok := cpm.LookupDiskFormat(format)
+	if !ok {
+		return cpm.BootDisk{}, fmt.Errorf("%v: no CP/M disk format for %q", path, format)
+	}
+	disk, err := io.LoadDisk(path, format)
+	if err != nil {
+		return cpm.BootDisk{}, err
+	}
+	return cpm.BootDisk{Disk: disk, Format: diskFormat}, nil
+}
@@ -127,9 +127,12 @@ func add8(a, b uint8, F R8, addCarry bool) uint8 {
 // sub8 performs a - b - carry (if subCarry is true) and returns the result while manipulating the flags
 // based on the same answer as for addc8 above
 func sub8(a, b uint8, F R8, subCarry bool) uint8 {
-	// a - b - c = a + ~b + 1 - c = a + ~b + !c
+	// a - b - c = a + ~b + 1 - c = a + ~b + !c, where c is 0 without subCarry
+	if !subCarry {
+		*F &^= FlagC
+	}
 	*F ^= FlagC
-	res := add8(a, ^b, F, subCarry)
+	res := add8(a, ^b, F, true)
 	*F ^= FlagC
 	*F ^= FlagH // should probably toggle the half carry flag too
 	*F |= FlagN // set add/subtract flag for subtract operation
@@ -181,6 +184,20 @@ func _bitwiseFlagSet(result uint8, F R8) uint8 {
 	return result
 }
 
+// ldIR returns the value of I or R for LD A,I and LD A,R and sets the flags like they do
+// * S is set if the value is negative; otherwise, it is reset.
+// * Z is set if the value is 0; otherwise, it is reset.
+// * H and N are reset.
+// * P/V contains the contents of IFF2.
+// * C is not affected.
+func ldIR(val uint8, iff2 bool, F R8) uint8 {
+	*F = (*F & FlagC) | (val & FlagS) | (isZero(val) << FlagZshift)
+	if iff2 {
+		*F |= FlagP
+	}
+	return val
+}
+
 /*
 func inc8(val *uint8, F R8) {
 	// do increment
@@ -146,6 +146,28 @@ func TestSubc8(t *testing.T) {
 	}
 }
 
+func TestSub8(t *testing.T) {
+	// without subCarry the carry flag is ignored, so the results are those of SBC without a carry
+	testCases := []struct {
+		a, b, r uint8 // a - b = r
+		fa      uint8 // flags after
+	}{
+		{0x00, 0x00, 0x00, 0x42}, {0x00, 0x01, 0xff, 0x93}, {0x01, 0x01, 0x00, 0x42},
+		{0x7f, 0x80, 0xff, 0x87}, {0x80, 0x01, 0x7f, 0x16}, {0xff, 0x81, 0x7e, 0x02},
+	}
+	for _, tC := range testCases {
+		F := NewR8()
+		*F = FlagC
+		res := sub8(tC.a, tC.b, F, false)
+		if res != tC.r {
+			t.Errorf("Sub8: %#02x - %#02x = %#02x, got %#02x", tC.a, tC.b, tC.r, res)
+		}
+		if *F != tC.fa {
+			t.Errorf("Sub8: %#02x - %#02x should give flags %#02x, got %#02x", tC.a, tC.b, tC.fa, *F)
+		}
+	}
+}
+
 /*
 func TestTest(t *testing.T) {
 
@@ -0,0 +1,162 @@
+package core
+
+// FrameKind is how a routine on the call stack was entered
+type FrameKind uint8
+
+// the ways to enter a routine
+const (
+	CallFrame FrameKind = iota
+	RestartFrame
+	InterruptFrame
+)
+
+// String returns the kind as the instruction that enters the routine, or "interrupt"
+func (k FrameKind) String() string {
+	return [...]string{"CALL", "RST", "interrupt"}[k]
+}
+
+// Frame is a routine on the call stack
+type Frame struct {
+	Kind FrameKind
+
+	// Caller is the address of the instruction that entered the routine, which for interrupts is the
+	// address of the interrupted instruction
+	Caller uint16
+
+	// Entry is the address of the routine
+	Entry uint16
+
+	// Return is the pushed return address, and SP the address it was pushed to
+	Return, SP uint16
+}
+
+// Mismatch is a return that does not match the call stack, which likely means that the stack was
+// corrupted
+type Mismatch struct {
+	// PC is the address of the return instruction, which popped the address To from SP
+	PC, SP, To uint16
+
+	// Frame is the routine whose return address was expected at SP, or nil if no call pushed an
+	// address there
+	Frame *Frame
+}
+
+// maxMismatches is the number of recent mismatches that are kept
+const maxMismatches = 16
+
+// stackWindow is how far below a frame SP can be while still on the same stack. Frames further away
+// belong to another stack that the program switched from, and are kept until it switches back.
+const stackWindow = 256
+
+// CallStack is a shadow call stack kept by the CPU. It records the routines entered by calls, restarts
+// and interrupts, and removes them when they return. The frames are keyed by the SP of their return
+// address, so that routines left without returning, for example by popping the return address and
+// jumping, are removed by the next return or call that uses the stack above them.
+type CallStack struct {
+	// Frames are the routines that have not returned, with the innermost last
+	Frames []Frame
+
+	// Mismatches are the recent returns that did not match a frame, with the latest last
+	Mismatches []Mismatch
+}
+
+// Depth returns the number of frames
+func (c *CallStack) Depth() int {
+	return len(c.Frames)
+}
+
+// Reset removes all frames and mismatches, for example when the program is restarted
+func (c *CallStack) Reset() {
+	c.Frames = c.Frames[:0]
+	c.Mismatches = c.Mismatches[:0]
+}
+
+// abandon removes the frames at or below sp on the same stack, whose return addresses were popped or
+// overwritten without returning
+func (c *CallStack) abandon(sp uint16) {
+	for n := len(c.Frames); n > 0; n-- {
+		f := c.Frames[n-1]
+		if f.SP > sp || sp-f.SP > stackWindow {
+			break
+		}
+		c.Frames = c.Frames[:n-1]
+	}
+}
+
+// enter records a routine whose return address was just pushed to sp
+func (c *CallStack) enter(f Frame) {
+	c.abandon(f.SP)
+	c.Frames = append(c.Frames, f)
+}
+
+// leave records a return from pc that popped the address to from sp
+func (c *CallStack) leave(pc, sp, to uint16) {
+	if sp > 0 {
+		c.abandon(sp - 1)
+	}
+	m := Mismatch{PC: pc, SP: sp, To: to}
+	if n := len(c.Frames); n > 0 && c.Frames[n-1].SP == sp {
+		f := c.Frames[n-1]
+		c.Frames = c.Frames[:n-1]
+		if f.Return == to {
+			return
+		}
+		m.Frame = &f
+	}
+	if len(c.Mismatches) == maxMismatches {
+		c.Mismatches = append(c.Mismatches[:0], c.Mismatches[1:]...)
+	}
+	c.Mismatches = append(c.Mismatches, m)
+}
+
+// call pushes the return address in PC and jumps to addr, recording a routine entered from the
+// instruction at caller
+func (z *Z80) call(kind FrameKind, caller, addr uint16) {
+	z.Mem.stackPush16(z.SP, z.PC)
+	if z.Calls != nil {
+		if z.History != nil {
+			z.History.calls()
+		}
+		z.Calls.enter(Frame{Kind: kind, Caller: caller, Entry: addr, Return: *z.PC, SP: *z.SP})
+	}
+	*z.PC = addr
+}
+
+// ret pops the return address into PC, recording the return from the instruction at pc
+func (z *Z80) ret(pc uint16) {
+	sp := *z.SP
+	z.Mem.stackPop16(z.SP, z.PC)
+	if z.Calls != nil {
+		if z.History != nil {
+			z.History.calls()
+		}
+		z.Calls.leave(pc, sp, *z.PC)
+	}
+}
+
+// Ret pops the return address from the stack into PC, like the RET instruction
+func (z *Z80) Ret() {
+	z.ret(*z.PC)
+}
+
+// Interrupt requests a maskable interrupt that calls the handler at addr, like interrupt mode 1 does
+// with $0038. It is only accepted while interrupts are enabled, and then disables them until the
+// handler enables them again and resumes the CPU if it is halted. It returns whether it was accepted.
+func (z *Z80) Interrupt(addr uint16) bool {
+	if !z.InterruptEnabled {
+		return false
+	}
+	accept := func() {
+		z.InterruptEnabled, z.IFF2 = false, false
+		z.Halted = false
+		z.Cycles += cyclesInterrupt
+		z.refresh()
+		z.call(InterruptFrame, *z.PC, addr)
+	}
+	if z.History != nil {
+		z.History.amend(accept)
+	} else {
+		accept()
+	}
+	return true
+}
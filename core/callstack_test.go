@@ -0,0 +1,94 @@
+package core
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCallStack(t *testing.T) {
+	z := NewZ80()
+	z.Calls = &CallStack{}
+	code := []uint8{
+		0x31, 0x00, 0x80, // LD SP,$8000
+		0xCD, 0x10, 0x00, // CALL $0010
+		0xCD, 0x18, 0x00, // CALL $0018
+		0xCD, 0x20, 0x00, // CALL $0020
+		0x76,             // HALT
+		0x00, 0x00, 0x00, // padding
+		0xEF,                               // 0010: RST $28
+		0xC9,                               // RET
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // padding
+		0xE1,                               // 0018: POP HL
+		0xE9,                               // JP (HL)
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // padding
+		0x21, 0x34, 0x12, // 0020: LD HL,$1234
+		0xE3, // EX (SP),HL
+		0xC9, // RET
+	}
+	z.Mem.Write(0, &code)
+	z.Mem.Poke(0x0028, 0xC9) // RET
+
+	// stop in the RST routine
+	for *z.PC != 0x0028 {
+		z.Step()
+	}
+	want := []Frame{
+		{CallFrame, 0x0003, 0x0010, 0x0006, 0x7FFE},
+		{RestartFrame, 0x0010, 0x0028, 0x0011, 0x7FFC},
+	}
+	if !reflect.DeepEqual(z.Calls.Frames, want) {
+		t.Errorf("Expected frames %+v, got %+v", want, z.Calls.Frames)
+	}
+
+	// the routine at $0018 returns by jumping, which is found when the next call pushes over it
+	for *z.PC != 0x0020 {
+		z.Step()
+	}
+	want = []Frame{{CallFrame, 0x0009, 0x0020, 0x000C, 0x7FFE}}
+	if !reflect.DeepEqual(z.Calls.Frames, want) || len(z.Calls.Mismatches) != 0 {
+		t.Errorf("Expected frames %+v and no mismatches, got %+v and %+v", want, z.Calls.Frames, z.Calls.Mismatches)
+	}
+
+	// the last routine overwrites its return address
+	for !z.Halted && *z.PC != 0x1234 {
+		z.Step()
+	}
+	wantMismatches := []Mismatch{{PC: 0x0024, SP: 0x7FFE, To: 0x1234, Frame: &want[0]}}
+	if len(z.Calls.Frames) != 0 || !reflect.DeepEqual(z.Calls.Mismatches, wantMismatches) {
+		t.Errorf("Expected mismatches %+v, got %+v and frames %+v", wantMismatches, z.Calls.Mismatches, z.Calls.Frames)
+	}
+}
+
+func TestInterrupt(t *testing.T) {
+	z := NewZ80()
+	z.Calls = &CallStack{}
+	code := []uint8{
+		0x31, 0x00, 0x80, // LD SP,$8000
+		0xFB, // EI
+		0x76, // HALT
+		0x76, // HALT
+	}
+	z.Mem.Write(0, &code)
+	z.Mem.Write(0x38, &[]uint8{0xFB, 0xED, 0x4D}) // EI, RETI
+
+	for !z.Halted {
+		z.Step()
+	}
+	if !z.Interrupt(0x38) || z.Halted || *z.PC != 0x0038 || z.InterruptEnabled {
+		t.Fatalf("Expected the interrupt to be accepted and resume at 0x0038, got PC %#04x", *z.PC)
+	}
+	want := []Frame{{InterruptFrame, 0x0005, 0x0038, 0x0005, 0x7FFE}}
+	if !reflect.DeepEqual(z.Calls.Frames, want) {
+		t.Errorf("Expected frames %+v, got %+v", want, z.Calls.Frames)
+	}
+	z.Step()
+	z.Step()
+	if *z.PC != 0x0005 || *z.SP != 0x8000 || len(z.Calls.Frames) != 0 || !z.InterruptEnabled {
+		t.Errorf("Expected RETI to return to 0x0005, got PC %#04x and SP %#04x", *z.PC, *z.SP)
+	}
+
+	z.InterruptEnabled = false
+	if z.Interrupt(0x38) || *z.PC != 0x0005 {
+		t.Errorf("Expected the interrupt to be ignored while interrupts are disabled")
+	}
+}
@@ -1,10 +1,95 @@
 package core
 
 import (
-	"fmt"
+	"io"
 	"log"
+	"os"
+	"strings"
+
+	z80io "github.com/antbern/z80-emulator/io"
+)
+
+// BDOS holds the state of the emulated CP/M 2.2 BDOS. Console functions use Input and Output, and
+// file functions operate on files in the host directory configured for each drive.
+type BDOS struct {
+	// Output receives all console output, Input provides console input. Input is read directly if it
+	// is an io.Input, so that it can be shared with the debugger prompt.
+	Output io.Writer
+	Input  io.Reader
+
+	// List receives output to the list device (printer) if set
+	List io.Writer
+
+	// Echo controls whether console input is echoed to Output. It is usually not needed when the host
+	// terminal already echoes the input.
+	Echo bool
+
+	// Drives maps the drives A: to P: to host directories. Drives without a directory are not available.
+	// The files of user 0 are in the directory, and those of users 1 to 15 in subdirectories named
+	// by the user number.
+	Drives [16]string
+
+	// ReturnCode is the program return code set through function 108
+	ReturnCode uint16
+
+	dma         uint16
+	drive, user uint8
+	iobyte      uint8
+
+	// console input that can be polled for the console status, which is Input itself if it is an
+	// io.Input
+	input *z80io.Input
+
+	// state for search first/next
+	searchResults []dirEntry
+	searchIndex   int
+
+	// open host files, keyed by their path, and the host files of opened FCBs, keyed by the address
+	// of the FCB
+	files map[string]*hostFile
+	fcbs  map[uint16]openFCB
+}
+
+// constants for the BDOS calling convention
+const (
+	// BDOSEntry is the address programs call to reach the BDOS
+	BDOSEntry = 0x0005
+	// DefaultDMA is the address of the default DMA buffer
+	DefaultDMA = 0x0080
+	// RecordSize is the size of a CP/M record
+	RecordSize = 128
 )
 
+// NewBDOS returns a new BDOS using the provided console input and output, with no drives configured
+func NewBDOS(in io.Reader, out io.Writer) *BDOS {
+	return &BDOS{Input: in, Output: out, dma: DefaultDMA, files: make(map[string]*hostFile), fcbs: make(map[uint16]openFCB)}
+}
+
+// Reset resets the disk system like BDOS function 13, selecting drive A: and the default DMA address
+// and closing all open files
+func (b *BDOS) Reset() {
+	b.drive = 0
+	b.dma = DefaultDMA
+	b.Close()
+}
+
+// Close closes all host files left open by the running program
+func (b *BDOS) Close() {
+	for path, f := range b.files {
+		f.Close()
+		delete(b.files, path)
+	}
+	for fcb := range b.fcbs {
+		delete(b.fcbs, fcb)
+	}
+}
+
+// HandleBDOS performs the BDOS function in C, for use when the BDOS entry point is trapped
+// rather than intercepting CALL 5
+func (z *Z80) HandleBDOS() {
+	z.handleBDOS()
+}
+
 // handleBDOS handles any CP/M BDOS calls (call 5)
 // Basic usage in code:
 // 	LD  DE,parameter
@@ -13,25 +98,243 @@ import (
 // Information about the available functions can be found here:
 // * http://seasip.info/Cpm/bdosfunc.html
 // * http://www.gaby.de/cpm/manuals/archive/cpm22htm/ch5.htm#Section_5.6
-// The most important ones are 2: Write Char and 9: Write String
-// By implementing the above, the Zexdoc Z80 exerciser can be run on this system :D
+// Results are returned in A and L for 8 bit values, and in HL (copied to BA) for 16 bit values.
 func (z *Z80) handleBDOS() {
+	if z.BDOS == nil {
+		z.BDOS = NewBDOS(os.Stdin, os.Stdout)
+	}
+	b := z.BDOS
+
 	log.Printf("BDOS CALL: C=%v, DE=%#04x ", *z.C, *z.DE)
 
+	// most functions return 0 unless they explicitly set a result
+	var result uint16
+
 	switch *z.C {
+	case 0: // System reset, warm boot through address 0
+		*z.PC = 0
+
+	case 1: // Console input, returns the character in A after echoing it
+		c := b.readConsole()
+		if b.Echo {
+			b.writeConsole(c)
+		}
+		result = uint16(c)
+
 	case 2: // Write char, E = the ascii character to write
-		fmt.Print(byte(*z.E))
+		b.writeConsole(*z.E)
+
+	case 3: // Auxiliary (reader) input, there is no reader so always return end of file
+		result = 0x1A
+
+	case 4: // Auxiliary (punch) output, discarded
+
+	case 5: // List output
+		if b.List != nil {
+			b.List.Write([]byte{*z.E})
+		}
+
+	case 6: // Direct console I/O
+		switch *z.E {
+		case 0xFF: // return a character if one is available, without echo
+			if b.consoleReady() {
+				result = uint16(b.readConsole())
+			}
+		case 0xFE: // console status
+			if b.consoleReady() {
+				result = 0xFF
+			}
+		case 0xFD: // blocking input without echo
+			result = uint16(b.readConsole())
+		default:
+			b.writeConsole(*z.E)
+		}
+
+	case 7: // Get IOBYTE
+		result = uint16(b.iobyte)
+
+	case 8: // Set IOBYTE
+		b.iobyte = *z.E
 
 	case 9: // Write string, DE = points to start of string, terminated with the $ character
 		// a for loop to perform the printing
 		addr := *z.DE
 		for {
-			c := rune(z.Mem.read8Inc(&addr))
+			c := z.Mem.read8(addr)
+			addr++
 			if c == '$' {
 				break
 			}
-			fmt.Printf("%c", c)
+			b.writeConsole(c)
+		}
+
+	case 10: // Read console buffer, DE = buffer with the max length in the first byte
+		b.readLine(z.Mem, *z.DE)
+
+	case 11: // Console status
+		if b.consoleReady() {
+			result = 0xFF
 		}
 
+	case 12: // Return version number, CP/M 2.2
+		result = 0x0022
+
+	case 13: // Reset disk system
+		b.Reset()
+
+	case 14: // Select disk
+		if b.Drives[*z.E&0x0f] == "" {
+			log.Printf("BDOS: Select error on drive %c:", 'A'+*z.E&0x0f)
+			result = 0xFF
+		} else {
+			b.drive = *z.E & 0x0f
+		}
+
+	case 24: // Return login vector, all configured drives are logged in
+		for i, dir := range b.Drives {
+			if dir != "" {
+				result |= 1 << uint(i)
+			}
+		}
+
+	case 25: // Return current disk
+		result = uint16(b.drive)
+
+	case 26: // Set DMA address
+		b.dma = *z.DE
+
+	case 27, 31: // Get allocation vector and disk parameter block addresses, not available
+		result = 0xFFFF
+
+	case 28, 37: // Write protect disk and reset drive, nothing to do
+
+	case 29: // Get read-only vector, no drives are read-only
+
+	case 30: // Set file attributes, not supported by the host but reported as successful
+
+	case 32: // Get/set user code
+		if *z.E == 0xFF {
+			result = uint16(b.user)
+		} else {
+			b.user = *z.E & 0x0f
+		}
+
+	case 108: // Get/set program return code (CP/M 3)
+		if *z.DE == 0xFFFF {
+			result = b.ReturnCode
+		} else {
+			b.ReturnCode = *z.DE
+		}
+
+	default:
+		if fn, ok := fileFunctions[*z.C]; ok {
+			result = fn(b, z.Mem, *z.DE)
+		} else {
+			log.Printf("BDOS: Unsupported function %v", *z.C)
+			result = 0xFF
+		}
+	}
+
+	// return the result in both A/L and B/H
+	*z.HL = result
+	*z.A = *z.L
+	*z.B = *z.H
+}
+
+// writeConsole writes a single character to the console
+func (b *BDOS) writeConsole(c uint8) {
+	if b.Output != nil {
+		b.Output.Write([]byte{c})
+	}
+}
+
+// startConsole uses Input directly if it is an io.Input, or starts reading it in the background
+func (b *BDOS) startConsole() {
+	if b.input != nil {
+		return
+	}
+	if in, ok := b.Input.(*z80io.Input); ok {
+		b.input = in
+	} else if b.Input != nil {
+		b.input = z80io.NewInput(b.Input)
+	} else {
+		b.input = z80io.NewInput(strings.NewReader(""))
+	}
+}
+
+// readConsole blocks until a character is available on the console. End of input returns ^Z.
+func (b *BDOS) readConsole() uint8 {
+	c, _ := b.ConsoleIn()
+	return c
+}
+
+// consoleReady returns true if there is console input available
+func (b *BDOS) consoleReady() bool {
+	b.startConsole()
+	return b.input.Ready()
+}
+
+// readLine implements function 10, reading a line into the buffer at addr
+func (b *BDOS) readLine(mem *RAM, addr uint16) {
+	max := int(mem.read8(addr))
+	var line []uint8
+	for {
+		c := b.readConsole()
+		if c == '\r' || c == 0x1A {
+			break
+		}
+		switch c {
+		case 0x08, 0x7F: // backspace and delete
+			if len(line) > 0 {
+				line = line[:len(line)-1]
+			}
+		default:
+			if len(line) < max {
+				line = append(line, c)
+			}
+		}
+		if b.Echo {
+			b.writeConsole(c)
+		}
+		if len(line) == max && max > 0 {
+			break
+		}
+	}
+	if b.Echo {
+		b.writeConsole('\r')
+		b.writeConsole('\n')
 	}
+
+	mem.put8(addr+1, uint8(len(line)))
+	for i, c := range line {
+		mem.put8(addr+2+uint16(i), c)
+	}
+}
+
+// ConsoleStatus returns 0xFF if console input is available and 0 otherwise
+func (b *BDOS) ConsoleStatus() uint8 {
+	if b.consoleReady() {
+		return 0xFF
+	}
+	return 0
+}
+
+// ConsoleIn blocks until a character is available on the console and returns it without echo.
+// At the end of the console input it returns ^Z and false.
+func (b *BDOS) ConsoleIn() (uint8, bool) {
+	b.startConsole()
+	c, err := b.input.ReadByte()
+	if err != nil {
+		return 0x1A, false
+	}
+	// CP/M uses CR as the line terminator
+	if c == '\n' {
+		c = '\r'
+	}
+	return c, true
+}
+
+// ConsoleOut writes a character to the console
+func (b *BDOS) ConsoleOut(c uint8) {
+	b.writeConsole(c)
 }
@@ -0,0 +1,340 @@
+package core
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	z80io "github.com/antbern/z80-emulator/io"
+)
+
+// newBDOSTest returns a CPU with the BDOS enabled, with drive A: mapped to a temporary directory
+func newBDOSTest(t *testing.T, input string) (*Z80, *bytes.Buffer, string) {
+	dir, err := ioutil.TempDir("", "bdostest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := &bytes.Buffer{}
+	z := NewZ80()
+	z.EnableBDOS = true
+	z.BDOS = NewBDOS(strings.NewReader(input), out)
+	z.BDOS.Drives[0] = dir
+	return &z, out, dir
+}
+
+// bdosCall performs a BDOS call with the function in C and the parameter in DE, returning A
+func bdosCall(z *Z80, fn uint8, de uint16) uint8 {
+	*z.C = fn
+	*z.DE = de
+	z.handleBDOS()
+	return *z.A
+}
+
+// setFCB clears the FCB at addr and fills in the file name, given in 8.3 form
+func setFCB(z *Z80, addr uint16, name string) {
+	for i := uint16(0); i < 36; i++ {
+		z.Mem.put8(addr+i, 0)
+	}
+	drive, cpmName := ParseFileName(name)
+	z.Mem.put8(addr+fcbDrive, drive)
+	for i := 0; i < 11; i++ {
+		z.Mem.put8(addr+fcbName+uint16(i), cpmName[i])
+	}
+}
+
+func TestBDOSConsole(t *testing.T) {
+	z, out, dir := newBDOSTest(t, "x\nhello\n")
+	defer os.RemoveAll(dir)
+
+	bdosCall(z, 2, 'A')
+	z.Mem.Write(0x200, &[]byte{'h', 'i', '$'})
+	bdosCall(z, 9, 0x200)
+	if out.String() != "Ahi" {
+		t.Errorf("Unexpected console output %q", out.String())
+	}
+
+	if c := bdosCall(z, 1, 0); c != 'x' {
+		t.Errorf("Console input returned %q, want 'x'", c)
+	}
+	// the newline after x is returned as CR
+	if c := bdosCall(z, 1, 0); c != '\r' {
+		t.Errorf("Console input returned %#02x, want CR", c)
+	}
+
+	// read console buffer with room for 10 characters
+	z.Mem.put8(0x300, 10)
+	bdosCall(z, 10, 0x300)
+	if n := z.Mem.read8(0x301); n != 5 {
+		t.Fatalf("Read console buffer returned %d characters, want 5", n)
+	}
+	if line := string(z.Mem.data[0x302:0x307]); line != "hello" {
+		t.Errorf("Read console buffer returned %q", line)
+	}
+
+	if v := bdosCall(z, 12, 0); v != 0x22 || *z.HL != 0x0022 {
+		t.Errorf("Version returned A=%#02x HL=%#04x", v, *z.HL)
+	}
+}
+
+func TestBDOSConsoleShared(t *testing.T) {
+	z, _, dir := newBDOSTest(t, "")
+	defer os.RemoveAll(dir)
+	in := z80io.NewInput(strings.NewReader("ab"))
+	z.BDOS.Input = in
+
+	if c := bdosCall(z, 1, 0); c != 'a' {
+		t.Errorf("Console input returned %q, want 'a'", c)
+	}
+	// the rest of the input is left for other readers such as the debugger
+	if c, err := in.ReadByte(); err != nil || c != 'b' {
+		t.Errorf("Expected the input to continue with 'b', got %q and %v", c, err)
+	}
+	if s := bdosCall(z, 11, 0); s != 0 {
+		t.Errorf("Console status returned %#02x at the end of the input, want 0", s)
+	}
+}
+
+func TestBDOSFiles(t *testing.T) {
+	z, _, dir := newBDOSTest(t, "")
+	defer os.RemoveAll(dir)
+	defer z.BDOS.Close()
+
+	const fcb = 0x5C
+	bdosCall(z, 26, 0x80)
+
+	// create a file with three records
+	setFCB(z, fcb, "TEST.TXT")
+	if r := bdosCall(z, 22, fcb); r != 0 {
+		t.Fatalf("Make file failed with %#02x", r)
+	}
+	for i := 0; i < 3; i++ {
+		for j := uint16(0); j < RecordSize; j++ {
+			z.Mem.put8(0x80+j, uint8(i+1))
+		}
+		if r := bdosCall(z, 21, fcb); r != 0 {
+			t.Fatalf("Write sequential failed with %#02x", r)
+		}
+	}
+	bdosCall(z, 16, fcb)
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "test.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 3*RecordSize || data[RecordSize] != 2 {
+		t.Fatalf("Unexpected host file contents, %d bytes", len(data))
+	}
+
+	// open with a wildcard and read back sequentially
+	setFCB(z, fcb, "TEST.T??")
+	if r := bdosCall(z, 15, fcb); r != 0 {
+		t.Fatalf("Open file failed with %#02x", r)
+	}
+	if rc := z.Mem.read8(fcb + fcbRC); rc != 3 {
+		t.Errorf("Open reported %d records, want 3", rc)
+	}
+	for i := 0; i < 3; i++ {
+		if r := bdosCall(z, 20, fcb); r != 0 || z.Mem.read8(0x80) != uint8(i+1) {
+			t.Fatalf("Read sequential of record %d returned %#02x with data %#02x", i, r, z.Mem.read8(0x80))
+		}
+	}
+	if r := bdosCall(z, 20, fcb); r != 1 {
+		t.Errorf("Expected end of file, got %#02x", r)
+	}
+
+	// random access
+	z.Mem.put8(fcb+fcbR0, 1)
+	if r := bdosCall(z, 33, fcb); r != 0 || z.Mem.read8(0x80) != 2 {
+		t.Errorf("Read random returned %#02x with data %#02x", r, z.Mem.read8(0x80))
+	}
+	bdosCall(z, 35, fcb)
+	if size := z.Mem.read8(fcb + fcbR0); size != 3 {
+		t.Errorf("Compute file size returned %d records, want 3", size)
+	}
+
+	// search for all files
+	setFCB(z, fcb, "A:*.*")
+	if r := bdosCall(z, 17, fcb); r != 0 {
+		t.Fatalf("Search first failed with %#02x", r)
+	}
+	if name := string(z.Mem.data[0x81:0x8C]); name != "TEST    TXT" {
+		t.Errorf("Search first found %q", name)
+	}
+	if r := bdosCall(z, 18, fcb); r != 0xFF {
+		t.Errorf("Search next should not find anything, got %#02x", r)
+	}
+
+	// rename and delete
+	setFCB(z, fcb, "TEST.TXT")
+	_, newName := ParseFileName("NEW.DAT")
+	for i := 0; i < 11; i++ {
+		z.Mem.put8(fcb+16+fcbName+uint16(i), newName[i])
+	}
+	if r := bdosCall(z, 23, fcb); r != 0 {
+		t.Fatalf("Rename failed with %#02x", r)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "new.dat")); err != nil {
+		t.Errorf("Renamed file not found: %v", err)
+	}
+	setFCB(z, fcb, "NEW.DAT")
+	if r := bdosCall(z, 19, fcb); r != 0 {
+		t.Errorf("Delete failed with %#02x", r)
+	}
+	if r := bdosCall(z, 15, fcb); r != 0xFF {
+		t.Errorf("Open of deleted file returned %#02x", r)
+	}
+}
+
+func TestBDOSOpenFiles(t *testing.T) {
+	z, _, dir := newBDOSTest(t, "")
+	defer os.RemoveAll(dir)
+	defer z.BDOS.Close()
+	for _, name := range []string{"a.txt", "b.txt"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	const fcb = 0x5C
+	bdosCall(z, 26, 0x80)
+
+	// the file is resolved when it is opened, without looking at the drive again
+	setFCB(z, fcb, "?.TXT")
+	if r := bdosCall(z, 15, fcb); r != 0 {
+		t.Fatalf("Open file failed with %#02x", r)
+	}
+	z.BDOS.Drives[0] = ""
+	if r := bdosCall(z, 20, fcb); r != 0 || string(z.Mem.data[0x80:0x85]) != "a.txt" {
+		t.Errorf("Read sequential returned %#02x with data %q", r, z.Mem.data[0x80:0x85])
+	}
+	z.BDOS.Drives[0] = dir
+
+	// names with wildcards are not read or written without opening them
+	setFCB(z, fcb, "?.TXT")
+	if r := bdosCall(z, 20, fcb); r != invalidFCB {
+		t.Errorf("Read sequential with a wildcard returned %#02x", r)
+	}
+	if r := bdosCall(z, 21, fcb); r != invalidFCB {
+		t.Errorf("Write sequential with a wildcard returned %#02x", r)
+	}
+
+	// writes to files that can only be read fail with a file R/O error in H
+	setFCB(z, fcb, "B.TXT")
+	f, err := os.Open(filepath.Join(dir, "b.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	z.BDOS.files[f.Name()] = &hostFile{File: f, readOnly: true}
+	if r := bdosCall(z, 15, fcb); r != 0 {
+		t.Fatalf("Open file failed with %#02x", r)
+	}
+	if r := bdosCall(z, 21, fcb); r != 0xFF || *z.H != 3 {
+		t.Errorf("Write to a read-only file returned A=%#02x H=%#02x", r, *z.H)
+	}
+
+	// the files of other users are in subdirectories
+	bdosCall(z, 32, 3)
+	setFCB(z, fcb, "A.TXT")
+	if r := bdosCall(z, 15, fcb); r != 0xFF {
+		t.Errorf("Open of a file of user 0 as user 3 returned %#02x", r)
+	}
+	if r := bdosCall(z, 22, fcb); r != 0 {
+		t.Fatalf("Make file failed with %#02x", r)
+	}
+	bdosCall(z, 16, fcb)
+	if _, err := os.Stat(filepath.Join(dir, "3", "a.txt")); err != nil {
+		t.Errorf("The file of user 3 was not made in its subdirectory: %v", err)
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(dir, "a.txt")); err != nil || string(data) != "a.txt" {
+		t.Errorf("The file of user 0 was changed: %q %v", data, err)
+	}
+}
+
+func TestBDOSFileNamesOutsideDrive(t *testing.T) {
+	z, _, dir := newBDOSTest(t, "")
+	defer os.RemoveAll(dir)
+	defer z.BDOS.Close()
+	drive := filepath.Join(dir, "drive")
+	if err := os.Mkdir(drive, 0755); err != nil {
+		t.Fatal(err)
+	}
+	z.BDOS.Drives[0] = drive
+
+	// names are written directly to the FCB since ParseFileName would split them at the dot
+	const fcb = 0x5C
+	setName := func(addr uint16, name string) {
+		for i := 0; i < 11; i++ {
+			z.Mem.put8(addr+fcbName+uint16(i), name[i])
+		}
+	}
+	for _, name := range []string{"../../pwTXT", "/TMP/PW TXT", "..\\PW   TXT", "A B     TXT"} {
+		setFCB(z, fcb, "")
+		setName(fcb, name)
+		if r := bdosCall(z, 22, fcb); r != 0xFF {
+			t.Errorf("Make file %q returned %#02x, want 0xFF", name, r)
+		}
+	}
+
+	setFCB(z, fcb, "TEST.TXT")
+	if r := bdosCall(z, 22, fcb); r != 0 {
+		t.Fatalf("Make file failed with %#02x", r)
+	}
+	bdosCall(z, 16, fcb)
+	setName(fcb+16, "../../pwTXT")
+	if r := bdosCall(z, 23, fcb); r != 0xFF {
+		t.Errorf("Rename to a path outside the drive returned %#02x, want 0xFF", r)
+	}
+
+	if infos, err := ioutil.ReadDir(dir); err != nil || len(infos) != 1 {
+		t.Errorf("Files were created outside the drive: %v", infos)
+	}
+	if _, err := os.Stat(filepath.Join(drive, "test.txt")); err != nil {
+		t.Errorf("The file was moved: %v", err)
+	}
+}
+
+func TestParseFileName(t *testing.T) {
+	tables := []struct {
+		spec, name string
+		drive      uint8
+	}{
+		{"test.com", "TEST    COM", 0},
+		{"b:*.asm", "????????ASM", 2},
+		{"P:AB*.C*", "AB??????C??", 16},
+		{"averylongname.text", "AVERYLONTEX", 0},
+	}
+	for _, table := range tables {
+		drive, name := ParseFileName(table.spec)
+		if drive != table.drive || name != table.name {
+			t.Errorf("ParseFileName(%q) = %d, %q, want %d, %q", table.spec, drive, name, table.drive, table.name)
+		}
+	}
+}
+
+func TestFCBNames(t *testing.T) {
+	tables := []struct {
+		host, fcb string
+		ok        bool
+	}{
+		{"test.com", "TEST    COM", true},
+		{"README", "README     ", true},
+		{"toolongname.txt", "", false},
+		{"a.b.c", "", false},
+		{"file.text", "", false},
+		{"../pw.txt", "", false},
+		{"dir/pw", "", false},
+		{"dir\\pw", "", false},
+	}
+	for _, table := range tables {
+		name, ok := toFCBName(table.host)
+		if ok != table.ok || name != table.fcb {
+			t.Errorf("toFCBName(%q) = %q, %v, want %q, %v", table.host, name, ok, table.fcb, table.ok)
+		}
+		if ok && toHostName(name) != strings.ToLower(table.host) {
+			t.Errorf("toHostName(%q) = %q", name, toHostName(name))
+		}
+	}
+}
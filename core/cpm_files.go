@@ -0,0 +1,596 @@
+package core
+
+import (
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// This file contains the BDOS file functions. Files are accessed through File Control Blocks (FCB)
+// in the memory of the Z80, and map to files in the host directory configured for each drive.
+// The layout of the FCB is described in http://seasip.info/Cpm/fcb.html
+
+// offsets of the fields within an FCB
+const (
+	fcbDrive  = 0  // 0 = default drive, 1-16 = A-P
+	fcbName   = 1  // 8 characters, space padded
+	fcbType   = 9  // 3 characters, space padded. The high bits are attributes.
+	fcbEX     = 12 // current extent, low 5 bits
+	fcbS2     = 14 // extent high byte
+	fcbRC     = 15 // record count in the current extent
+	fcbAlloc  = 16 // allocation map, 16 bytes
+	fcbCR     = 32 // current record within the extent
+	fcbR0     = 33 // random record number, r0-r2
+	dirSize   = 32 // size of a directory entry
+	extentRec = 128
+)
+
+// results of the file functions besides 0 for success and 0xFF for files that are not found. Read and
+// write return invalidFCB for names with wildcards. Read-only disks and files are reported with 0xFF
+// in A and the extended error in H, like the return error mode of CP/M 3.
+const (
+	invalidFCB = 9
+	diskRO     = 0x02FF
+	fileRO     = 0x03FF
+)
+
+// fileFunctions maps BDOS function numbers to the implementation of the file functions.
+// Each function gets the address of the FCB (from DE) and returns the value for HL, of which the low
+// byte is also returned in A.
+var fileFunctions = map[uint8]func(*BDOS, *RAM, uint16) uint16{
+	15: (*BDOS).openFile,
+	16: (*BDOS).closeFile,
+	17: (*BDOS).searchFirst,
+	18: (*BDOS).searchNext,
+	19: (*BDOS).deleteFile,
+	20: (*BDOS).readSequential,
+	21: (*BDOS).writeSequential,
+	22: (*BDOS).makeFile,
+	23: (*BDOS).renameFile,
+	33: (*BDOS).readRandom,
+	34: (*BDOS).writeRandom,
+	35: (*BDOS).computeFileSize,
+	36: (*BDOS).setRandomRecord,
+	40: (*BDOS).writeRandom,
+}
+
+// dirEntry is a host file visible to CP/M
+type dirEntry struct {
+	name string // the CP/M name in FCB form, 11 characters
+	path string
+	size int64
+}
+
+// openFCB is the host file of an FCB, resolved when the file is opened or made
+type openFCB struct {
+	name string // the name in the FCB, which no longer refers to the file if it is changed
+	path string
+}
+
+// hostFile is an open host file
+type hostFile struct {
+	*os.File
+	readOnly bool // the file could only be opened for reading
+}
+
+// fcbFileName returns the 11 character name and type from an FCB, with the attribute bits removed
+func fcbFileName(mem *RAM, fcb uint16) string {
+	name := make([]byte, 11)
+	for i := range name {
+		name[i] = mem.read8(fcb+fcbName+uint16(i)) & 0x7f
+	}
+	return strings.ToUpper(string(name))
+}
+
+// toFCBName converts a host file name to the 11 character FCB form, or returns false if it is
+// not a valid CP/M file name
+func toFCBName(host string) (string, bool) {
+	base, ext := host, ""
+	if i := strings.LastIndex(host, "."); i >= 0 {
+		base, ext = host[:i], host[i+1:]
+	}
+	if len(base) == 0 || len(base) > 8 || len(ext) > 3 || strings.ContainsAny(host, " *?:<>=,;[]/\\") {
+		return "", false
+	}
+	if strings.Count(host, ".") > 1 {
+		return "", false
+	}
+	for _, c := range host {
+		if c < 0x21 || c > 0x7e {
+			return "", false
+		}
+	}
+	return strings.ToUpper(base + strings.Repeat(" ", 8-len(base)) + ext + strings.Repeat(" ", 3-len(ext))), true
+}
+
+// ParseFileName parses a CP/M file specification such as "B:NAME.TYP" the way the CCP does, into a
+// drive number (0 for the default drive, 1-16 for A-P) and an 11 character FCB name.
+// An asterisk fills the rest of the name or type with question marks.
+func ParseFileName(spec string) (uint8, string) {
+	spec = strings.ToUpper(spec)
+	drive := uint8(0)
+	if len(spec) >= 2 && spec[1] == ':' && spec[0] >= 'A' && spec[0] <= 'P' {
+		drive = spec[0] - 'A' + 1
+		spec = spec[2:]
+	}
+
+	base, ext := spec, ""
+	if i := strings.Index(spec, "."); i >= 0 {
+		base, ext = spec[:i], spec[i+1:]
+	}
+	field := func(s string, length int) string {
+		if i := strings.Index(s, "*"); i >= 0 {
+			s = s[:i] + strings.Repeat("?", length)
+		}
+		if len(s) > length {
+			s = s[:length]
+		}
+		return s + strings.Repeat(" ", length-len(s))
+	}
+	return drive, field(base, 8) + field(ext, 3)
+}
+
+// toHostName converts an 11 character FCB name to a lower case host file name
+func toHostName(name string) string {
+	base := strings.TrimRight(name[:8], " ")
+	ext := strings.TrimRight(name[8:], " ")
+	if ext == "" {
+		return strings.ToLower(base)
+	}
+	return strings.ToLower(base + "." + ext)
+}
+
+// hostPath returns the path of the host file for an 11 character FCB name in a drive directory, or
+// false if the name is not a valid CP/M file name or the path is outside the directory
+func hostPath(dir, name string) (string, bool) {
+	host := toHostName(name)
+	if fcbName, ok := toFCBName(host); !ok || fcbName != name {
+		return "", false
+	}
+	path := filepath.Join(dir, host)
+	if rel, err := filepath.Rel(dir, path); err != nil || rel != host {
+		return "", false
+	}
+	return path, true
+}
+
+// matchName compares a name to a pattern where ? matches any character
+func matchName(pattern, name string) bool {
+	for i := 0; i < len(pattern) && i < len(name); i++ {
+		if pattern[i] != '?' && pattern[i] != name[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// driveDir returns the host directory for the drive in the FCB and the current user. The files of
+// user 0 are in the directory of the drive, and those of the other users in subdirectories named by
+// the user number.
+func (b *BDOS) driveDir(mem *RAM, fcb uint16) (string, bool) {
+	drive := mem.read8(fcb + fcbDrive)
+	if drive == 0 || drive == '?' {
+		drive = b.drive
+	} else {
+		drive = (drive - 1) & 0x0f
+	}
+	dir := b.Drives[drive]
+	if dir != "" && b.user != 0 {
+		dir = filepath.Join(dir, strconv.Itoa(int(b.user)))
+	}
+	return dir, dir != ""
+}
+
+// findFiles returns the host files in the drive of the FCB matching its (possibly wildcard) name
+func (b *BDOS) findFiles(mem *RAM, fcb uint16) []dirEntry {
+	dir, ok := b.driveDir(mem, fcb)
+	if !ok {
+		return nil
+	}
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		// the directories of users without files do not need to exist
+		if !os.IsNotExist(err) {
+			log.Printf("BDOS: %v", err)
+		}
+		return nil
+	}
+
+	pattern := fcbFileName(mem, fcb)
+	var entries []dirEntry
+	for _, info := range infos {
+		if !info.Mode().IsRegular() {
+			continue
+		}
+		name, ok := toFCBName(info.Name())
+		if ok && matchName(pattern, name) {
+			entries = append(entries, dirEntry{name: name, path: filepath.Join(dir, info.Name()), size: info.Size()})
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].name < entries[j].name })
+	return entries
+}
+
+// findFile returns the single host file named by the FCB
+func (b *BDOS) findFile(mem *RAM, fcb uint16) (dirEntry, bool) {
+	entries := b.findFiles(mem, fcb)
+	if len(entries) == 0 {
+		return dirEntry{}, false
+	}
+	return entries[0], true
+}
+
+// filePath returns the host file of an FCB for reading and writing, which was resolved when the file
+// was opened or made. An FCB that was not opened is looked up once by its name, which must not have
+// wildcards. Returns invalidFCB for names with wildcards and 0xFF for files that are not found.
+func (b *BDOS) filePath(mem *RAM, fcb uint16) (string, uint16) {
+	name := fcbFileName(mem, fcb)
+	if strings.Contains(name, "?") {
+		return "", invalidFCB
+	}
+	if f, ok := b.fcbs[fcb]; ok && f.name == name {
+		return f.path, 0
+	}
+	entry, ok := b.findFile(mem, fcb)
+	if !ok {
+		return "", 0xFF
+	}
+	b.fcbs[fcb] = openFCB{name: name, path: entry.path}
+	return entry.path, 0
+}
+
+// hostFile returns an open handle to the host file, reusing handles between calls
+func (b *BDOS) hostFile(path string) (*hostFile, error) {
+	if f, ok := b.files[path]; ok {
+		return f, nil
+	}
+	f := &hostFile{}
+	var err error
+	if f.File, err = os.OpenFile(path, os.O_RDWR, 0); err != nil {
+		// fall back to read-only access
+		if f.File, err = os.Open(path); err != nil {
+			return nil, err
+		}
+		f.readOnly = true
+	}
+	b.files[path] = f
+	return f, nil
+}
+
+// closeHostFile closes the handle to the host file if it is open, and forgets the FCBs of the file
+// if forget is set
+func (b *BDOS) closeHostFile(path string, forget bool) {
+	if f, ok := b.files[path]; ok {
+		f.Close()
+		delete(b.files, path)
+	}
+	if forget {
+		for fcb, f := range b.fcbs {
+			if f.path == path {
+				delete(b.fcbs, fcb)
+			}
+		}
+	}
+}
+
+// records returns the number of 128 byte records needed for size bytes
+func records(size int64) int {
+	return int((size + RecordSize - 1) / RecordSize)
+}
+
+// setExtentInfo updates the record count and allocation map of the FCB for its current extent
+func setExtentInfo(mem *RAM, fcb uint16, size int64) {
+	extent := int(mem.read8(fcb+fcbS2))<<5 | int(mem.read8(fcb+fcbEX)&0x1f)
+	rc := records(size) - extent*extentRec
+	if rc < 0 {
+		rc = 0
+	} else if rc > extentRec {
+		rc = extentRec
+	}
+	mem.put8(fcb+fcbRC, uint8(rc))
+
+	// mark the allocation map as used so programs looking at it see a non-empty extent
+	for i := uint16(0); i < 16; i++ {
+		val := uint8(0)
+		if int(i)*8 < rc {
+			val = uint8(i + 1)
+		}
+		mem.put8(fcb+fcbAlloc+i, val)
+	}
+}
+
+// sequentialRecord returns the record number from the extent and current record fields
+func sequentialRecord(mem *RAM, fcb uint16) int {
+	extent := int(mem.read8(fcb+fcbS2))<<5 | int(mem.read8(fcb+fcbEX)&0x1f)
+	return extent*extentRec + int(mem.read8(fcb+fcbCR))
+}
+
+// setSequentialRecord sets the extent and current record fields from a record number
+func setSequentialRecord(mem *RAM, fcb uint16, record int) {
+	mem.put8(fcb+fcbCR, uint8(record%extentRec))
+	mem.put8(fcb+fcbEX, uint8((record/extentRec)&0x1f))
+	mem.put8(fcb+fcbS2, uint8(record/extentRec>>5))
+}
+
+// randomRecord returns the random record number from r0-r2, and false if it is out of range
+func randomRecord(mem *RAM, fcb uint16) (int, bool) {
+	if mem.read8(fcb+fcbR0+2) != 0 {
+		return 0, false
+	}
+	return int(mem.read8(fcb+fcbR0)) | int(mem.read8(fcb+fcbR0+1))<<8, true
+}
+
+// setRandomRecordField stores a record number in r0-r2
+func setRandomRecordField(mem *RAM, fcb uint16, record int) {
+	mem.put8(fcb+fcbR0, uint8(record))
+	mem.put8(fcb+fcbR0+1, uint8(record>>8))
+	mem.put8(fcb+fcbR0+2, uint8(record>>16))
+}
+
+func (b *BDOS) openFile(mem *RAM, fcb uint16) uint16 {
+	entry, ok := b.findFile(mem, fcb)
+	if !ok {
+		return 0xFF
+	}
+
+	// store the actual name in case the FCB contained wildcards
+	for i := 0; i < 11; i++ {
+		mem.put8(fcb+fcbName+uint16(i), entry.name[i])
+	}
+	b.fcbs[fcb] = openFCB{name: entry.name, path: entry.path}
+	mem.put8(fcb+fcbS2, 0)
+	setExtentInfo(mem, fcb, entry.size)
+	return 0
+}
+
+func (b *BDOS) closeFile(mem *RAM, fcb uint16) uint16 {
+	path, result := b.filePath(mem, fcb)
+	if result != 0 {
+		return 0xFF
+	}
+	b.closeHostFile(path, false)
+	delete(b.fcbs, fcb)
+	return 0
+}
+
+func (b *BDOS) searchFirst(mem *RAM, fcb uint16) uint16 {
+	b.searchResults = b.findFiles(mem, fcb)
+	b.searchIndex = 0
+	return b.searchNext(mem, fcb)
+}
+
+// searchNext writes the next directory entry of the search to the DMA buffer
+func (b *BDOS) searchNext(mem *RAM, fcb uint16) uint16 {
+	if b.searchIndex >= len(b.searchResults) {
+		return 0xFF
+	}
+	entry := b.searchResults[b.searchIndex]
+	b.searchIndex++
+
+	// the size is reported through the last extent of the file
+	recs := records(entry.size)
+	lastExtent := 0
+	if recs > 0 {
+		lastExtent = (recs - 1) / extentRec
+	}
+
+	for i := uint16(0); i < dirSize; i++ {
+		mem.put8(b.dma+i, 0)
+	}
+	mem.put8(b.dma, b.user)
+	for i := 0; i < 11; i++ {
+		mem.put8(b.dma+fcbName+uint16(i), entry.name[i])
+	}
+	mem.put8(b.dma+fcbEX, uint8(lastExtent&0x1f))
+	mem.put8(b.dma+fcbS2, uint8(lastExtent>>5))
+	mem.put8(b.dma+fcbRC, uint8(recs-lastExtent*extentRec))
+	return 0
+}
+
+func (b *BDOS) deleteFile(mem *RAM, fcb uint16) uint16 {
+	entries := b.findFiles(mem, fcb)
+	if len(entries) == 0 {
+		return 0xFF
+	}
+	for _, entry := range entries {
+		b.closeHostFile(entry.path, true)
+		if err := os.Remove(entry.path); err != nil {
+			log.Printf("BDOS: %v", err)
+			if os.IsPermission(err) {
+				return diskRO
+			}
+			return 0xFF
+		}
+	}
+	return 0
+}
+
+func (b *BDOS) makeFile(mem *RAM, fcb uint16) uint16 {
+	dir, ok := b.driveDir(mem, fcb)
+	if !ok {
+		return 0xFF
+	}
+	name := fcbFileName(mem, fcb)
+	path, ok := hostPath(dir, name)
+	if !ok {
+		return 0xFF
+	}
+
+	// replace any existing file with the same name
+	if entry, ok := b.findFile(mem, fcb); ok {
+		b.closeHostFile(entry.path, true)
+		os.Remove(entry.path)
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		log.Printf("BDOS: %v", err)
+		return 0xFF
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		log.Printf("BDOS: %v", err)
+		if os.IsPermission(err) {
+			return diskRO
+		}
+		return 0xFF
+	}
+	b.files[path] = &hostFile{File: f}
+	b.fcbs[fcb] = openFCB{name: name, path: path}
+
+	mem.put8(fcb+fcbEX, 0)
+	mem.put8(fcb+fcbS2, 0)
+	mem.put8(fcb+fcbCR, 0)
+	setExtentInfo(mem, fcb, 0)
+	return 0
+}
+
+func (b *BDOS) renameFile(mem *RAM, fcb uint16) uint16 {
+	entry, ok := b.findFile(mem, fcb)
+	if !ok {
+		return 0xFF
+	}
+	newPath, ok := hostPath(filepath.Dir(entry.path), fcbFileName(mem, fcb+16))
+	if !ok {
+		return 0xFF
+	}
+	b.closeHostFile(entry.path, true)
+
+	if err := os.Rename(entry.path, newPath); err != nil {
+		log.Printf("BDOS: %v", err)
+		if os.IsPermission(err) {
+			return diskRO
+		}
+		return 0xFF
+	}
+	return 0
+}
+
+// readRecord reads a record of the file into the DMA buffer, padding it with ^Z.
+// Returns 1 if the record is past the end of the file.
+func (b *BDOS) readRecord(mem *RAM, fcb uint16, record int) uint16 {
+	path, result := b.filePath(mem, fcb)
+	if result != 0 {
+		return result
+	}
+	f, err := b.hostFile(path)
+	if err != nil {
+		log.Printf("BDOS: %v", err)
+		return 0xFF
+	}
+
+	buf := make([]byte, RecordSize)
+	n, err := f.ReadAt(buf, int64(record)*RecordSize)
+	if n == 0 {
+		if err != nil && err != io.EOF {
+			log.Printf("BDOS: %v", err)
+		}
+		return 1
+	}
+	for i := n; i < RecordSize; i++ {
+		buf[i] = 0x1A
+	}
+	for i, c := range buf {
+		mem.put8(b.dma+uint16(i), c)
+	}
+	return 0
+}
+
+// writeRecord writes the DMA buffer to a record of the file
+func (b *BDOS) writeRecord(mem *RAM, fcb uint16, record int) uint16 {
+	path, result := b.filePath(mem, fcb)
+	if result != 0 {
+		return result
+	}
+	f, err := b.hostFile(path)
+	if err != nil {
+		log.Printf("BDOS: %v", err)
+		return 0xFF
+	}
+	if f.readOnly {
+		log.Printf("BDOS: %v is read-only", path)
+		return fileRO
+	}
+
+	buf := make([]byte, RecordSize)
+	for i := range buf {
+		buf[i] = mem.read8(b.dma + uint16(i))
+	}
+	if _, err := f.WriteAt(buf, int64(record)*RecordSize); err != nil {
+		log.Printf("BDOS: %v", err)
+		return 2
+	}
+	return 0
+}
+
+// fileSize returns the size of the file of the FCB
+func (b *BDOS) fileSize(mem *RAM, fcb uint16) int64 {
+	if path, result := b.filePath(mem, fcb); result == 0 {
+		if f, err := b.hostFile(path); err == nil {
+			if info, err := f.Stat(); err == nil {
+				return info.Size()
+			}
+		}
+	}
+	return 0
+}
+
+func (b *BDOS) readSequential(mem *RAM, fcb uint16) uint16 {
+	record := sequentialRecord(mem, fcb)
+	result := b.readRecord(mem, fcb, record)
+	if result == 0 {
+		setSequentialRecord(mem, fcb, record+1)
+		setExtentInfo(mem, fcb, b.fileSize(mem, fcb))
+	}
+	return result
+}
+
+func (b *BDOS) writeSequential(mem *RAM, fcb uint16) uint16 {
+	record := sequentialRecord(mem, fcb)
+	result := b.writeRecord(mem, fcb, record)
+	if result == 0 {
+		setSequentialRecord(mem, fcb, record+1)
+		setExtentInfo(mem, fcb, b.fileSize(mem, fcb))
+	}
+	return result
+}
+
+func (b *BDOS) readRandom(mem *RAM, fcb uint16) uint16 {
+	record, ok := randomRecord(mem, fcb)
+	if !ok {
+		return 6
+	}
+	// random access also sets the sequential position, without advancing it
+	setSequentialRecord(mem, fcb, record)
+	return b.readRecord(mem, fcb, record)
+}
+
+func (b *BDOS) writeRandom(mem *RAM, fcb uint16) uint16 {
+	record, ok := randomRecord(mem, fcb)
+	if !ok {
+		return 6
+	}
+	setSequentialRecord(mem, fcb, record)
+	result := b.writeRecord(mem, fcb, record)
+	if result == 0 {
+		setExtentInfo(mem, fcb, b.fileSize(mem, fcb))
+	}
+	return result
+}
+
+func (b *BDOS) computeFileSize(mem *RAM, fcb uint16) uint16 {
+	if _, result := b.filePath(mem, fcb); result != 0 {
+		return 0xFF
+	}
+	setRandomRecordField(mem, fcb, records(b.fileSize(mem, fcb)))
+	return 0
+}
+
+func (b *BDOS) setRandomRecord(mem *RAM, fcb uint16) uint16 {
+	setRandomRecordField(mem, fcb, sequentialRecord(mem, fcb))
+	return 0
+}
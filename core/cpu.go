@@ -7,9 +7,6 @@ import (
 	"github.com/antbern/z80-emulator/io"
 )
 
-// a lookup table to be used when evaluating conditional call/jump op codes
-var condTable = []Condition{NonZero, Zero, NoCarry, Carry, ParityOdd, ParityEven, SignPos, SignNeg}
-
 // Z80 contains all internal registers and such for the Z80 processor
 type Z80 struct {
 	// the 16 bit registers
@@ -25,17 +22,82 @@ type Z80 struct {
 	// the stack pointer and program counter
 	SP, PC R16
 
+	// the r, rp and rp2 tables of the decoder, see decode.go. The (HL) entry of regR is nil.
+	regR          [8]R8
+	regRP, regRP2 [4]R16
+
 	// memory and IO device
 	Mem *RAM
 	IO  io.Device
 
-	// internal flags
+	// the interrupt vector base and memory refresh registers. The lower 7 bits of R count the opcode
+	// fetches, and bit 7 is only changed by LD R,A.
+	I, R uint8
+
+	// internal flags, where InterruptEnabled is the interrupt flip-flop IFF1 and IFF2 keeps a copy of
+	// it during non-maskable interrupts
 	Halted, InterruptEnabled bool
+	IFF2                     bool
+
+	// IM is the interrupt mode set by IM 0, IM 1 and IM 2
+	IM uint8
+
+	// Cycles is the total number of clock cycles (T-states) executed so far
+	Cycles uint64
+
+	// Instructions is the number of steps executed so far, counting the NOPs executed while halted
+	Instructions uint64
 
 	// EnableBDOS controls whether or not a CALL 5 will act as normal or go to the CP/M BDOS
 	EnableBDOS bool
+
+	// BDOS holds the state of the CP/M BDOS, created with the console on stdin/stdout if nil
+	BDOS *BDOS
+
+	// Traps maps addresses to functions that are called instead of executing the instruction
+	// at that address. This is used to implement system calls in Go.
+	Traps map[uint16]Trap
+
+	// Symbols names addresses in register dumps and trace output if set
+	Symbols Symbolizer
+
+	// Calls is the shadow call stack, which is only kept if it is set
+	Calls *CallStack
+
+	// History records the executed instructions while it is set, see Record
+	History *History
+
+	// Tracer is told about each executed instruction if it is set
+	Tracer Tracer
+}
+
+// Symbolizer gives names to addresses, for example from the labels of an assembler listing.
+// Symbolize returns an empty string for addresses without a name.
+type Symbolizer interface {
+	Symbolize(addr uint16) string
+}
+
+// Tracer is told about the instructions executed by the CPU, for example to write a trace of them.
+// Trace is called after each instruction with the registers from before it, so that the address of
+// the instruction is in before.PC. Instructions redone by a History in the past are not traced.
+type Tracer interface {
+	Trace(z *Z80, before Registers)
+}
+
+// FormatAddr returns the address in hex, followed by its name if it has one
+func (z *Z80) FormatAddr(addr uint16) string {
+	if z.Symbols != nil {
+		if name := z.Symbols.Symbolize(addr); name != "" {
+			return fmt.Sprintf("%#04x <%s>", addr, name)
+		}
+	}
+	return fmt.Sprintf("%#04x", addr)
 }
 
+// Trap is a function called when the PC reaches a trapped address. It is responsible for moving the
+// PC forward, for example by calling Ret to return to the caller.
+type Trap func(z *Z80)
+
 // NewZ80 creates a new Z80 CPU instance with memory, and registers
 func NewZ80() Z80 {
 	z80 := Z80{Mem: NewRAM(), Halted: false, EnableBDOS: false}
@@ -57,24 +119,77 @@ func NewZ80() Z80 {
 	// and the stack pointer and program counter
 	z80.SP = NewR16Single()
 	z80.PC = NewR16Single()
+
+	z80.setRegisterTables()
 	return z80
 }
 
-// Step causes the CPU to handle the next instruction
+// Step causes the CPU to handle the next instruction. Any clocked IO devices are advanced by the
+// number of clock cycles the instruction took.
 func (z *Z80) Step() {
-	// TODO: for now, just don't do anything upon halted. Later: let interrupt resume execution
+	if z.History != nil && z.History.Forward() {
+		// redo the recorded instruction in the past
+		return
+	}
+	if z.History != nil {
+		z.History.begin()
+		defer z.History.end()
+	}
+
+	var before Registers
+	if z.Tracer != nil {
+		before = z.Registers()
+	}
+
+	start := z.Cycles
+	z.execute()
+	z.Instructions++
+	z.Mem.endInstruction()
+
+	if c, ok := z.IO.(io.Clocked); ok {
+		c.Tick(z.Cycles - start)
+	}
+	if z.Tracer != nil {
+		z.Tracer.Trace(z, before)
+	}
+}
+
+// execute handles the next instruction and updates the cycle counter
+func (z *Z80) execute() {
+	// TODO: for now, just execute NOPs upon halted. Later: let interrupt resume execution
 	if z.Halted {
+		z.Cycles += uint64(cycleTable[0x00])
+		z.refresh()
+		return
+	}
+
+	if trap, ok := z.Traps[*z.PC]; ok {
+		// count the trap as a RET since that is what it usually ends with
+		z.Cycles += uint64(cycleTable[0xC9])
+		z.refresh()
+		trap(z)
 		return
 	}
 
+	// the address of the instruction, for the call stack
+	pc := *z.PC
+
 	// read next operand and move PC forward
 	// opCode := uint8(0x58)
 	opCode := z.Mem.read8Inc(z.PC)
+	z.Cycles += uint64(cycleTable[opCode])
+	z.refresh()
 
 	// TODO: check for prefixed multi-byte op codes
 	if opCode == 0xCB { // bit manipulations and roll/shift
 		op := parseOP(z.Mem.read8Inc(z.PC))
-		reg := z.regTableR(op.z)
+		z.refresh()
+		z.Cycles += uint64(cyclesCB(op) - cycleTable[opCode])
+		kind := Read | Write
+		if op.x == 1 {
+			kind = Read
+		}
+		reg := z.regTableR(op.z, kind)
 		switch op.x {
 		case 0: // TODO: rot[y] r[z]
 		case 1: // BIT y, r[z]: Z = NOT bit y in r[z]
@@ -88,8 +203,30 @@ func (z *Z80) Step() {
 		return
 	} else if opCode == 0xED {
 		op := parseOP(z.Mem.read8Inc(z.PC))
+		z.refresh()
+		z.Cycles += uint64(cyclesED - cycleTable[opCode])
 		if op.x == 1 {
 			// TODO: lots of operations
+			switch op.z {
+			case 5: // RETN and RETI, which both restore IFF1 from IFF2
+				z.Cycles += cyclesRETI - cyclesED
+				z.InterruptEnabled = z.IFF2
+				z.ret(pc)
+			case 6: // IM im[y]
+				z.IM = imTable[op.y]
+			case 7:
+				z.Cycles += cyclesLDIR - cyclesED
+				switch op.y {
+				case 0: // LD I, A
+					z.I = *z.A
+				case 1: // LD R, A
+					z.R = *z.A
+				case 2: // LD A, I
+					*z.A = ldIR(z.I, z.IFF2, z.F)
+				case 3: // LD A, R
+					*z.A = ldIR(z.R, z.IFF2, z.F)
+				}
+			}
 		} else if op.x == 2 {
 			// TODO: bli[y,z] block instruction
 		}
@@ -99,7 +236,6 @@ func (z *Z80) Step() {
 
 	// normal op-code, parse operands
 	op := parseOP(opCode)
-	log.Printf("Operand: %#02x -> %+v", opCode, op)
 
 	// handle the op-codes using a giant switch matrix
 	switch op.x {
@@ -116,6 +252,7 @@ func (z *Z80) Step() {
 				if *z.B > 0 { // if B is not yet zero, jump
 					disp := z.Mem.read8Inc(z.PC)
 					*z.PC += uint16(int8(disp))
+					z.Cycles += cyclesDJNZTaken
 				} else {
 					*z.PC++ // increment PC to skip the displacement byte (no jump performed)
 				}
@@ -127,6 +264,7 @@ func (z *Z80) Step() {
 				if condTable[op.y-4].isTrue(z.F) {
 					disp := z.Mem.read8Inc(z.PC)
 					*z.PC += uint16(int8(disp))
+					z.Cycles += cyclesJRTaken
 				} else {
 					*z.PC++ // increment PC to skip the displacement byte
 				}
@@ -151,20 +289,20 @@ func (z *Z80) Step() {
 				break
 			}
 
-			var b R8
+			var addr uint16
 			switch op.p {
 			case 0:
-				b = z.Mem.ptr8(*z.BC)
+				addr = *z.BC
 			case 1:
-				b = z.Mem.ptr8(*z.DE)
+				addr = *z.DE
 			case 3:
-				b = z.Mem.ptr8(z.Mem.read16Inc(z.PC))
+				addr = z.Mem.read16Inc(z.PC)
 			}
 			// perform load in either direction based on q
 			if op.q == 0 {
-				*b = *z.A
+				z.Mem.put8(addr, *z.A)
 			} else if op.q == 1 {
-				*z.A = *b
+				*z.A = z.Mem.read8(addr)
 			}
 		case 3:
 			reg := z.regTableRP(op.p, false)
@@ -174,13 +312,13 @@ func (z *Z80) Step() {
 				*reg--
 			}
 		case 4: // INC r[y]
-			reg := z.regTableR(op.y)
+			reg := z.regTableR(op.y, Read|Write)
 			*reg++
 		case 5: // DEC r[y]
-			reg := z.regTableR(op.y)
+			reg := z.regTableR(op.y, Read|Write)
 			*reg--
 		case 6: // LD r[y], n
-			reg := z.regTableR(op.y)
+			reg := z.regTableR(op.y, Write)
 			*reg = z.Mem.read8Inc(z.PC)
 		case 7:
 			// TODO: some accumulator operands
@@ -194,34 +332,18 @@ func (z *Z80) Step() {
 			break
 		}
 		// 	LD r[y], r[z]
-		dst := z.regTableR(op.y)
-		src := z.regTableR(op.z)
+		src := z.regTableR(op.z, Read)
+		dst := z.regTableR(op.y, Write)
 		*dst = *src
 	case 2: // x: ALU operation alu[y] with argument r[z]
-		reg := z.regTableR(op.z)
-		switch op.y {
-		case 0: // ADD A, reg
-			*z.A = add8(*z.A, *reg, z.F, false)
-		case 1: // ADC A, reg
-			*z.A = add8(*z.A, *reg, z.F, true)
-		case 2: // SUB A, reg
-			*z.A = sub8(*z.A, *reg, z.F, false)
-		case 3: // SBC A, reg
-			*z.A = sub8(*z.A, *reg, z.F, true)
-		case 4: // AND A, reg
-			*z.A = and8(*z.A, *reg, z.F)
-		case 5: // XOR A, reg
-			*z.A = xor8(*z.A, *reg, z.F)
-		case 6: // OR A, reg
-			*z.A = or8(*z.A, *reg, z.F)
-		case 7: // CP i.e, A-r
-			sub8(*z.A, *reg, z.F, false)
-		}
+		reg := z.regTableR(op.z, Read)
+		*z.A = aluTable[op.y](*z.A, *reg, z.F)
 	case 3: // x
 		switch op.z {
 		case 0: // RET cc[y]
 			if condTable[op.y].isTrue(z.F) {
-				z.Mem.stackPop16(z.SP, z.PC)
+				z.ret(pc)
+				z.Cycles += cyclesRETTaken
 			}
 		case 1:
 			if op.q == 0 { // POP rp2[p]
@@ -230,37 +352,35 @@ func (z *Z80) Step() {
 			} else if op.q == 1 {
 				switch op.p {
 				case 0: // RET
-					z.Mem.stackPop16(z.SP, z.PC)
+					z.ret(pc)
 				case 1: // EXX
 					exchange16(z.BC, z.BCa)
 					exchange16(z.DE, z.DEa)
 					exchange16(z.HL, z.HLa)
-				case 2: // JP HL / JP (HL)
-					*z.PC = z.Mem.read16(*z.HL)
+				case 2: // JP HL / JP (HL), jumps to the address in HL despite the syntax
+					*z.PC = *z.HL
 				case 3: // LD SP, HL
 					*z.SP = *z.HL
 				}
 			}
 		case 2: // JP cc[y], nn
+			// the address is always fetched
+			nn := z.Mem.read16Inc(z.PC)
 			if condTable[op.y].isTrue(z.F) {
-				*z.PC = z.Mem.read16(*z.PC)
-			} else {
-				*z.PC += 2 // increment PC to skip jump address
+				*z.PC = nn
 			}
 		case 3:
 			switch op.y {
 			case 0: // JP nn
-				*z.PC = z.Mem.read16(*z.PC)
+				*z.PC = z.Mem.read16Inc(z.PC)
 			case 1: // CB prefix
 			case 2: // OUT (n), A
 				addr := z.Mem.read8Inc(z.PC)
-				if z.IO != nil {
-					z.IO.Write(addr, *z.A)
-				}
+				z.out(addr, *z.A)
 			case 3: // IN A, (n)
 				addr := z.Mem.read8Inc(z.PC)
 				if z.IO != nil {
-					*z.A = z.IO.Read(addr)
+					*z.A = z.in(addr)
 				}
 			case 4: // EX (SP), HL
 				tmp := *z.HL
@@ -269,20 +389,20 @@ func (z *Z80) Step() {
 			case 5: // EX DE, HL
 				exchange16(z.DE, z.HL)
 			case 6: // DI
-				z.InterruptEnabled = false
+				z.InterruptEnabled, z.IFF2 = false, false
 			case 7: // EI
-				z.InterruptEnabled = true
+				z.InterruptEnabled, z.IFF2 = true, true
 			}
 		case 4: // CALL cc[y], nn
 			if condTable[op.y].isTrue(z.F) {
+				z.Cycles += cyclesCALLTaken
 				// read adress to call, push return pointer to the stack and move PC
 				addr := z.Mem.read16Inc(z.PC)
 				if z.EnableBDOS && addr == 5 { // BDOS call
 					z.handleBDOS()
 					break
 				}
-				z.Mem.stackPush16(z.SP, z.PC)
-				*z.PC = addr
+				z.call(CallFrame, pc, addr)
 			} else {
 				*z.PC += 2 // increment PC to skip jump address
 			}
@@ -297,86 +417,68 @@ func (z *Z80) Step() {
 					z.handleBDOS()
 					break
 				}
-				z.Mem.stackPush16(z.SP, z.PC)
-				*z.PC = addr
-				log.Printf("CALL to %#04X", addr)
+				z.call(CallFrame, pc, addr)
+				log.Printf("CALL to %v", z.FormatAddr(addr))
 			}
 		case 6: // ALU[y] n
 			nn := z.Mem.read8Inc(z.PC)
-			switch op.y {
-			case 0: // ADD A, nn
-				*z.A = add8(*z.A, nn, z.F, false)
-			case 1: // ADC A, nn
-				*z.A = add8(*z.A, nn, z.F, true)
-			case 2: // SUB A, nn
-				*z.A = sub8(*z.A, nn, z.F, false)
-			case 3: // SBC A, nn
-				*z.A = sub8(*z.A, nn, z.F, true)
-			case 4: // AND A, nn
-				*z.A = and8(*z.A, nn, z.F)
-			case 5: // XOR A, nn
-				*z.A = xor8(*z.A, nn, z.F)
-			case 6: // OR A, nn
-				*z.A = or8(*z.A, nn, z.F)
-			case 7: // CP i.e, A-nn
-				sub8(*z.A, nn, z.F, false)
-			}
-		case 7: // RST y*8
-			*z.PC = uint16(op.y) * 8
+			*z.A = aluTable[op.y](*z.A, nn, z.F)
+		case 7: // RST y*8, a call that pushes the return pointer like CALL nn
+			z.call(RestartFrame, pc, uint16(op.y)*8)
 		}
 	}
 
 }
 
+// out writes a value to a port of the IO device
+func (z *Z80) out(port, val uint8) {
+	if z.IO != nil {
+		z.IO.Write(port, val)
+	}
+	if z.History != nil {
+		z.History.port(io.PortAccess{Out: true, Port: port, Value: val})
+	}
+}
+
+// in reads a port of the IO device, which must be set
+func (z *Z80) in(port uint8) uint8 {
+	val := z.IO.Read(port)
+	if z.History != nil {
+		z.History.port(io.PortAccess{Port: port, Value: val})
+	}
+	return val
+}
+
+// refresh increments the lower 7 bits of R for an opcode fetch, like the memory refresh that follows it
+func (z *Z80) refresh() {
+	z.R = z.R&0x80 | (z.R+1)&0x7F
+}
+
 // echanges / swaps the values of two R16 registers
 func exchange16(a, b R16) {
 	*a, *b = *b, *a
 }
 
-// codeToRegister takes a bit-code and returns a pointer to the correct 8-bit register or memory address
-func (z *Z80) regTableR(code uint8) R8 {
-	switch code {
-	case 0:
-		return z.B
-	case 1:
-		return z.C
-	case 2:
-		return z.D
-	case 3:
-		return z.E
-	case 4:
-		return z.H
-	case 5:
-		return z.L
-	case 6:
-		return z.Mem.ptr8(*z.HL)
-	case 7:
-		return z.A
+// regTableR returns the register r[code], or the byte in memory at HL for (HL) that the instruction
+// accesses with the kinds
+func (z *Z80) regTableR(code uint8, kind AccessKind) R8 {
+	if reg := z.regR[code]; reg != nil {
+		return reg
 	}
-
-	return nil
+	return z.Mem.ptr8(*z.HL, kind)
 }
 
+// regTableRP returns the register pair rp[code], or rp2[code] with AF instead of SP if withAF is set
 func (z *Z80) regTableRP(code uint8, withAF bool) R16 {
-	switch code {
-	case 0:
-		return z.BC
-	case 1:
-		return z.DE
-	case 2:
-		return z.HL
-	case 3:
-		if withAF {
-			return z.AF
-		}
-		return z.SP
+	if withAF {
+		return z.regRP2[code]
 	}
-	return nil
+	return z.regRP[code]
 }
 
 func (z *Z80) String() string {
-	return fmt.Sprintf("PC: %#04x SP: %#04x\n A: %#02x F: %#02x B: %#02x C: %#02x D: %#02x E: %#02x H: %#02x L: %#02x\nAF: %#04x BC: %#04x DE: %#04x HL: %#04x IX: %#04x IY: %#04x",
-		*z.PC, *z.SP, *z.A, *z.F, *z.B, *z.C, *z.D, *z.E, *z.H, *z.L, *z.AF, *z.BC, *z.DE, *z.HL, *z.IX, *z.IY)
+	return fmt.Sprintf("PC: %v SP: %#04x\n A: %#02x F: %#02x B: %#02x C: %#02x D: %#02x E: %#02x H: %#02x L: %#02x\nAF: %#04x BC: %#04x DE: %#04x HL: %#04x IX: %#04x IY: %#04x",
+		z.FormatAddr(*z.PC), *z.SP, *z.A, *z.F, *z.B, *z.C, *z.D, *z.E, *z.H, *z.L, *z.AF, *z.BC, *z.DE, *z.HL, *z.IX, *z.IY)
 }
 
 // OP splits an op-code into its different parts according to the description in http://www.z80.info/decoding.htm
@@ -2,6 +2,18 @@ package core
 
 import "testing"
 
+func TestJPHL(t *testing.T) {
+	z := NewZ80()
+	*z.PC = 0x0100
+	*z.HL = 0x0200
+	z.Mem.put8(0x0100, 0xE9) // JP (HL)
+	z.Mem.put16(0x0200, 0x1234)
+	z.Step()
+	if *z.PC != 0x0200 {
+		t.Errorf("Expected JP (HL) to jump to the address in HL 0x0200, got PC %#04x", *z.PC)
+	}
+}
+
 func TestExchange(t *testing.T) {
 	// and the stack pointer and program counter
 	A := NewR16Single()
@@ -18,3 +30,63 @@ func TestExchange(t *testing.T) {
 	}
 
 }
+
+func TestRST(t *testing.T) {
+	z := NewZ80()
+	*z.SP = 0x8000
+	*z.PC = 0x0100
+	z.Mem.Poke(0x0100, 0xEF) // RST $28
+	z.Mem.Poke(0x0028, 0xC9) // RET
+	z.Step()
+	if *z.PC != 0x0028 || *z.SP != 0x7FFE || z.Mem.PeekWord(0x7FFE) != 0x0101 {
+		t.Errorf("Expected RST to push 0x0101 and jump to 0x0028, got PC %#04x and SP %#04x", *z.PC, *z.SP)
+	}
+	z.Step()
+	if *z.PC != 0x0101 || *z.SP != 0x8000 {
+		t.Errorf("Expected to return to 0x0101, got PC %#04x and SP %#04x", *z.PC, *z.SP)
+	}
+}
+
+func TestInterruptRegisters(t *testing.T) {
+	z := NewZ80()
+	code := []uint8{
+		0x3E, 0x80, // LD A, $80
+		0xED, 0x47, // LD I, A
+		0x3E, 0x00, // LD A, 0
+		0xED, 0x4F, // LD R, A
+		0xED, 0x5E, // IM 2
+		0xFB,       // EI
+		0xED, 0x57, // LD A, I
+	}
+	z.Mem.Write(0, &code)
+	for i := 0; i < 7; i++ {
+		z.Step()
+	}
+	// R counts the 5 opcode fetches of IM 2, EI and LD A,I
+	if z.I != 0x80 || z.R != 5 || z.IM != 2 || !z.InterruptEnabled || !z.IFF2 {
+		t.Errorf("Expected I = $80, R = 5, IM 2 and interrupts enabled, got I = %#02x, R = %#02x, IM %d, IFF1 %v and IFF2 %v", z.I, z.R, z.IM, z.InterruptEnabled, z.IFF2)
+	}
+	if *z.A != 0x80 || *z.F != FlagS|FlagP {
+		t.Errorf("Expected LD A,I to load $80 with S and P/V set, got A = %#02x and F = %#02x", *z.A, *z.F)
+	}
+
+	// the fetches only change the lower 7 bits of R
+	z.R = 0xFF
+	code = []uint8{0x00} // NOP
+	z.Mem.Write(*z.PC, &code)
+	z.Step()
+	if z.R != 0x80 {
+		t.Errorf("Expected R to wrap around to $80 keeping bit 7, got %#02x", z.R)
+	}
+
+	// RETN restores IFF1 from IFF2
+	*z.SP = 0x8000
+	z.Mem.PokeWord(0x8000, 0x1234)
+	code = []uint8{0xED, 0x45} // RETN
+	z.Mem.Write(0x0100, &code)
+	*z.PC, z.InterruptEnabled = 0x0100, false
+	z.Step()
+	if *z.PC != 0x1234 || !z.InterruptEnabled {
+		t.Errorf("Expected RETN to return to 0x1234 with interrupts enabled, got PC %#04x and IFF1 %v", *z.PC, z.InterruptEnabled)
+	}
+}
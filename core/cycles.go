@@ -0,0 +1,58 @@
+package core
+
+// cycleTable contains the number of clock cycles (T-states) used by each of the unprefixed op codes.
+// For conditional jumps, calls and returns the value is for when the condition is false, the extra
+// cycles used when the branch is taken are added by the instruction itself.
+// Values taken from http://clrhome.org/table/
+var cycleTable = [256]uint8{
+	//0  1   2   3   4   5   6   7   8   9   A   B   C   D   E   F
+	4, 10, 7, 6, 4, 4, 7, 4, 4, 11, 7, 6, 4, 4, 7, 4, // 0x00
+	8, 10, 7, 6, 4, 4, 7, 4, 12, 11, 7, 6, 4, 4, 7, 4, // 0x10
+	7, 10, 16, 6, 4, 4, 7, 4, 7, 11, 16, 6, 4, 4, 7, 4, // 0x20
+	7, 10, 13, 6, 11, 11, 10, 4, 7, 11, 13, 6, 4, 4, 7, 4, // 0x30
+	4, 4, 4, 4, 4, 4, 7, 4, 4, 4, 4, 4, 4, 4, 7, 4, // 0x40
+	4, 4, 4, 4, 4, 4, 7, 4, 4, 4, 4, 4, 4, 4, 7, 4, // 0x50
+	4, 4, 4, 4, 4, 4, 7, 4, 4, 4, 4, 4, 4, 4, 7, 4, // 0x60
+	7, 7, 7, 7, 7, 7, 4, 7, 4, 4, 4, 4, 4, 4, 7, 4, // 0x70
+	4, 4, 4, 4, 4, 4, 7, 4, 4, 4, 4, 4, 4, 4, 7, 4, // 0x80
+	4, 4, 4, 4, 4, 4, 7, 4, 4, 4, 4, 4, 4, 4, 7, 4, // 0x90
+	4, 4, 4, 4, 4, 4, 7, 4, 4, 4, 4, 4, 4, 4, 7, 4, // 0xA0
+	4, 4, 4, 4, 4, 4, 7, 4, 4, 4, 4, 4, 4, 4, 7, 4, // 0xB0
+	5, 10, 10, 10, 10, 11, 7, 11, 5, 10, 10, 4, 10, 17, 7, 11, // 0xC0
+	5, 10, 10, 11, 10, 11, 7, 11, 5, 4, 10, 11, 10, 4, 7, 11, // 0xD0
+	5, 10, 10, 19, 10, 11, 7, 11, 5, 4, 10, 4, 10, 4, 7, 11, // 0xE0
+	5, 10, 10, 4, 10, 11, 7, 11, 5, 6, 10, 4, 10, 4, 7, 11, // 0xF0
+}
+
+// extra cycles used by conditional instructions when the branch is taken
+const (
+	cyclesJRTaken   = 5
+	cyclesDJNZTaken = 5
+	cyclesRETTaken  = 6
+	cyclesCALLTaken = 7
+)
+
+// cyclesCB returns the number of clock cycles used by a CB prefixed instruction,
+// including the cycles for the prefix itself
+func cyclesCB(op OP) uint8 {
+	if op.z != 6 {
+		return 8
+	}
+	if op.x == 1 { // BIT y, (HL)
+		return 12
+	}
+	return 15
+}
+
+// cyclesED is the number of clock cycles used by an ED prefixed instruction. Many of the instructions
+// use more than this, but since they are not implemented yet they are all counted as the shortest one.
+const cyclesED = 8
+
+// cyclesLDIR is the number of clock cycles used by LD A,I, LD A,R, LD I,A and LD R,A
+const cyclesLDIR = 9
+
+// cyclesRETI is the number of clock cycles used by RETI and RETN
+const cyclesRETI = 14
+
+// cyclesInterrupt is the number of clock cycles used to accept an interrupt and call its handler
+const cyclesInterrupt = 13
@@ -0,0 +1,119 @@
+package core
+
+// Names of the operands and operations selected by the fields of an op code, in the order of the
+// decoding tables in http://www.z80.info/decoding.htm. The disassembler uses these names, and the CPU
+// looks up its registers, conditions, ALU operations and interrupt modes by them, so that the two can
+// not disagree. TestDecodeMatchesCPU in the disasm package executes each op code that selects from
+// these tables to check it.
+var (
+	// RegNames is the r table of 8 bit registers
+	RegNames = [8]string{"B", "C", "D", "E", "H", "L", "(HL)", "A"}
+	// RegPairNames is the rp table of register pairs
+	RegPairNames = [4]string{"BC", "DE", "HL", "SP"}
+	// RegPairNamesAF is the rp2 table of register pairs used by PUSH and POP
+	RegPairNamesAF = [4]string{"BC", "DE", "HL", "AF"}
+	// CondNames is the cc table of conditions
+	CondNames = [8]string{"NZ", "Z", "NC", "C", "PO", "PE", "P", "M"}
+	// ALUNames is the alu table of arithmetic and logic operations on A
+	ALUNames = [8]string{"ADD", "ADC", "SUB", "SBC", "AND", "XOR", "OR", "CP"}
+	// RotNames is the rot table of rotate and shift operations of the CB prefix
+	RotNames = [8]string{"RLC", "RRC", "RL", "RR", "SLA", "SRA", "SLL", "SRL"}
+	// AccNames are the accumulator and flag operations with x=0, z=7
+	AccNames = [8]string{"RLCA", "RRCA", "RLA", "RRA", "DAA", "CPL", "SCF", "CCF"}
+	// IMModes is the im table of interrupt modes
+	IMModes = [8]string{"0", "0", "1", "2", "0", "0", "1", "2"}
+	// BlockNames is the bli table of block instructions, indexed by y-4 and z
+	BlockNames = [4][4]string{
+		{"LDI", "CPI", "INI", "OUTI"},
+		{"LDD", "CPD", "IND", "OUTD"},
+		{"LDIR", "CPIR", "INIR", "OTIR"},
+		{"LDDR", "CPDR", "INDR", "OTDR"},
+	}
+)
+
+// conditions are the conditions of the cc table by name
+var conditions = map[string]Condition{
+	"NZ": NonZero, "Z": Zero, "NC": NoCarry, "C": Carry, "PO": ParityOdd, "PE": ParityEven, "P": SignPos, "M": SignNeg,
+}
+
+// aluOps are the operations of the alu table by name, which return the new value of A
+var aluOps = map[string]func(a, b uint8, F R8) uint8{
+	"ADD": func(a, b uint8, F R8) uint8 { return add8(a, b, F, false) },
+	"ADC": func(a, b uint8, F R8) uint8 { return add8(a, b, F, true) },
+	"SUB": func(a, b uint8, F R8) uint8 { return sub8(a, b, F, false) },
+	"SBC": func(a, b uint8, F R8) uint8 { return sub8(a, b, F, true) },
+	"AND": and8,
+	"XOR": xor8,
+	"OR":  or8,
+	"CP": func(a, b uint8, F R8) uint8 {
+		sub8(a, b, F, false)
+		return a
+	},
+}
+
+// the cc, alu and im tables of the CPU, in the order of CondNames, ALUNames and IMModes
+var (
+	condTable [8]Condition
+	aluTable  [8]func(a, b uint8, F R8) uint8
+	imTable   [8]uint8
+)
+
+func init() {
+	for i, name := range CondNames {
+		c, ok := conditions[name]
+		if !ok {
+			panic("no condition " + name)
+		}
+		condTable[i] = c
+	}
+	for i, name := range ALUNames {
+		op, ok := aluOps[name]
+		if !ok {
+			panic("no ALU operation " + name)
+		}
+		aluTable[i] = op
+	}
+	for i, mode := range IMModes {
+		imTable[i] = mode[0] - '0'
+	}
+}
+
+// setRegisterTables sets the r, rp and rp2 tables of the CPU from RegNames, RegPairNames and
+// RegPairNamesAF
+func (z *Z80) setRegisterTables() {
+	for i, name := range RegNames {
+		if name == "(HL)" {
+			continue
+		}
+		if _, z.regR[i] = z.register(name); z.regR[i] == nil {
+			panic("no register " + name)
+		}
+	}
+	for i := range RegPairNames {
+		z.regRP[i], _ = z.register(RegPairNames[i])
+		z.regRP2[i], _ = z.register(RegPairNamesAF[i])
+		if z.regRP[i] == nil || z.regRP2[i] == nil {
+			panic("no register pair " + RegPairNames[i] + " or " + RegPairNamesAF[i])
+		}
+	}
+}
+
+// DecodeOP splits an op code into its x, y, z, p and q fields
+func DecodeOP(opCode uint8) OP {
+	return parseOP(opCode)
+}
+
+// X returns bits 7-6 of the op code
+func (op OP) X() uint8 { return op.x }
+
+// Y returns bits 5-3 of the op code
+func (op OP) Y() uint8 { return op.y }
+
+// Z returns bits 2-0 of the op code
+func (op OP) Z() uint8 { return op.z }
+
+// P returns bits 5-4 of the op code
+func (op OP) P() uint8 { return op.p }
+
+// Q returns bit 3 of the op code
+func (op OP) Q() uint8 { return op.q }
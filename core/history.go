@@ -0,0 +1,413 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/antbern/z80-emulator/io"
+)
+
+// Registers holds the registers and the internal state of the CPU
+type Registers struct {
+	AF, BC, DE, HL, IX, IY uint16
+	AFa, BCa, DEa, HLa     uint16
+	SP, PC                 uint16
+
+	I, R, IM uint8
+
+	Halted, InterruptEnabled, IFF2 bool
+	Cycles, Instructions           uint64
+}
+
+// Registers returns the registers and the internal state of the CPU
+func (z *Z80) Registers() Registers {
+	return Registers{
+		AF: *z.AF, BC: *z.BC, DE: *z.DE, HL: *z.HL, IX: *z.IX, IY: *z.IY,
+		AFa: *z.AFa, BCa: *z.BCa, DEa: *z.DEa, HLa: *z.HLa,
+		SP: *z.SP, PC: *z.PC,
+		Halted: z.Halted, InterruptEnabled: z.InterruptEnabled,
+		Cycles: z.Cycles, Instructions: z.Instructions,
+		I: z.I, R: z.R, IM: z.IM, IFF2: z.IFF2,
+	}
+}
+
+// SetRegisters sets the registers and the internal state of the CPU
+func (z *Z80) SetRegisters(r Registers) {
+	*z.AF, *z.BC, *z.DE, *z.HL, *z.IX, *z.IY = r.AF, r.BC, r.DE, r.HL, r.IX, r.IY
+	*z.AFa, *z.BCa, *z.DEa, *z.HLa = r.AFa, r.BCa, r.DEa, r.HLa
+	*z.SP, *z.PC = r.SP, r.PC
+	z.Halted, z.InterruptEnabled = r.Halted, r.InterruptEnabled
+	z.Cycles, z.Instructions = r.Cycles, r.Instructions
+	z.I, z.R, z.IM, z.IFF2 = r.I, r.R, r.IM, r.IFF2
+}
+
+// Change is a byte in memory changed by an instruction
+type Change struct {
+	Addr     uint16
+	Old, New uint8
+}
+
+// journal collects the old values of the bytes written by an instruction, and the IN and OUT
+// operations it performs, for its record
+type journal struct {
+	record  *Record
+	changes []Change
+	ports   []io.PortAccess
+}
+
+// write records the old value of a byte that may be written
+func (j *journal) write(addr uint16, old uint8) {
+	j.changes = append(j.changes, Change{Addr: addr, Old: old})
+}
+
+// resolve returns the changed bytes with their new values in data, keeping the first write of each
+// address since that has the value from before the instruction
+func (j *journal) resolve(data []uint8) []Change {
+	var changes []Change
+	for i, c := range j.changes {
+		first := true
+		for _, prev := range j.changes[:i] {
+			if prev.Addr == c.Addr {
+				first = false
+				break
+			}
+		}
+		if c.New = data[c.Addr]; first && c.New != c.Old {
+			changes = append(changes, c)
+		}
+	}
+	return changes
+}
+
+// Record holds what an instruction changed, so that it can be undone and redone
+type Record struct {
+	// Before are the registers before the instruction, with the PC of the instruction
+	Before Registers
+
+	// Changes are the bytes in memory that the instruction changed
+	Changes []Change
+
+	// Ports are the IN and OUT operations of the instruction, with the values that were read
+	Ports []io.PortAccess
+
+	// the frames of the call stack before and after the instruction, if it changed them
+	framesBefore, framesAfter []Frame
+	calls                     bool
+}
+
+// snapshot is the full state of the CPU before an instruction
+type snapshot struct {
+	regs   Registers
+	mem    []uint8
+	frames []Frame
+}
+
+// ErrNoHistory is returned when seeking to an instruction that is not recorded
+var ErrNoHistory = errors.New("the instruction is not recorded")
+
+// History records what each instruction executed by the CPU changes, so that the CPU can be taken
+// back to the state before any of the recent instructions and forward again. The records are kept in
+// a ring buffer with a limit, and full snapshots of the state are taken at intervals to make seeking
+// fast. Instructions are numbered by the Instructions counter of the CPU.
+//
+// While the CPU is in the past, Step redoes the recorded instructions instead of executing them, so
+// that the IO devices and traps are not run again. Changing the registers or memory there makes a new
+// future, and Truncate must then be called to forget the recorded one.
+type History struct {
+	cpu *Z80
+
+	// records is a ring buffer of length limit, with the oldest record at first. pos is the number of
+	// records before the current state, which equals n at the head, where new instructions are
+	// recorded.
+	records       []Record
+	first, n, pos int
+	limit         int
+
+	// head is the state at the head, saved when leaving it
+	head Registers
+
+	// snapshots are taken every interval instructions, oldest first
+	snapshots []snapshot
+	interval  uint64
+
+	// journal is set while an instruction is recorded
+	journal *journal
+}
+
+// NewHistory returns a history that keeps up to limit records, with a snapshot every interval
+// instructions. It is started with Record.
+func NewHistory(limit int, interval uint64) *History {
+	if limit < 1 {
+		limit = 1
+	}
+	if interval == 0 {
+		interval = 1
+	}
+	return &History{records: make([]Record, limit), limit: limit, interval: interval}
+}
+
+// Record starts recording the instructions executed by the CPU, forgetting any earlier records
+func (z *Z80) Record(h *History) {
+	h.cpu = z
+	h.first, h.n, h.pos = 0, 0, 0
+	h.snapshots = h.snapshots[:0]
+	z.History = h
+}
+
+// StopRecording stops recording and forgets the records, leaving the CPU in its current state
+func (z *Z80) StopRecording() {
+	z.History = nil
+}
+
+// record returns the record at an index from the oldest one
+func (h *History) record(i int) *Record {
+	return &h.records[(h.first+i)%h.limit]
+}
+
+// First returns the number of the oldest recorded instruction, and Last the number of the
+// instruction at the head, which is not executed yet
+func (h *History) First() uint64 {
+	if h.n == 0 {
+		return h.cpu.Instructions
+	}
+	return h.record(0).Before.Instructions
+}
+
+// Last returns the number of the instruction at the head
+func (h *History) Last() uint64 {
+	return h.First() + uint64(h.n)
+}
+
+// Len returns the number of recorded instructions
+func (h *History) Len() int {
+	return h.n
+}
+
+// InPast reports whether the CPU is at a recorded instruction rather than at the head
+func (h *History) InPast() bool {
+	return h.pos < h.n
+}
+
+// Previous returns the record of the instruction executed last, which Back undoes, or nil if there
+// is none
+func (h *History) Previous() *Record {
+	if h.pos == 0 {
+		return nil
+	}
+	return h.record(h.pos - 1)
+}
+
+// begin starts recording the instruction that is about to be executed at the head
+func (h *History) begin() {
+	z := h.cpu
+	if z.Instructions%h.interval == 0 {
+		h.takeSnapshot()
+	}
+	if h.n == h.limit {
+		// forget the oldest record and the snapshots before it
+		h.first = (h.first + 1) % h.limit
+		h.n--
+		h.pos--
+		for len(h.snapshots) > 0 && h.snapshots[0].regs.Instructions < h.First() {
+			h.snapshots = h.snapshots[1:]
+		}
+	}
+	r := h.record(h.n)
+	*r = Record{Before: z.Registers()}
+	h.journal = &journal{record: r}
+	z.Mem.journal = h.journal
+}
+
+// end finishes recording the instruction that was executed
+func (h *History) end() {
+	z := h.cpu
+	r := h.journal.record
+	r.Changes = h.journal.resolve(z.Mem.data)
+	r.Ports = h.journal.ports
+	if r.calls {
+		r.framesAfter = copyFrames(z.Calls)
+	}
+	z.Mem.journal = nil
+	h.journal = nil
+	h.n++
+	h.pos = h.n
+}
+
+// amend records the changes made by f between instructions, such as accepting an interrupt, as part
+// of the instruction executed last. In the past the recorded future is forgotten first.
+func (h *History) amend(f func()) {
+	h.Truncate()
+	if h.n == 0 {
+		f()
+		return
+	}
+	z := h.cpu
+	r := h.record(h.n - 1)
+	if !r.calls {
+		// the instruction did not change the call stack, so it had the current frames before it
+		r.framesBefore = copyFrames(z.Calls)
+	}
+	h.journal = &journal{record: r}
+	z.Mem.journal = h.journal
+	f()
+	for _, c := range h.journal.resolve(z.Mem.data) {
+		merged := false
+		for i := range r.Changes {
+			if r.Changes[i].Addr == c.Addr {
+				r.Changes[i].New, merged = c.New, true
+			}
+		}
+		if !merged {
+			r.Changes = append(r.Changes, c)
+		}
+	}
+	r.calls = true
+	r.framesAfter = copyFrames(z.Calls)
+	z.Mem.journal = nil
+	h.journal = nil
+}
+
+// port records an IN or OUT operation of the instruction being recorded
+func (h *History) port(a io.PortAccess) {
+	if h.journal != nil {
+		h.journal.ports = append(h.journal.ports, a)
+	}
+}
+
+// calls saves the call stack before the instruction being recorded changes it
+func (h *History) calls() {
+	if h.journal == nil {
+		return
+	}
+	if r := h.journal.record; !r.calls {
+		r.calls = true
+		r.framesBefore = copyFrames(h.cpu.Calls)
+	}
+}
+
+// copyFrames returns a copy of the frames of a call stack, which may be nil
+func copyFrames(c *CallStack) []Frame {
+	if c == nil {
+		return nil
+	}
+	return append([]Frame(nil), c.Frames...)
+}
+
+// setFrames sets the frames of the call stack of the CPU, if it has one
+func (h *History) setFrames(frames []Frame) {
+	if h.cpu.Calls != nil {
+		h.cpu.Calls.Frames = append(h.cpu.Calls.Frames[:0], frames...)
+	}
+}
+
+// takeSnapshot saves the full state at the head before the next instruction
+func (h *History) takeSnapshot() {
+	z := h.cpu
+	s := snapshot{regs: z.Registers(), mem: append([]uint8(nil), z.Mem.data...), frames: copyFrames(z.Calls)}
+	if n := len(h.snapshots); n > 0 && h.snapshots[n-1].regs.Instructions == s.regs.Instructions {
+		h.snapshots[n-1] = s
+		return
+	}
+	h.snapshots = append(h.snapshots, s)
+}
+
+// Back undoes the instruction executed last, returning false if it is not recorded
+func (h *History) Back() bool {
+	if h.pos == 0 {
+		return false
+	}
+	z := h.cpu
+	if h.pos == h.n {
+		h.head = z.Registers()
+	}
+	h.pos--
+	r := h.record(h.pos)
+	for i := len(r.Changes) - 1; i >= 0; i-- {
+		z.Mem.data[r.Changes[i].Addr] = r.Changes[i].Old
+	}
+	if r.calls {
+		h.setFrames(r.framesBefore)
+	}
+	z.SetRegisters(r.Before)
+	return true
+}
+
+// Forward redoes the next recorded instruction, returning false at the head. The writes are made
+// like those of the instruction, so that watches see them, but only the bytes the instruction changed
+// are recorded, so reads and writes of the same value are not seen.
+func (h *History) Forward() bool {
+	if h.pos == h.n {
+		return false
+	}
+	z := h.cpu
+	r := h.record(h.pos)
+	for _, c := range r.Changes {
+		z.Mem.put8(c.Addr, c.New)
+	}
+	z.Mem.endInstruction()
+	if r.calls {
+		h.setFrames(r.framesAfter)
+	}
+	h.pos++
+	if h.pos == h.n {
+		z.SetRegisters(h.head)
+	} else {
+		z.SetRegisters(h.record(h.pos).Before)
+	}
+	return true
+}
+
+// Seek takes the CPU to the state before an instruction, which must be recorded or be the one at the
+// head. It starts from the closest snapshot if that is closer than the current state.
+func (h *History) Seek(instruction uint64) error {
+	if instruction < h.First() || instruction > h.Last() {
+		return fmt.Errorf("instruction %d: %w, the history has %d to %d", instruction, ErrNoHistory, h.First(), h.Last())
+	}
+	target := int(instruction - h.First())
+	distance := func(pos int) int {
+		if pos > target {
+			return pos - target
+		}
+		return target - pos
+	}
+	best := -1
+	for i, s := range h.snapshots {
+		if pos := int(s.regs.Instructions - h.First()); distance(pos) < distance(h.pos) && (best < 0 || distance(pos) < distance(int(h.snapshots[best].regs.Instructions-h.First()))) {
+			best = i
+		}
+	}
+	if best >= 0 {
+		h.restore(h.snapshots[best])
+	}
+	for h.pos > target {
+		h.Back()
+	}
+	for h.pos < target {
+		h.Forward()
+	}
+	return nil
+}
+
+// restore sets the state to a snapshot, without forgetting the records after it
+func (h *History) restore(s snapshot) {
+	z := h.cpu
+	if h.pos == h.n {
+		h.head = z.Registers()
+	}
+	copy(z.Mem.data, s.mem)
+	h.setFrames(s.frames)
+	z.SetRegisters(s.regs)
+	h.pos = int(s.regs.Instructions - h.First())
+}
+
+// Truncate forgets the records after the current state, which becomes the head. It is called when
+// the state was changed in the past.
+func (h *History) Truncate() {
+	if h.pos == h.n {
+		return
+	}
+	h.n = h.pos
+	for len(h.snapshots) > 0 && h.snapshots[len(h.snapshots)-1].regs.Instructions >= h.cpu.Instructions {
+		h.snapshots = h.snapshots[:len(h.snapshots)-1]
+	}
+}
@@ -0,0 +1,152 @@
+package core
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/antbern/z80-emulator/io"
+)
+
+// counter is an IO device that reads as the number of reads so far
+type counter struct {
+	reads uint8
+}
+
+func (c *counter) Read(port uint8) uint8 {
+	c.reads++
+	return c.reads
+}
+
+func (c *counter) Write(port, val uint8) {}
+
+// newHistoryCPU returns a CPU running a loop that stores the values read from a port and calls a
+// routine that writes them to another
+func newHistoryCPU() Z80 {
+	z := NewZ80()
+	z.IO = &counter{}
+	z.Calls = &CallStack{}
+	code := []uint8{
+		0x31, 0x00, 0x80, // LD SP,$8000
+		0x21, 0x00, 0x90, // LD HL,$9000
+		0xDB, 0x10, // 0006: IN A,($10)
+		0x77,             // LD (HL),A
+		0x23,             // INC HL
+		0xCD, 0x0F, 0x00, // CALL $000F
+		0x18, 0xF7, // JR $0006
+		0xD3, 0x20, // 000F: OUT ($20),A
+		0xC9, // RET
+	}
+	z.Mem.Write(0, &code)
+	return z
+}
+
+func TestHistory(t *testing.T) {
+	z := newHistoryCPU()
+	z.Record(NewHistory(100, 8))
+
+	// run and save the states to compare with
+	type state struct {
+		regs   Registers
+		mem    []uint8
+		frames []Frame
+	}
+	var states []state
+	for i := 0; i < 50; i++ {
+		states = append(states, state{z.Registers(), append([]uint8(nil), z.Mem.data...), copyFrames(z.Calls)})
+		z.Step()
+	}
+	states = append(states, state{z.Registers(), append([]uint8(nil), z.Mem.data...), copyFrames(z.Calls)})
+
+	check := func(i int) {
+		t.Helper()
+		s := states[i]
+		if got := z.Registers(); got != s.regs {
+			t.Errorf("Expected the registers %+v at instruction %d, got %+v", s.regs, i, got)
+		}
+		if !bytes.Equal(z.Mem.data, s.mem) {
+			t.Errorf("Expected the memory at instruction %d to be restored", i)
+		}
+		if !reflect.DeepEqual(z.Calls.Frames, s.frames) && len(z.Calls.Frames)+len(s.frames) > 0 {
+			t.Errorf("Expected the frames %+v at instruction %d, got %+v", s.frames, i, z.Calls.Frames)
+		}
+	}
+
+	if h := z.History; h.First() != 0 || h.Last() != 50 || h.InPast() {
+		t.Errorf("Expected instructions 0 to 50 at the head, got %d to %d", h.First(), h.Last())
+	}
+	for _, i := range []int{49, 13, 0, 31, 32, 50, 7} {
+		if err := z.History.Seek(uint64(i)); err != nil {
+			t.Fatal(err)
+		}
+		check(i)
+	}
+	z.History.Seek(49)
+	if got, want := z.History.Previous().Ports, []io.PortAccess{{Out: true, Port: 0x20, Value: 7}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected the ports %+v of the OUT instruction, got %+v", want, got)
+	}
+	for z.History.Back() {
+	}
+	check(0)
+
+	// stepping in the past redoes the instructions without reading the device
+	for i := 0; i < 20; i++ {
+		z.Step()
+	}
+	check(20)
+	if reads := z.IO.(*counter).reads; reads != 7 {
+		t.Errorf("Expected the device to be read 7 times, got %d", reads)
+	}
+
+	// changing the past forgets the future
+	*z.A = 0x42
+	z.History.Truncate()
+	z.Step()
+	if z.History.Last() != 21 || z.History.InPast() {
+		t.Errorf("Expected a new head at 21, got %d", z.History.Last())
+	}
+}
+
+func TestHistoryLimit(t *testing.T) {
+	z := newHistoryCPU()
+	z.Record(NewHistory(20, 8))
+	for i := 0; i < 50; i++ {
+		z.Step()
+	}
+	if h := z.History; h.First() != 30 || h.Last() != 50 || h.Len() != 20 {
+		t.Errorf("Expected the last 20 instructions, got %d to %d", h.First(), h.Last())
+	}
+	if err := z.History.Seek(10); !errors.Is(err, ErrNoHistory) {
+		t.Errorf("Expected an error seeking before the history, got %v", err)
+	}
+	if err := z.History.Seek(30); err != nil || z.Instructions != 30 {
+		t.Errorf("Expected to seek to the oldest instruction, got %d and %v", z.Instructions, err)
+	}
+}
+
+func TestHistoryInterrupt(t *testing.T) {
+	z := NewZ80()
+	z.Calls = &CallStack{}
+	code := []uint8{
+		0x31, 0x00, 0x80, // LD SP,$8000
+		0xFB, // EI
+		0x76, // HALT
+	}
+	z.Mem.Write(0, &code)
+	z.Record(NewHistory(10, 10))
+	for !z.Halted {
+		z.Step()
+	}
+	z.Interrupt(0x38)
+
+	// the interrupt is undone with the HALT before it
+	z.History.Back()
+	if *z.PC != 0x0004 || z.Halted || !z.InterruptEnabled || z.Mem.PeekWord(0x7FFE) != 0 || len(z.Calls.Frames) != 0 {
+		t.Errorf("Expected to be back before the HALT, got PC %#04x and %+v", *z.PC, z.Calls.Frames)
+	}
+	z.Step()
+	if *z.PC != 0x0038 || z.Mem.PeekWord(0x7FFE) != 0x0005 || len(z.Calls.Frames) != 1 {
+		t.Errorf("Expected to redo the interrupt, got PC %#04x and %+v", *z.PC, z.Calls.Frames)
+	}
+}
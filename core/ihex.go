@@ -0,0 +1,239 @@
+package core
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Segment is a block of data to be placed at an address in memory
+type Segment struct {
+	Addr uint32
+	Data []uint8
+}
+
+// Image is a memory image made up of segments, with an optional start address
+type Image struct {
+	Segments []Segment
+	Start    uint32
+	HasStart bool
+}
+
+// Intel HEX record types
+const (
+	hexData                   = 0x00
+	hexEOF                    = 0x01
+	hexExtendedSegmentAddress = 0x02
+	hexStartSegmentAddress    = 0x03
+	hexExtendedLinearAddress  = 0x04
+	hexStartLinearAddress     = 0x05
+)
+
+// ErrChecksum is returned when the checksum of a record does not match its contents
+var ErrChecksum = errors.New("checksum mismatch")
+
+// LineError is an error in a line of a text file
+type LineError struct {
+	Line int
+	Err  error
+}
+
+func (e *LineError) Error() string {
+	return fmt.Sprintf("line %d: %v", e.Line, e.Err)
+}
+
+func (e *LineError) Unwrap() error {
+	return e.Err
+}
+
+// ReadIntelHex parses an Intel HEX file. Each data record becomes its own segment, with the address
+// extended by the last type 02 or 04 record. The start address is taken from a type 03 or 05 record.
+func ReadIntelHex(r io.Reader) (*Image, error) {
+	img := &Image{}
+	var base uint32
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		fail := func(format string, args ...interface{}) (*Image, error) {
+			return nil, &LineError{line, fmt.Errorf(format, args...)}
+		}
+
+		if text[0] != ':' {
+			return fail("record does not start with ':'")
+		}
+		rec, err := hex.DecodeString(text[1:])
+		if err != nil {
+			return fail("invalid hex digits: %v", err)
+		}
+		if len(rec) < 5 || len(rec) != int(rec[0])+5 {
+			return fail("record length does not match its byte count")
+		}
+		var sum uint8
+		for _, b := range rec {
+			sum += b
+		}
+		if sum != 0 {
+			return nil, &LineError{line, ErrChecksum}
+		}
+
+		addr := uint32(rec[1])<<8 | uint32(rec[2])
+		data := rec[4 : len(rec)-1]
+		switch rec[3] {
+		case hexData:
+			if len(data) > 0 {
+				img.Segments = append(img.Segments, Segment{Addr: base + addr, Data: data})
+			}
+		case hexEOF:
+			return img, nil
+		case hexExtendedSegmentAddress, hexExtendedLinearAddress:
+			if len(data) != 2 {
+				return fail("address record with %d bytes of data", len(data))
+			}
+			base = uint32(data[0])<<8 | uint32(data[1])
+			if rec[3] == hexExtendedSegmentAddress {
+				base <<= 4
+			} else {
+				base <<= 16
+			}
+		case hexStartSegmentAddress:
+			if len(data) != 4 {
+				return fail("start address record with %d bytes of data", len(data))
+			}
+			cs := uint32(data[0])<<8 | uint32(data[1])
+			ip := uint32(data[2])<<8 | uint32(data[3])
+			img.Start, img.HasStart = cs<<4+ip, true
+		case hexStartLinearAddress:
+			if len(data) != 4 {
+				return fail("start address record with %d bytes of data", len(data))
+			}
+			img.Start = uint32(data[0])<<24 | uint32(data[1])<<16 | uint32(data[2])<<8 | uint32(data[3])
+			img.HasStart = true
+		default:
+			return fail("unsupported record type %#02x", rec[3])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, &LineError{line, errors.New("missing end of file record")}
+}
+
+// Load writes the segments of the image into memory. Segments must fit in the 64K address space.
+func (ram *RAM) Load(img *Image) error {
+	for _, s := range img.Segments {
+		if s.Addr+uint32(len(s.Data)) > ramSize {
+			return fmt.Errorf("segment at %#04x with %d bytes does not fit in memory", s.Addr, len(s.Data))
+		}
+	}
+	for _, s := range img.Segments {
+		copy(ram.data[s.Addr:], s.Data)
+	}
+	return nil
+}
+
+// LoadIntelHex loads an Intel HEX file into memory, setting the PC to its start address if it has one
+func (z *Z80) LoadIntelHex(r io.Reader) error {
+	img, err := ReadIntelHex(r)
+	if err != nil {
+		return err
+	}
+	return z.LoadImage(img)
+}
+
+// LoadImage loads an image into memory, setting the PC to its start address if it has one
+func (z *Z80) LoadImage(img *Image) error {
+	if err := z.Mem.Load(img); err != nil {
+		return err
+	}
+	if img.HasStart {
+		if img.Start >= ramSize {
+			return fmt.Errorf("start address %#x is outside memory", img.Start)
+		}
+		*z.PC = uint16(img.Start)
+	}
+	return nil
+}
+
+// maximum number of data bytes in the records written by WriteIntelHex
+const hexRecordSize = 16
+
+// writeHexRecord writes a record with its byte count and checksum
+func writeHexRecord(w io.Writer, addr uint16, typ uint8, data []uint8) error {
+	rec := append([]uint8{uint8(len(data)), uint8(addr >> 8), uint8(addr), typ}, data...)
+	var sum uint8
+	for _, b := range rec {
+		sum += b
+	}
+	rec = append(rec, -sum)
+	_, err := fmt.Fprintf(w, ":%s\n", strings.ToUpper(hex.EncodeToString(rec)))
+	return err
+}
+
+// WriteIntelHex writes the image as an Intel HEX file, with type 04 records for addresses above 64K and
+// a type 05 record for the start address
+func WriteIntelHex(w io.Writer, img *Image) error {
+	var base uint32
+	for _, s := range img.Segments {
+		for offset := 0; offset < len(s.Data); {
+			addr := s.Addr + uint32(offset)
+			if addr&^0xFFFF != base {
+				base = addr &^ 0xFFFF
+				if err := writeHexRecord(w, 0, hexExtendedLinearAddress, []uint8{uint8(base >> 24), uint8(base >> 16)}); err != nil {
+					return err
+				}
+			}
+			// records do not cross a 64K boundary
+			n := len(s.Data) - offset
+			if n > hexRecordSize {
+				n = hexRecordSize
+			}
+			if rest := int(0x10000 - addr&0xFFFF); n > rest {
+				n = rest
+			}
+			if err := writeHexRecord(w, uint16(addr), hexData, s.Data[offset:offset+n]); err != nil {
+				return err
+			}
+			offset += n
+		}
+	}
+	if img.HasStart {
+		start := []uint8{uint8(img.Start >> 24), uint8(img.Start >> 16), uint8(img.Start >> 8), uint8(img.Start)}
+		if err := writeHexRecord(w, 0, hexStartLinearAddress, start); err != nil {
+			return err
+		}
+	}
+	return writeHexRecord(w, 0, hexEOF, nil)
+}
+
+// Flatten returns the contents of the image from its lowest to its highest address as a single block,
+// with the gaps between segments filled with fill
+func (img *Image) Flatten(fill uint8) (uint32, []uint8) {
+	if len(img.Segments) == 0 {
+		return 0, nil
+	}
+	low, high := img.Segments[0].Addr, uint32(0)
+	for _, s := range img.Segments {
+		if s.Addr < low {
+			low = s.Addr
+		}
+		if end := s.Addr + uint32(len(s.Data)); end > high {
+			high = end
+		}
+	}
+	data := make([]uint8, high-low)
+	for i := range data {
+		data[i] = fill
+	}
+	for _, s := range img.Segments {
+		copy(data[s.Addr-low:], s.Data)
+	}
+	return low, data
+}
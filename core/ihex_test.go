@@ -0,0 +1,113 @@
+package core
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestReadIntelHex(t *testing.T) {
+	input := `:0300300002337A1E
+:020000021000EC
+:02000000AABB99
+:0400000300001234B3
+:00000001FF
+`
+	img, err := ReadIntelHex(strings.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(img.Segments) != 2 {
+		t.Fatalf("Expected 2 segments, got %d", len(img.Segments))
+	}
+	if s := img.Segments[0]; s.Addr != 0x0030 || len(s.Data) != 3 || s.Data[2] != 0x7A {
+		t.Errorf("Unexpected first segment %#v", s)
+	}
+	if s := img.Segments[1]; s.Addr != 0x10000 || s.Data[0] != 0xAA {
+		t.Errorf("Extended segment address not applied, got %#x", s.Addr)
+	}
+	if !img.HasStart || img.Start != 0x1234 {
+		t.Errorf("Expected start address 0x1234, got %#x (%v)", img.Start, img.HasStart)
+	}
+}
+
+func TestReadIntelHexErrors(t *testing.T) {
+	tables := []struct {
+		input string
+		line  int
+	}{
+		{":0300300002337A1F\n:00000001FF\n", 1},
+		{":00000001FF\n", 0},
+		{"\n:0300300002337A1E\n0000\n", 3},
+		{":03003000\n", 1},
+		{":0300300002337A1E\n", 1},
+	}
+	for _, table := range tables {
+		_, err := ReadIntelHex(strings.NewReader(table.input))
+		if table.line == 0 {
+			if err != nil {
+				t.Errorf("Unexpected error for %q: %v", table.input, err)
+			}
+			continue
+		}
+		var lineErr *LineError
+		if !errors.As(err, &lineErr) || lineErr.Line != table.line {
+			t.Errorf("Expected an error on line %d for %q, got %v", table.line, table.input, err)
+		}
+	}
+
+	_, err := ReadIntelHex(strings.NewReader(":0300300002337A1F\n"))
+	if !errors.Is(err, ErrChecksum) {
+		t.Errorf("Expected a checksum error, got %v", err)
+	}
+}
+
+func TestLoadIntelHex(t *testing.T) {
+	z := NewZ80()
+	input := ":03FFFD00010203FB\n:0400000500000100F6\n:00000001FF\n"
+	if err := z.LoadIntelHex(strings.NewReader(input)); err != nil {
+		t.Fatal(err)
+	}
+	if z.Mem.Peek(0xFFFF) != 0x03 || *z.PC != 0x0100 {
+		t.Errorf("Unexpected memory %#02x or PC %#04x", z.Mem.Peek(0xFFFF), *z.PC)
+	}
+
+	// data past the end of memory is rejected
+	input = ":020000040001F9\n:0100000042BD\n:00000001FF\n"
+	if err := z.LoadIntelHex(strings.NewReader(input)); err == nil {
+		t.Errorf("Expected an error loading data outside memory")
+	}
+}
+
+func TestWriteIntelHex(t *testing.T) {
+	data := make([]uint8, 20)
+	for i := range data {
+		data[i] = uint8(i)
+	}
+	img := &Image{
+		Segments: []Segment{{Addr: 0x0100, Data: data}, {Addr: 0xFFFE, Data: []uint8{1, 2, 3, 4}}},
+		Start:    0x0100, HasStart: true,
+	}
+	var sb strings.Builder
+	if err := WriteIntelHex(&sb, img); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(sb.String(), ":10010000000102030405060708090A0B0C0D0E0F77\n") {
+		t.Errorf("Unexpected first record in\n%v", sb.String())
+	}
+
+	read, err := ReadIntelHex(strings.NewReader(sb.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !read.HasStart || read.Start != 0x0100 {
+		t.Errorf("Expected start address 0x0100, got %#x", read.Start)
+	}
+	low, flat := read.Flatten(0xFF)
+	if low != 0x0100 || len(flat) != 0x10002-0x100 {
+		t.Fatalf("Flatten returned %#x with %d bytes", low, len(flat))
+	}
+	if flat[19] != 19 || flat[20] != 0xFF || flat[0xFFFE-0x100] != 1 || flat[len(flat)-1] != 4 {
+		t.Errorf("Unexpected flattened contents")
+	}
+}
@@ -8,6 +8,13 @@ import (
 // RAM represents the RAM in the Z80
 type RAM struct {
 	data []uint8
+
+	// watch is only set while addresses are watched, so that accesses cost a nil check otherwise
+	watch   *watch
+	watcher Watcher
+
+	// journal is only set while an instruction is recorded by a History
+	journal *journal
 }
 
 const ramSize = 0x10000
@@ -21,58 +28,125 @@ func NewRAM() *RAM {
 }
 
 func (ram *RAM) Write(addr uint16, data *[]uint8) {
-	if int(addr)+len(*data) >= ramSize {
+	if int(addr)+len(*data) > ramSize {
 		log.Panic("[RAM] Tried to write outside RAM")
 	}
+	if ram.journal != nil {
+		for i := range *data {
+			ram.journal.write(addr+uint16(i), ram.data[int(addr)+i])
+		}
+	}
 	copy(ram.data[addr:], *data)
 }
 
+// the accesses of the CPU, which are reported to the watcher for watched addresses. Fetches of
+// instructions and their operands use read8Inc and read16Inc.
 func (ram *RAM) read8(addr uint16) uint8 {
+	if ram.watch != nil {
+		ram.watch.access(Read, addr, ram.data[addr], ram.data[addr])
+	}
 	return ram.data[addr]
 }
 
 func (ram *RAM) read8Inc(addr *uint16) uint8 {
 	(*addr)++
+	if ram.watch != nil {
+		ram.watch.access(Fetch, *addr-1, ram.data[*addr-1], ram.data[*addr-1])
+	}
 	return ram.data[(*addr)-1]
 }
 
 func (ram *RAM) put8(addr uint16, data uint8) {
+	if ram.watch != nil {
+		ram.watch.access(Write, addr, ram.data[addr], data)
+	}
+	if ram.journal != nil {
+		ram.journal.write(addr, ram.data[addr])
+	}
 	ram.data[addr] = data
 }
 
 func (ram *RAM) read16(addr uint16) uint16 {
-	return uint16(ram.data[addr+1])<<8 | uint16(ram.data[addr])
+	lo := ram.read8(addr)
+	return uint16(ram.read8(addr+1))<<8 | uint16(lo)
 }
 
 func (ram *RAM) read16Inc(addr *uint16) uint16 {
-	(*addr) += 2
-	return uint16(ram.data[*addr-1])<<8 | uint16(ram.data[*addr-2])
+	lo := ram.read8Inc(addr)
+	return uint16(ram.read8Inc(addr))<<8 | uint16(lo)
 }
 
 func (ram *RAM) put16(addr uint16, data uint16) {
-	ram.data[addr] = uint8(data & 0xff)
-	ram.data[addr+1] = uint8((data >> 8) & 0xff)
+	ram.put8(addr, uint8(data&0xff))
+	ram.put8(addr+1, uint8((data>>8)&0xff))
 }
 
-func (ram *RAM) ptr8(addr uint16) *uint8 {
+// ptr8 returns a pointer to a byte for instructions that access memory through (HL) like a register,
+// with the kinds of accesses the instruction makes through it. A watched read is reported right away
+// and a watched write at the end of the instruction, with the value it left in the byte, so a write of
+// the same value is still reported but the write comes after the other accesses of the instruction.
+func (ram *RAM) ptr8(addr uint16, kind AccessKind) *uint8 {
+	if ram.watch != nil {
+		if kind&Read != 0 {
+			ram.watch.access(Read, addr, ram.data[addr], ram.data[addr])
+		}
+		if kind&Write != 0 {
+			ram.watch.pointer(addr, ram.data[addr])
+		}
+	}
+	if ram.journal != nil && kind&Write != 0 {
+		ram.journal.write(addr, ram.data[addr])
+	}
 	return &ram.data[addr]
 }
 
-/// Functions for pushing/popping registers to/from the stack
+// Functions for pushing/popping registers to/from the stack
 func (ram *RAM) stackPush16(sp R16, src R16) {
 	*sp--
-	ram.data[*sp] = uint8(*src >> 8)
+	ram.put8(*sp, uint8(*src>>8))
 	*sp--
-	ram.data[*sp] = uint8(*src & 0xff)
+	ram.put8(*sp, uint8(*src&0xff))
 }
 
 func (ram *RAM) stackPop16(sp R16, dst R16) {
-	*dst = uint16(ram.data[*sp])
+	*dst = uint16(ram.read8(*sp))
 	*sp++
-	*dst |= uint16(ram.data[*sp]) << 8
+	*dst |= uint16(ram.read8(*sp)) << 8
 	*sp++
 }
 
+// endInstruction reports the accesses through pointers when an instruction is done
+func (ram *RAM) endInstruction() {
+	if ram.watch != nil {
+		ram.watch.resolve(ram.data)
+	}
+}
+
+// Peek returns the byte at the specified address. Like the other exported accessors it is not seen by
+// watches.
+func (ram *RAM) Peek(addr uint16) uint8 {
+	return ram.data[addr]
+}
+
+// Poke writes a byte to the specified address
+func (ram *RAM) Poke(addr uint16, val uint8) {
+	if ram.journal != nil {
+		ram.journal.write(addr, ram.data[addr])
+	}
+	ram.data[addr] = val
+}
+
+// PeekWord returns the little-endian word at the specified address
+func (ram *RAM) PeekWord(addr uint16) uint16 {
+	return uint16(ram.data[addr+1])<<8 | uint16(ram.data[addr])
+}
+
+// PokeWord writes a little-endian word to the specified address
+func (ram *RAM) PokeWord(addr uint16, val uint16) {
+	ram.Poke(addr, uint8(val))
+	ram.Poke(addr+1, uint8(val>>8))
+}
+
 // Dump prints the RAM contents to the provided writer
 func (ram *RAM) Dump(start, length uint16) string {
 	return hex.Dump(ram.data[start : start+length])
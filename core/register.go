@@ -25,3 +25,107 @@ func NewR16Single() R16 {
 func NewR8() R8 {
 	return new(uint8)
 }
+
+// RegisterNames are the names accepted by Reg and SetReg, with the alternative registers written as AF'
+var RegisterNames = []string{
+	"A", "F", "B", "C", "D", "E", "H", "L", "IXH", "IXL", "IYH", "IYL", "I", "R",
+	"AF", "BC", "DE", "HL", "IX", "IY", "SP", "PC", "AF'", "BC'", "DE'", "HL'",
+}
+
+// register returns the 16 bit or 8 bit register with the upper case name, or nil for both if there is
+// no such register
+func (z *Z80) register(name string) (R16, R8) {
+	switch name {
+	case "AF":
+		return z.AF, nil
+	case "BC":
+		return z.BC, nil
+	case "DE":
+		return z.DE, nil
+	case "HL":
+		return z.HL, nil
+	case "IX":
+		return z.IX, nil
+	case "IY":
+		return z.IY, nil
+	case "SP":
+		return z.SP, nil
+	case "PC":
+		return z.PC, nil
+	case "AF'":
+		return z.AFa, nil
+	case "BC'":
+		return z.BCa, nil
+	case "DE'":
+		return z.DEa, nil
+	case "HL'":
+		return z.HLa, nil
+	case "A":
+		return nil, z.A
+	case "F":
+		return nil, z.F
+	case "B":
+		return nil, z.B
+	case "C":
+		return nil, z.C
+	case "D":
+		return nil, z.D
+	case "E":
+		return nil, z.E
+	case "H":
+		return nil, z.H
+	case "L":
+		return nil, z.L
+	case "IXH":
+		return nil, z.IXH
+	case "IXL":
+		return nil, z.IXL
+	case "IYH":
+		return nil, z.IYH
+	case "IYL":
+		return nil, z.IYL
+	case "I":
+		return nil, &z.I
+	case "R":
+		return nil, &z.R
+	}
+	return nil, nil
+}
+
+// Reg returns the value of a register by its upper case name, and whether the register exists
+func (z *Z80) Reg(name string) (uint16, bool) {
+	r16, r8 := z.register(name)
+	switch {
+	case r16 != nil:
+		return *r16, true
+	case r8 != nil:
+		return uint16(*r8), true
+	}
+	return 0, false
+}
+
+// SetReg sets a register by its upper case name. 8 bit registers get the low byte of the value.
+func (z *Z80) SetReg(name string, value uint16) bool {
+	r16, r8 := z.register(name)
+	switch {
+	case r16 != nil:
+		*r16 = value
+	case r8 != nil:
+		*r8 = uint8(value)
+	default:
+		return false
+	}
+	return true
+}
+
+// RegSize returns the size of a register in bytes, or 0 if there is no such register
+func (z *Z80) RegSize(name string) int {
+	r16, r8 := z.register(name)
+	switch {
+	case r16 != nil:
+		return 2
+	case r8 != nil:
+		return 1
+	}
+	return 0
+}
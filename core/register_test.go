@@ -51,3 +51,26 @@ func TestRegs(t *testing.T) {
 	}
 
 }
+
+func TestRegByName(t *testing.T) {
+	z := NewZ80()
+	for _, name := range RegisterNames {
+		if !z.SetReg(name, 0x1234) {
+			t.Errorf("SetReg(%v) failed", name)
+		}
+	}
+	*z.HL = 0xABCD
+	if v, ok := z.Reg("H"); !ok || v != 0xAB {
+		t.Errorf("Expected H = 0xAB, got %#02x %v", v, ok)
+	}
+	z.SetReg("L", 0x1FF)
+	if *z.HL != 0xABFF {
+		t.Errorf("Expected HL = 0xABFF, got %#04x", *z.HL)
+	}
+	if v, _ := z.Reg("AF'"); v != 0x1234 || z.RegSize("AF'") != 2 || z.RegSize("IXL") != 1 {
+		t.Errorf("Unexpected alternative register %#04x or sizes", v)
+	}
+	if _, ok := z.Reg("Q"); ok || z.SetReg("Q", 0) || z.RegSize("Q") != 0 {
+		t.Error("Unknown register was accepted")
+	}
+}
@@ -0,0 +1,178 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	z80io "github.com/antbern/z80-emulator/io"
+)
+
+// The machine state format starts with stateMagic and the version as a little-endian uint16,
+// followed by chunks that each have a four letter tag, the length of the data as a little-endian
+// uint32 and the data. The chunks are:
+//
+//	REGS  the Registers, encoded with encoding/binary in little-endian order
+//	RAM   the 64 KB of memory
+//	DEVS  the state of the IO device if it implements io.Stateful
+//
+// Readers skip chunks they do not know, so chunks can be added without a new version. Changes to
+// the existing chunks, such as new fields in Registers, need a new version.
+const (
+	stateMagic = "Z80STATE"
+
+	// StateVersion is the version of the machine state format written by SaveState
+	StateVersion = 1
+)
+
+// the tags of the chunks
+const (
+	chunkRegisters = "REGS"
+	chunkRAM       = "RAM "
+	chunkDevices   = "DEVS"
+)
+
+// ErrNotState is returned when loading a file that is not a machine state
+var ErrNotState = errors.New("not a machine state")
+
+// writeChunk writes a chunk with a tag and data
+func writeChunk(w io.Writer, tag string, data []uint8) error {
+	if _, err := io.WriteString(w, tag); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.LittleEndian, uint32(len(data))); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+// SaveState writes the registers, memory and device state of the CPU. The call stack, history and
+// traps are not included.
+func (z *Z80) SaveState(w io.Writer) error {
+	if _, err := io.WriteString(w, stateMagic); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.LittleEndian, uint16(StateVersion)); err != nil {
+		return err
+	}
+
+	var regs bytes.Buffer
+	binary.Write(&regs, binary.LittleEndian, z.Registers())
+	if err := writeChunk(w, chunkRegisters, regs.Bytes()); err != nil {
+		return err
+	}
+	if err := writeChunk(w, chunkRAM, z.Mem.data); err != nil {
+		return err
+	}
+	if s, ok := z.IO.(z80io.Stateful); ok {
+		var devs bytes.Buffer
+		if err := s.SaveState(&devs); err != nil {
+			return fmt.Errorf("saving the devices: %w", err)
+		}
+		if err := writeChunk(w, chunkDevices, devs.Bytes()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LoadState restores a state written by SaveState. The devices are restored if the state has them
+// and the IO device implements io.Stateful. The call stack is cleared, and a history starts over.
+// Nothing is changed if the state cannot be restored completely.
+func (z *Z80) LoadState(r io.Reader) error {
+	header := make([]uint8, len(stateMagic)+2)
+	if _, err := io.ReadFull(r, header); err != nil || string(header[:len(stateMagic)]) != stateMagic {
+		return ErrNotState
+	}
+	if v := binary.LittleEndian.Uint16(header[len(stateMagic):]); v != StateVersion {
+		return fmt.Errorf("unsupported machine state version %d, expected %d", v, StateVersion)
+	}
+
+	chunks := make(map[string][]uint8)
+	for {
+		var tag [4]uint8
+		if _, err := io.ReadFull(r, tag[:]); err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("reading the machine state: %w", err)
+		}
+		var size uint32
+		if err := binary.Read(r, binary.LittleEndian, &size); err != nil {
+			return fmt.Errorf("reading the machine state: %w", err)
+		}
+		data := make([]uint8, size)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return fmt.Errorf("reading chunk %q: %w", tag, err)
+		}
+		chunks[string(tag[:])] = data
+	}
+
+	var regs Registers
+	if err := binary.Read(bytes.NewReader(chunks[chunkRegisters]), binary.LittleEndian, &regs); err != nil {
+		return fmt.Errorf("the registers are missing: %w", err)
+	}
+	if len(chunks[chunkRAM]) != ramSize {
+		return fmt.Errorf("the memory has %d bytes, expected %d", len(chunks[chunkRAM]), ramSize)
+	}
+	// the devices are restored last, since they validate their state while restoring it, and are
+	// put back into their current state if that fails
+	if devs, ok := chunks[chunkDevices]; ok {
+		s, ok := z.IO.(z80io.Stateful)
+		if !ok {
+			return errors.New("the state has devices, but the IO device cannot restore them")
+		}
+		var current bytes.Buffer
+		if err := s.SaveState(&current); err != nil {
+			return fmt.Errorf("saving the devices before restoring them: %w", err)
+		}
+		if err := s.LoadState(bytes.NewReader(devs)); err != nil {
+			if err := s.LoadState(&current); err != nil {
+				return fmt.Errorf("putting back the devices after a failed restore: %w", err)
+			}
+			return fmt.Errorf("restoring the devices: %w", err)
+		}
+	}
+
+	z.SetRegisters(regs)
+	copy(z.Mem.data, chunks[chunkRAM])
+	if z.Calls != nil {
+		z.Calls.Reset()
+	}
+	if z.History != nil {
+		z.Record(z.History)
+	}
+	return nil
+}
+
+// SaveStateFile writes the state of the CPU to a file
+func (z *Z80) SaveStateFile(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	if err := z.SaveState(w); err != nil {
+		f.Close()
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// LoadStateFile restores the state of the CPU from a file
+func (z *Z80) LoadStateFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return z.LoadState(bufio.NewReader(f))
+}
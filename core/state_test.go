@@ -0,0 +1,95 @@
+package core
+
+import (
+	"bytes"
+	"errors"
+	goio "io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/antbern/z80-emulator/io"
+)
+
+func TestState(t *testing.T) {
+	z := newHistoryCPU()
+	bus := io.NewBus()
+	bus.Attach(io.SioBase, 4, io.NewSIO(nil, nil))
+	z.IO = bus
+	for i := 0; i < 20; i++ {
+		z.Step()
+	}
+	*z.AFa, z.InterruptEnabled = 0x1234, true
+	z.I, z.R, z.IM, z.IFF2 = 0x3F, 0x12, 1, true
+
+	var state bytes.Buffer
+	if err := z.SaveState(&state); err != nil {
+		t.Fatal(err)
+	}
+	saved := state.Bytes()
+
+	z2 := NewZ80()
+	bus2 := io.NewBus()
+	bus2.Attach(io.SioBase, 4, io.NewSIO(nil, nil))
+	z2.IO = bus2
+	z2.Calls = &CallStack{Frames: []Frame{{}}}
+	if err := z2.LoadState(bytes.NewReader(saved)); err != nil {
+		t.Fatal(err)
+	}
+	if z2.Registers() != z.Registers() || !bytes.Equal(z2.Mem.data, z.Mem.data) || len(z2.Calls.Frames) != 0 {
+		t.Errorf("Expected the registers %+v and memory to be restored, got %+v", z.Registers(), z2.Registers())
+	}
+
+	// the devices are restored if the state has them
+	z3 := NewZ80()
+	if err := z3.LoadState(bytes.NewReader(saved)); err == nil {
+		t.Errorf("Expected an error restoring devices without an IO device")
+	}
+
+	if err := z2.LoadState(bytes.NewReader([]uint8("not a state"))); !errors.Is(err, ErrNotState) {
+		t.Errorf("Expected ErrNotState, got %v", err)
+	}
+	// a failure to restore the devices changes nothing
+	dev := &stateDevice{state: []uint8{1}}
+	z3.IO = dev
+	regs := z3.Registers()
+	var bad bytes.Buffer
+	z.IO = &stateDevice{state: []uint8{0xFF, 2}}
+	if err := z.SaveState(&bad); err != nil {
+		t.Fatal(err)
+	}
+	if err := z3.LoadState(&bad); err == nil {
+		t.Errorf("Expected an error restoring an invalid device state")
+	}
+	if z3.Registers() != regs || !bytes.Equal(z3.Mem.data, make([]uint8, ramSize)) || !bytes.Equal(dev.state, []uint8{1}) {
+		t.Errorf("Expected a failed restore to change nothing, got the registers %+v and device state %v", z3.Registers(), dev.state)
+	}
+
+	newer := append([]uint8(nil), saved...)
+	newer[len(stateMagic)] = StateVersion + 1
+	if err := z2.LoadState(bytes.NewReader(newer)); err == nil {
+		t.Errorf("Expected an error for a newer version")
+	}
+}
+
+// stateDevice is a device whose state is some bytes, which fails to restore a state starting with
+// 0xFF after taking it over
+type stateDevice struct {
+	state []uint8
+}
+
+func (d *stateDevice) Write(port, val uint8) {}
+
+func (d *stateDevice) Read(port uint8) uint8 { return 0 }
+
+func (d *stateDevice) SaveState(w goio.Writer) error {
+	_, err := w.Write(d.state)
+	return err
+}
+
+func (d *stateDevice) LoadState(r goio.Reader) error {
+	var err error
+	if d.state, err = ioutil.ReadAll(r); err == nil && len(d.state) > 0 && d.state[0] == 0xFF {
+		err = errors.New("invalid state")
+	}
+	return err
+}
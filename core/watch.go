@@ -0,0 +1,94 @@
+package core
+
+import "strings"
+
+// AccessKind is a kind of memory access, or a set of kinds
+type AccessKind uint8
+
+// the kinds of memory accesses
+const (
+	Read AccessKind = 1 << iota
+	Write
+	// Fetch is the fetch of an instruction or its operands
+	Fetch
+)
+
+// String returns the kinds as "read", "write" and "fetch" separated by "/"
+func (k AccessKind) String() string {
+	var names []string
+	for i, name := range []string{"read", "write", "fetch"} {
+		if k&(1<<uint(i)) != 0 {
+			names = append(names, name)
+		}
+	}
+	return strings.Join(names, "/")
+}
+
+// Access is a watched memory access by the CPU
+type Access struct {
+	Kind AccessKind
+	Addr uint16
+
+	// Old and New are the values before and after the access, which are the same for reads and fetches
+	Old, New uint8
+}
+
+// Watcher is called for the watched memory accesses of the CPU
+type Watcher func(a Access)
+
+// watch holds the watched kinds of accesses for each address
+type watch struct {
+	kinds   [ramSize]AccessKind
+	watcher Watcher
+
+	// pointers are the writes through pointers in the current instruction, see ptr8
+	pointers []Access
+}
+
+// access reports an access if it is watched
+func (w *watch) access(kind AccessKind, addr uint16, old, new uint8) {
+	if w.kinds[addr]&kind != 0 && w.watcher != nil {
+		w.watcher(Access{Kind: kind, Addr: addr, Old: old, New: new})
+	}
+}
+
+// pointer records a write through a pointer, which is reported by resolve
+func (w *watch) pointer(addr uint16, old uint8) {
+	if w.kinds[addr]&Write != 0 {
+		w.pointers = append(w.pointers, Access{Kind: Write, Addr: addr, Old: old})
+	}
+}
+
+// resolve reports the writes through pointers in the instruction that ended
+func (w *watch) resolve(data []uint8) {
+	for _, p := range w.pointers {
+		p.New = data[p.Addr]
+		w.access(p.Kind, p.Addr, p.Old, p.New)
+	}
+	w.pointers = w.pointers[:0]
+}
+
+// Watch reports the accesses of the kinds to the addresses from start to end, inclusive, to the
+// watcher set with SetWatcher, in addition to the accesses already watched. Accesses through the
+// exported methods such as Peek and Poke are not reported.
+func (ram *RAM) Watch(start, end uint16, kinds AccessKind) {
+	if ram.watch == nil {
+		ram.watch = &watch{watcher: ram.watcher}
+	}
+	for addr := int(start); addr <= int(end); addr++ {
+		ram.watch.kinds[addr] |= kinds
+	}
+}
+
+// ClearWatches stops watching all addresses
+func (ram *RAM) ClearWatches() {
+	ram.watch = nil
+}
+
+// SetWatcher sets the function that receives the watched accesses
+func (ram *RAM) SetWatcher(w Watcher) {
+	ram.watcher = w
+	if ram.watch != nil {
+		ram.watch.watcher = w
+	}
+}
@@ -0,0 +1,64 @@
+package core
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestWatch(t *testing.T) {
+	z := NewZ80()
+	code := []uint8{
+		0x31, 0x00, 0x80, // LD SP,$8000
+		0x21, 0x00, 0x90, // LD HL,$9000
+		0x34,       // INC (HL)
+		0x36, 0x01, // LD (HL),1
+		0x7E,             // LD A,(HL)
+		0x32, 0x01, 0x90, // LD ($9001),A
+		0xCD, 0x11, 0x00, // CALL $0011
+		0x76, // HALT
+		0xC9, // 0011: RET
+	}
+	z.Mem.Write(0, &code)
+
+	var got []Access
+	z.Mem.SetWatcher(func(a Access) { got = append(got, a) })
+	z.Mem.Watch(0x9000, 0x9001, Read|Write)
+	z.Mem.Watch(0x7FFE, 0x7FFF, Read|Write)
+	z.Mem.Watch(0x0011, 0x0011, Fetch)
+	z.Mem.Peek(0x9000)
+	for !z.Halted {
+		z.Step()
+	}
+
+	// INC (HL) both reads and writes, and LD (HL),1 writes the value the byte already has
+	want := []Access{
+		{Read, 0x9000, 0x00, 0x00},
+		{Write, 0x9000, 0x00, 0x01},
+		{Write, 0x9000, 0x01, 0x01},
+		{Read, 0x9000, 0x01, 0x01},
+		{Write, 0x9001, 0x00, 0x01},
+		{Write, 0x7FFF, 0x00, 0x00},
+		{Write, 0x7FFE, 0x00, 0x10},
+		{Fetch, 0x0011, 0xC9, 0xC9},
+		{Read, 0x7FFE, 0x10, 0x10},
+		{Read, 0x7FFF, 0x00, 0x00},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected accesses\n got %+v\nwant %+v", got, want)
+	}
+
+	// no more accesses are reported after clearing the watches
+	z.Mem.ClearWatches()
+	got = nil
+	z.Halted = false
+	*z.PC = 0
+	for !z.Halted {
+		z.Step()
+	}
+	if len(got) != 0 {
+		t.Errorf("Expected no accesses after ClearWatches, got %+v", got)
+	}
+	if (Read | Fetch).String() != "read/fetch" {
+		t.Errorf("Unexpected kinds %v", Read|Fetch)
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/antbern/z80-emulator/cpm"
+)
+
+// runCPM implements the cpm subcommand, which runs a CP/M .COM program and returns its exit status
+func runCPM(args []string) int {
+	fs := flag.NewFlagSet("cpm", flag.ExitOnError)
+	var drives driveFlags
+	fs.Var(&drives, "drive", "Map a CP/M drive to a host directory, e.g. A=./disk (repeatable). Defaults to A= the directory of the program")
+	verbose := fs.Bool("v", false, "Log emulator debug output to stderr")
+	var tracing traceFlags
+	tracing.register(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s cpm [flags] program.com [arguments...]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() < 1 {
+		fs.Usage()
+		return 2
+	}
+	program := fs.Arg(0)
+
+	if !*verbose {
+		log.SetOutput(ioutil.Discard)
+	}
+
+	cfg := cpm.Config{Input: os.Stdin, Output: os.Stdout, Drives: drives.dirs}
+	if cfg.Drives == [16]string{} {
+		cfg.Drives[0] = filepath.Dir(program)
+	}
+
+	m := cpm.NewMachine(cfg)
+	if err := m.LoadCOM(program, fs.Args()[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, "Error loading program:", err)
+		return 1
+	}
+
+	tracer, err := tracing.open(nil)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error opening trace:", err)
+		return 1
+	}
+	if tracer != nil {
+		m.CPU.Tracer = tracer
+		defer tracing.close(tracer)
+	}
+
+	code, err := m.Run()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error running program:", err)
+		return 1
+	}
+	return code
+}
@@ -0,0 +1,91 @@
+package cpm
+
+import "github.com/antbern/z80-emulator/core"
+
+// BIOS function numbers, in the order of the entries in the jump table
+const (
+	BiosBoot = iota
+	BiosWBoot
+	BiosConst
+	BiosConin
+	BiosConout
+	BiosList
+	BiosPunch
+	BiosReader
+	BiosHome
+	BiosSeldsk
+	BiosSettrk
+	BiosSetsec
+	BiosSetdma
+	BiosRead
+	BiosWrite
+	BiosListst
+	BiosSectran
+	biosEntries
+)
+
+// BIOS is the set of handlers called for the entries of the trapped BIOS jump table. Each handler
+// gets the CPU with the parameters in BC (and DE for SECTRAN) and stores its result in A or HL.
+// The return to the caller is performed by the trap itself, unless the handler jumps elsewhere.
+type BIOS [biosEntries]core.Trap
+
+// installBIOS writes the BIOS jump table at base. Each entry jumps to a stub containing a RET
+// instruction, and the stub address is trapped to call the handler for that entry.
+func installBIOS(z *core.Z80, base uint16, bios *BIOS) {
+	stubs := base + 3*biosEntries
+	for i := uint16(0); i < biosEntries; i++ {
+		stub := stubs + i
+		z.Mem.Poke(base+3*i, 0xC3) // JP stub
+		z.Mem.PokeWord(base+3*i+1, stub)
+		z.Mem.Poke(stub, 0xC9) // RET, in case the trap is removed
+
+		handler := bios[i]
+		z.Traps[stub] = func(z *core.Z80) {
+			if handler != nil {
+				handler(z)
+			}
+			if *z.PC == stub {
+				z.Ret()
+			}
+		}
+	}
+}
+
+// consoleBIOS returns a BIOS whose character I/O entries use the console of the BDOS. The disk
+// entries report that no disks are available.
+func consoleBIOS(b *core.BDOS) BIOS {
+	var bios BIOS
+	bios[BiosConst] = func(z *core.Z80) {
+		*z.A = b.ConsoleStatus()
+	}
+	bios[BiosConin] = func(z *core.Z80) {
+		*z.A, _ = b.ConsoleIn()
+	}
+	bios[BiosConout] = func(z *core.Z80) {
+		b.ConsoleOut(*z.C)
+	}
+	bios[BiosList] = func(z *core.Z80) {
+		if b.List != nil {
+			b.List.Write([]byte{*z.C})
+		}
+	}
+	bios[BiosReader] = func(z *core.Z80) {
+		*z.A = 0x1A
+	}
+	bios[BiosListst] = func(z *core.Z80) {
+		*z.A = 0xFF
+	}
+	bios[BiosSeldsk] = func(z *core.Z80) {
+		*z.HL = 0 // no such disk
+	}
+	bios[BiosRead] = func(z *core.Z80) {
+		*z.A = 1 // unrecoverable error
+	}
+	bios[BiosWrite] = func(z *core.Z80) {
+		*z.A = 1
+	}
+	bios[BiosSectran] = func(z *core.Z80) {
+		*z.HL = *z.BC // no translation
+	}
+	return bios
+}
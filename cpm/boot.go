@@ -0,0 +1,334 @@
+package cpm
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+
+	"github.com/antbern/z80-emulator/core"
+	z80io "github.com/antbern/z80-emulator/io"
+)
+
+// BootConfig contains the settings for booting CP/M from disk images
+type BootConfig struct {
+	// Input and Output is the console. The machine stops when the console input ends.
+	Input  io.Reader
+	Output io.Writer
+
+	// Disks are inserted in drives A:, B: and so on. The system is loaded from drive A:. Writes by the
+	// BIOS only change the disks in memory.
+	Disks []BootDisk
+
+	// IO is an optional device for IN and OUT instructions
+	IO z80io.Device
+
+	// Native loads all records of the system tracks, including the BIOS, and starts the BIOS from
+	// the disk instead of the trapped BIOS. The BIOS must then use the devices attached to IO, with
+	// the console as an SIO at the ports from io.SioBase. The machine stops when the BIOS polls the
+	// console after its input has ended, or when Stop is called.
+	Native bool
+}
+
+// BootDisk is a disk image together with its CP/M format
+type BootDisk struct {
+	Disk   *z80io.Disk
+	Format DiskFormat
+}
+
+// address of the disk tables (DPH, DPB, translation tables and buffers), after the BIOS jump table
+const tablesBase = BIOSBase + 0x80
+
+// ErrNoRecord is returned when a record does not exist on the disk
+var ErrNoRecord = errors.New("record not found")
+
+// diskBIOS implements the BIOS disk functions on disk images
+type diskBIOS struct {
+	m     *Machine
+	disks []BootDisk
+	dph   []uint16 // address of the DPH of each disk
+
+	disk               int
+	track, sector, dma uint16
+}
+
+// Boot returns a machine that boots CP/M 2.2 from the system tracks of the disk in drive A:.
+// The CCP and BDOS are loaded to CCPBase, and the BIOS is implemented as traps on the jump table
+// at BIOSBase unless Native is set.
+func Boot(cfg BootConfig) (*Machine, error) {
+	if len(cfg.Disks) == 0 {
+		return nil, errors.New("no disk to boot from")
+	}
+
+	cpu := core.NewZ80()
+	m := &Machine{CPU: &cpu, BDOS: core.NewBDOS(cfg.Input, cfg.Output)}
+	cpu.IO = cfg.IO
+	cpu.Traps = make(map[uint16]core.Trap)
+
+	d := &diskBIOS{m: m, disks: cfg.Disks, dma: core.DefaultDMA}
+
+	if cfg.Native {
+		system := cfg.Disks[0]
+		records := 0
+		for t := 0; t < int(system.Format.DPB.OFF); t++ {
+			records += trackRecords(system.Disk, t)
+		}
+		if err := d.loadSystem(records - system.Format.BootSkip); err != nil {
+			return nil, err
+		}
+		cpu.IO = m.nativeIO(cfg)
+		*cpu.PC = BIOSBase
+		return m, nil
+	}
+
+	bios := consoleBIOS(m.BDOS)
+	bios[BiosConin] = func(z *core.Z80) {
+		c, ok := m.BDOS.ConsoleIn()
+		if !ok {
+			m.exit(z)
+		}
+		*z.A = c
+	}
+	bios[BiosBoot] = d.boot
+	bios[BiosWBoot] = d.wboot
+	bios[BiosHome] = func(z *core.Z80) { d.track = 0 }
+	bios[BiosSeldsk] = d.seldsk
+	bios[BiosSettrk] = func(z *core.Z80) { d.track = *z.BC }
+	bios[BiosSetsec] = func(z *core.Z80) { d.sector = *z.BC }
+	bios[BiosSetdma] = func(z *core.Z80) { d.dma = *z.BC }
+	bios[BiosRead] = d.read
+	bios[BiosWrite] = d.write
+	bios[BiosSectran] = func(z *core.Z80) {
+		if *z.DE == 0 {
+			*z.HL = *z.BC
+		} else {
+			*z.HL = uint16(z.Mem.Peek(*z.DE + *z.BC))
+		}
+	}
+	installBIOS(&cpu, BIOSBase, &bios)
+
+	if err := d.writeTables(); err != nil {
+		return nil, err
+	}
+
+	// start at the cold boot entry of the BIOS
+	*cpu.SP = TPA
+	*cpu.PC = BIOSBase
+	return m, nil
+}
+
+// nativeConsole is the SIO console of a native BIOS, which stops the machine when the BIOS polls
+// for input after the console input has ended
+type nativeConsole struct {
+	*z80io.SIO
+	input *z80io.Input
+	m     *Machine
+}
+
+func (c *nativeConsole) Read(port uint8) uint8 {
+	if port == z80io.SioACtrl && c.input.Ended() {
+		c.m.Stop()
+	}
+	return c.SIO.Read(port)
+}
+
+// nativeIO returns the devices of a native BIOS, which are the devices of the configuration with an
+// SIO for the console
+func (m *Machine) nativeIO(cfg BootConfig) z80io.Device {
+	input, ok := cfg.Input.(*z80io.Input)
+	if !ok {
+		r := cfg.Input
+		if r == nil {
+			r = strings.NewReader("")
+		}
+		input = z80io.NewInput(r)
+	}
+	bus := z80io.NewBus()
+	if cfg.IO != nil {
+		bus.Attach(0, 256, cfg.IO)
+	}
+	bus.Attach(z80io.SioBase, 4, &nativeConsole{SIO: z80io.NewSIO(input, cfg.Output), input: input, m: m})
+	return bus
+}
+
+// writeTables writes the disk parameter headers and their tables into memory after the BIOS
+func (d *diskBIOS) writeTables() error {
+	mem := d.m.CPU.Mem
+	next := uint32(tablesBase)
+	alloc := func(size int) uint16 {
+		addr := next
+		next += uint32(size)
+		return uint16(addr)
+	}
+
+	// a single directory buffer is shared by all disks
+	dirbuf := alloc(core.RecordSize)
+	for _, disk := range d.disks {
+		dpb := disk.Format.DPB
+		dph := alloc(16)
+		dpbAddr := alloc(15)
+		xlt := uint16(0)
+		if len(disk.Format.Skew) > 0 {
+			xlt = alloc(len(disk.Format.Skew))
+		}
+		csv := alloc(int(dpb.CKS))
+		alv := alloc(int(dpb.DSM)/8 + 1)
+		if next > 0x10000 {
+			return fmt.Errorf("disk tables for %d disks do not fit in memory", len(d.disks))
+		}
+
+		for i, b := range dpb.Bytes() {
+			mem.Poke(dpbAddr+uint16(i), b)
+		}
+		for i, b := range disk.Format.Skew {
+			mem.Poke(xlt+uint16(i), b)
+		}
+		for _, word := range []struct {
+			offset uint16
+			val    uint16
+		}{{0, xlt}, {2, 0}, {4, 0}, {6, 0}, {8, dirbuf}, {10, dpbAddr}, {12, csv}, {14, alv}} {
+			mem.PokeWord(dph+word.offset, word.val)
+		}
+		d.dph = append(d.dph, dph)
+	}
+	return nil
+}
+
+// trackRecords returns the number of 128 byte records on a CP/M track of the disk
+func trackRecords(disk *z80io.Disk, track int) int {
+	t := disk.Track(track/disk.Heads, track%disk.Heads)
+	if t == nil {
+		return 0
+	}
+	records := 0
+	for _, s := range t.Sectors {
+		records += len(s.Data) / core.RecordSize
+	}
+	return records
+}
+
+// locateRecord returns the physical sector and the offset within it of a record on a CP/M track.
+// Tracks alternate between the heads of double sided disks.
+func locateRecord(disk *z80io.Disk, track, record int) (*z80io.Sector, int, error) {
+	t := disk.Track(track/disk.Heads, track%disk.Heads)
+	if t == nil || len(t.Sectors) == 0 {
+		return nil, 0, fmt.Errorf("track %d: %w", track, ErrNoRecord)
+	}
+
+	perSector := len(t.Sectors[0].Data) / core.RecordSize
+	firstID := t.Sectors[0].ID
+	for _, s := range t.Sectors {
+		if s.ID < firstID {
+			firstID = s.ID
+		}
+	}
+	id := int(firstID) + record/perSector
+	for _, s := range t.Sectors {
+		if int(s.ID) == id && len(s.Data) == perSector*core.RecordSize {
+			return s, (record % perSector) * core.RecordSize, nil
+		}
+	}
+	return nil, 0, fmt.Errorf("track %d record %d: %w", track, record, ErrNoRecord)
+}
+
+// loadSystem loads records from the start of the system tracks of drive A: to CCPBase
+func (d *diskBIOS) loadSystem(count int) error {
+	system := d.disks[0]
+	addr := uint16(CCPBase)
+	track, record := 0, system.Format.BootSkip
+	for i := 0; i < count; i++ {
+		for record >= trackRecords(system.Disk, track) {
+			record -= trackRecords(system.Disk, track)
+			track++
+			if track >= system.Disk.Cylinders*system.Disk.Heads {
+				return fmt.Errorf("loading system: %w", ErrNoRecord)
+			}
+		}
+		s, offset, err := locateRecord(system.Disk, track, record)
+		if err != nil {
+			return fmt.Errorf("loading system: %w", err)
+		}
+		for j := 0; j < core.RecordSize; j++ {
+			d.m.CPU.Mem.Poke(addr, s.Data[offset+j])
+			addr++
+		}
+		record++
+	}
+	return nil
+}
+
+// boot is the cold boot trap
+func (d *diskBIOS) boot(z *core.Z80) {
+	z.Mem.Poke(iobyteAddr, 0)
+	z.Mem.Poke(driveUserAddr, 0)
+	d.gocpm(z)
+}
+
+// wboot is the warm boot trap, which reloads the CCP and BDOS
+func (d *diskBIOS) wboot(z *core.Z80) {
+	d.gocpm(z)
+}
+
+// gocpm loads the CCP and BDOS, sets up page zero and starts the CCP
+func (d *diskBIOS) gocpm(z *core.Z80) {
+	if err := d.loadSystem(d.disks[0].Format.SystemRecords); err != nil {
+		log.Printf("BIOS: %v", err)
+		d.m.exit(z)
+		return
+	}
+	z.Mem.Poke(warmBootVector, 0xC3) // JP WBOOT
+	z.Mem.PokeWord(warmBootVector+1, BIOSBase+3)
+	z.Mem.Poke(bdosVector, 0xC3) // JP BDOS
+	z.Mem.PokeWord(bdosVector+1, BDOSBase+6)
+	d.dma = core.DefaultDMA
+
+	// the CCP expects the current drive and user in C
+	*z.C = z.Mem.Peek(driveUserAddr)
+	*z.SP = TPA
+	*z.PC = CCPBase
+}
+
+func (d *diskBIOS) seldsk(z *core.Z80) {
+	disk := int(*z.C)
+	if disk >= len(d.disks) {
+		*z.HL = 0
+		return
+	}
+	d.disk = disk
+	*z.HL = d.dph[disk]
+}
+
+// record returns the sector and offset for the current track and sector
+func (d *diskBIOS) record() (*z80io.Sector, int, error) {
+	disk := d.disks[d.disk]
+	sector := int(d.sector)
+	if len(disk.Format.Skew) > 0 {
+		sector-- // translated sectors start at 1
+	}
+	return locateRecord(disk.Disk, int(d.track), sector)
+}
+
+func (d *diskBIOS) read(z *core.Z80) {
+	s, offset, err := d.record()
+	if err != nil {
+		*z.A = 1
+		return
+	}
+	for i := 0; i < core.RecordSize; i++ {
+		z.Mem.Poke(d.dma+uint16(i), s.Data[offset+i])
+	}
+	*z.A = 0
+}
+
+func (d *diskBIOS) write(z *core.Z80) {
+	s, offset, err := d.record()
+	if err != nil || d.disks[d.disk].Disk.WriteProtected {
+		*z.A = 1
+		return
+	}
+	for i := 0; i < core.RecordSize; i++ {
+		s.Data[offset+i] = z.Mem.Peek(d.dma + uint16(i))
+	}
+	*z.A = 0
+}
@@ -0,0 +1,134 @@
+package cpm
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	z80io "github.com/antbern/z80-emulator/io"
+)
+
+// newBootDisk returns a formatted ibm-8-sssd disk with the program as the CCP in the system tracks
+func newBootDisk(t *testing.T, program []byte) BootDisk {
+	g, ok := z80io.LookupGeometry("ibm-8-sssd")
+	if !ok {
+		t.Fatal("ibm-8-sssd geometry not found")
+	}
+	format, ok := LookupDiskFormat("ibm-8-sssd")
+	if !ok {
+		t.Fatal("ibm-8-sssd disk format not found")
+	}
+	disk := z80io.NewDisk(g)
+
+	// the system starts after the cold start loader in the first sector
+	copy(disk.Track(0, 0).Sectors[1].Data, program)
+	return BootDisk{Disk: disk, Format: format}
+}
+
+func TestBoot(t *testing.T) {
+	program := []byte{
+		0x0E, 'X', // LD C, 'X'
+		0xCD, 0x0C, 0xFA, // CALL CONOUT
+		0x0E, 0x00, // LD C, 0
+		0xCD, 0x1B, 0xFA, // CALL SELDSK
+		0x01, 0x02, 0x00, // LD BC, 2
+		0xCD, 0x1E, 0xFA, // CALL SETTRK
+		0x01, 0x01, 0x00, // LD BC, 1
+		0xCD, 0x21, 0xFA, // CALL SETSEC
+		0x01, 0x00, 0x80, // LD BC, 0x8000
+		0xCD, 0x24, 0xFA, // CALL SETDMA
+		0xCD, 0x27, 0xFA, // CALL READ
+		0x01, 0x02, 0x00, // LD BC, 2
+		0xCD, 0x21, 0xFA, // CALL SETSEC
+		0xCD, 0x2A, 0xFA, // CALL WRITE
+		0xCD, 0x09, 0xFA, // CALL CONIN, ends the machine at the end of the input
+	}
+	disk := newBootDisk(t, program)
+	directory := disk.Disk.Track(2, 0)
+	for i := range directory.Sectors[0].Data {
+		directory.Sectors[0].Data[i] = 0x42
+	}
+
+	out := &bytes.Buffer{}
+	m, err := Boot(BootConfig{Input: strings.NewReader(""), Output: out, Disks: []BootDisk{disk}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	if out.String() != "X" {
+		t.Errorf("Unexpected console output %q", out.String())
+	}
+	mem := m.CPU.Mem
+	dph := *m.CPU.HL
+	if dph < tablesBase || mem.PeekWord(dph) == 0 {
+		t.Errorf("SELDSK returned DPH %#04x without a translation table", dph)
+	}
+	if spt := mem.PeekWord(mem.PeekWord(dph + 10)); spt != 26 {
+		t.Errorf("DPB has %d records per track, want 26", spt)
+	}
+	if mem.Peek(0x8000) != 0x42 || mem.Peek(0x807F) != 0x42 {
+		t.Errorf("READ did not load the record to the DMA address")
+	}
+	if directory.Sectors[1].Data[0] != 0x42 {
+		t.Errorf("WRITE did not store the record on the disk")
+	}
+	if mem.PeekWord(bdosVector+1) != BDOSBase+6 {
+		t.Errorf("Page zero not set up by the cold boot")
+	}
+}
+
+func TestBootSelectMissingDisk(t *testing.T) {
+	program := []byte{
+		0x0E, 0x01, // LD C, 1
+		0xCD, 0x1B, 0xFA, // CALL SELDSK
+		0xCD, 0x09, 0xFA, // CALL CONIN
+	}
+	m, err := Boot(BootConfig{Disks: []BootDisk{newBootDisk(t, program)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if *m.CPU.HL != 0 {
+		t.Errorf("SELDSK of a missing drive returned %#04x, want 0", *m.CPU.HL)
+	}
+}
+
+func TestBootNative(t *testing.T) {
+	// a BIOS that prints X and echoes the console input through the SIO
+	bios := []byte{
+		0x3E, 'X', // LD A, 'X'
+		0xD3, 0x20, // OUT (SIO_A_DATA), A
+		0xDB, 0x22, // loop: IN A, (SIO_A_CTRL)
+		0xE6, 0x01, // AND 1
+		0x28, 0xFA, // JR Z, loop
+		0xDB, 0x20, // IN A, (SIO_A_DATA)
+		0xD3, 0x20, // OUT (SIO_A_DATA), A
+		0x18, 0xF4, // JR loop
+	}
+	disk := newBootDisk(t, nil)
+
+	// the BIOS is loaded from the record after the cold start loader and the CCP and BDOS
+	record := 1 + (BIOSBase-CCPBase)/128
+	for _, s := range disk.Disk.Track(record/26, 0).Sectors {
+		if int(s.ID) == record%26+1 {
+			copy(s.Data, bios)
+		}
+	}
+
+	out := &bytes.Buffer{}
+	m, err := Boot(BootConfig{Input: strings.NewReader("hi\n"), Output: out, Disks: []BootDisk{disk}, Native: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "Xhi\r" {
+		t.Errorf("Unexpected console output %q", out.String())
+	}
+}
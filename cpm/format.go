@@ -0,0 +1,59 @@
+package cpm
+
+// DPB is a CP/M 2.2 Disk Parameter Block, describing the layout of the file system on a disk
+type DPB struct {
+	SPT           uint16 // 128 byte records per track
+	BSH, BLM, EXM uint8  // block shift, block mask and extent mask
+	DSM           uint16 // number of the last block on the disk
+	DRM           uint16 // number of the last directory entry
+	AL0, AL1      uint8  // directory allocation bitmap
+	CKS           uint16 // size of the directory check vector
+	OFF           uint16 // number of reserved (system) tracks
+}
+
+// Bytes returns the DPB in the 15 byte form used in memory
+func (d DPB) Bytes() []uint8 {
+	return []uint8{
+		uint8(d.SPT), uint8(d.SPT >> 8), d.BSH, d.BLM, d.EXM,
+		uint8(d.DSM), uint8(d.DSM >> 8), uint8(d.DRM), uint8(d.DRM >> 8),
+		d.AL0, d.AL1, uint8(d.CKS), uint8(d.CKS >> 8), uint8(d.OFF), uint8(d.OFF >> 8),
+	}
+}
+
+// DiskFormat describes how CP/M uses a disk with a certain geometry
+type DiskFormat struct {
+	// Geometry is the name of the physical format in the io package geometry table
+	Geometry string
+	DPB      DPB
+
+	// Skew is the sector translation table used by SECTRAN. Translated sectors start at 1, while
+	// sectors without translation start at 0.
+	Skew []uint8
+
+	// BootSkip is the number of records at the start of the disk before the CCP and BDOS, usually
+	// the cold start loader. SystemRecords is the number of records holding the CCP and BDOS.
+	BootSkip, SystemRecords int
+}
+
+// ibmSkew is the standard sector skew factor 6 table for 8" single density disks
+var ibmSkew = []uint8{1, 7, 13, 19, 25, 5, 11, 17, 23, 3, 9, 15, 21, 2, 8, 14, 20, 26, 6, 12, 18, 24, 4, 10, 16, 22}
+
+// DiskFormats is a table of CP/M file system layouts for the known disk geometries
+var DiskFormats = []DiskFormat{
+	{Geometry: "ibm-8-sssd", DPB: DPB{SPT: 26, BSH: 3, BLM: 7, EXM: 0, DSM: 242, DRM: 63, AL0: 0xC0, AL1: 0, CKS: 16, OFF: 2},
+		Skew: ibmSkew, BootSkip: 1, SystemRecords: 44},
+	{Geometry: "kaypro2", DPB: DPB{SPT: 40, BSH: 3, BLM: 7, EXM: 0, DSM: 194, DRM: 63, AL0: 0xF0, AL1: 0, CKS: 16, OFF: 1},
+		BootSkip: 1, SystemRecords: 44},
+	{Geometry: "osborne1-dd", DPB: DPB{SPT: 40, BSH: 4, BLM: 15, EXM: 1, DSM: 184, DRM: 63, AL0: 0x80, AL1: 0, CKS: 16, OFF: 3},
+		BootSkip: 1, SystemRecords: 44},
+}
+
+// LookupDiskFormat returns the CP/M disk format for the named geometry
+func LookupDiskFormat(geometry string) (DiskFormat, bool) {
+	for _, f := range DiskFormats {
+		if f.Geometry == geometry {
+			return f, true
+		}
+	}
+	return DiskFormat{}, false
+}
@@ -0,0 +1,224 @@
+package cpm
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync/atomic"
+
+	"github.com/antbern/z80-emulator/core"
+	z80io "github.com/antbern/z80-emulator/io"
+)
+
+// The memory map of a 64K CP/M 2.2 system. Only the BDOS entry point and the BIOS jump table exist
+// in memory, the rest of the system is implemented as traps.
+const (
+	// TPA is the start of the Transient Program Area where .COM files are loaded
+	TPA = 0x0100
+	// CCPBase is where the CCP would normally be loaded. Programs may overwrite it.
+	CCPBase = 0xE400
+	// BDOSBase is the start of the BDOS. The top of the TPA is the BDOS entry point, BDOSBase + 6.
+	BDOSBase = 0xEC00
+	// BIOSBase is the address of the BIOS jump table
+	BIOSBase = 0xFA00
+)
+
+// addresses in page zero
+const (
+	warmBootVector = 0x0000
+	iobyteAddr     = 0x0003
+	driveUserAddr  = 0x0004
+	bdosVector     = 0x0005
+	fcb1Addr       = 0x005C
+	fcb2Addr       = 0x006C
+	tailAddr       = 0x0080
+)
+
+// Config contains the settings for a CP/M machine
+type Config struct {
+	// Input and Output is the console
+	Input  io.Reader
+	Output io.Writer
+
+	// Drives maps the drives A: to P: to host directories
+	Drives [16]string
+
+	// IO is an optional device for IN and OUT instructions
+	IO z80io.Device
+}
+
+// Machine is a Z80 set up to run CP/M programs, with page zero, a trapped BDOS and a trapped BIOS
+type Machine struct {
+	CPU  *core.Z80
+	BDOS *core.BDOS
+
+	exited   bool
+	exitCode int
+
+	// stopped is set by Stop
+	stopped int32
+}
+
+// ErrHalted is returned by Run if the CPU executes HALT, since there are no interrupts in the CP/M
+// machine to resume execution
+var ErrHalted = errors.New("CPU halted")
+
+// NewMachine returns a new CP/M machine with page zero, the BDOS and the BIOS set up
+func NewMachine(cfg Config) *Machine {
+	cpu := core.NewZ80()
+	m := &Machine{CPU: &cpu, BDOS: core.NewBDOS(cfg.Input, cfg.Output)}
+	m.BDOS.Drives = cfg.Drives
+	cpu.BDOS = m.BDOS
+	cpu.IO = cfg.IO
+	cpu.Traps = make(map[uint16]core.Trap)
+
+	// the BDOS entry point, with a serial number in the first 6 bytes
+	bdosEntry := uint16(BDOSBase + 6)
+	cpu.Mem.Poke(bdosEntry, 0xC9) // RET, in case the trap is removed
+	cpu.Traps[bdosEntry] = func(z *core.Z80) {
+		z.HandleBDOS()
+		if *z.PC == bdosEntry {
+			z.Ret()
+		}
+	}
+
+	// a warm boot through the BIOS or a jump to 0 ends the program
+	bios := consoleBIOS(m.BDOS)
+	bios[BiosBoot] = m.exit
+	bios[BiosWBoot] = m.exit
+	installBIOS(&cpu, BIOSBase, &bios)
+	cpu.Traps[warmBootVector] = m.exit
+
+	m.resetPageZero()
+	return m
+}
+
+// resetPageZero writes the jump instructions and system variables of page zero
+func (m *Machine) resetPageZero() {
+	mem := m.CPU.Mem
+	mem.Poke(warmBootVector, 0xC3) // JP WBOOT
+	mem.PokeWord(warmBootVector+1, BIOSBase+3)
+	mem.Poke(iobyteAddr, 0)
+	mem.Poke(driveUserAddr, 0)
+	mem.Poke(bdosVector, 0xC3) // JP BDOS
+	mem.PokeWord(bdosVector+1, BDOSBase+6)
+}
+
+// exit is the trap for warm boots, which ends the program
+func (m *Machine) exit(z *core.Z80) {
+	m.exited = true
+	m.exitCode = ExitStatus(m.BDOS.ReturnCode)
+}
+
+// ExitStatus converts a CP/M 3 program return code (BDOS function 108) to a host exit status.
+// Codes from 0xFF00 to 0xFFFE indicate failure and return 1, 0xFFFF indicates a fatal error and
+// returns 2. All other codes indicate success.
+func ExitStatus(code uint16) int {
+	switch {
+	case code == 0xFFFF:
+		return 2
+	case code >= 0xFF00:
+		return 1
+	}
+	return 0
+}
+
+// LoadCOM loads a .COM program from the host file at path, with the arguments as its command tail
+func (m *Machine) LoadCOM(path string, args []string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return m.LoadCOMData(data, args)
+}
+
+// LoadCOMData loads a .COM program into the TPA and prepares to run it like the CCP does: the
+// command tail and the two default FCBs are filled in from the arguments, the DMA is set to the
+// command tail and the stack holds a return address to the warm boot vector.
+func (m *Machine) LoadCOMData(data []byte, args []string) error {
+	if len(data) > BDOSBase-TPA {
+		return fmt.Errorf("program is too large for the TPA (%d bytes, max %d)", len(data), BDOSBase-TPA)
+	}
+	m.CPU.Mem.Write(TPA, &data)
+	m.resetPageZero()
+	m.BDOS.Reset()
+	m.exited = false
+	m.exitCode = 0
+
+	// the command tail is upper case and starts with a space
+	tail := ""
+	if len(args) > 0 {
+		tail = " " + strings.ToUpper(strings.Join(args, " "))
+	}
+	if len(tail) > 127 {
+		tail = tail[:127]
+	}
+	m.CPU.Mem.Poke(tailAddr, uint8(len(tail)))
+	for i := 0; i < len(tail); i++ {
+		m.CPU.Mem.Poke(tailAddr+1+uint16(i), tail[i])
+	}
+	m.CPU.Mem.Poke(tailAddr+1+uint16(len(tail)), 0)
+
+	// the default FCBs hold the first two arguments parsed as file names
+	m.setFCB(fcb1Addr, args, 0)
+	m.setFCB(fcb2Addr, args, 1)
+
+	// the stack starts below the BDOS with a return address to the warm boot vector
+	*m.CPU.SP = BDOSBase
+	*m.CPU.SP -= 2
+	m.CPU.Mem.PokeWord(*m.CPU.SP, warmBootVector)
+	*m.CPU.PC = TPA
+	return nil
+}
+
+// setFCB fills in the default FCB at addr from argument i
+func (m *Machine) setFCB(addr uint16, args []string, i int) {
+	spec := ""
+	if i < len(args) {
+		spec = args[i]
+	}
+	drive, name := core.ParseFileName(spec)
+
+	// the second FCB overlaps the first one, so only clear the part up to the random record fields
+	length := uint16(16)
+	if addr == fcb1Addr {
+		length = 36
+	}
+	for j := uint16(0); j < length; j++ {
+		m.CPU.Mem.Poke(addr+j, 0)
+	}
+	m.CPU.Mem.Poke(addr, drive)
+	for j := 0; j < 11; j++ {
+		m.CPU.Mem.Poke(addr+1+uint16(j), name[j])
+	}
+}
+
+// Exited returns true and the exit status if the program has ended
+func (m *Machine) Exited() (bool, int) {
+	return m.exited, m.exitCode
+}
+
+// Step executes a single instruction of the program
+func (m *Machine) Step() {
+	m.CPU.Step()
+}
+
+// Stop ends Run after the current instruction. It may be called from another goroutine, such as on
+// an interrupt, and ends machines that have no trapped exit, such as those running a native BIOS.
+func (m *Machine) Stop() {
+	atomic.StoreInt32(&m.stopped, 1)
+}
+
+// Run executes the program until it ends or Stop is called, and returns its exit status
+func (m *Machine) Run() (int, error) {
+	defer m.BDOS.Close()
+	for !m.exited && atomic.LoadInt32(&m.stopped) == 0 {
+		if m.CPU.Halted {
+			return 0, fmt.Errorf("%w at %#04x", ErrHalted, *m.CPU.PC-1)
+		}
+		m.CPU.Step()
+	}
+	return m.exitCode, nil
+}
@@ -0,0 +1,82 @@
+package cpm
+
+import (
+	"bytes"
+	"testing"
+)
+
+func runProgram(t *testing.T, program []byte, args []string) (*Machine, string, int) {
+	out := &bytes.Buffer{}
+	m := NewMachine(Config{Output: out})
+	if err := m.LoadCOMData(program, args); err != nil {
+		t.Fatal(err)
+	}
+	code, err := m.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m, out.String(), code
+}
+
+func TestRunCOM(t *testing.T) {
+	program := []byte{
+		0x0E, 0x09, // LD C, 9
+		0x11, 0x0A, 0x01, // LD DE, msg
+		0xCD, 0x05, 0x00, // CALL 5
+		0xC9,          // RET
+		0x00,          // padding
+		'h', 'i', '$', // msg
+	}
+
+	m, out, code := runProgram(t, program, []string{"b:file.txt", "*.com"})
+	if out != "hi" || code != 0 {
+		t.Errorf("Expected output \"hi\" and exit status 0, got %q and %d", out, code)
+	}
+
+	mem := m.CPU.Mem
+	if top := mem.PeekWord(0x0006); top != BDOSBase+6 {
+		t.Errorf("Expected top of TPA %#04x, got %#04x", BDOSBase+6, top)
+	}
+	if wboot := mem.PeekWord(0x0001); wboot != BIOSBase+3 {
+		t.Errorf("Expected warm boot vector %#04x, got %#04x", BIOSBase+3, wboot)
+	}
+
+	tail := make([]byte, mem.Peek(tailAddr))
+	for i := range tail {
+		tail[i] = mem.Peek(tailAddr + 1 + uint16(i))
+	}
+	if string(tail) != " B:FILE.TXT *.COM" {
+		t.Errorf("Unexpected command tail %q", tail)
+	}
+	if mem.Peek(fcb1Addr) != 2 || mem.Peek(fcb1Addr+1) != 'F' || mem.Peek(fcb1Addr+9) != 'T' {
+		t.Errorf("First FCB not filled in from the first argument")
+	}
+	if mem.Peek(fcb2Addr) != 0 || mem.Peek(fcb2Addr+1) != '?' || mem.Peek(fcb2Addr+9) != 'C' {
+		t.Errorf("Second FCB not filled in from the second argument")
+	}
+}
+
+func TestExitStatus(t *testing.T) {
+	program := []byte{
+		0x0E, 0x6C, // LD C, 108
+		0x11, 0x00, 0xFF, // LD DE, 0xFF00
+		0xCD, 0x05, 0x00, // CALL 5
+		0xC3, 0x00, 0x00, // JP 0
+	}
+	if _, _, code := runProgram(t, program, nil); code != 1 {
+		t.Errorf("Expected exit status 1, got %d", code)
+	}
+}
+
+func TestBIOSConsole(t *testing.T) {
+	program := []byte{
+		0x2A, 0x01, 0x00, // LD HL, (1) - address of WBOOT
+		0x0E, 'X', // LD C, 'X'
+		0x11, 0x09, 0x00, // LD DE, 9 - offset from WBOOT to CONOUT
+		0x19, // ADD HL, DE
+		0xE9, // JP (HL), with the return address to the warm boot vector on the stack
+	}
+	if _, out, _ := runProgram(t, program, nil); out != "X" {
+		t.Errorf("Expected BIOS CONOUT to print \"X\", got %q", out)
+	}
+}
@@ -0,0 +1,29 @@
+package debugger
+
+// cmdBacktrace prints the routines on the call stack of the CPU, innermost first, and the recent
+// returns that did not match it
+func (d *Debugger) cmdBacktrace(args []string) error {
+	calls := d.CPU.Calls
+	d.printf("#0  %v\n", d.CPU.FormatAddr(*d.CPU.PC))
+	for i := len(calls.Frames) - 1; i >= 0; i-- {
+		f := calls.Frames[i]
+		d.printf("#%-2d %v  %v %v, returns to %v", len(calls.Frames)-i, d.CPU.FormatAddr(f.Caller), f.Kind, d.CPU.FormatAddr(f.Entry), d.CPU.FormatAddr(f.Return))
+		if got := d.CPU.Mem.PeekWord(f.SP); got != f.Return {
+			d.printf(", but SP %#04x has %v", f.SP, d.CPU.FormatAddr(got))
+		}
+		d.printf("\n")
+	}
+	if len(calls.Mismatches) == 0 {
+		return nil
+	}
+	d.printf("Returns that did not match a call, which likely means the stack was corrupted:\n")
+	for _, m := range calls.Mismatches {
+		d.printf("  %v returned to %v from SP %#04x", d.CPU.FormatAddr(m.PC), d.CPU.FormatAddr(m.To), m.SP)
+		if m.Frame != nil {
+			d.printf(", but the %v at %v pushed %v\n", m.Frame.Kind, d.CPU.FormatAddr(m.Frame.Caller), d.CPU.FormatAddr(m.Frame.Return))
+		} else {
+			d.printf(", which no call pushed\n")
+		}
+	}
+	return nil
+}
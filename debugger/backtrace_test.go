@@ -0,0 +1,51 @@
+package debugger
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestBacktrace(t *testing.T) {
+	d, out := newDebugger("b sub\nc\nbt\n")
+	d.Run()
+	want := "#0  0x000b <sub>\n#1  0x0005 <loop>  CALL 0x000b <sub>, returns to 0x0008 <loop+3>\n"
+	if !strings.Contains(out.String(), want) {
+		t.Errorf("Expected the backtrace %q:\n%v", want, out)
+	}
+}
+
+func TestBacktraceMismatch(t *testing.T) {
+	// a routine that overwrites its return address, and returns to the address in HL
+	d, out := newDebuggerFor("o $0E\nbt\n",
+		"LD SP,$8000",
+		"CALL sub", // 0003
+		"HALT",     // 0006
+		"sub: LD HL,$0D",
+		"EX (SP),HL", // 000A
+		"RET",        // 000B
+		"HALT",       // 000C
+		"NOP",        // 000D
+		"LD HL,$0C",  // 000E
+		"PUSH HL",
+		"RET", // 0012
+	)
+	d.Run()
+	for _, want := range []string{
+		"#0  0x000e\n",
+		"0x000b returned to 0x000d from SP 0x7ffe, but the CALL at 0x0003 pushed 0x0006\n",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("Expected %q in the backtrace:\n%v", want, out)
+		}
+	}
+	if strings.Contains(out.String(), "#1") {
+		t.Errorf("Expected no frames after the return:\n%v", out)
+	}
+
+	out.Reset()
+	d.Execute("n 3")
+	d.Execute("bt")
+	if want := "0x0012 returned to 0x000c from SP 0x7ffe, which no call pushed\n"; !strings.Contains(out.String(), want) {
+		t.Errorf("Expected %q in the backtrace:\n%v", want, out)
+	}
+}
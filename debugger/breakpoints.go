@@ -0,0 +1,347 @@
+package debugger
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/antbern/z80-emulator/asm"
+)
+
+// Breakpoint stops the program before the instruction at an address is executed, or when its
+// condition becomes true if it is global
+type Breakpoint struct {
+	ID      int
+	Addr    uint16
+	Enabled bool
+
+	// Global breakpoints have no address and check their condition after every instruction. They stop
+	// the program when the condition becomes true rather than while it stays true.
+	Global bool
+
+	// Cond is the condition for stopping, or nil to always stop
+	Cond *asm.Expr
+
+	// Ignore is the number of hits to ignore before stopping
+	Ignore int
+
+	// Hits counts how many times the breakpoint was reached with its condition true, including the
+	// ignored hits
+	Hits int
+
+	// active is set while the condition of a global breakpoint is true
+	active bool
+}
+
+// AddBreakpoint adds an enabled breakpoint at an address
+func (d *Debugger) AddBreakpoint(addr uint16) *Breakpoint {
+	bp := &Breakpoint{ID: d.nextID, Addr: addr, Enabled: true}
+	d.nextID++
+	d.breakpoints = append(d.breakpoints, bp)
+	return bp
+}
+
+// AddGlobalBreakpoint adds an enabled breakpoint without an address that stops the program when its
+// condition becomes true
+func (d *Debugger) AddGlobalBreakpoint(cond string) (*Breakpoint, error) {
+	x, active, err := d.condition(cond)
+	if err != nil {
+		return nil, err
+	}
+	bp := d.AddBreakpoint(0)
+	bp.Global, bp.Cond, bp.active = true, x, active
+	return bp, nil
+}
+
+// SetCondition sets the condition of a breakpoint, or removes it if cond is empty
+func (d *Debugger) SetCondition(bp *Breakpoint, cond string) error {
+	if strings.TrimSpace(cond) == "" {
+		if bp.Global {
+			return errors.New("a breakpoint without an address needs a condition")
+		}
+		bp.Cond = nil
+		return nil
+	}
+	x, active, err := d.condition(cond)
+	if err != nil {
+		return err
+	}
+	bp.Cond, bp.active = x, active
+	return nil
+}
+
+// condition parses a condition and returns whether it is true now. Undefined symbols are reported
+// early by this first evaluation.
+func (d *Debugger) condition(cond string) (*asm.Expr, bool, error) {
+	x, err := d.compile(cond)
+	if err != nil {
+		return nil, false, err
+	}
+	v, err := d.evalExpr(x)
+	if errors.Is(err, asm.ErrUndefined) {
+		return nil, false, err
+	}
+	return x, err == nil && v != 0, nil
+}
+
+// Breakpoints returns the breakpoints in the order they were added
+func (d *Debugger) Breakpoints() []*Breakpoint {
+	return d.breakpoints
+}
+
+// RemoveBreakpoint removes a breakpoint
+func (d *Debugger) RemoveBreakpoint(bp *Breakpoint) {
+	for i, b := range d.breakpoints {
+		if b == bp {
+			d.breakpoints = append(d.breakpoints[:i], d.breakpoints[i+1:]...)
+			return
+		}
+	}
+}
+
+// hitBreakpoint returns the first enabled breakpoint that stops the program at the PC and counts the
+// hit, or nil if there is none. A condition that fails to evaluate stops the program with the error.
+func (d *Debugger) hitBreakpoint() (*Breakpoint, error) {
+	var hit *Breakpoint
+	for _, bp := range d.breakpoints {
+		if !bp.Enabled || !bp.Global && bp.Addr != *d.CPU.PC {
+			continue
+		}
+		if bp.Cond != nil {
+			v, err := d.evalExpr(bp.Cond)
+			if err != nil {
+				return bp, err
+			}
+			// global breakpoints are checked for every instruction, so only count changes
+			wasActive := bp.active
+			bp.active = v != 0
+			if v == 0 || bp.Global && wasActive {
+				continue
+			}
+		}
+		bp.Hits++
+		if bp.Ignore > 0 {
+			bp.Ignore--
+			continue
+		}
+		if hit == nil {
+			hit = bp
+		}
+	}
+	return hit, nil
+}
+
+// describe returns the location of a breakpoint, with the address of a global breakpoint given by
+// pc, and its condition
+func (d *Debugger) describe(bp *Breakpoint, pc uint16) string {
+	s := "at " + d.CPU.FormatAddr(pc)
+	if bp.Cond != nil {
+		s += " if " + bp.Cond.String()
+	}
+	return s
+}
+
+// parseBreakpoint adds a breakpoint from the arguments "addr", "addr if cond" or "if cond"
+func (d *Debugger) parseBreakpoint(args []string) (*Breakpoint, error) {
+	var cond string
+	for i, arg := range args {
+		if strings.EqualFold(arg, "if") {
+			cond = strings.Join(args[i+1:], " ")
+			if cond == "" {
+				return nil, errors.New("expected a condition after if")
+			}
+			args = args[:i]
+			break
+		}
+	}
+
+	switch {
+	case len(args) == 0 && cond != "":
+		return d.AddGlobalBreakpoint(cond)
+	case len(args) != 1:
+		return nil, usage("b")
+	}
+	addr, err := d.address(args[0])
+	if err != nil {
+		return nil, err
+	}
+	var x *asm.Expr
+	if cond != "" {
+		if x, _, err = d.condition(cond); err != nil {
+			return nil, err
+		}
+	}
+	bp := d.AddBreakpoint(addr)
+	bp.Cond = x
+	return bp, nil
+}
+
+// breakpoint returns the breakpoint with an id given as an argument
+func (d *Debugger) breakpoint(arg string) (*Breakpoint, error) {
+	id, err := strconv.Atoi(arg)
+	if err != nil {
+		return nil, fmt.Errorf("expected a breakpoint number, got %q", arg)
+	}
+	for _, bp := range d.breakpoints {
+		if bp.ID == id {
+			return bp, nil
+		}
+	}
+	return nil, fmt.Errorf("no breakpoint %d", id)
+}
+
+func (d *Debugger) cmdBreak(args []string) error {
+	if len(args) == 0 {
+		if len(d.breakpoints) == 0 {
+			d.printf("No breakpoints\n")
+		}
+		for _, bp := range d.breakpoints {
+			state := ""
+			if bp.Ignore > 0 {
+				state += fmt.Sprintf(", ignoring the next %d", bp.Ignore)
+			}
+			if !bp.Enabled {
+				state += " (disabled)"
+			}
+			where := "anywhere"
+			if !bp.Global {
+				where = d.CPU.FormatAddr(bp.Addr)
+			}
+			if bp.Cond != nil {
+				where += " if " + bp.Cond.String()
+			}
+			d.printf("%d: %v, hit %d times%v\n", bp.ID, where, bp.Hits, state)
+		}
+		return nil
+	}
+	bp, err := d.parseBreakpoint(args)
+	if err != nil {
+		return err
+	}
+	if bp.Global {
+		d.printf("Breakpoint %d if %v\n", bp.ID, bp.Cond)
+	} else {
+		d.printf("Breakpoint %d %v\n", bp.ID, d.describe(bp, bp.Addr))
+	}
+	return nil
+}
+
+func (d *Debugger) cmdDelete(args []string) error {
+	if len(args) != 1 {
+		return usage("d")
+	}
+	if strings.EqualFold(args[0], "all") {
+		d.breakpoints, d.watchpoints, d.ports = nil, nil, nil
+		d.updateWatches()
+		return nil
+	}
+	// a number is the id of any kind of breakpoint, anything else is an address
+	if id, err := strconv.Atoi(args[0]); err == nil {
+		if !d.forID(id, d.RemoveBreakpoint, d.RemoveWatchpoint, d.RemovePortBreakpoint) {
+			return fmt.Errorf("no breakpoint %d", id)
+		}
+		return nil
+	}
+	addr, err := d.address(args[0])
+	if err != nil {
+		return err
+	}
+	found := false
+	for _, bp := range append([]*Breakpoint{}, d.breakpoints...) {
+		if !bp.Global && bp.Addr == addr {
+			d.RemoveBreakpoint(bp)
+			found = true
+		}
+	}
+	if !found {
+		return fmt.Errorf("no breakpoint at %v", d.CPU.FormatAddr(addr))
+	}
+	return nil
+}
+
+func (d *Debugger) cmdCond(args []string) error {
+	if len(args) < 1 {
+		return usage("cond")
+	}
+	bp, err := d.breakpoint(args[0])
+	if err != nil {
+		return err
+	}
+	return d.SetCondition(bp, strings.Join(args[1:], " "))
+}
+
+func (d *Debugger) cmdIgnore(args []string) error {
+	if len(args) != 2 {
+		return usage("ignore")
+	}
+	bp, err := d.breakpoint(args[0])
+	if err != nil {
+		return err
+	}
+	n, err := d.eval(args[1])
+	if err != nil {
+		return err
+	}
+	if n < 0 {
+		return fmt.Errorf("the count must not be negative")
+	}
+	bp.Ignore = n
+	return nil
+}
+
+// forID calls the function for the kind of breakpoint with an id, returning false if there is none
+func (d *Debugger) forID(id int, bpFunc func(*Breakpoint), wpFunc func(*Watchpoint), pbFunc func(*PortBreakpoint)) bool {
+	for _, bp := range d.breakpoints {
+		if bp.ID == id {
+			bpFunc(bp)
+			return true
+		}
+	}
+	for _, wp := range d.watchpoints {
+		if wp.ID == id {
+			wpFunc(wp)
+			return true
+		}
+	}
+	for _, pb := range d.ports {
+		if pb.ID == id {
+			pbFunc(pb)
+			return true
+		}
+	}
+	return false
+}
+
+// enable enables or disables the breakpoints of all kinds given by the arguments
+func (d *Debugger) enable(args []string, enabled bool) error {
+	if len(args) == 0 {
+		return fmt.Errorf("expected breakpoint numbers or all")
+	}
+	defer d.updateWatches()
+	bpFunc := func(bp *Breakpoint) { bp.Enabled = enabled }
+	wpFunc := func(wp *Watchpoint) { wp.Enabled = enabled }
+	pbFunc := func(pb *PortBreakpoint) { pb.Enabled = enabled }
+	if len(args) == 1 && strings.EqualFold(args[0], "all") {
+		for _, bp := range d.breakpoints {
+			bpFunc(bp)
+		}
+		for _, wp := range d.watchpoints {
+			wpFunc(wp)
+		}
+		for _, pb := range d.ports {
+			pbFunc(pb)
+		}
+		return nil
+	}
+	for _, arg := range args {
+		id, err := strconv.Atoi(arg)
+		if err != nil {
+			return fmt.Errorf("expected a breakpoint number, got %q", arg)
+		}
+		if !d.forID(id, bpFunc, wpFunc, pbFunc) {
+			return fmt.Errorf("no breakpoint %d", id)
+		}
+	}
+	return nil
+}
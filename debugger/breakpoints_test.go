@@ -0,0 +1,70 @@
+package debugger
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestConditionalBreakpoints(t *testing.T) {
+	d, out := newDebugger("b sub if B == 2 && !ZF\nc\nb\nn\nn\nc\n")
+	d.Run()
+	if *d.CPU.B != 0 || !d.CPU.Halted {
+		t.Errorf("Expected the program to halt, B = %d", *d.CPU.B)
+	}
+	for _, s := range []string{
+		"Breakpoint 1 at 0x000b <sub> if B == 2 && !ZF\n",
+		"1: 0x000b <sub> if B == 2 && !ZF, hit 1 times\n",
+		"B: 0x02",
+	} {
+		if !strings.Contains(out.String(), s) {
+			t.Errorf("Expected %q in the output:\n%v", s, out)
+		}
+	}
+}
+
+func TestIgnoreCount(t *testing.T) {
+	d, out := newDebugger("b sub\nignore 1 1\nb\nc\ndisable 1\nc\n")
+	d.Run()
+	if !strings.Contains(out.String(), "1: 0x000b <sub>, hit 0 times, ignoring the next 1\n") {
+		t.Errorf("Expected the ignore count in the list:\n%v", out)
+	}
+	bp := d.Breakpoints()[0]
+	if bp.Hits != 2 || bp.Ignore != 0 || bp.Enabled || !d.CPU.Halted {
+		t.Errorf("Expected the second call to stop, got %d hits:\n%v", bp.Hits, out)
+	}
+}
+
+func TestGlobalBreakpoint(t *testing.T) {
+	// the condition is true in all three calls, but stops once per call since it becomes true there
+	d, out := newDebugger("b if SP < $8000 && WORD(SP) == loop+3\nc\nc\ncond 1 A == $43\nc\n")
+	d.Run()
+	if got := strings.Count(out.String(), "Breakpoint 1 at 0x000b <sub> if SP < $8000 && WORD(SP) == loop+3\n"); got != 2 {
+		t.Errorf("Expected the breakpoint to stop twice, got %d:\n%v", got, out)
+	}
+	if !d.CPU.Halted || d.Breakpoints()[0].Hits != 2 {
+		t.Errorf("Expected the changed condition to never be true:\n%v", out)
+	}
+
+	// conditions are checked when they are set
+	for _, line := range []string{"b if", "b if nothing", "b 0 if (", "cond 1", "cond 2 A", "ignore 1 -1"} {
+		d, out := newDebugger("b if A\n" + line + "\n")
+		d.Run()
+		if strings.Count(out.String(), ">") != 3 || !strings.HasSuffix(strings.TrimSuffix(out.String(), ">"), "\n") || len(d.Breakpoints()) != 1 {
+			t.Errorf("Expected %q to fail:\n%v", line, out)
+		}
+	}
+}
+
+func TestExpressions(t *testing.T) {
+	d, out := newDebugger("reg HL $100\ne $100 $34 $12\nreg F $41\np (HL) + WORD(HL) + ZF + CF + SF\np [1+2]*3\np BC'\n")
+	d.Run()
+	for _, s := range []string{
+		"4714 = 0x126A", // $34 + $1234 + ZF + CF
+		"9 = 0x9",
+		"0 = 0x0",
+	} {
+		if !strings.Contains(out.String(), s) {
+			t.Errorf("Expected %q in the output:\n%v", s, out)
+		}
+	}
+}
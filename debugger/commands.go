@@ -0,0 +1,471 @@
+package debugger
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/antbern/z80-emulator/asm"
+	"github.com/antbern/z80-emulator/core"
+	"github.com/antbern/z80-emulator/spectrum"
+)
+
+// command is a debugger command
+type command struct {
+	names []string // the name and its aliases
+	args  string   // the arguments for the help
+	help  string
+	run   func(d *Debugger, args []string) error
+
+	// resumes is set for commands that execute instructions, after which the state is printed
+	resumes bool
+}
+
+// commands are all commands, set in init since help refers to it
+var commands []*command
+
+func init() {
+	commands = []*command{
+		{names: []string{"help", "h", "?"}, args: "[command]", help: "List the commands, or show the help of a command", run: (*Debugger).cmdHelp},
+		{names: []string{"n", "stepi"}, args: "[count]", help: "Execute one or count instructions (also an empty line)", run: (*Debugger).cmdNext, resumes: true},
+		{names: []string{"nt"}, help: "Execute 100 instructions", run: func(d *Debugger, args []string) error { return d.cmdNext([]string{"100"}) }, resumes: true},
+		{names: []string{"so", "over"}, help: "Step over a CALL, RST, DJNZ or repeating block instruction, running until the instruction after it", run: (*Debugger).cmdOver, resumes: true},
+		{names: []string{"out", "finish"}, help: "Run until the current routine returns to its caller", run: (*Debugger).cmdOut, resumes: true},
+		{names: []string{"rt", "toret"}, help: "Run until the RET of the current routine, stopping before it", run: (*Debugger).cmdToReturn, resumes: true},
+		{names: []string{"rs", "rstep"}, args: "[count]", help: "Step back one or count instructions while recording", run: (*Debugger).cmdReverseStep, resumes: true},
+		{names: []string{"rc", "rcontinue"}, help: "Run backwards until a breakpoint, watchpoint or port breakpoint is hit, or the start of the history", run: (*Debugger).cmdReverseContinue, resumes: true},
+		{names: []string{"seek", "goto"}, args: "instruction", help: "Go to the state before a recorded instruction, numbered from the start of the program", run: (*Debugger).cmdSeek, resumes: true},
+		{names: []string{"record"}, args: "[limit|off]", help: "Record the last limit instructions for running backwards, stop recording, or show the history", run: (*Debugger).cmdRecord},
+		{names: []string{"c", "continue"}, help: "Continue until a breakpoint is hit or the CPU halts", run: (*Debugger).cmdContinue, resumes: true},
+		{names: []string{"o", "until"}, args: "addr", help: "Run until the PC reaches an address", run: (*Debugger).cmdUntil, resumes: true},
+		{names: []string{"s", "step"}, help: "Run until the next source line", run: (*Debugger).cmdStep, resumes: true},
+		{names: []string{"r", "run"}, args: "line [file]", help: "Run to a source line, given as N, file:N or line N of file", run: (*Debugger).cmdRunTo, resumes: true},
+		{names: []string{"l", "list"}, args: "[line [file]]", help: "List the source around the PC or a line", run: (*Debugger).cmdList},
+		{names: []string{"b", "break"}, args: "[addr] [if cond]", help: "Set a breakpoint at an address, or anywhere with a condition, or list the breakpoints", run: (*Debugger).cmdBreak},
+		{names: []string{"w", "watch"}, args: "[r|w|x] start [end]", help: "Stop after reads, writes (the default) or instruction fetches in a range of memory, or list the watchpoints", run: (*Debugger).cmdWatch},
+		{names: []string{"pb", "port"}, args: "[in|out] port [last] [=value]", help: "Stop after IN or OUT operations on a port or range of ports, optionally with a value, or list the port breakpoints", run: func(d *Debugger, args []string) error { return d.portCommand(args, false) }},
+		{names: []string{"plog"}, args: "[in|out] port [last] [=value]", help: "Log IN or OUT operations like pb without stopping", run: func(d *Debugger, args []string) error { return d.portCommand(args, true) }},
+		{names: []string{"d", "delete"}, args: "id|addr|all", help: "Delete breakpoints of all kinds", run: (*Debugger).cmdDelete},
+		{names: []string{"cond"}, args: "id [cond]", help: "Set the condition of a breakpoint, or remove it", run: (*Debugger).cmdCond},
+		{names: []string{"ignore"}, args: "id count", help: "Ignore the next count hits of a breakpoint", run: (*Debugger).cmdIgnore},
+		{names: []string{"enable"}, args: "id|all", help: "Enable breakpoints of all kinds", run: func(d *Debugger, args []string) error { return d.enable(args, true) }},
+		{names: []string{"disable"}, args: "id|all", help: "Disable breakpoints of all kinds", run: func(d *Debugger, args []string) error { return d.enable(args, false) }},
+		{names: []string{"bt", "backtrace"}, help: "Show the routines that were called to get to the PC, and returns that did not match a call", run: (*Debugger).cmdBacktrace},
+		{names: []string{"x", "examine"}, args: "[addr [length]]", help: "Dump memory, continuing after the last dump without an address", run: (*Debugger).cmdExamine},
+		{names: []string{"e", "enter"}, args: "addr value|\"text\"...", help: "Write bytes and strings to memory", run: (*Debugger).cmdEnter},
+		{names: []string{"f", "fill"}, args: "addr length value", help: "Fill memory with a byte", run: (*Debugger).cmdFill},
+		{names: []string{"reg", "regs"}, args: "[name [value]]", help: "Show all registers, or show or set a register, also as name=value", run: (*Debugger).cmdReg},
+		{names: []string{"p", "print"}, args: "expr", help: "Print the value of an expression in several bases", run: (*Debugger).cmdPrint},
+		{names: []string{"u", "dis"}, args: "[addr [count]]", help: "Disassemble instructions, continuing after the last ones without an address", run: (*Debugger).cmdDisasm},
+		{names: []string{"a", "asm"}, args: "[addr]", help: "Assemble instructions into memory until an empty line", run: (*Debugger).cmdAssemble},
+		{names: []string{"save"}, args: "file", help: "Save the registers, memory and device state to a file, or a ZX Spectrum snapshot to a .sna or .z80 file", run: (*Debugger).cmdSave},
+		{names: []string{"restore"}, args: "file", help: "Restore a state saved with save or -save-state, with the same devices attached, or a ZX Spectrum .sna or .z80 snapshot", run: (*Debugger).cmdRestore, resumes: true},
+		{names: []string{"base"}, args: "[2|8|10|16]", help: "Show or set the number base used to print values", run: (*Debugger).cmdBase},
+		{names: []string{"q", "quit"}, help: "Quit the emulator", run: func(d *Debugger, args []string) error { d.quit = true; return nil }},
+	}
+}
+
+// lookupCommand returns the command with a name or alias, or nil if there is none
+func lookupCommand(name string) *command {
+	for _, cmd := range commands {
+		for _, n := range cmd.names {
+			if n == name {
+				return cmd
+			}
+		}
+	}
+	return nil
+}
+
+func (d *Debugger) cmdHelp(args []string) error {
+	if len(args) > 0 {
+		cmd := lookupCommand(strings.ToLower(args[0]))
+		if cmd == nil {
+			return fmt.Errorf("unknown command %q", args[0])
+		}
+		d.printf("%v %v\n  %v\n", strings.Join(cmd.names, ", "), cmd.args, cmd.help)
+		return nil
+	}
+	for _, cmd := range commands {
+		d.printf("%-22s %v\n", cmd.names[0]+" "+cmd.args, cmd.help)
+	}
+	d.printf("Values are expressions such as 42, 0x2A, $2A, 2Ah, %%101010, 'A' or labels such as putc+3\n")
+	d.printf("They can use registers such as A, HL and SP, the flags SF, ZF, HF, PF/VF, NF and CF, the byte (addr) and\n")
+	d.printf("WORD(addr) in memory, [ ] to group, arithmetic and comparisons, as in: b if (HL) == $0D && ZF\n")
+	return nil
+}
+
+// usage returns an error with the usage of a command
+func usage(name string) error {
+	cmd := lookupCommand(name)
+	return fmt.Errorf("usage: %v %v", name, cmd.args)
+}
+
+func (d *Debugger) cmdNext(args []string) error {
+	count := 1
+	if len(args) > 0 {
+		n, err := d.eval(args[0])
+		if err != nil {
+			return err
+		}
+		count = n
+	}
+	i := 0
+	return d.run(func() bool {
+		i++
+		return i >= count
+	})
+}
+
+func (d *Debugger) cmdContinue(args []string) error {
+	return d.run(func() bool { return false })
+}
+
+func (d *Debugger) cmdUntil(args []string) error {
+	if len(args) != 1 {
+		return usage("o")
+	}
+	addr, err := d.address(args[0])
+	if err != nil {
+		return err
+	}
+	return d.run(func() bool { return *d.CPU.PC == addr })
+}
+
+func (d *Debugger) cmdStep(args []string) error {
+	from, _ := d.Sources.Locate(*d.CPU.PC)
+	return d.run(func() bool { return d.atNewLine(from) })
+}
+
+func (d *Debugger) cmdRunTo(args []string) error {
+	addr, err := d.lineAddress(args)
+	if err != nil {
+		return err
+	}
+	return d.run(func() bool { return *d.CPU.PC == addr })
+}
+
+func (d *Debugger) cmdList(args []string) error {
+	addr := *d.CPU.PC
+	if len(args) > 0 {
+		var err error
+		if addr, err = d.lineAddress(args); err != nil {
+			return err
+		}
+	}
+	line, ok := d.Sources.Locate(addr)
+	if !ok {
+		return fmt.Errorf("no source for %v", d.CPU.FormatAddr(addr))
+	}
+	d.printSource(line, 5, 5)
+	return nil
+}
+
+// formatByte formats a byte in the current base
+func (d *Debugger) formatByte(b uint8) string {
+	switch d.base {
+	case 2:
+		return fmt.Sprintf("%08b", b)
+	case 8:
+		return fmt.Sprintf("%03o", b)
+	case 10:
+		return fmt.Sprintf("%3d", b)
+	}
+	return fmt.Sprintf("%02X", b)
+}
+
+// formatValue formats a register value of size bytes in the current base
+func (d *Debugger) formatValue(v uint16, size int) string {
+	switch d.base {
+	case 2:
+		return fmt.Sprintf("%0*b", size*8, v)
+	case 8:
+		return fmt.Sprintf("%o", v)
+	case 10:
+		return fmt.Sprintf("%d", v)
+	}
+	return fmt.Sprintf("%0*X", size*2, v)
+}
+
+func (d *Debugger) cmdExamine(args []string) error {
+	addr, length := d.nextExamine, 64
+	if len(args) > 2 {
+		return usage("x")
+	}
+	if len(args) > 0 {
+		var err error
+		if addr, err = d.address(args[0]); err != nil {
+			return err
+		}
+	}
+	if len(args) > 1 {
+		n, err := d.eval(args[1])
+		if err != nil {
+			return err
+		}
+		length = n
+	}
+
+	perLine := 16
+	if d.base == 2 {
+		perLine = 8
+	}
+	for i := 0; i < length; i += perLine {
+		var values []string
+		ascii := ""
+		for j := i; j < i+perLine && j < length; j++ {
+			b := d.CPU.Mem.Peek(addr + uint16(j))
+			values = append(values, d.formatByte(b))
+			if b >= 0x20 && b < 0x7F {
+				ascii += string(rune(b))
+			} else {
+				ascii += "."
+			}
+		}
+		d.printf("%04X  %v  |%v|\n", addr+uint16(i), strings.Join(values, " "), ascii)
+	}
+	d.nextExamine = addr + uint16(length)
+	return nil
+}
+
+// bytesOf returns the bytes of values and quoted strings
+func (d *Debugger) bytesOf(args []string) ([]uint8, error) {
+	var data []uint8
+	for _, arg := range args {
+		if len(arg) > 2 && arg[0] == '"' && arg[len(arg)-1] == '"' {
+			data = append(data, arg[1:len(arg)-1]...)
+			continue
+		}
+		v, err := d.value(arg, 1)
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, uint8(v))
+	}
+	return data, nil
+}
+
+func (d *Debugger) cmdEnter(args []string) error {
+	if len(args) < 2 {
+		return usage("e")
+	}
+	addr, err := d.address(args[0])
+	if err != nil {
+		return err
+	}
+	data, err := d.bytesOf(args[1:])
+	if err != nil {
+		return err
+	}
+	d.changed()
+	for i, b := range data {
+		d.CPU.Mem.Poke(addr+uint16(i), b)
+	}
+	return nil
+}
+
+func (d *Debugger) cmdFill(args []string) error {
+	if len(args) != 3 {
+		return usage("f")
+	}
+	addr, err := d.address(args[0])
+	if err != nil {
+		return err
+	}
+	length, err := d.eval(args[1])
+	if err != nil {
+		return err
+	}
+	v, err := d.value(args[2], 1)
+	if err != nil {
+		return err
+	}
+	d.changed()
+	for i := 0; i < length; i++ {
+		d.CPU.Mem.Poke(addr+uint16(i), uint8(v))
+	}
+	return nil
+}
+
+// flagNames are the names of the bits of F from bit 7 to 0, with - for the unused bits
+const flagNames = "SZ-H-PNC"
+
+// formatFlags returns the set flags of F as letters
+func formatFlags(f uint8) string {
+	var sb strings.Builder
+	for i := 0; i < 8; i++ {
+		if f&(0x80>>uint(i)) != 0 && flagNames[i] != '-' {
+			sb.WriteByte(flagNames[i])
+		} else {
+			sb.WriteByte('-')
+		}
+	}
+	return sb.String()
+}
+
+func (d *Debugger) cmdReg(args []string) error {
+	if len(args) == 1 && strings.Contains(args[0], "=") {
+		args = strings.SplitN(args[0], "=", 2)
+	}
+	switch len(args) {
+	case 0:
+		cpu := d.CPU
+		d.printf("PC %v  SP %v  Flags %v\n", d.CPU.FormatAddr(*cpu.PC), d.formatValue(*cpu.SP, 2), formatFlags(*cpu.F))
+		for _, group := range [][]string{{"AF", "BC", "DE", "HL", "IX", "IY"}, {"AF'", "BC'", "DE'", "HL'"}} {
+			var parts []string
+			for _, name := range group {
+				v, _ := cpu.Reg(name)
+				parts = append(parts, fmt.Sprintf("%-3v %v", name, d.formatValue(v, 2)))
+			}
+			d.printf("%v\n", strings.Join(parts, "  "))
+		}
+		return nil
+	case 1, 2:
+		name := strings.ToUpper(args[0])
+		size := d.CPU.RegSize(name)
+		if size == 0 {
+			return fmt.Errorf("unknown register %q, expected one of %v", args[0], strings.Join(core.RegisterNames, " "))
+		}
+		if len(args) == 2 {
+			v, err := d.value(args[1], size)
+			if err != nil {
+				return err
+			}
+			d.changed()
+			d.CPU.SetReg(name, v)
+		}
+		v, _ := d.CPU.Reg(name)
+		d.printf("%v = %v\n", name, d.formatValue(v, size))
+		return nil
+	}
+	return usage("reg")
+}
+
+func (d *Debugger) cmdPrint(args []string) error {
+	if len(args) == 0 {
+		return usage("p")
+	}
+	v, err := d.eval(strings.Join(args, " "))
+	if err != nil {
+		return err
+	}
+	d.printf("%d = 0x%X = 0o%o = 0b%b", v, uint16(v), uint16(v), uint16(v))
+	if v >= 0x20 && v < 0x7F {
+		d.printf(" = '%c'", rune(v))
+	}
+	if name := d.Symbols.Symbolize(uint16(v)); name != "" {
+		d.printf(" = %v", name)
+	}
+	d.printf("\n")
+	return nil
+}
+
+func (d *Debugger) cmdDisasm(args []string) error {
+	addr, count := d.nextDisasm, 10
+	if len(args) > 2 {
+		return usage("u")
+	}
+	if len(args) > 0 {
+		var err error
+		if addr, err = d.address(args[0]); err != nil {
+			return err
+		}
+	}
+	if len(args) > 1 {
+		n, err := d.eval(args[1])
+		if err != nil {
+			return err
+		}
+		count = n
+	}
+	for i := 0; i < count; i++ {
+		if name, ok := d.Symbols.Name(addr); ok {
+			d.printf("%v:\n", name)
+		}
+		in := d.decode(addr)
+		d.printInstruction(in)
+		addr += uint16(in.Len())
+	}
+	d.nextDisasm = addr
+	return nil
+}
+
+func (d *Debugger) cmdAssemble(args []string) error {
+	addr := *d.CPU.PC
+	if len(args) > 1 {
+		return usage("a")
+	}
+	if len(args) == 1 {
+		var err error
+		if addr, err = d.address(args[0]); err != nil {
+			return err
+		}
+	}
+	for {
+		d.printf("%04X  ", addr)
+		text, ok := d.readLine()
+		if !ok || strings.TrimSpace(text) == "" {
+			return nil
+		}
+		code, err := asm.Assemble(text, addr, d.Symbols)
+		if err != nil {
+			d.printf("%v\n", err)
+			continue
+		}
+		d.changed()
+		for _, b := range code {
+			d.CPU.Mem.Poke(addr, b)
+			addr++
+		}
+	}
+}
+
+func (d *Debugger) cmdSave(args []string) error {
+	if len(args) != 1 {
+		return usage("save")
+	}
+	save := d.CPU.SaveStateFile
+	if spectrum.IsSnapshot(args[0]) {
+		save = func(path string) error { return spectrum.SaveFile(d.CPU, path) }
+	}
+	if err := save(args[0]); err != nil {
+		return err
+	}
+	d.printf("Saved the state at instruction %d to %v\n", d.CPU.Instructions, args[0])
+	return nil
+}
+
+func (d *Debugger) cmdRestore(args []string) error {
+	if len(args) != 1 {
+		return usage("restore")
+	}
+	load := d.CPU.LoadStateFile
+	if spectrum.IsSnapshot(args[0]) {
+		load = func(path string) error { return spectrum.LoadFile(d.CPU, path) }
+	}
+	if err := load(args[0]); err != nil {
+		return err
+	}
+	d.nextExamine = 0
+	d.printf("Restored the state at instruction %d from %v\n", d.CPU.Instructions, args[0])
+	if d.CPU.History != nil {
+		d.printf("The recording starts over, the history is now empty\n")
+	}
+	return nil
+}
+
+func (d *Debugger) cmdBase(args []string) error {
+	if len(args) > 1 {
+		return usage("base")
+	}
+	if len(args) == 1 {
+		switch args[0] {
+		case "2", "8", "10", "16":
+			d.base, _ = strconv.Atoi(args[0])
+		default:
+			return usage("base")
+		}
+	}
+	d.printf("Values are printed in base %d\n", d.base)
+	return nil
+}
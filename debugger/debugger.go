@@ -0,0 +1,306 @@
+// Package debugger is an interactive debugger for the Z80, with commands to run and step the program,
+// examine and change memory and registers, and set breakpoints.
+package debugger
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync/atomic"
+
+	"github.com/antbern/z80-emulator/asm"
+	"github.com/antbern/z80-emulator/core"
+	"github.com/antbern/z80-emulator/disasm"
+	z80io "github.com/antbern/z80-emulator/io"
+	"github.com/antbern/z80-emulator/symbols"
+)
+
+// Debugger reads commands and controls the CPU
+type Debugger struct {
+	CPU *core.Z80
+
+	// Symbols and Sources are the labels and listings of the program, which are empty by default
+	Symbols *symbols.Table
+	Sources *symbols.Sources
+
+	in  *bufio.Reader
+	out io.Writer
+
+	breakpoints []*Breakpoint
+	nextID      int
+
+	// triggers stop the program while it runs freely
+	triggers []trigger
+
+	watchpoints []*Watchpoint
+	accesses    []core.Access // the watched accesses of the current instruction
+
+	// the port breakpoints, and the tap around the IO device of the CPU that is added for them
+	ports        []*PortBreakpoint
+	tap          *z80io.Tap
+	portAccesses []z80io.PortAccess
+
+	// base is the number base used to print values
+	base int
+
+	// the addresses where x and u continue without an address, where u starts at the PC after the
+	// program has run
+	nextExamine, nextDisasm uint16
+
+	interrupted int32
+	quit        bool
+}
+
+// New returns a debugger for the CPU that reads commands from in and writes to out. The CPU is made
+// to keep a call stack for the backtraces.
+func New(cpu *core.Z80, in io.Reader, out io.Writer) *Debugger {
+	if cpu.Calls == nil {
+		cpu.Calls = &core.CallStack{}
+	}
+	return &Debugger{
+		CPU:        cpu,
+		nextDisasm: *cpu.PC,
+		Symbols:    symbols.NewTable(),
+		Sources:    &symbols.Sources{},
+		in:         bufio.NewReader(in),
+		out:        out,
+		nextID:     1,
+		base:       16,
+	}
+}
+
+// printf writes to the output of the debugger
+func (d *Debugger) printf(format string, args ...interface{}) {
+	fmt.Fprintf(d.out, format, args...)
+}
+
+// readLine reads a line of input, returning false at the end of the input
+func (d *Debugger) readLine() (string, bool) {
+	text, err := d.in.ReadString('\n')
+	if err != nil && text == "" {
+		return "", false
+	}
+	return strings.TrimRight(text, "\r\n"), true
+}
+
+// Run reads and executes commands until the quit command or the end of the input
+func (d *Debugger) Run() {
+	d.quit = false
+	for !d.quit {
+		d.printf(">")
+		line, ok := d.readLine()
+		if !ok {
+			return
+		}
+		d.Execute(line)
+	}
+}
+
+// Execute executes a single command line. An empty line steps one instruction.
+func (d *Debugger) Execute(line string) {
+	args := splitArgs(line)
+	name := "n"
+	if len(args) > 0 {
+		name, args = strings.ToLower(args[0]), args[1:]
+	}
+	cmd := lookupCommand(name)
+	if cmd == nil {
+		d.printf("Unknown command %q, try help\n", name)
+		return
+	}
+	if err := cmd.run(d, args); err != nil {
+		d.printf("%v\n", err)
+		return
+	}
+	if cmd.resumes {
+		d.nextDisasm = *d.CPU.PC
+		d.printStatus()
+	}
+}
+
+// Interrupt stops a running command at the next instruction. It can be called from another goroutine,
+// for example on Ctrl-C.
+func (d *Debugger) Interrupt() {
+	atomic.StoreInt32(&d.interrupted, 1)
+}
+
+// errInterrupted is returned by run when it is stopped by Interrupt
+var errInterrupted = errors.New("interrupted")
+
+// run executes instructions until stop returns true, a breakpoint, watchpoint or port breakpoint is
+// hit, the CPU halts or Interrupt is called. At least one instruction is executed, so that it can
+// continue from a breakpoint.
+func (d *Debugger) run(stop func() bool) error {
+	atomic.StoreInt32(&d.interrupted, 0)
+	for {
+		pc := *d.CPU.PC
+		replayed := d.CPU.History != nil && d.CPU.History.InPast()
+		d.CPU.Step()
+		if replayed {
+			// the IO device is not used when redoing the instruction
+			d.portAccesses = append(d.portAccesses, d.CPU.History.Previous().Ports...)
+		}
+		// report all accesses of the instruction before stopping
+		watched := d.hitWatchpoints(pc)
+		if d.hitPorts(pc) || watched {
+			return nil
+		}
+		switch {
+		case d.CPU.Halted:
+			d.printf("CPU halted\n")
+			return nil
+		case stop():
+			return nil
+		case atomic.LoadInt32(&d.interrupted) != 0:
+			return errInterrupted
+		}
+		bp, err := d.hitBreakpoint()
+		if err != nil {
+			return fmt.Errorf("breakpoint %d: %v", bp.ID, err)
+		}
+		if bp != nil {
+			d.printf("Breakpoint %d %v\n", bp.ID, d.describe(bp, *d.CPU.PC))
+			return nil
+		}
+	}
+}
+
+// printStatus prints the source line, registers and next instruction
+func (d *Debugger) printStatus() {
+	if line, ok := d.Sources.Locate(*d.CPU.PC); ok {
+		d.printSource(line, 2, 2)
+	}
+	d.printf("%v\n", d.CPU.String())
+	if h := d.CPU.History; h != nil && h.InPast() {
+		d.printf("In the past at instruction %d, the history has %d to %d\n", d.CPU.Instructions, h.First(), h.Last())
+	}
+	d.printInstruction(d.decode(*d.CPU.PC))
+}
+
+// decode disassembles an instruction in memory with the labels of the program
+func (d *Debugger) decode(addr uint16) disasm.Instruction {
+	dec := &disasm.Decoder{Label: func(a uint16) string {
+		name, _ := d.Symbols.Name(a)
+		return name
+	}}
+	return dec.Decode(d.CPU.Mem, addr)
+}
+
+// printInstruction prints a disassembled instruction with its address and bytes
+func (d *Debugger) printInstruction(in disasm.Instruction) {
+	var bytes []string
+	for _, b := range in.Bytes {
+		bytes = append(bytes, fmt.Sprintf("%02X", b))
+	}
+	d.printf("%-20v %-12s %v\n", d.CPU.FormatAddr(in.Addr), strings.Join(bytes, " "), in)
+}
+
+// flags are the names of the bits of F in expressions
+var flags = map[string]uint8{
+	"SF": core.FlagS, "ZF": core.FlagZ, "HF": core.FlagH, "PF": core.FlagP, "VF": core.FlagV, "NF": core.FlagN, "CF": core.FlagC,
+}
+
+// lookup returns the value of a register, a flag or a symbol for expressions
+func (d *Debugger) lookup(name string) (int, bool) {
+	upper := strings.ToUpper(name)
+	if v, ok := d.CPU.Reg(upper); ok {
+		return int(v), true
+	}
+	if mask, ok := flags[upper]; ok {
+		return boolValue(*d.CPU.F&mask != 0), true
+	}
+	v, ok := d.Symbols.Lookup(name)
+	return int(v), ok
+}
+
+func boolValue(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// compile parses an expression over the registers, flags, memory and symbols. Registers and flags
+// such as A, HL, SP, ZF and CF are evaluated when the expression is, (expr) is the byte in memory at
+// an address and WORD(expr) the word, and brackets group.
+func (d *Debugger) compile(expr string) (*asm.Expr, error) {
+	return asm.ParseExpr(expr, true)
+}
+
+// evalExpr evaluates a compiled expression with the current state of the CPU, where $ is the PC
+func (d *Debugger) evalExpr(x *asm.Expr) (int, error) {
+	return x.Eval(*d.CPU.PC, d.lookup, d.CPU.Mem.Peek)
+}
+
+// eval evaluates an expression with the current state of the CPU
+func (d *Debugger) eval(expr string) (int, error) {
+	x, err := d.compile(expr)
+	if err != nil {
+		return 0, err
+	}
+	return d.evalExpr(x)
+}
+
+// address evaluates an expression that must be an address
+func (d *Debugger) address(expr string) (uint16, error) {
+	v, err := d.eval(expr)
+	if err != nil {
+		return 0, err
+	}
+	if v < 0 || v > 0xFFFF {
+		return 0, fmt.Errorf("address %#x is out of range", v)
+	}
+	return uint16(v), nil
+}
+
+// value evaluates an expression that must fit in size bytes, allowing negative values, which are
+// returned in two's complement in size bytes
+func (d *Debugger) value(expr string, size int) (uint16, error) {
+	v, err := d.eval(expr)
+	if err != nil {
+		return 0, err
+	}
+	max := 1<<(8*uint(size)) - 1
+	if v < -(max+1)/2 || v > max {
+		return 0, fmt.Errorf("value %v does not fit in %d bits", v, 8*size)
+	}
+	return uint16(v & max), nil
+}
+
+// splitArgs splits a command line at spaces that are not in brackets or strings
+func splitArgs(line string) []string {
+	var args []string
+	depth, start := 0, -1
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case c == ' ' || c == '\t':
+			if depth == 0 && start >= 0 {
+				args = append(args, line[start:i])
+				start = -1
+			}
+			continue
+		case c == '(' || c == '[':
+			depth++
+		case (c == ')' || c == ']') && depth > 0:
+			depth--
+		case c == '"' || c == '\'':
+			if end := strings.IndexByte(line[i+1:], c); end >= 0 && !(c == '\'' && start >= 0 && i > start) {
+				if start < 0 {
+					start = i
+				}
+				i += end + 1
+				continue
+			}
+		}
+		if start < 0 {
+			start = i
+		}
+	}
+	if start >= 0 {
+		args = append(args, line[start:])
+	}
+	return args
+}
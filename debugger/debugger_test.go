@@ -0,0 +1,184 @@
+package debugger
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/antbern/z80-emulator/asm"
+	"github.com/antbern/z80-emulator/core"
+	"github.com/antbern/z80-emulator/symbols"
+)
+
+// testProgram calls sub three times and halts
+var testProgram = []string{
+	"LD SP,$8000",
+	"LD B,3",
+	"loop: CALL sub",
+	"DJNZ loop",
+	"HALT",
+	"sub: LD A,$42",
+	"RET",
+}
+
+// newDebugger returns a debugger for the test program with its labels, that reads the script as its
+// input
+func newDebugger(script string) (*Debugger, *bytes.Buffer) {
+	d, out := newDebuggerFor(script, testProgram...)
+	d.Symbols.Add(symbols.Symbol{Name: "loop", Value: 0x0005, Kind: symbols.Label})
+	d.Symbols.Add(symbols.Symbol{Name: "sub", Value: 0x000B, Kind: symbols.Label})
+	return d, out
+}
+
+// newDebuggerFor returns a debugger for a program without labels
+func newDebuggerFor(script string, program ...string) (*Debugger, *bytes.Buffer) {
+	cpu := core.NewZ80()
+	for i, b := range asm.MustAssemble(0, program...) {
+		cpu.Mem.Poke(uint16(i), b)
+	}
+	out := &bytes.Buffer{}
+	d := New(&cpu, strings.NewReader(script), out)
+	cpu.Symbols = d.Symbols
+	return d, out
+}
+
+func TestBreakpoints(t *testing.T) {
+	d, out := newDebugger("b sub\nc\nc\nb\nd 1\nc\n")
+	d.Run()
+
+	if got := strings.Count(out.String(), "Breakpoint 1 at 0x000b <sub>\n"); got != 3 {
+		t.Errorf("Expected the breakpoint to be set and hit twice, got %d messages:\n%v", got, out)
+	}
+	if !strings.Contains(out.String(), "1: 0x000b <sub>, hit 2 times") {
+		t.Errorf("Expected the breakpoint in the list:\n%v", out)
+	}
+	if !d.CPU.Halted || *d.CPU.B != 0 || len(d.Breakpoints()) != 0 {
+		t.Errorf("Expected the program to halt after deleting the breakpoint, B = %d:\n%v", *d.CPU.B, out)
+	}
+}
+
+func TestStepping(t *testing.T) {
+	d, out := newDebugger("n 2\n\no loop+3\n")
+	d.Run()
+	if *d.CPU.PC != 0x0008 || *d.CPU.A != 0x42 {
+		t.Errorf("Expected to stop after the call at 0x0008 with A = $42, got PC %#04x and A %#02x", *d.CPU.PC, *d.CPU.A)
+	}
+	if !strings.Contains(out.String(), "0x000b <sub>         3E 42        LD A,$42\n") {
+		t.Errorf("Expected the next instruction after stepping into sub:\n%v", out)
+	}
+}
+
+func TestMemory(t *testing.T) {
+	d, out := newDebugger("e $100 1 -2 \"Hi\" 'x'\nf $104 3 $AA\nx $100 8\nbase 10\nx $100 2\nbase 3\n")
+	d.Run()
+
+	want := []uint8{1, 0xFE, 'H', 'i', 0xAA, 0xAA, 0xAA, 0}
+	for i, b := range want {
+		if got := d.CPU.Mem.Peek(0x100 + uint16(i)); got != b {
+			t.Errorf("Expected %#02x at %#04x, got %#02x", b, 0x100+i, got)
+		}
+	}
+	for _, s := range []string{
+		"0100  01 FE 48 69 AA AA AA 00  |..Hi....|\n",
+		"0100    1 254  |..|\n",
+		"usage: base [2|8|10|16]\n",
+	} {
+		if !strings.Contains(out.String(), s) {
+			t.Errorf("Expected %q in the output:\n%v", s, out)
+		}
+	}
+	// 'x' is a character constant and no string
+	if d.CPU.Mem.Peek(0x104) == 'x' {
+		t.Errorf("Expected the fill to overwrite the character")
+	}
+}
+
+func TestRegisters(t *testing.T) {
+	d, out := newDebugger("reg hl $1234\nreg A=sub+1\nreg BC' 7\nreg b -1\nreg A 256\nreg Q 1\nreg\np sub*2\n")
+	d.Run()
+
+	if *d.CPU.HL != 0x1234 || *d.CPU.A != 0x0C || *d.CPU.B != 0xFF {
+		t.Errorf("Unexpected registers HL = %#04x, A = %#02x, B = %#02x", *d.CPU.HL, *d.CPU.A, *d.CPU.B)
+	}
+	if v, _ := d.CPU.Reg("BC'"); v != 7 {
+		t.Errorf("Expected BC' = 7, got %v", v)
+	}
+	for _, s := range []string{
+		"HL = 1234\n",
+		"value 256 does not fit in 8 bits\n",
+		"unknown register \"Q\"",
+		"BC' 0007",
+		"22 = 0x16 = 0o26 = 0b10110 = sub+11\n",
+	} {
+		if !strings.Contains(out.String(), s) {
+			t.Errorf("Expected %q in the output:\n%v", s, out)
+		}
+	}
+}
+
+func TestAssembleCommand(t *testing.T) {
+	d, _ := newDebugger("a sub\nLD A,$55\nbogus\nRET\n\nc\n")
+	d.Run()
+	if *d.CPU.A != 0x55 || !d.CPU.Halted {
+		t.Errorf("Expected the patched sub to set A = $55, got %#02x", *d.CPU.A)
+	}
+}
+
+func TestHelp(t *testing.T) {
+	d, out := newDebugger("help\nhelp x\nfoo\n")
+	d.Run()
+	for _, s := range []string{"q                      Quit the emulator\n", "x, examine [addr [length]]\n", "Unknown command \"foo\", try help\n"} {
+		if !strings.Contains(out.String(), s) {
+			t.Errorf("Expected %q in the output:\n%v", s, out)
+		}
+	}
+}
+
+func TestSplitArgs(t *testing.T) {
+	for line, want := range map[string][]string{
+		"":                    nil,
+		"  x  $100   8 ":      {"x", "$100", "8"},
+		"p (2 + 3) * 4":       {"p", "(2 + 3)", "*", "4"},
+		"e 0 \"a b\" ' ' AF'": {"e", "0", "\"a b\"", "' '", "AF'"},
+	} {
+		if got := splitArgs(line); strings.Join(got, "|") != strings.Join(want, "|") || len(got) != len(want) {
+			t.Errorf("splitArgs(%q) = %q, expected %q", line, got, want)
+		}
+	}
+}
+
+func TestSaveRestore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "statetest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state")
+
+	d, out := newDebugger("o loop+3\nsave " + path + "\nc\nrestore " + path + "\n")
+	d.Run()
+	if *d.CPU.PC != 0x0008 || *d.CPU.B != 3 || *d.CPU.SP != 0x8000 || d.CPU.Halted {
+		t.Errorf("Expected to be back after the first call, got PC %#04x and B = %d:\n%v", *d.CPU.PC, *d.CPU.B, out)
+	}
+	if !strings.Contains(out.String(), "Restored the state at instruction 5 from "+path) {
+		t.Errorf("Expected the state to be restored:\n%v", out)
+	}
+
+	// restoring starts the recording over
+	d, out = newDebugger("record\no loop+3\nsave " + path + "\nc\nrestore " + path + "\nrs\n")
+	d.Run()
+	if !strings.Contains(out.String(), "The recording starts over, the history is now empty") || *d.CPU.PC != 0x0008 {
+		t.Errorf("Expected the history to start over after restoring:\n%v", out)
+	}
+
+	// Spectrum snapshots have the registers without the instruction counter
+	path = filepath.Join(dir, "state.z80")
+	d, out = newDebugger("o loop+3\nsave " + path + "\nc\nrestore " + path + "\n")
+	d.Run()
+	if *d.CPU.PC != 0x0008 || *d.CPU.B != 3 || *d.CPU.SP != 0x8000 || !strings.Contains(out.String(), "Restored the state at instruction 0 from "+path) {
+		t.Errorf("Expected to be back after the first call from the snapshot, got PC %#04x and B = %d:\n%v", *d.CPU.PC, *d.CPU.B, out)
+	}
+}
@@ -0,0 +1,158 @@
+package debugger
+
+import (
+	"fmt"
+	"strings"
+
+	z80io "github.com/antbern/z80-emulator/io"
+)
+
+// PortBreakpoint stops the program after an IN or OUT operation selected by its filter, or logs the
+// operation without stopping
+type PortBreakpoint struct {
+	ID      int
+	Filter  z80io.PortFilter
+	Enabled bool
+
+	// Log makes the breakpoint print the operations instead of stopping
+	Log bool
+
+	// Hits counts the selected operations
+	Hits int
+}
+
+// AddPortBreakpoint adds an enabled port breakpoint, which logs the operations instead of stopping if
+// log is set. The IO device of the CPU is wrapped in a tap to see the operations.
+func (d *Debugger) AddPortBreakpoint(f z80io.PortFilter, log bool) *PortBreakpoint {
+	if d.tap == nil {
+		d.tap = z80io.NewTap(d.CPU.IO, func(a z80io.PortAccess) {
+			d.portAccesses = append(d.portAccesses, a)
+		})
+		d.CPU.IO = d.tap
+	}
+	pb := &PortBreakpoint{ID: d.nextID, Filter: f, Enabled: true, Log: log}
+	d.nextID++
+	d.ports = append(d.ports, pb)
+	return pb
+}
+
+// PortBreakpoints returns the port breakpoints in the order they were added
+func (d *Debugger) PortBreakpoints() []*PortBreakpoint {
+	return d.ports
+}
+
+// RemovePortBreakpoint removes a port breakpoint
+func (d *Debugger) RemovePortBreakpoint(pb *PortBreakpoint) {
+	for i, p := range d.ports {
+		if p == pb {
+			d.ports = append(d.ports[:i], d.ports[i+1:]...)
+			return
+		}
+	}
+}
+
+// hitPorts reports the selected port operations of the instruction at pc, returning true if a port
+// breakpoint stops the program
+func (d *Debugger) hitPorts(pc uint16) bool {
+	if len(d.portAccesses) == 0 {
+		return false
+	}
+	stop := false
+	for _, a := range d.portAccesses {
+		for _, pb := range d.ports {
+			if !pb.Enabled || !pb.Filter.Matches(a) {
+				continue
+			}
+			pb.Hits++
+			kind := "Port breakpoint"
+			if pb.Log {
+				kind = "Port log"
+			} else {
+				stop = true
+			}
+			d.printf("%v %d: %v by %v\n", kind, pb.ID, a, d.CPU.FormatAddr(pc))
+		}
+	}
+	d.portAccesses = d.portAccesses[:0]
+	return stop
+}
+
+// parsePortFilter parses the arguments "[in|out] port [last] [=value]", where the value may also
+// follow the port directly as in "out SIO_A_CTRL=$18"
+func (d *Debugger) parsePortFilter(args []string) (z80io.PortFilter, error) {
+	f := z80io.PortFilter{In: true, Out: true}
+	if len(args) > 0 {
+		switch strings.ToLower(args[0]) {
+		case "in":
+			f.Out, args = false, args[1:]
+		case "out":
+			f.In, args = false, args[1:]
+		}
+	}
+	parts := strings.SplitN(strings.Join(args, " "), "=", 2)
+	ports := splitArgs(parts[0])
+	if len(ports) < 1 || len(ports) > 2 {
+		return f, usage("pb")
+	}
+	first, err := d.value(ports[0], 1)
+	if err != nil {
+		return f, err
+	}
+	last := first
+	if len(ports) == 2 {
+		if last, err = d.value(ports[1], 1); err != nil {
+			return f, err
+		}
+	}
+	f.First, f.Last = uint8(first), uint8(last)
+	if f.Last < f.First {
+		return f, fmt.Errorf("the last port $%02X is before the first $%02X", f.Last, f.First)
+	}
+	if len(parts) == 2 {
+		v, err := d.value(parts[1], 1)
+		if err != nil {
+			return f, err
+		}
+		f.HasValue, f.Value = true, uint8(v)
+	}
+	return f, nil
+}
+
+// parsePortBreakpoint adds a port breakpoint from the arguments of parsePortFilter
+func (d *Debugger) parsePortBreakpoint(args []string, log bool) (*PortBreakpoint, error) {
+	f, err := d.parsePortFilter(args)
+	if err != nil {
+		return nil, err
+	}
+	return d.AddPortBreakpoint(f, log), nil
+}
+
+// portCommand implements the port breakpoint and log commands, which list both without arguments
+func (d *Debugger) portCommand(args []string, log bool) error {
+	if len(args) == 0 {
+		if len(d.ports) == 0 {
+			d.printf("No port breakpoints\n")
+		}
+		for _, pb := range d.ports {
+			state := ""
+			if pb.Log {
+				state = ", logged"
+			}
+			if !pb.Enabled {
+				state += " (disabled)"
+			}
+			d.printf("%d: %v, hit %d times%v\n", pb.ID, pb.Filter, pb.Hits, state)
+		}
+		return nil
+	}
+	pb, err := d.parsePortBreakpoint(args, log)
+	if err != nil {
+		return err
+	}
+	kind := "Port breakpoint"
+	if log {
+		kind = "Port log"
+	}
+	d.printf("%v %d: %v\n", kind, pb.ID, pb.Filter)
+	return nil
+}
@@ -0,0 +1,74 @@
+package debugger
+
+import (
+	"strings"
+	"testing"
+
+	z80io "github.com/antbern/z80-emulator/io"
+)
+
+// portProgram writes two control bytes to the SIO and reads its data port
+var portProgram = []string{
+	"LD A,$18",
+	"OUT ($22),A",
+	"LD A,$05",
+	"OUT ($22),A",
+	"IN A,($20)",
+	"HALT",
+}
+
+// recorder is an IO device that records the writes and reads $42
+type recorder struct {
+	writes []uint8
+}
+
+func (r *recorder) Write(port, val uint8) { r.writes = append(r.writes, val) }
+func (r *recorder) Read(port uint8) uint8 { return 0x42 }
+
+func TestPortBreakpoints(t *testing.T) {
+	d, out := newDebuggerFor("pb out $22=5\nplog in $20 $23\npb out $10\npb\nc\nc\nd 1\nd 3\nd 99\npb\n", portProgram...)
+	dev := &recorder{}
+	d.CPU.IO = dev
+	d.Run()
+
+	if !d.CPU.Halted || *d.CPU.A != 0x42 || len(dev.writes) != 2 {
+		t.Errorf("Expected the operations to reach the device, got A = %#02x and writes %v", *d.CPU.A, dev.writes)
+	}
+	for _, s := range []string{
+		"Port breakpoint 1: OUT port $22 value $05\n",
+		"Port log 2: IN ports $20-$23\n",
+		"3: OUT port $10, hit 0 times\n",
+		"Port breakpoint 1: OUT $05 to port $22 by 0x0006\nPC: 0x0008",
+		"Port log 2: IN $42 from port $20 by 0x0008\nCPU halted\n",
+		"no breakpoint 99\n",
+		">2: IN ports $20-$23, hit 1 times, logged\n",
+	} {
+		if !strings.Contains(out.String(), s) {
+			t.Errorf("Expected %q in the output:\n%v", s, out)
+		}
+	}
+
+	for _, spec := range []string{"", "in", "out 1 2 3", "$100", "2 1", "out 1=", "in 0=256"} {
+		if _, err := d.parsePortFilter(splitArgs(spec)); err == nil {
+			t.Errorf("Expected an error for the port filter %q", spec)
+		}
+	}
+}
+
+func TestPortTrigger(t *testing.T) {
+	d, out := newDebuggerFor("", portProgram...)
+	if err := d.AddTrigger("plog", "$22"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.AddTrigger("port", "in $20"); err != nil {
+		t.Fatal(err)
+	}
+	d.Start(false)
+	want := "Port log 1: OUT $18 to port $22 by 0x0002\nPort log 1: OUT $05 to port $22 by 0x0006\nPort breakpoint 2: IN $FF from port $20 by 0x0008\n"
+	if !strings.HasPrefix(out.String(), want) || *d.CPU.PC != 0x000A {
+		t.Errorf("Expected the log and the port breakpoint to enter interactive mode:\n%v", out)
+	}
+	if _, ok := d.CPU.IO.(*z80io.Tap); !ok {
+		t.Errorf("Expected the IO device to be tapped")
+	}
+}
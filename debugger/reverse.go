@@ -0,0 +1,175 @@
+package debugger
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+
+	"github.com/antbern/z80-emulator/core"
+)
+
+// the defaults for recording, where a snapshot of the whole memory is taken every snapshotInterval
+// instructions to make seeking fast
+const (
+	defaultRecordLimit = 100000
+	snapshotInterval   = 4096
+)
+
+// errNotRecording is returned by the reverse commands without a history
+var errNotRecording = errors.New("not recording, start with record")
+
+// Record starts recording the last limit instructions, so that the program can run backwards
+func (d *Debugger) Record(limit int) {
+	d.CPU.Record(core.NewHistory(limit, snapshotInterval))
+}
+
+// changed is called before the state of the CPU is changed by a command, which makes a new future if
+// it is in the past
+func (d *Debugger) changed() {
+	if h := d.CPU.History; h != nil && h.InPast() {
+		h.Truncate()
+		d.printf("Changing the past, the recorded instructions after %d are forgotten\n", d.CPU.Instructions)
+	}
+}
+
+// reverse undoes instructions until stop returns true, a breakpoint, write or fetch watchpoint or port
+// breakpoint is hit, the start of the history is reached or Interrupt is called. It stops before the
+// instruction that hit, so that running forward hits it again. At least one instruction is undone.
+func (d *Debugger) reverse(stop func() bool) error {
+	h := d.CPU.History
+	if h == nil {
+		return errNotRecording
+	}
+	atomic.StoreInt32(&d.interrupted, 0)
+	for {
+		r := h.Previous()
+		if r == nil {
+			d.printf("At the start of the history\n")
+			return nil
+		}
+		h.Back()
+		pc := *d.CPU.PC
+
+		// the accesses of the undone instruction, where reads are not recorded
+		for _, c := range r.Changes {
+			d.addAccess(core.Access{Kind: core.Write, Addr: c.Addr, Old: c.Old, New: c.New})
+		}
+		d.addAccess(core.Access{Kind: core.Fetch, Addr: pc, Old: d.CPU.Mem.Peek(pc), New: d.CPU.Mem.Peek(pc)})
+		d.portAccesses = append(d.portAccesses, r.Ports...)
+		watched := d.hitWatchpoints(pc)
+		if d.hitPorts(pc) || watched {
+			return nil
+		}
+
+		switch {
+		case stop():
+			return nil
+		case atomic.LoadInt32(&d.interrupted) != 0:
+			return errInterrupted
+		}
+		bp, err := d.reverseBreakpoint()
+		if err != nil {
+			return fmt.Errorf("breakpoint %d: %v", bp.ID, err)
+		}
+		if bp != nil {
+			d.printf("Breakpoint %d %v\n", bp.ID, d.describe(bp, *d.CPU.PC))
+			return nil
+		}
+	}
+}
+
+// addAccess adds an access for hitWatchpoints if an enabled watchpoint selects it
+func (d *Debugger) addAccess(a core.Access) {
+	for _, wp := range d.watchpoints {
+		if wp.Enabled && a.Addr >= wp.Start && a.Addr <= wp.End && wp.Kinds&a.Kind != 0 {
+			d.accesses = append(d.accesses, a)
+			return
+		}
+	}
+}
+
+// reverseBreakpoint returns the first enabled breakpoint at the PC with its condition true, counting
+// the hit. Ignore counts and global breakpoints are only used when running forward.
+func (d *Debugger) reverseBreakpoint() (*Breakpoint, error) {
+	for _, bp := range d.breakpoints {
+		if !bp.Enabled || bp.Global || bp.Addr != *d.CPU.PC {
+			continue
+		}
+		if bp.Cond != nil {
+			v, err := d.evalExpr(bp.Cond)
+			if err != nil {
+				return bp, err
+			}
+			if v == 0 {
+				continue
+			}
+		}
+		bp.Hits++
+		return bp, nil
+	}
+	return nil, nil
+}
+
+func (d *Debugger) cmdReverseStep(args []string) error {
+	count := 1
+	if len(args) > 0 {
+		n, err := d.eval(args[0])
+		if err != nil {
+			return err
+		}
+		count = n
+	}
+	i := 0
+	return d.reverse(func() bool {
+		i++
+		return i >= count
+	})
+}
+
+func (d *Debugger) cmdReverseContinue(args []string) error {
+	return d.reverse(func() bool { return false })
+}
+
+func (d *Debugger) cmdSeek(args []string) error {
+	if len(args) != 1 {
+		return usage("seek")
+	}
+	if d.CPU.History == nil {
+		return errNotRecording
+	}
+	n, err := d.eval(args[0])
+	if err != nil {
+		return err
+	}
+	if n < 0 {
+		return fmt.Errorf("instruction %d is negative", n)
+	}
+	return d.CPU.History.Seek(uint64(n))
+}
+
+func (d *Debugger) cmdRecord(args []string) error {
+	if len(args) > 1 {
+		return usage("record")
+	}
+	if len(args) == 1 {
+		if strings.EqualFold(args[0], "off") {
+			d.CPU.StopRecording()
+			d.printf("Stopped recording\n")
+			return nil
+		}
+		limit, err := d.eval(args[0])
+		if err != nil {
+			return err
+		}
+		if limit < 1 {
+			return fmt.Errorf("the limit must be at least one instruction, got %d", limit)
+		}
+		d.Record(limit)
+	} else if d.CPU.History == nil {
+		d.Record(defaultRecordLimit)
+	}
+	h := d.CPU.History
+	d.printf("Recording, the history has instructions %d to %d and the CPU is at %d\n", h.First(), h.Last(), d.CPU.Instructions)
+	return nil
+}
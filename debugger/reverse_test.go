@@ -0,0 +1,62 @@
+package debugger
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestReverse(t *testing.T) {
+	for _, test := range []struct {
+		script string
+		pc, sp uint16
+		b      uint8
+	}{
+		{"record\nc\nrs\n", 0x000A, 0x8000, 0},
+		{"record\nc\nrs\nrs 2\n", 0x000D, 0x7FFE, 1},
+		{"record\nc\nb sub\nrc\n", 0x000B, 0x7FFE, 1},
+		{"record\nc\nb sub\nrc\nrc\n", 0x000B, 0x7FFE, 2},
+		{"record\nc\nb sub\nrc\nrc\nn\n", 0x000D, 0x7FFE, 2},
+		{"record\nc\nrc\n", 0x0000, 0x0000, 0},
+		{"record\nc\nseek 3\n", 0x000B, 0x7FFE, 3},
+		{"record 4\nc\nrc\n", 0x000B, 0x7FFE, 1},
+	} {
+		d, out := newDebugger(test.script)
+		d.Run()
+		if *d.CPU.PC != test.pc || *d.CPU.SP != test.sp || *d.CPU.B != test.b {
+			t.Errorf("Expected %q to stop at %#04x with SP %#04x and B = %d, got %#04x, SP %#04x and B = %d:\n%v", test.script, test.pc, test.sp, test.b, *d.CPU.PC, *d.CPU.SP, *d.CPU.B, out)
+		}
+	}
+}
+
+func TestReverseMessages(t *testing.T) {
+	d, out := newDebugger("rs\nrecord\nc\nb sub\nrc\nreg B=5\nrecord\n")
+	d.Run()
+	for _, want := range []string{
+		"not recording, start with record\n",
+		"Breakpoint 1 at 0x000b <sub>\n",
+		"In the past at instruction 11, the history has 0 to 15\n",
+		"Changing the past, the recorded instructions after 11 are forgotten\n",
+		"Recording, the history has instructions 0 to 11 and the CPU is at 11\n",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("Expected %q:\n%v", want, out)
+		}
+	}
+}
+
+func TestReverseWatchpoint(t *testing.T) {
+	d, out := newDebuggerFor("record\nw $9000\nc\nc\nrc\nrc\n",
+		"LD SP,$8000",
+		"LD HL,$9000",
+		"LD (HL),1",
+		"LD (HL),2", // 0008
+		"HALT",
+	)
+	d.Run()
+	if *d.CPU.PC != 0x0006 || d.CPU.Mem.Peek(0x9000) != 0 {
+		t.Errorf("Expected to stop before the first write, got PC %#04x:\n%v", *d.CPU.PC, out)
+	}
+	if got := strings.Count(out.String(), "Watchpoint 1: write of 0x9000 by 0x0008, $01 -> $02\n"); got != 2 {
+		t.Errorf("Expected the second write to be seen forward and backward, got %d:\n%v", got, out)
+	}
+}
@@ -0,0 +1,64 @@
+package debugger
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/antbern/z80-emulator/symbols"
+)
+
+// parseLineSpec parses a source line given as "N", "N file.asm", "file.asm:N" or
+// "line N of file.asm". Without a file name the main file of the first listing is used.
+func parseLineSpec(args []string) (string, int, error) {
+	file, number := "", -1
+	for _, arg := range args {
+		switch strings.ToLower(arg) {
+		case "to", "line", "of":
+			continue
+		}
+		if i := strings.LastIndex(arg, ":"); i > 0 {
+			file, arg = arg[:i], arg[i+1:]
+		}
+		if n, err := strconv.Atoi(arg); err == nil && number < 0 {
+			number = n
+		} else {
+			file = arg
+		}
+	}
+	if number < 0 {
+		return "", 0, fmt.Errorf("expected a line number")
+	}
+	return file, number, nil
+}
+
+// atNewLine returns true if the PC is at the first instruction of a source line other than from
+func (d *Debugger) atNewLine(from *symbols.Line) bool {
+	line, ok := d.Sources.Locate(*d.CPU.PC)
+	return ok && line != from && line.Addr == *d.CPU.PC
+}
+
+// printSource prints the lines around a source line, marking the current one
+func (d *Debugger) printSource(current *symbols.Line, before, after int) {
+	d.printf("%v:\n", current.File)
+	for _, line := range d.Sources.Context(current, before, after) {
+		marker := "  "
+		if line == current {
+			marker = "=>"
+		}
+		addr := "    "
+		if len(line.Bytes) > 0 {
+			addr = fmt.Sprintf("%04x", line.Addr)
+		}
+		d.printf("%v %5d  %v  %v\n", marker, line.Number, addr, line.Source)
+	}
+}
+
+// lineAddress returns the address of a source line given by parseLineSpec arguments
+func (d *Debugger) lineAddress(args []string) (uint16, error) {
+	file, number, err := parseLineSpec(args)
+	if err != nil {
+		return 0, err
+	}
+	return d.Sources.Address(file, number)
+}
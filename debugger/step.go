@@ -0,0 +1,132 @@
+package debugger
+
+import (
+	"github.com/antbern/z80-emulator/core"
+	"github.com/antbern/z80-emulator/disasm"
+)
+
+// stackWindow is how far SP can be loaded away from a frame before the program is considered to run
+// on another stack
+const stackWindow = 256
+
+// repeating are the block instructions that repeat until a counter runs out
+var repeating = map[string]bool{
+	"LDIR": true, "LDDR": true, "CPIR": true, "CPDR": true, "INIR": true, "INDR": true, "OTIR": true, "OTDR": true,
+}
+
+// frame tracks the stack frame of a running routine by SP, to find where the routine returns even if
+// it pushes and pops registers, calls itself recursively or runs on another stack for a while
+type frame struct {
+	cpu *core.Z80
+
+	// top is the lowest address of the stack used by the callers of the routine. A return that pops
+	// from top or above returns from the routine, while the returns of the routines that it calls pop
+	// from below top.
+	top uint16
+
+	// switched is set while SP is loaded with an address far from the frame, after which the returns
+	// are on another stack until SP is loaded back
+	switched bool
+
+	// the instruction at the PC returns from the frame, or loads SP
+	returns, loadsSP bool
+}
+
+// newFrame returns a frame whose callers use the stack from top
+func (d *Debugger) newFrame(top uint16) *frame {
+	f := &frame{cpu: d.CPU, top: top}
+	f.next()
+	return f
+}
+
+// next records what the instruction at the PC does to the frame
+func (f *frame) next() {
+	pc, sp := *f.cpu.PC, *f.cpu.SP
+	f.returns = !f.switched && sp >= f.top && returns(f.cpu.Mem, pc, *f.cpu.F)
+	f.loadsSP = loadsSP(f.cpu.Mem, pc)
+}
+
+// executed updates the frame after the instruction recorded by next, returning true if it returned
+// from the frame
+func (f *frame) executed() bool {
+	if f.loadsSP {
+		sp := int(*f.cpu.SP)
+		f.switched = sp < int(f.top)-stackWindow || sp > int(f.top)+stackWindow
+	}
+	returned := f.returns
+	f.next()
+	return returned
+}
+
+// returns reports whether the instruction at pc returns, which is RET, RETI and RETN, and RET cc when
+// its condition is true with the flags f
+func returns(mem *core.RAM, pc uint16, f uint8) bool {
+	op := mem.Peek(pc)
+	switch {
+	case op == 0xC9:
+		return true
+	case op == 0xED:
+		// RETN, RETI and their undocumented duplicates
+		return mem.Peek(pc+1)&0xC7 == 0x45
+	case op&0xC7 == 0xC0:
+		// the conditions NZ, Z, NC, C, PO, PE, P and M
+		y := op >> 3 & 7
+		mask := []uint8{core.FlagZ, core.FlagC, core.FlagP, core.FlagS}[y>>1]
+		return (f&mask != 0) == (y&1 == 1)
+	}
+	return false
+}
+
+// loadsSP reports whether the instruction at pc loads SP, which is LD SP,nn, LD SP,(nn) and LD SP
+// from HL, IX or IY
+func loadsSP(mem *core.RAM, pc uint16) bool {
+	switch op := mem.Peek(pc); op {
+	case 0x31, 0xF9:
+		return true
+	case 0xDD, 0xFD:
+		return mem.Peek(pc+1) == 0xF9
+	case 0xED:
+		return mem.Peek(pc+1) == 0x7B
+	}
+	return false
+}
+
+// cmdOver steps over calls, DJNZ loops and repeating block instructions by running until the
+// instruction after them, with SP back where it was. It also stops when the routine that is called,
+// or the routine of a loop, returns elsewhere, for example to after the inline arguments of a call.
+func (d *Debugger) cmdOver(args []string) error {
+	in := d.decode(*d.CPU.PC)
+	if in.Flow != disasm.Call && in.Mnemonic != "DJNZ" && !repeating[in.Mnemonic] {
+		return d.cmdNext(nil)
+	}
+	next := in.Addr + uint16(in.Len())
+	sp := *d.CPU.SP
+	top := sp
+	if in.Flow == disasm.Call {
+		// the return address is pushed below SP
+		top -= 2
+	}
+	f := d.newFrame(top)
+	return d.run(func() bool {
+		return f.executed() || *d.CPU.PC == next && *d.CPU.SP >= sp && !f.switched
+	})
+}
+
+// cmdOut runs until the current routine has returned to its caller. The routine may have pushed
+// registers, which are popped before it returns.
+func (d *Debugger) cmdOut(args []string) error {
+	f := d.newFrame(*d.CPU.SP)
+	return d.run(f.executed)
+}
+
+// cmdToReturn runs until the instruction that returns from the current routine, without executing it
+func (d *Debugger) cmdToReturn(args []string) error {
+	f := d.newFrame(*d.CPU.SP)
+	if f.returns {
+		return nil
+	}
+	return d.run(func() bool {
+		f.executed()
+		return f.returns
+	})
+}
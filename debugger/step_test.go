@@ -0,0 +1,116 @@
+package debugger
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestStepOver(t *testing.T) {
+	for _, test := range []struct {
+		script string
+		pc, sp uint16
+		b      uint8
+	}{
+		// LD SP is stepped as usual, the CALL and DJNZ are stepped over
+		{"so\n", 0x0003, 0x8000, 0},
+		{"o loop\nso\n", 0x0008, 0x8000, 3},
+		{"o loop\nso\nso\n", 0x000A, 0x8000, 0},
+		{"o sub\nout\n", 0x0008, 0x8000, 3},
+		{"o sub\nrt\n", 0x000D, 0x7FFE, 3},
+		{"o sub\nrt\nrt\n", 0x000D, 0x7FFE, 3},
+	} {
+		d, out := newDebugger(test.script)
+		d.Run()
+		if *d.CPU.PC != test.pc || *d.CPU.SP != test.sp || *d.CPU.B != test.b {
+			t.Errorf("Expected %q to stop at %#04x with SP %#04x and B = %d, got %#04x, SP %#04x and B = %d:\n%v", test.script, test.pc, test.sp, test.b, *d.CPU.PC, *d.CPU.SP, *d.CPU.B, out)
+		}
+	}
+}
+
+func TestStepOverBreakpoint(t *testing.T) {
+	d, out := newDebugger("b sub\no loop\nso\n")
+	d.Run()
+	if *d.CPU.PC != 0x000B || !strings.Contains(out.String(), "Breakpoint 1 at 0x000b <sub>") {
+		t.Errorf("Expected the breakpoint in the routine to stop the step over:\n%v", out)
+	}
+}
+
+func TestStepOverRecursion(t *testing.T) {
+	program := []string{
+		"LD SP,$8000",
+		"LD B,3",
+		"CALL rec",
+		"HALT",
+		"rec: DEC B",
+		"LD A,B",
+		"OR A",
+		"RET Z",    // 000C
+		"CALL rec", // 000D
+		"RET",      // 0010
+	}
+
+	// the returns of the deeper calls to the instruction after the recursive call don't stop
+	d, out := newDebuggerFor("o $0D\nso\n", program...)
+	d.Run()
+	if *d.CPU.PC != 0x0010 || *d.CPU.SP != 0x7FFE || *d.CPU.B != 0 {
+		t.Errorf("Expected to stop at 0x0010 with SP 0x7ffe, got %#04x and %#04x:\n%v", *d.CPU.PC, *d.CPU.SP, out)
+	}
+
+	// stepping out of the deepest call, which returns with RET Z, to the second one, where the RET is
+	// the next instruction
+	d, out = newDebuggerFor("o $0C\no $0C\no $0C\nout\nrt\n", program...)
+	d.Run()
+	if *d.CPU.PC != 0x0010 || *d.CPU.SP != 0x7FFC {
+		t.Errorf("Expected to stop at the RET of the second call, got %#04x and SP %#04x:\n%v", *d.CPU.PC, *d.CPU.SP, out)
+	}
+}
+
+func TestStepOverStackManipulation(t *testing.T) {
+	// a routine that skips the inline data after its call
+	d, out := newDebuggerFor("o 3\nso\n",
+		"LD SP,$8000",
+		"CALL skip",
+		"RST $38", // the inline data byte $FF
+		"HALT",
+		"skip: POP HL",
+		"INC HL",
+		"PUSH HL",
+		"RET",
+	)
+	d.Run()
+	if *d.CPU.PC != 0x0007 || *d.CPU.SP != 0x8000 || d.CPU.Halted {
+		t.Errorf("Expected to stop after the inline data, got %#04x and SP %#04x:\n%v", *d.CPU.PC, *d.CPU.SP, out)
+	}
+
+	// a routine that calls another one on its own stack, and one that returns by popping the return
+	// address and jumping to it
+	program := []string{
+		"LD SP,$8000",
+		"CALL switch", // 0003
+		"CALL jump",   // 0006
+		"HALT",        // 0009
+		"switch: LD HL,0",
+		"ADD HL,SP",
+		"LD SP,$F000",
+		"PUSH HL",
+		"CALL inner",
+		"POP HL",
+		"LD SP,HL",
+		"RET",
+		"inner: RET",
+		"jump: POP HL",
+		"JP (HL)",
+	}
+	d, out = newDebuggerFor("o 3\nso\nso\n", program...)
+	d.Run()
+	if *d.CPU.PC != 0x0009 || *d.CPU.SP != 0x8000 || d.CPU.Halted {
+		t.Errorf("Expected to step over both calls, got %#04x and SP %#04x:\n%v", *d.CPU.PC, *d.CPU.SP, out)
+	}
+
+	// stepping out of the routine that switches the stack ignores the returns on the other stack
+	d, out = newDebuggerFor("o $0E\nout\n", program...)
+	d.Run()
+	if *d.CPU.PC != 0x0006 || *d.CPU.SP != 0x8000 {
+		t.Errorf("Expected to return to 0x0006, got %#04x and SP %#04x:\n%v", *d.CPU.PC, *d.CPU.SP, out)
+	}
+}
@@ -0,0 +1,210 @@
+package debugger
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/antbern/z80-emulator/core"
+	"github.com/antbern/z80-emulator/symbols"
+)
+
+// trigger enters interactive mode when it fires while the program runs freely
+type trigger struct {
+	desc  string
+	fired func(cpu *core.Z80) bool
+}
+
+// AddTrigger adds a trigger that stops the free-running program started by Start. The kinds are
+//
+//	pc     an address with an optional condition such as "putc if A == 13", which sets a breakpoint
+//	       that also stops the program later on
+//	after  a number of instructions, or of clock cycles with a c suffix such as 4000000c
+//	op     opcode bytes such as "ED B0" or 0x76, or a mnemonic such as HALT
+//	reg    a register value such as A=0x42
+//	if     a condition such as "SP < $F000 && (HL) == 0"
+//	watch  a range of memory with the kinds of accesses such as "rw buf buf+15", which sets a
+//	       watchpoint that also stops the program later on
+//	port   IN or OUT operations such as "out SIO_A_CTRL=$18" or "in $20 $23", which sets a port
+//	       breakpoint that also stops the program later on
+//	plog   IN or OUT operations like port that are logged without stopping the program
+func (d *Debugger) AddTrigger(kind, spec string) error {
+	switch kind {
+	case "pc":
+		args := splitArgs(spec)
+		if len(args) == 0 || strings.EqualFold(args[0], "if") {
+			return fmt.Errorf("expected an address, got %q", spec)
+		}
+		_, err := d.parseBreakpoint(args)
+		return err
+	case "if":
+		x, _, err := d.condition(spec)
+		if err != nil {
+			return err
+		}
+		d.triggers = append(d.triggers, trigger{"if " + spec, func(cpu *core.Z80) bool {
+			// a condition that fails to evaluate also stops the program, to show the problem
+			v, err := d.evalExpr(x)
+			return v != 0 || err != nil
+		}})
+		return nil
+	case "watch":
+		_, err := d.parseWatchpoint(splitArgs(spec))
+		return err
+	case "port", "plog":
+		_, err := d.parsePortBreakpoint(splitArgs(spec), kind == "plog")
+		return err
+	case "after":
+		return d.addAfter(spec)
+	case "op":
+		return d.addOpcode(spec)
+	case "reg":
+		return d.addRegister(spec)
+	}
+	return fmt.Errorf("unknown trigger %q", kind)
+}
+
+// addAfter adds a trigger that fires after a number of instructions or clock cycles from now
+func (d *Debugger) addAfter(spec string) error {
+	cycles := false
+	n, err := symbols.ParseNumber(spec)
+	if err != nil {
+		for _, suffix := range []string{"cycles", "c"} {
+			if strings.HasSuffix(strings.ToLower(spec), suffix) {
+				if n, err = symbols.ParseNumber(strings.TrimSpace(spec[:len(spec)-len(suffix)])); err == nil {
+					cycles = true
+					break
+				}
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("expected a number of instructions, or cycles such as 1000c, got %q", spec)
+		}
+	}
+
+	if cycles {
+		end := d.CPU.Cycles + n
+		d.triggers = append(d.triggers, trigger{fmt.Sprintf("after %d cycles", n), func(cpu *core.Z80) bool {
+			return cpu.Cycles >= end
+		}})
+	} else {
+		end := d.CPU.Instructions + n
+		d.triggers = append(d.triggers, trigger{fmt.Sprintf("after %d instructions", n), func(cpu *core.Z80) bool {
+			return cpu.Instructions >= end
+		}})
+	}
+	return nil
+}
+
+// addOpcode adds a trigger that fires before an instruction with an opcode or mnemonic is executed
+func (d *Debugger) addOpcode(spec string) error {
+	var code []uint8
+	for _, f := range strings.FieldsFunc(spec, func(r rune) bool { return r == ' ' || r == ',' }) {
+		// bare pairs of hex digits such as ED B0 are hex, other numbers need a prefix or suffix
+		if len(f) == 2 && symbols.IsHexDigit(f[0]) && symbols.IsHexDigit(f[1]) {
+			f = "0x" + f
+		}
+		v, err := symbols.ParseNumber(f)
+		if err != nil {
+			code = nil
+			break
+		}
+		if v > 0xFF {
+			return fmt.Errorf("opcode byte %q is out of range", f)
+		}
+		code = append(code, uint8(v))
+	}
+
+	if code != nil {
+		d.triggers = append(d.triggers, trigger{fmt.Sprintf("opcode % X", code), func(cpu *core.Z80) bool {
+			for i, b := range code {
+				if cpu.Mem.Peek(*cpu.PC+uint16(i)) != b {
+					return false
+				}
+			}
+			return true
+		}})
+		return nil
+	}
+
+	mnemonic := strings.ToUpper(strings.TrimSpace(spec))
+	if mnemonic == "" {
+		return fmt.Errorf("expected opcode bytes or a mnemonic")
+	}
+	d.triggers = append(d.triggers, trigger{"opcode " + mnemonic, func(cpu *core.Z80) bool {
+		text := d.decode(*cpu.PC).String()
+		return text == mnemonic || strings.HasPrefix(text, mnemonic+" ")
+	}})
+	return nil
+}
+
+// addRegister adds a trigger that fires when a register holds a value
+func (d *Debugger) addRegister(spec string) error {
+	parts := strings.SplitN(spec, "=", 2)
+	name := strings.ToUpper(strings.TrimSpace(parts[0]))
+	size := d.CPU.RegSize(name)
+	if len(parts) != 2 || size == 0 {
+		return fmt.Errorf("expected a register value such as A=0x42, got %q", spec)
+	}
+	v, err := d.value(parts[1], size)
+	if err != nil {
+		return err
+	}
+	d.triggers = append(d.triggers, trigger{fmt.Sprintf("%v=%#x", name, v), func(cpu *core.Z80) bool {
+		r, _ := cpu.Reg(name)
+		return r == v
+	}})
+	return nil
+}
+
+// triggered returns the first trigger that fired, or nil
+func (d *Debugger) triggered() *trigger {
+	for i := range d.triggers {
+		if d.triggers[i].fired(d.CPU) {
+			return &d.triggers[i]
+		}
+	}
+	return nil
+}
+
+// Start runs the program freely until a trigger fires, a breakpoint is hit or Interrupt is called,
+// and then enters interactive mode like Run. With interactive set it enters interactive mode before
+// the first instruction. A program that halts while running freely has ended, and Start returns.
+func (d *Debugger) Start(interactive bool) {
+	if !interactive {
+		var fired *trigger
+		triggered := func() bool {
+			fired = d.triggered()
+			return fired != nil
+		}
+		// run checks the triggers and breakpoints after each instruction, so they are also checked
+		// before the first one
+		var err error
+		stopped := triggered()
+		if !stopped {
+			var bp *Breakpoint
+			bp, err = d.hitBreakpoint()
+			switch {
+			case err != nil:
+				err = fmt.Errorf("breakpoint %d: %v", bp.ID, err)
+			case bp != nil:
+				d.printf("Breakpoint %d %v\n", bp.ID, d.describe(bp, *d.CPU.PC))
+				stopped = true
+			default:
+				err = d.run(triggered)
+			}
+		}
+		switch {
+		case err != nil:
+			d.printf("%v\n", err)
+		case fired != nil:
+			d.printf("Trigger %v fired\n", fired.desc)
+		case !stopped && d.CPU.Halted:
+			return
+		}
+		// the triggers have done their job
+		d.triggers = nil
+	}
+	d.nextDisasm = *d.CPU.PC
+	d.printStatus()
+	d.Run()
+}
@@ -0,0 +1,85 @@
+package debugger
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTriggers(t *testing.T) {
+	for _, test := range []struct {
+		kind, spec string
+		pc         uint16
+		message    string
+	}{
+		{"pc", "sub", 0x000B, "Breakpoint 1 at 0x000b <sub>\n"},
+		{"pc", "sub if B == 1", 0x000B, "Breakpoint 1 at 0x000b <sub> if B == 1\n"},
+		{"if", "SP < $8000 && (SP) == 8", 0x000B, "Trigger if SP < $8000 && (SP) == 8 fired\n"},
+		{"after", "4", 0x000D, "Trigger after 4 instructions fired\n"},
+		{"after", "$1F c", 0x000B, "Trigger after 31 cycles fired\n"},
+		{"op", "c9", 0x000D, "Trigger opcode C9 fired\n"},
+		{"op", "0x10, $FB", 0x0008, "Trigger opcode 10 FB fired\n"},
+		{"op", "halt", 0x000A, "Trigger opcode HALT fired\n"},
+		{"op", "LD", 0x0000, "Trigger opcode LD fired\n"},
+		{"reg", "b=2", 0x0005, "Trigger B=0x2 fired\n"},
+		{"reg", "SP=$7FFE", 0x000B, "Trigger SP=0x7ffe fired\n"},
+	} {
+		d, out := newDebugger("")
+		if err := d.AddTrigger(test.kind, test.spec); err != nil {
+			t.Errorf("Trigger %v %q: %v", test.kind, test.spec, err)
+			continue
+		}
+		d.Start(false)
+		if *d.CPU.PC != test.pc || !strings.HasPrefix(out.String(), test.message) {
+			t.Errorf("Trigger %v %q: expected %q at %#04x, got PC %#04x:\n%v", test.kind, test.spec, test.message, test.pc, *d.CPU.PC, out)
+		}
+	}
+}
+
+func TestRegisterTriggerNegative(t *testing.T) {
+	d, out := newDebuggerFor("", "LD A,1", "DEC A", "DEC A", "HALT")
+	if err := d.AddTrigger("reg", "A=-1"); err != nil {
+		t.Fatal(err)
+	}
+	d.Start(false)
+	if *d.CPU.PC != 0x0004 || !strings.HasPrefix(out.String(), "Trigger A=0xff fired\n") {
+		t.Errorf("Expected A=-1 to fire when A is 0xFF, got PC %#04x:\n%v", *d.CPU.PC, out)
+	}
+}
+
+func TestTriggersBeforeFirstInstruction(t *testing.T) {
+	for _, test := range [][2]string{{"pc", "0"}, {"reg", "B=0"}, {"if", "PC == 0"}} {
+		d, out := newDebugger("")
+		if err := d.AddTrigger(test[0], test[1]); err != nil {
+			t.Fatal(err)
+		}
+		d.Start(false)
+		if *d.CPU.PC != 0 || d.CPU.Instructions != 0 || strings.Contains(out.String(), "CPU halted") {
+			t.Errorf("Trigger %v %q: expected to stop before the first instruction, got PC %#04x:\n%v", test[0], test[1], *d.CPU.PC, out)
+		}
+	}
+}
+
+func TestTriggerErrors(t *testing.T) {
+	d, _ := newDebugger("")
+	for _, spec := range [][2]string{{"pc", "nowhere"}, {"pc", "if A"}, {"pc", "0 if"}, {"if", "A =="}, {"if", "nothing"}, {"after", "soon"}, {"op", "0x100"}, {"op", ""}, {"reg", "Q=1"}, {"reg", "A"}, {"reg", "A=256"}, {"sp", "0"}} {
+		if err := d.AddTrigger(spec[0], spec[1]); err == nil {
+			t.Errorf("Expected an error for trigger %v %q", spec[0], spec[1])
+		}
+	}
+}
+
+func TestStart(t *testing.T) {
+	// without triggers the program runs until it halts, and interactive mode is not entered
+	d, out := newDebugger("q\n")
+	d.Start(false)
+	if !d.CPU.Halted || out.String() != "CPU halted\n" {
+		t.Errorf("Expected the program to run until it halts:\n%v", out)
+	}
+
+	// interactive mode before the first instruction
+	d, out = newDebugger("q\n")
+	d.Start(true)
+	if *d.CPU.PC != 0 || !strings.Contains(out.String(), "0x0000               31 00 80     LD SP,$8000\n>") {
+		t.Errorf("Expected to start in interactive mode:\n%v", out)
+	}
+}
@@ -0,0 +1,159 @@
+package debugger
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/antbern/z80-emulator/core"
+)
+
+// Watchpoint stops the program after an instruction that accessed memory in a range of addresses
+type Watchpoint struct {
+	ID         int
+	Start, End uint16
+	Kinds      core.AccessKind
+	Enabled    bool
+
+	// Hits counts the accesses that stopped the program
+	Hits int
+}
+
+// AddWatchpoint adds an enabled watchpoint for the kinds of accesses to the addresses from start to
+// end, inclusive
+func (d *Debugger) AddWatchpoint(start, end uint16, kinds core.AccessKind) *Watchpoint {
+	wp := &Watchpoint{ID: d.nextID, Start: start, End: end, Kinds: kinds, Enabled: true}
+	d.nextID++
+	d.watchpoints = append(d.watchpoints, wp)
+	d.updateWatches()
+	return wp
+}
+
+// Watchpoints returns the watchpoints in the order they were added
+func (d *Debugger) Watchpoints() []*Watchpoint {
+	return d.watchpoints
+}
+
+// RemoveWatchpoint removes a watchpoint
+func (d *Debugger) RemoveWatchpoint(wp *Watchpoint) {
+	for i, w := range d.watchpoints {
+		if w == wp {
+			d.watchpoints = append(d.watchpoints[:i], d.watchpoints[i+1:]...)
+			break
+		}
+	}
+	d.updateWatches()
+}
+
+// updateWatches watches the memory of the enabled watchpoints, and nothing if there are none so that
+// the memory accesses of the CPU are not slowed down
+func (d *Debugger) updateWatches() {
+	mem := d.CPU.Mem
+	mem.ClearWatches()
+	mem.SetWatcher(func(a core.Access) {
+		d.accesses = append(d.accesses, a)
+	})
+	for _, wp := range d.watchpoints {
+		if wp.Enabled {
+			mem.Watch(wp.Start, wp.End, wp.Kinds)
+		}
+	}
+}
+
+// hitWatchpoints reports the watched accesses of the instruction at pc, returning true if there were any
+func (d *Debugger) hitWatchpoints(pc uint16) bool {
+	if len(d.accesses) == 0 {
+		return false
+	}
+	for _, a := range d.accesses {
+		for _, wp := range d.watchpoints {
+			if !wp.Enabled || a.Addr < wp.Start || a.Addr > wp.End || wp.Kinds&a.Kind == 0 {
+				continue
+			}
+			wp.Hits++
+			value := fmt.Sprintf("$%02X", a.New)
+			if a.Kind == core.Write {
+				value = fmt.Sprintf("$%02X -> $%02X", a.Old, a.New)
+			}
+			d.printf("Watchpoint %d: %v of %v by %v, %v\n", wp.ID, a.Kind, d.CPU.FormatAddr(a.Addr), d.CPU.FormatAddr(pc), value)
+		}
+	}
+	d.accesses = d.accesses[:0]
+	return true
+}
+
+// parseKinds parses access kinds given as letters r, w and x, returning false for other text
+func parseKinds(s string) (core.AccessKind, bool) {
+	var kinds core.AccessKind
+	for _, c := range strings.ToLower(s) {
+		switch c {
+		case 'r':
+			kinds |= core.Read
+		case 'w':
+			kinds |= core.Write
+		case 'x':
+			kinds |= core.Fetch
+		default:
+			return 0, false
+		}
+	}
+	return kinds, s != ""
+}
+
+// parseWatchpoint adds a watchpoint from the arguments "[r|w|x...] start [end]", watching writes by
+// default
+func (d *Debugger) parseWatchpoint(args []string) (*Watchpoint, error) {
+	kinds := core.Write
+	if len(args) > 1 {
+		if k, ok := parseKinds(args[0]); ok {
+			kinds, args = k, args[1:]
+		}
+	}
+	if len(args) < 1 || len(args) > 2 {
+		return nil, usage("watch")
+	}
+	start, err := d.address(args[0])
+	if err != nil {
+		return nil, err
+	}
+	end := start
+	if len(args) == 2 {
+		if end, err = d.address(args[1]); err != nil {
+			return nil, err
+		}
+		if end < start {
+			return nil, fmt.Errorf("the end %v is before the start %v", d.CPU.FormatAddr(end), d.CPU.FormatAddr(start))
+		}
+	}
+	return d.AddWatchpoint(start, end, kinds), nil
+}
+
+// describeWatchpoint returns the kinds and addresses of a watchpoint
+func (d *Debugger) describeWatchpoint(wp *Watchpoint) string {
+	s := fmt.Sprintf("%v of %v", wp.Kinds, d.CPU.FormatAddr(wp.Start))
+	if wp.End != wp.Start {
+		s += " to " + d.CPU.FormatAddr(wp.End)
+	}
+	return s
+}
+
+func (d *Debugger) cmdWatch(args []string) error {
+	if len(args) == 0 {
+		if len(d.watchpoints) == 0 {
+			d.printf("No watchpoints\n")
+		}
+		for _, wp := range d.watchpoints {
+			state := ""
+			if !wp.Enabled {
+				state = " (disabled)"
+			}
+			d.printf("%d: %v, hit %d times%v\n", wp.ID, d.describeWatchpoint(wp), wp.Hits, state)
+		}
+		return nil
+	}
+	wp, err := d.parseWatchpoint(args)
+	if err != nil {
+		return err
+	}
+	d.printf("Watchpoint %d: %v\n", wp.ID, d.describeWatchpoint(wp))
+	return nil
+}
@@ -0,0 +1,46 @@
+package debugger
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestWatchpoints(t *testing.T) {
+	d, out := newDebugger("watch $7FFE $7FFF\nw r $7FFE\nwatch x sub+2\nwatch\nc\nc\nc\ndisable 1\nd 2\nc\nd all\nc\n")
+	d.Run()
+	for _, s := range []string{
+		"Watchpoint 1: write of 0x7ffe <sub+32755> to 0x7fff <sub+32756>\n",
+		"Watchpoint 2: read of 0x7ffe <sub+32755>\n",
+		"3: fetch of 0x000d <sub+2>, hit 0 times\n",
+		// CALL sub
+		"Watchpoint 1: write of 0x7fff <sub+32756> by 0x0005 <loop>, $00 -> $00\nWatchpoint 1: write of 0x7ffe <sub+32755> by 0x0005 <loop>, $00 -> $08\n",
+		// RET
+		"Watchpoint 3: fetch of 0x000d <sub+2> by 0x000d <sub+2>, $C9\nWatchpoint 2: read of 0x7ffe <sub+32755> by 0x000d <sub+2>, $08\n",
+		// the second CALL writes the same values, and only the RET fetch is left
+		"Watchpoint 1: write of 0x7ffe <sub+32755> by 0x0005 <loop>, $08 -> $08\n",
+		"Watchpoint 3: fetch of 0x000d <sub+2> by 0x000d <sub+2>, $C9\n" + "PC: 0x0008",
+	} {
+		if !strings.Contains(out.String(), s) {
+			t.Errorf("Expected %q in the output:\n%v", s, out)
+		}
+	}
+	if !d.CPU.Halted || d.CPU.Mem.Peek(0x7FFE) != 0x08 {
+		t.Errorf("Expected the program to run to the end after deleting the watchpoints:\n%v", out)
+	}
+}
+
+func TestWatchpointTrigger(t *testing.T) {
+	d, out := newDebugger("")
+	if err := d.AddTrigger("watch", "w $7FFE"); err != nil {
+		t.Fatal(err)
+	}
+	d.Start(false)
+	if *d.CPU.PC != 0x000B || !strings.HasPrefix(out.String(), "Watchpoint 1: write of 0x7ffe <sub+32755> by 0x0005 <loop>, $00 -> $08\n") {
+		t.Errorf("Expected the watchpoint to enter interactive mode:\n%v", out)
+	}
+	for _, spec := range []string{"", "w", "rz 0", "w 2 1"} {
+		if err := d.AddTrigger("watch", spec); err == nil {
+			t.Errorf("Expected an error for the watchpoint %q", spec)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/antbern/z80-emulator/core"
+	"github.com/antbern/z80-emulator/disasm"
+	"github.com/antbern/z80-emulator/loader"
+	"github.com/antbern/z80-emulator/symbols"
+)
+
+// runDisasm implements the disasm subcommand, which prints a linear disassembly of program files, or
+// traces the program flow to write re-assemblable source
+func runDisasm(args []string) int {
+	fs := flag.NewFlagSet("disasm", flag.ExitOnError)
+	format := fs.String("format", "", "The format of the files (bin, ihex or srec), chosen by file extension if empty")
+	start := fs.String("start", "", "The first address to disassemble, defaults to the start of each loaded segment")
+	end := fs.String("end", "", "The last address to disassemble, defaults to the end of each loaded segment")
+	var symFiles listFlags
+	fs.Var(&symFiles, "sym", "A listing or symbol file with labels for the program (repeatable)")
+	trace := fs.Bool("trace", false, "Follow the program flow from the entry points to separate code from data, and write re-assemblable source")
+	var entries listFlags
+	fs.Var(&entries, "entry", "An entry point address or label for -trace (repeatable). The reset address, RST vectors and NMI handler are always used")
+	symEntries := fs.Bool("sym-entries", false, "Use the labels of instructions in the listings given with -sym as entry points for -trace. Labels of data, and labels from symbol files without source, are not used, but a label of code that is never executed is still decoded as code")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s disasm [flags] file[@addr]...\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() < 1 {
+		fs.Usage()
+		return 2
+	}
+
+	var specs []loader.Spec
+	for _, arg := range fs.Args() {
+		spec, err := loader.ParseSpec(arg)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+		specs = append(specs, spec)
+	}
+	img, err := loader.LoadAll(specs, *format)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error loading file:", err)
+		return 1
+	}
+	ram := core.NewRAM()
+	if err := ram.Load(img); err != nil {
+		fmt.Fprintln(os.Stderr, "Error loading file:", err)
+		return 1
+	}
+
+	syms := symbols.NewTable()
+	sources := &symbols.Sources{}
+	for _, file := range symFiles {
+		var t *symbols.Table
+		if strings.EqualFold(filepath.Ext(file), ".lst") {
+			l, err := symbols.LoadListing(file)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "Error loading symbols:", err)
+				return 1
+			}
+			t = l.Symbols()
+			sources.Add(l)
+		} else if t, err = symbols.Load(file); err != nil {
+			fmt.Fprintln(os.Stderr, "Error loading symbols:", err)
+			return 1
+		}
+		syms.Merge(t)
+	}
+
+	// the ranges to disassemble
+	type addrRange struct{ start, end uint16 }
+	var ranges []addrRange
+	for _, s := range img.Segments {
+		if len(s.Data) > 0 {
+			ranges = append(ranges, addrRange{uint16(s.Addr), uint16(s.Addr + uint32(len(s.Data)) - 1)})
+		}
+	}
+	if *start != "" || *end != "" {
+		r := addrRange{0, 0xFFFF}
+		if len(ranges) > 0 {
+			r = addrRange{ranges[0].start, ranges[len(ranges)-1].end}
+		}
+		if *start != "" {
+			if r.start, err = syms.ParseAddress(*start); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return 2
+			}
+		}
+		if *end != "" {
+			if r.end, err = syms.ParseAddress(*end); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return 2
+			}
+		}
+		ranges = []addrRange{r}
+	}
+
+	if *trace {
+		tracer := &disasm.Tracer{Entries: disasm.DefaultEntries, Names: func(addr uint16) string {
+			name, _ := syms.Name(addr)
+			return name
+		}}
+		if img.HasStart {
+			tracer.Entries = append(tracer.Entries, uint16(img.Start))
+		}
+		for _, e := range entries {
+			addr, err := syms.ParseAddress(e)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return 2
+			}
+			tracer.Entries = append(tracer.Entries, addr)
+		}
+		if *symEntries {
+			// only labels of instructions, since the labels of strings and tables would be decoded
+			// as code
+			for _, s := range syms.Symbols() {
+				if line, ok := sources.Locate(s.Value); ok && s.Kind == symbols.Label && !line.IsData() {
+					tracer.Entries = append(tracer.Entries, s.Value)
+				}
+			}
+		}
+		for _, r := range ranges {
+			if err := tracer.Trace(ram, r.start, r.end).WriteSource(os.Stdout); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return 1
+			}
+		}
+		return 0
+	}
+
+	d := &disasm.Decoder{Label: func(addr uint16) string {
+		name, _ := syms.Name(addr)
+		return name
+	}}
+	for _, r := range ranges {
+		for _, in := range d.Disassemble(ram, r.start, r.end) {
+			if name, ok := syms.Name(in.Addr); ok {
+				fmt.Printf("%s:\n", name)
+			}
+			fmt.Printf("%04X  %-12s  %v\n", in.Addr, formatBytes(in.Bytes), in)
+		}
+	}
+	return 0
+}
+
+// formatBytes returns bytes as space separated hex pairs
+func formatBytes(data []uint8) string {
+	var parts []string
+	for _, b := range data {
+		parts = append(parts, fmt.Sprintf("%02X", b))
+	}
+	return strings.Join(parts, " ")
+}
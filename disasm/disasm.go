@@ -0,0 +1,516 @@
+// Package disasm disassembles Z80 machine code into Zilog mnemonics, using the decoding tables of
+// the core package
+package disasm
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/antbern/z80-emulator/core"
+)
+
+// Memory is the memory read by the disassembler. It is implemented by core.RAM.
+type Memory interface {
+	Peek(addr uint16) uint8
+}
+
+// Bytes is a block of code at an origin address, for disassembling code that is not in a RAM.
+// Addresses outside the block read as 0.
+type Bytes struct {
+	Origin uint16
+	Data   []uint8
+}
+
+// Peek returns the byte at the address
+func (b Bytes) Peek(addr uint16) uint8 {
+	i := int(addr - b.Origin)
+	if i < len(b.Data) {
+		return b.Data[i]
+	}
+	return 0
+}
+
+// Flow tells how an instruction affects the program flow
+type Flow int
+
+const (
+	// Next means that execution continues with the next instruction
+	Next Flow = iota
+	// Jump is an unconditional jump to the target (JP, JR)
+	Jump
+	// Branch is a conditional jump to the target (JP cc, JR cc, DJNZ)
+	Branch
+	// Call is a call to the target (CALL, CALL cc, RST), which returns to the next instruction
+	Call
+	// Return is an unconditional return (RET, RETI, RETN)
+	Return
+	// CondReturn is a conditional return (RET cc)
+	CondReturn
+	// Indirect is a jump to an address in a register (JP (HL), JP (IX), JP (IY))
+	Indirect
+	// Halt stops execution until an interrupt (HALT)
+	Halt
+)
+
+// Instruction is a decoded instruction
+type Instruction struct {
+	Addr  uint16
+	Bytes []uint8
+
+	// Mnemonic is the operation, like "LD", and Operands the comma separated operands, like "A,(HL)"
+	Mnemonic string
+	Operands string
+
+	// Flow is the effect on the program flow, with the destination in Target for jumps and calls
+	Flow   Flow
+	Target uint16
+
+	// Ref is set for instructions with a 16 bit immediate or absolute address operand, which is
+	// stored in RefAddr. Jump and call targets are not included.
+	Ref     bool
+	RefAddr uint16
+}
+
+// Len returns the length of the instruction in bytes
+func (i Instruction) Len() int {
+	return len(i.Bytes)
+}
+
+// String returns the instruction in assembler syntax
+func (i Instruction) String() string {
+	if i.Operands == "" {
+		return i.Mnemonic
+	}
+	return i.Mnemonic + " " + i.Operands
+}
+
+// Decoder decodes instructions, optionally naming the addresses used by them
+type Decoder struct {
+	// Label returns the name of an address used as a jump target or a 16 bit operand, or an empty
+	// string to print it as a number
+	Label func(addr uint16) string
+}
+
+// Decode decodes the instruction at addr without naming any addresses
+func Decode(mem Memory, addr uint16) Instruction {
+	return (&Decoder{}).Decode(mem, addr)
+}
+
+// Length returns the length of the instruction at addr
+func Length(mem Memory, addr uint16) int {
+	return Decode(mem, addr).Len()
+}
+
+// Disassemble decodes all instructions from start up to and including end
+func Disassemble(mem Memory, start, end uint16) []Instruction {
+	return (&Decoder{}).Disassemble(mem, start, end)
+}
+
+// Disassemble decodes all instructions from start up to and including end
+func (d *Decoder) Disassemble(mem Memory, start, end uint16) []Instruction {
+	var instrs []Instruction
+	addr := uint32(start)
+	for addr <= uint32(end) {
+		in := d.Decode(mem, uint16(addr))
+		instrs = append(instrs, in)
+		addr += uint32(in.Len())
+	}
+	return instrs
+}
+
+// decoding holds the state while decoding one instruction
+type decoding struct {
+	d   *Decoder
+	mem Memory
+	pc  uint16
+	in  *Instruction
+
+	// index is HL, IX or IY depending on the prefix, and the displacement of (IX+d) is read the
+	// first time it is used
+	index    string
+	disp     int8
+	dispRead bool
+}
+
+func (s *decoding) fetch() uint8 {
+	b := s.mem.Peek(s.pc)
+	s.in.Bytes = append(s.in.Bytes, b)
+	s.pc++
+	return b
+}
+
+func (s *decoding) fetch16() uint16 {
+	lo := s.fetch()
+	return uint16(s.fetch())<<8 | uint16(lo)
+}
+
+// hex8 and hex16 format numbers in the notation used by the listings
+func hex8(v uint8) string {
+	return fmt.Sprintf("$%02X", v)
+}
+
+func hex16(v uint16) string {
+	return fmt.Sprintf("$%04X", v)
+}
+
+// addr formats an address, using its label if there is one
+func (s *decoding) addr(a uint16) string {
+	if s.d.Label != nil {
+		if name := s.d.Label(a); name != "" {
+			return name
+		}
+	}
+	return hex16(a)
+}
+
+// nn fetches a 16 bit operand that is an address or a value
+func (s *decoding) nn() string {
+	v := s.fetch16()
+	s.in.Ref, s.in.RefAddr = true, v
+	return s.addr(v)
+}
+
+// target fetches a 16 bit jump target
+func (s *decoding) target(flow Flow) string {
+	s.in.Flow, s.in.Target = flow, s.fetch16()
+	return s.addr(s.in.Target)
+}
+
+// relative fetches the displacement of a relative jump
+func (s *decoding) relative(flow Flow) string {
+	d := int8(s.fetch())
+	s.in.Flow, s.in.Target = flow, s.pc+uint16(d)
+	return s.addr(s.in.Target)
+}
+
+// indexed returns (HL), or (IX+d) with the displacement fetched the first time
+func (s *decoding) indexed() string {
+	if s.index == "HL" {
+		return "(HL)"
+	}
+	if !s.dispRead {
+		s.disp, s.dispRead = int8(s.fetch()), true
+	}
+	if s.disp < 0 {
+		return fmt.Sprintf("(%s-%s)", s.index, hex8(uint8(-int(s.disp))))
+	}
+	return fmt.Sprintf("(%s+%s)", s.index, hex8(uint8(s.disp)))
+}
+
+// r returns the name of an 8 bit register. With an index prefix H and L are replaced by the halves of
+// the index register, unless the instruction also uses (IX+d).
+func (s *decoding) r(i uint8, memOperand bool) string {
+	switch {
+	case i == 6:
+		return s.indexed()
+	case (i == 4 || i == 5) && s.index != "HL" && !memOperand:
+		return s.index + core.RegNames[i][:1]
+	}
+	return core.RegNames[i]
+}
+
+// rp returns the name of a register pair, with HL replaced by the index register
+func (s *decoding) rp(i uint8, af bool) string {
+	if i == 2 {
+		return s.index
+	}
+	if af {
+		return core.RegPairNamesAF[i]
+	}
+	return core.RegPairNames[i]
+}
+
+// set stores the mnemonic and operands
+func (s *decoding) set(mnemonic string, operands ...string) {
+	s.in.Mnemonic = mnemonic
+	s.in.Operands = strings.Join(operands, ",")
+}
+
+// invalid marks the bytes read so far as data, for op codes that are not instructions
+func (s *decoding) invalid() {
+	var bytes []string
+	for _, b := range s.in.Bytes {
+		bytes = append(bytes, hex8(b))
+	}
+	s.set("DB", bytes...)
+	s.in.Flow = Next
+}
+
+// Decode decodes the instruction at addr
+func (d *Decoder) Decode(mem Memory, addr uint16) Instruction {
+	in := Instruction{Addr: addr}
+	s := &decoding{d: d, mem: mem, pc: addr, in: &in, index: "HL"}
+
+	opCode := s.fetch()
+	switch opCode {
+	case 0xCB:
+		s.decodeCB(s.fetch())
+	case 0xED:
+		s.decodeED(s.fetch())
+	case 0xDD, 0xFD:
+		s.index = "IX"
+		if opCode == 0xFD {
+			s.index = "IY"
+		}
+		switch next := mem.Peek(s.pc); next {
+		case 0xDD, 0xFD, 0xED:
+			// the prefix has no effect and acts like a NOP
+			s.invalid()
+		case 0xCB:
+			s.fetch()
+			s.indexed()
+			s.decodeCB(s.fetch())
+		default:
+			s.decode(s.fetch())
+		}
+	default:
+		s.decode(opCode)
+	}
+	return in
+}
+
+// usesMemory returns true if an unprefixed op code has (HL) as an operand
+func usesMemory(op core.OP) bool {
+	switch op.X() {
+	case 0:
+		return (op.Z() >= 4 && op.Z() <= 6) && op.Y() == 6
+	case 1:
+		return (op.Z() == 6 || op.Y() == 6) && !(op.Z() == 6 && op.Y() == 6)
+	case 2:
+		return op.Z() == 6
+	}
+	return false
+}
+
+// decode decodes an unprefixed op code, or one with a DD or FD prefix
+func (s *decoding) decode(opCode uint8) {
+	op := core.DecodeOP(opCode)
+	x, y, z, p, q := op.X(), op.Y(), op.Z(), op.P(), op.Q()
+	mem := usesMemory(op)
+
+	switch x {
+	case 0:
+		switch z {
+		case 0:
+			switch y {
+			case 0:
+				s.set("NOP")
+			case 1:
+				s.set("EX", "AF", "AF'")
+			case 2:
+				s.set("DJNZ", s.relative(Branch))
+			case 3:
+				s.set("JR", s.relative(Jump))
+			default:
+				s.set("JR", core.CondNames[y-4], s.relative(Branch))
+			}
+		case 1:
+			if q == 0 {
+				s.set("LD", s.rp(p, false), s.nn())
+			} else {
+				s.set("ADD", s.index, s.rp(p, false))
+			}
+		case 2:
+			switch {
+			case p == 2 && q == 0:
+				s.set("LD", "("+s.nn()+")", s.index)
+			case p == 2:
+				s.set("LD", s.index, "("+s.nn()+")")
+			case p == 3 && q == 0:
+				s.set("LD", "("+s.nn()+")", "A")
+			case p == 3:
+				s.set("LD", "A", "("+s.nn()+")")
+			case q == 0:
+				s.set("LD", "("+core.RegPairNames[p]+")", "A")
+			default:
+				s.set("LD", "A", "("+core.RegPairNames[p]+")")
+			}
+		case 3:
+			if q == 0 {
+				s.set("INC", s.rp(p, false))
+			} else {
+				s.set("DEC", s.rp(p, false))
+			}
+		case 4:
+			s.set("INC", s.r(y, mem))
+		case 5:
+			s.set("DEC", s.r(y, mem))
+		case 6:
+			dst := s.r(y, mem) // the displacement comes before the immediate value
+			s.set("LD", dst, hex8(s.fetch()))
+		case 7:
+			s.set(core.AccNames[y])
+		}
+	case 1:
+		if z == 6 && y == 6 {
+			s.set("HALT")
+			s.in.Flow = Halt
+			return
+		}
+		s.set("LD", s.r(y, mem), s.r(z, mem))
+	case 2:
+		s.alu(y, s.r(z, mem))
+	case 3:
+		switch z {
+		case 0:
+			s.set("RET", core.CondNames[y])
+			s.in.Flow = CondReturn
+		case 1:
+			switch {
+			case q == 0:
+				s.set("POP", s.rp(p, true))
+			case p == 0:
+				s.set("RET")
+				s.in.Flow = Return
+			case p == 1:
+				s.set("EXX")
+			case p == 2:
+				s.set("JP", "("+s.index+")")
+				s.in.Flow = Indirect
+			default:
+				s.set("LD", "SP", s.index)
+			}
+		case 2:
+			s.set("JP", core.CondNames[y], s.target(Branch))
+		case 3:
+			switch y {
+			case 0:
+				s.set("JP", s.target(Jump))
+			case 2:
+				s.set("OUT", "("+hex8(s.fetch())+")", "A")
+			case 3:
+				s.set("IN", "A", "("+hex8(s.fetch())+")")
+			case 4:
+				s.set("EX", "(SP)", s.index)
+			case 5:
+				s.set("EX", "DE", "HL")
+			case 6:
+				s.set("DI")
+			case 7:
+				s.set("EI")
+			}
+		case 4:
+			s.set("CALL", core.CondNames[y], s.target(Call))
+		case 5:
+			if q == 0 {
+				s.set("PUSH", s.rp(p, true))
+			} else {
+				// p = 0 is CALL nn, the other values are prefixes handled by Decode
+				s.set("CALL", s.target(Call))
+			}
+		case 6:
+			s.alu(y, hex8(s.fetch()))
+		case 7:
+			s.in.Flow, s.in.Target = Call, uint16(y)*8
+			s.set("RST", hex8(y*8))
+		}
+	}
+}
+
+// alu sets an arithmetic or logic operation, with A as the first operand where Zilog writes it
+func (s *decoding) alu(y uint8, operand string) {
+	switch y {
+	case 0, 1, 3: // ADD, ADC and SBC
+		s.set(core.ALUNames[y], "A", operand)
+	default:
+		s.set(core.ALUNames[y], operand)
+	}
+}
+
+// decodeCB decodes a CB prefixed op code. With an index prefix the operand is always (IX+d), and the
+// result is also copied to r[z] unless z is 6.
+func (s *decoding) decodeCB(opCode uint8) {
+	op := core.DecodeOP(opCode)
+	x, y, z := op.X(), op.Y(), op.Z()
+
+	operand := s.r(z, false)
+	if s.index != "HL" {
+		operand = s.indexed()
+	}
+	copyTo := ""
+	if s.index != "HL" && z != 6 && x != 1 {
+		copyTo = core.RegNames[z]
+	}
+
+	var operands []string
+	switch x {
+	case 0:
+		operands = []string{operand}
+		s.in.Mnemonic = core.RotNames[y]
+	default:
+		operands = []string{fmt.Sprint(y), operand}
+		s.in.Mnemonic = [4]string{"", "BIT", "RES", "SET"}[x]
+	}
+	if copyTo != "" {
+		operands = append(operands, copyTo)
+	}
+	s.set(s.in.Mnemonic, operands...)
+}
+
+// decodeED decodes an ED prefixed op code
+func (s *decoding) decodeED(opCode uint8) {
+	op := core.DecodeOP(opCode)
+	x, y, z, p, q := op.X(), op.Y(), op.Z(), op.P(), op.Q()
+
+	switch {
+	case x == 1:
+		switch z {
+		case 0:
+			if y == 6 {
+				s.set("IN", "(C)")
+			} else {
+				s.set("IN", core.RegNames[y], "(C)")
+			}
+		case 1:
+			if y == 6 {
+				s.set("OUT", "(C)", "0")
+			} else {
+				s.set("OUT", "(C)", core.RegNames[y])
+			}
+		case 2:
+			if q == 0 {
+				s.set("SBC", "HL", core.RegPairNames[p])
+			} else {
+				s.set("ADC", "HL", core.RegPairNames[p])
+			}
+		case 3:
+			if q == 0 {
+				s.set("LD", "("+s.nn()+")", core.RegPairNames[p])
+			} else {
+				s.set("LD", core.RegPairNames[p], "("+s.nn()+")")
+			}
+		case 4:
+			s.set("NEG")
+		case 5:
+			if y == 1 {
+				s.set("RETI")
+			} else {
+				s.set("RETN")
+			}
+			s.in.Flow = Return
+		case 6:
+			s.set("IM", core.IMModes[y])
+		case 7:
+			switch y {
+			case 0:
+				s.set("LD", "I", "A")
+			case 1:
+				s.set("LD", "R", "A")
+			case 2:
+				s.set("LD", "A", "I")
+			case 3:
+				s.set("LD", "A", "R")
+			case 4:
+				s.set("RRD")
+			case 5:
+				s.set("RLD")
+			default:
+				s.invalid()
+			}
+		}
+	case x == 2 && z <= 3 && y >= 4:
+		s.set(core.BlockNames[y-4][z])
+	default:
+		s.invalid()
+	}
+}
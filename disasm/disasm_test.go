@@ -0,0 +1,273 @@
+package disasm
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/antbern/z80-emulator/core"
+	"github.com/antbern/z80-emulator/symbols"
+)
+
+func TestDecode(t *testing.T) {
+	tables := []struct {
+		code []uint8
+		text string
+	}{
+		{[]uint8{0x00}, "NOP"},
+		{[]uint8{0x08}, "EX AF,AF'"},
+		{[]uint8{0x10, 0xFE}, "DJNZ $1000"},
+		{[]uint8{0x20, 0x05}, "JR NZ,$1007"},
+		{[]uint8{0x21, 0x34, 0x12}, "LD HL,$1234"},
+		{[]uint8{0x22, 0x34, 0x12}, "LD ($1234),HL"},
+		{[]uint8{0x3A, 0x34, 0x12}, "LD A,($1234)"},
+		{[]uint8{0x0A}, "LD A,(BC)"},
+		{[]uint8{0x36, 0x42}, "LD (HL),$42"},
+		{[]uint8{0x07}, "RLCA"},
+		{[]uint8{0x76}, "HALT"},
+		{[]uint8{0x7E}, "LD A,(HL)"},
+		{[]uint8{0x8A}, "ADC A,D"},
+		{[]uint8{0xA8}, "XOR B"},
+		{[]uint8{0xC8}, "RET Z"},
+		{[]uint8{0xF1}, "POP AF"},
+		{[]uint8{0xE9}, "JP (HL)"},
+		{[]uint8{0xF9}, "LD SP,HL"},
+		{[]uint8{0xDA, 0x00, 0x20}, "JP C,$2000"},
+		{[]uint8{0xD3, 0x20}, "OUT ($20),A"},
+		{[]uint8{0xDB, 0x21}, "IN A,($21)"},
+		{[]uint8{0xE3}, "EX (SP),HL"},
+		{[]uint8{0xEB}, "EX DE,HL"},
+		{[]uint8{0xF4, 0x00, 0x30}, "CALL P,$3000"},
+		{[]uint8{0xCD, 0xE9, 0x04}, "CALL $04E9"},
+		{[]uint8{0xFE, 0x0D}, "CP $0D"},
+		{[]uint8{0xFF}, "RST $38"},
+		{[]uint8{0xCB, 0x07}, "RLC A"},
+		{[]uint8{0xCB, 0x3E}, "SRL (HL)"},
+		{[]uint8{0xCB, 0x7F}, "BIT 7,A"},
+		{[]uint8{0xCB, 0xC6}, "SET 0,(HL)"},
+		{[]uint8{0xED, 0x78}, "IN A,(C)"},
+		{[]uint8{0xED, 0x71}, "OUT (C),0"},
+		{[]uint8{0xED, 0x52}, "SBC HL,DE"},
+		{[]uint8{0xED, 0x43, 0x00, 0x80}, "LD ($8000),BC"},
+		{[]uint8{0xED, 0x7B, 0x00, 0x80}, "LD SP,($8000)"},
+		{[]uint8{0xED, 0x44}, "NEG"},
+		{[]uint8{0xED, 0x4D}, "RETI"},
+		{[]uint8{0xED, 0x5E}, "IM 2"},
+		{[]uint8{0xED, 0x57}, "LD A,I"},
+		{[]uint8{0xED, 0x6F}, "RLD"},
+		{[]uint8{0xED, 0xB0}, "LDIR"},
+		{[]uint8{0xED, 0xBB}, "OTDR"},
+		{[]uint8{0xED, 0x00}, "DB $ED,$00"},
+		{[]uint8{0xDD, 0x21, 0x00, 0x40}, "LD IX,$4000"},
+		{[]uint8{0xDD, 0x7E, 0xFE}, "LD A,(IX-$02)"},
+		{[]uint8{0xFD, 0x36, 0x05, 0x42}, "LD (IY+$05),$42"},
+		{[]uint8{0xDD, 0x66, 0x01}, "LD H,(IX+$01)"},
+		{[]uint8{0xDD, 0x65}, "LD IXH,IXL"},
+		{[]uint8{0xFD, 0x09}, "ADD IY,BC"},
+		{[]uint8{0xFD, 0xE9}, "JP (IY)"},
+		{[]uint8{0xDD, 0xE3}, "EX (SP),IX"},
+		{[]uint8{0xDD, 0x34, 0x10}, "INC (IX+$10)"},
+		{[]uint8{0xDD, 0xCB, 0x03, 0x46}, "BIT 0,(IX+$03)"},
+		{[]uint8{0xFD, 0xCB, 0xFF, 0x16}, "RL (IY-$01)"},
+		{[]uint8{0xDD, 0xCB, 0x03, 0xC0}, "SET 0,(IX+$03),B"},
+	}
+	for _, table := range tables {
+		in := Decode(Bytes{Origin: 0x1000, Data: table.code}, 0x1000)
+		if in.String() != table.text || in.Len() != len(table.code) {
+			t.Errorf("Decoding % X gave %q (%d bytes), want %q (%d bytes)", table.code, in.String(), in.Len(), table.text, len(table.code))
+		}
+	}
+
+	// a prefix followed by another prefix is a single byte NOP
+	if in := Decode(Bytes{Data: []uint8{0xDD, 0xFD, 0x21}}, 0); in.String() != "DB $DD" || in.Len() != 1 {
+		t.Errorf("Expected a lone prefix, got %q (%d bytes)", in, in.Len())
+	}
+}
+
+func TestFlow(t *testing.T) {
+	code := Bytes{Origin: 0x100, Data: []uint8{0x18, 0xFE, 0xC0, 0xCD, 0x34, 0x12, 0xDD, 0xE9, 0xD7}}
+	tables := []struct {
+		addr   uint16
+		flow   Flow
+		target uint16
+	}{
+		{0x100, Jump, 0x100}, {0x102, CondReturn, 0}, {0x103, Call, 0x1234}, {0x106, Indirect, 0}, {0x108, Call, 0x10},
+	}
+	for _, table := range tables {
+		in := Decode(code, table.addr)
+		if in.Flow != table.flow || in.Target != table.target {
+			t.Errorf("%v at %#04x: flow %v target %#04x, want %v %#04x", in, table.addr, in.Flow, in.Target, table.flow, table.target)
+		}
+	}
+
+	d := &Decoder{Label: func(addr uint16) string {
+		if addr == 0x1234 {
+			return "print"
+		}
+		return ""
+	}}
+	if in := d.Decode(code, 0x103); in.String() != "CALL print" {
+		t.Errorf("Expected the target to be named, got %q", in)
+	}
+}
+
+// TestListingLengths checks the instruction lengths against the code of the monitor listing
+func TestListingLengths(t *testing.T) {
+	f, err := os.Open("../input/monitor.lst")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer f.Close()
+	l, err := symbols.ReadListing(f, "monitor.asm")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checked := 0
+	for _, line := range l.Lines {
+		// skip data, which has a directive as the first or second field after any label
+		fields := strings.Fields(line.Source)
+		if len(line.Bytes) == 0 || line.Skipped || len(fields) == 0 ||
+			strings.HasPrefix(fields[0], ".") || len(fields) > 1 && strings.HasPrefix(fields[1], ".") {
+			continue
+		}
+		in := Decode(Bytes{Origin: line.Addr, Data: line.Bytes}, line.Addr)
+		if in.Len() != len(line.Bytes) {
+			t.Errorf("Line %d of %v (%q): decoded %q with %d bytes, listing has %d", line.Number, line.File, line.Source, in, in.Len(), len(line.Bytes))
+		}
+		checked++
+	}
+	if checked < 100 {
+		t.Errorf("Only %d instructions checked", checked)
+	}
+}
+
+// cpuTest sets up a CPU with distinct register values to execute an instruction at $1000, with the
+// flags in F, $66 at the address in HL and a return address of $2000 on the stack
+func cpuTest(code []uint8, f uint8) *core.Z80 {
+	z := core.NewZ80()
+	for name, v := range map[string]uint16{"BC": 0x1122, "DE": 0x3344, "HL": 0x8010, "A": 0x77, "F": uint16(f), "SP": 0x9000, "PC": 0x1000} {
+		z.SetReg(name, v)
+	}
+	z.Mem.Poke(0x8010, 0x66)
+	z.Mem.PokeWord(0x9000, 0x2000)
+	for i, b := range code {
+		z.Mem.Poke(0x1000+uint16(i), b)
+	}
+	return &z
+}
+
+// operandValue returns the value of a register operand, or of the memory at HL for (HL)
+func operandValue(t *testing.T, z *core.Z80, name string) uint16 {
+	if name == "(HL)" {
+		hl, _ := z.Reg("HL")
+		return uint16(z.Mem.Peek(hl))
+	}
+	v, ok := z.Reg(name)
+	if !ok {
+		t.Fatalf("Unknown register %q", name)
+	}
+	return v
+}
+
+// TestDecodeMatchesCPU executes the instructions that select registers, register pairs, conditions
+// and operations by the fields of the op code, and checks that the CPU does what the disassembler
+// shows
+func TestDecodeMatchesCPU(t *testing.T) {
+	before := func(name string) uint16 {
+		return operandValue(t, cpuTest(nil, 0), name)
+	}
+
+	// the flag and its value for which each condition is true
+	conditions := map[string]struct {
+		flag uint8
+		set  bool
+	}{
+		"NZ": {core.FlagZ, false}, "Z": {core.FlagZ, true}, "NC": {core.FlagC, false}, "C": {core.FlagC, true},
+		"PO": {core.FlagP, false}, "PE": {core.FlagP, true}, "P": {core.FlagS, false}, "M": {core.FlagS, true},
+	}
+
+	for op := 0; op < 0x100; op++ {
+		code := []uint8{uint8(op), 0x5A, 0x12}
+		in := Decode(Bytes{Origin: 0x1000, Data: code}, 0x1000)
+		operands := strings.Split(in.Operands, ",")
+		x, y, z, q := op>>6, op>>3&7, op&7, op>>3&1
+		check := func(name string, got, want uint16) {
+			if got != want {
+				t.Errorf("%02X %v: %v is %#04x, want %#04x", op, in, name, got, want)
+			}
+		}
+
+		switch {
+		case x == 1 && op != 0x76: // LD r,r'
+			cpu := cpuTest(code, 0)
+			cpu.Step()
+			check(operands[0], operandValue(t, cpu, operands[0]), before(operands[1])&0xFF)
+
+		case x == 2: // alu r
+			src := operands[len(operands)-1]
+			a, v := before("A"), before(src)&0xFF
+			want := map[string]uint16{"ADD": a + v, "ADC": a + v + 1, "SUB": a - v, "SBC": a - v - 1,
+				"AND": a & v, "XOR": a ^ v, "OR": a | v, "CP": a}[in.Mnemonic]
+			cpu := cpuTest(code, core.FlagC)
+			cpu.Step()
+			check("A", operandValue(t, cpu, "A"), want&0xFF)
+
+		case x == 0 && z == 6: // LD r,n
+			cpu := cpuTest(code, 0)
+			cpu.Step()
+			check(operands[0], operandValue(t, cpu, operands[0]), 0x5A)
+
+		case x == 0 && (z == 4 || z == 5): // INC r and DEC r
+			cpu := cpuTest(code, 0)
+			cpu.Step()
+			want := before(operands[0]) + 1
+			if z == 5 {
+				want = before(operands[0]) - 1
+			}
+			check(operands[0], operandValue(t, cpu, operands[0]), want&0xFF)
+
+		case x == 0 && z == 1 && q == 0: // LD rp,nn
+			cpu := cpuTest(code, 0)
+			cpu.Step()
+			check(operands[0], operandValue(t, cpu, operands[0]), 0x125A)
+
+		case x == 0 && z == 3: // INC rp and DEC rp
+			cpu := cpuTest(code, 0)
+			cpu.Step()
+			want := before(operands[0]) + 1
+			if q == 1 {
+				want = before(operands[0]) - 1
+			}
+			check(operands[0], operandValue(t, cpu, operands[0]), want)
+
+		case x == 3 && z == 5 && q == 0: // PUSH rp2
+			cpu := cpuTest(code, 0)
+			cpu.Step()
+			check(operands[0], cpu.Mem.PeekWord(0x8FFE), before(operands[0]))
+
+		case x == 3 && z == 1 && q == 0: // POP rp2
+			cpu := cpuTest(code, 0)
+			cpu.Step()
+			check(operands[0], operandValue(t, cpu, operands[0]), 0x2000)
+
+		case x == 3 && (z == 0 || z == 2 || z == 4), x == 0 && z == 0 && y >= 4: // RET, JP, CALL and JR cc
+			cond, ok := conditions[operands[0]]
+			if !ok {
+				t.Errorf("%02X %v: unknown condition %q", op, in, operands[0])
+				continue
+			}
+			target := map[int]uint16{0: 0x2000, 2: 0x125A, 4: 0x125A}[z]
+			if x == 0 {
+				target = 0x1002 + 0x5A
+			}
+			for _, f := range []uint8{0, core.FlagZ, core.FlagC, core.FlagP, core.FlagS, 0xFF} {
+				cpu := cpuTest(code, f)
+				cpu.Step()
+				if taken := operandValue(t, cpu, "PC") == target; taken != (f&cond.flag != 0 == cond.set) {
+					t.Errorf("%02X %v: taken is %v with F=%02X", op, in, taken, f)
+				}
+			}
+		}
+	}
+}
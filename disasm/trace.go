@@ -0,0 +1,274 @@
+package disasm
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// DefaultEntries are the entry points of a Z80 ROM: the reset address, the RST vectors and the
+// non-maskable interrupt handler
+var DefaultEntries = []uint16{0x00, 0x08, 0x10, 0x18, 0x20, 0x28, 0x30, 0x38, 0x66}
+
+// Program is the result of a tracing disassembly, where the bytes reached by following the program
+// flow from the entry points are code and all other bytes are data
+type Program struct {
+	Start, End uint16
+
+	mem Memory
+
+	// instructions by address, and the start address of the instruction covering each code byte
+	code  map[uint16]Instruction
+	owner map[uint16]uint16
+
+	// labels by address, for jump and call targets and referenced addresses
+	labels map[uint16]string
+}
+
+// Tracer disassembles by following the program flow from entry points
+type Tracer struct {
+	// Entries are the addresses where execution can start
+	Entries []uint16
+
+	// Names returns the name of an address from a symbol table, or an empty string to use a
+	// generated L_xxxx label
+	Names func(addr uint16) string
+}
+
+// Trace disassembles the memory from start to end following the program flow from the entry points
+// within the range. Jumps, branches and calls are followed, and their targets get labels.
+func (t *Tracer) Trace(mem Memory, start, end uint16) *Program {
+	p := &Program{Start: start, End: end, mem: mem,
+		code: make(map[uint16]Instruction), owner: make(map[uint16]uint16), labels: make(map[uint16]string)}
+
+	var work []uint16
+	for _, e := range t.Entries {
+		if p.contains(e) {
+			work = append(work, e)
+		}
+	}
+	targets := make(map[uint16]bool)
+	refs := make(map[uint16]bool)
+
+	for len(work) > 0 {
+		addr := work[len(work)-1]
+		work = work[:len(work)-1]
+
+		// follow the flow until it ends or reaches code that is already known
+		for p.contains(addr) {
+			if _, ok := p.owner[addr]; ok {
+				break
+			}
+			in := Decode(mem, addr)
+			if !p.free(in) {
+				break
+			}
+			p.code[addr] = in
+			for i := range in.Bytes {
+				p.owner[addr+uint16(i)] = addr
+			}
+
+			switch in.Flow {
+			case Jump, Branch, Call:
+				targets[in.Target] = true
+				if p.contains(in.Target) {
+					work = append(work, in.Target)
+				}
+			}
+			if in.Ref {
+				refs[in.RefAddr] = true
+			}
+			if in.Flow == Jump || in.Flow == Return || in.Flow == Indirect {
+				break
+			}
+			next := addr + uint16(in.Len())
+			if next < addr {
+				break // wrapped around the end of memory
+			}
+			addr = next
+		}
+	}
+
+	// label the targets, and the referenced addresses that are not inside an instruction
+	name := func(addr uint16) {
+		if t.Names != nil {
+			if n := t.Names(addr); n != "" {
+				p.labels[addr] = n
+				return
+			}
+		}
+		p.labels[addr] = fmt.Sprintf("L_%04X", addr)
+	}
+	for addr := range targets {
+		if p.contains(addr) {
+			name(addr)
+		}
+	}
+	for addr := range refs {
+		if owner, ok := p.owner[addr]; p.contains(addr) && (!ok || owner == addr) {
+			name(addr)
+		}
+	}
+	for _, e := range t.Entries {
+		if _, ok := p.code[e]; ok && p.labels[e] == "" {
+			name(e)
+		}
+	}
+	return p
+}
+
+// contains returns true if the address is within the disassembled range
+func (p *Program) contains(addr uint16) bool {
+	return addr >= p.Start && addr <= p.End
+}
+
+// free returns true if all bytes of the instruction are within the range and not part of other code
+func (p *Program) free(in Instruction) bool {
+	for i := range in.Bytes {
+		a := in.Addr + uint16(i)
+		if _, ok := p.owner[a]; ok || !p.contains(a) || a < in.Addr {
+			return false
+		}
+	}
+	return true
+}
+
+// IsCode returns true if the byte at the address was reached as part of an instruction
+func (p *Program) IsCode(addr uint16) bool {
+	_, ok := p.owner[addr]
+	return ok
+}
+
+// Label returns the label of an address
+func (p *Program) Label(addr uint16) (string, bool) {
+	l, ok := p.labels[addr]
+	return l, ok
+}
+
+// Instructions returns the traced instructions in address order
+func (p *Program) Instructions() []Instruction {
+	var instrs []Instruction
+	for _, in := range p.code {
+		instrs = append(instrs, in)
+	}
+	sort.Slice(instrs, func(i, j int) bool { return instrs[i].Addr < instrs[j].Addr })
+	return instrs
+}
+
+// canonical returns false for instructions that an assembler would encode differently, such as
+// undocumented duplicates of ED instructions and prefixes that have no effect
+func canonical(in Instruction) bool {
+	b := in.Bytes
+	switch {
+	case b[0] == 0xDD || b[0] == 0xFD:
+		text := in.String()
+		return strings.Contains(text, "IX") || strings.Contains(text, "IY")
+	case b[0] == 0xED && len(b) > 1 && b[1]&0xC0 == 0x40:
+		switch b[1] & 0x07 {
+		case 4: // NEG
+			return b[1] == 0x44
+		case 5: // RETN and RETI
+			return b[1] == 0x45 || b[1] == 0x4D
+		case 6: // IM
+			return b[1] == 0x46 || b[1] == 0x56 || b[1] == 0x5E
+		}
+	}
+	return true
+}
+
+// dataParts splits bytes into the operands of a DB directive, with runs of printable characters
+// as strings
+func dataParts(data []uint8) []string {
+	var parts []string
+	for i := 0; i < len(data); {
+		j := i
+		for j < len(data) && data[j] >= 0x20 && data[j] < 0x7F && data[j] != '"' {
+			j++
+		}
+		if j-i >= 3 {
+			parts = append(parts, `"`+string(data[i:j])+`"`)
+			i = j
+			continue
+		}
+		parts = append(parts, hex8(data[i]))
+		i++
+	}
+	return parts
+}
+
+// dataBytes returns a DB directive for the bytes
+func dataBytes(data []uint8) string {
+	return "DB " + strings.Join(dataParts(data), ",")
+}
+
+// maxDataLine is the length of the operands of a DB directive, after which a new line is started
+const maxDataLine = 64
+
+// WriteSource writes the program as assembler source that assembles to the same bytes. Labels that
+// point into the middle of an instruction are defined with EQU.
+func (p *Program) WriteSource(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	d := &Decoder{Label: func(addr uint16) string {
+		return p.labels[addr]
+	}}
+
+	fmt.Fprintf(bw, "; disassembly of %s to %s\n", hex16(p.Start), hex16(p.End))
+	var inside []uint16
+	for addr := range p.labels {
+		if owner, ok := p.owner[addr]; ok && owner != addr {
+			inside = append(inside, addr)
+		}
+	}
+	sort.Slice(inside, func(i, j int) bool { return inside[i] < inside[j] })
+	for _, addr := range inside {
+		fmt.Fprintf(bw, "%s\tEQU\t%s\t\t; inside the instruction at %s\n", p.labels[addr], hex16(addr), hex16(p.owner[addr]))
+	}
+	fmt.Fprintf(bw, "\n\tORG\t%s\n", hex16(p.Start))
+
+	// data is written with a line per zero terminated string, or when a line gets too long
+	var data []uint8
+	flush := func() {
+		var line []string
+		length := 0
+		for _, part := range dataParts(data) {
+			line = append(line, part)
+			length += len(part) + 1
+			terminator := part == "$00" && len(line) > 1 && line[len(line)-2] != "$00"
+			if length >= maxDataLine || terminator {
+				fmt.Fprintf(bw, "\tDB %s\n", strings.Join(line, ","))
+				line, length = nil, 0
+			}
+		}
+		if len(line) > 0 {
+			fmt.Fprintf(bw, "\tDB %s\n", strings.Join(line, ","))
+		}
+		data = nil
+	}
+
+	addr := uint32(p.Start)
+	for addr <= uint32(p.End) {
+		a := uint16(addr)
+		if label, ok := p.labels[a]; ok {
+			flush()
+			fmt.Fprintf(bw, "%s:\n", label)
+		}
+		in, ok := p.code[a]
+		if !ok {
+			data = append(data, p.mem.Peek(a))
+			addr++
+			continue
+		}
+		flush()
+		in = d.Decode(p.mem, a)
+		if canonical(in) {
+			fmt.Fprintf(bw, "\t%s\n", in.String())
+		} else {
+			fmt.Fprintf(bw, "\t%s\t\t; %s\n", dataBytes(in.Bytes), in.String())
+		}
+		addr += uint32(in.Len())
+	}
+	flush()
+	return bw.Flush()
+}
@@ -0,0 +1,94 @@
+package disasm
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/antbern/z80-emulator/asm"
+)
+
+func TestTrace(t *testing.T) {
+	code := Bytes{Origin: 0, Data: []uint8{
+		0xC3, 0x08, 0x00, // 0000 JP start
+		'H', 'i', '!', 0x00, // 0003 message
+		0x00,             // 0007 padding
+		0x21, 0x03, 0x00, // 0008 start: LD HL,message
+		0xCD, 0x10, 0x00, // 000B CALL sub
+		0x18, 0xF8, // 000E JR start
+		0xC9, // 0010 sub: RET
+		0xFF, // 0011 unreached
+	}}
+	tracer := &Tracer{Entries: []uint16{0}, Names: func(addr uint16) string {
+		if addr == 0x10 {
+			return "sub"
+		}
+		return ""
+	}}
+	p := tracer.Trace(code, 0, 0x11)
+
+	for addr, isCode := range map[uint16]bool{0x00: true, 0x02: true, 0x03: false, 0x07: false, 0x08: true, 0x0F: true, 0x10: true, 0x11: false} {
+		if p.IsCode(addr) != isCode {
+			t.Errorf("Expected IsCode(%#04x) = %v", addr, isCode)
+		}
+	}
+	for addr, label := range map[uint16]string{0x00: "L_0000", 0x03: "L_0003", 0x08: "L_0008", 0x10: "sub"} {
+		if l, ok := p.Label(addr); !ok || l != label {
+			t.Errorf("Expected label %v at %#04x, got %q", label, addr, l)
+		}
+	}
+	if len(p.Instructions()) != 5 {
+		t.Errorf("Expected 5 instructions, got %v", p.Instructions())
+	}
+
+	var out bytes.Buffer
+	if err := p.WriteSource(&out); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"\tORG\t$0000\n", "\tJP L_0008\n", "L_0003:\n\tDB \"Hi!\",$00\n\tDB $00\n", "\tLD HL,L_0003\n", "\tCALL sub\n", "sub:\n\tRET\n\tDB $FF\n"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("Expected %q in the source:\n%s", want, out.String())
+		}
+	}
+}
+
+func TestTraceOverlap(t *testing.T) {
+	// a jump into the middle of an instruction, and an ineffective prefix
+	code := Bytes{Origin: 0x100, Data: []uint8{
+		0x3E, 0x18, // 0100 LD A,$18 (also JR at 0101)
+		0x28, 0xFD, // 0102 JR Z,$0101
+		0xDD, 0x00, // 0104 DD NOP
+		0xC9, // 0106 RET
+	}}
+	p := (&Tracer{Entries: []uint16{0x100}}).Trace(code, 0x100, 0x106)
+
+	var out bytes.Buffer
+	p.WriteSource(&out)
+	for _, want := range []string{"L_0101\tEQU\t$0101", "\tJR Z,L_0101\n", "\tDB $DD,$00\t\t; NOP\n", "\tRET\n"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("Expected %q in the source:\n%s", want, out.String())
+		}
+	}
+}
+
+// TestWriteSourceAssembles checks that the traced source of the monitor assembles to the same binary
+func TestWriteSourceAssembles(t *testing.T) {
+	data, err := ioutil.ReadFile("../input/monitor.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := (&Tracer{}).Trace(Bytes{Data: data}, 0, uint16(len(data)-1))
+	var out bytes.Buffer
+	if err := p.WriteSource(&out); err != nil {
+		t.Fatal(err)
+	}
+
+	prog, err := (&asm.Assembler{}).Assemble("monitor.asm", out.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, code := prog.Binary(0); !bytes.Equal(code, data) {
+		t.Errorf("The traced source assembles to %d bytes that differ from the %d bytes of the binary", len(code), len(data))
+	}
+}
@@ -0,0 +1,56 @@
+package io
+
+// Bus implements a Device that dispatches IN and OUT operations to several attached devices
+// based on the port number. Ports that no device has claimed read as 0xff and ignore writes.
+type Bus struct {
+	ports   [256]Device
+	clocked []Clocked
+}
+
+// NewBus returns a new empty IO bus
+func NewBus() *Bus {
+	return &Bus{}
+}
+
+// Attach maps count consecutive ports starting at base to the provided device. The device receives
+// the full port number, not the offset from base. Later attachments replace earlier ones.
+// Devices implementing Clocked are ticked by the bus.
+func (b *Bus) Attach(base uint8, count int, dev Device) {
+	for i := 0; i < count && int(base)+i < len(b.ports); i++ {
+		b.ports[int(base)+i] = dev
+	}
+
+	if c, ok := dev.(Clocked); ok {
+		for _, existing := range b.clocked {
+			if existing == c {
+				return
+			}
+		}
+		b.clocked = append(b.clocked, c)
+	}
+}
+
+// Tick forwards the clock cycles to all attached clocked devices
+func (b *Bus) Tick(cycles uint64) {
+	for _, c := range b.clocked {
+		c.Tick(cycles)
+	}
+}
+
+// Device returns the device attached to the specified port, or nil if there is none
+func (b *Bus) Device(port uint8) Device {
+	return b.ports[port]
+}
+
+func (b *Bus) Write(port, val uint8) {
+	if dev := b.ports[port]; dev != nil {
+		dev.Write(port, val)
+	}
+}
+
+func (b *Bus) Read(port uint8) uint8 {
+	if dev := b.ports[port]; dev != nil {
+		return dev.Read(port)
+	}
+	return 0xff
+}
@@ -0,0 +1,442 @@
+package io
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+)
+
+// CompactFlash implements the Device interface and represents an 8-bit IDE/CompactFlash interface,
+// as used on RC2014-style machines, backed by a raw disk image file on the host.
+// Only LBA28 addressing is supported.
+type CompactFlash struct {
+	base  uint8
+	image *os.File
+	mode  DiskMode
+
+	// number of sectors in the image
+	sectors uint32
+
+	// sectors written while in copy-on-write mode, keyed by LBA
+	overlay map[uint32][]uint8
+
+	// the task file registers
+	features, count, status, errReg uint8
+	lba                             [4]uint8
+
+	// the command currently transferring data (0 if none) and the sector buffer
+	command   uint8
+	remaining uint8
+	buffer    [SectorSize]uint8
+	index     int
+}
+
+// DiskMode decides how writes to a disk image are handled
+type DiskMode int
+
+const (
+	// ReadOnly rejects all writes to the image with an error
+	ReadOnly DiskMode = iota
+	// CopyOnWrite keeps written sectors in memory and never modifies the image file
+	CopyOnWrite
+)
+
+// SectorSize is the size in bytes of a single IDE sector
+const SectorSize = 512
+
+// offsets of the task file registers from the port base
+const (
+	cfData     = 0
+	cfError    = 1 // read: error, write: features
+	cfCount    = 2
+	cfLBA0     = 3
+	cfLBA1     = 4
+	cfLBA2     = 5
+	cfLBA3     = 6 // bits 0-3 are LBA 24-27, bit 6 selects LBA mode
+	cfStatus   = 7 // read: status, write: command
+	cfRegCount = 8
+)
+
+// bits in the status register
+const (
+	CfStatusBSY  = 1 << 7
+	CfStatusDRDY = 1 << 6
+	CfStatusDF   = 1 << 5
+	CfStatusDSC  = 1 << 4
+	CfStatusDRQ  = 1 << 3
+	CfStatusERR  = 1 << 0
+)
+
+// bits in the error register
+const (
+	CfErrorIDNF = 1 << 4 // sector ID not found
+	CfErrorABRT = 1 << 2 // command aborted
+)
+
+// supported commands
+const (
+	CfCmdReadSector      = 0x20
+	CfCmdReadSectorNR    = 0x21
+	CfCmdWriteSector     = 0x30
+	CfCmdWriteSectorNR   = 0x31
+	CfCmdIdentify        = 0xEC
+	CfCmdSetFeatures     = 0xEF
+	CfCmdInitParameters  = 0x91
+	CfCmdRecalibrate     = 0x10
+	CfCmdIdle            = 0xE3
+	CfCmdCheckPowerMode  = 0xE5
+	CfCmdFlushCache      = 0xE7
+	CfCmdExecDiagnostics = 0x90
+)
+
+// ErrLBAOutOfRange is returned when accessing a sector outside of the image
+var ErrLBAOutOfRange = errors.New("LBA out of range")
+
+// ErrReadOnly is returned when writing to an image opened in ReadOnly mode
+var ErrReadOnly = errors.New("image is read-only")
+
+// NewCompactFlash opens the image file at path and returns a new CompactFlash device with its
+// task file registers starting at port base. The image file itself is never written to.
+func NewCompactFlash(path string, base uint8, mode DiskMode) (*CompactFlash, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return &CompactFlash{
+		base:    base,
+		image:   f,
+		mode:    mode,
+		sectors: uint32(info.Size() / SectorSize),
+		overlay: make(map[uint32][]uint8),
+		status:  CfStatusDRDY | CfStatusDSC,
+	}, nil
+}
+
+// Close closes the underlying image file
+func (cf *CompactFlash) Close() error {
+	return cf.image.Close()
+}
+
+// Ports returns the number of consecutive ports used by the device, starting at its base
+func (cf *CompactFlash) Ports() int {
+	return cfRegCount
+}
+
+// Sectors returns the number of 512 byte sectors in the image
+func (cf *CompactFlash) Sectors() uint32 {
+	return cf.sectors
+}
+
+// ReadSector reads the sector at lba into buf, which must be at least SectorSize bytes long
+func (cf *CompactFlash) ReadSector(lba uint32, buf []uint8) error {
+	if lba >= cf.sectors {
+		return fmt.Errorf("read sector %d: %w", lba, ErrLBAOutOfRange)
+	}
+	if data, ok := cf.overlay[lba]; ok {
+		copy(buf, data)
+		return nil
+	}
+	_, err := cf.image.ReadAt(buf[:SectorSize], int64(lba)*SectorSize)
+	return err
+}
+
+// WriteSector writes the first SectorSize bytes of buf to the sector at lba
+func (cf *CompactFlash) WriteSector(lba uint32, buf []uint8) error {
+	if lba >= cf.sectors {
+		return fmt.Errorf("write sector %d: %w", lba, ErrLBAOutOfRange)
+	}
+	if cf.mode == ReadOnly {
+		return fmt.Errorf("write sector %d: %w", lba, ErrReadOnly)
+	}
+	data := make([]uint8, SectorSize)
+	copy(data, buf)
+	cf.overlay[lba] = data
+	return nil
+}
+
+func (cf *CompactFlash) Write(port, val uint8) {
+	switch port - cf.base {
+	case cfData:
+		cf.writeData(val)
+	case cfError:
+		cf.features = val
+	case cfCount:
+		cf.count = val
+	case cfLBA0, cfLBA1, cfLBA2, cfLBA3:
+		cf.lba[port-cf.base-cfLBA0] = val
+	case cfStatus:
+		cf.execute(val)
+	}
+}
+
+func (cf *CompactFlash) Read(port uint8) uint8 {
+	switch port - cf.base {
+	case cfData:
+		return cf.readData()
+	case cfError:
+		return cf.errReg
+	case cfCount:
+		return cf.count
+	case cfLBA0, cfLBA1, cfLBA2, cfLBA3:
+		return cf.lba[port-cf.base-cfLBA0]
+	case cfStatus:
+		return cf.status
+	}
+	return 0xff
+}
+
+// currentLBA assembles the 28 bit LBA from the task file registers
+func (cf *CompactFlash) currentLBA() uint32 {
+	return uint32(cf.lba[3]&0x0f)<<24 | uint32(cf.lba[2])<<16 | uint32(cf.lba[1])<<8 | uint32(cf.lba[0])
+}
+
+// setLBA stores lba into the task file registers, keeping the upper bits of the drive/head register
+func (cf *CompactFlash) setLBA(lba uint32) {
+	cf.lba[0] = uint8(lba)
+	cf.lba[1] = uint8(lba >> 8)
+	cf.lba[2] = uint8(lba >> 16)
+	cf.lba[3] = (cf.lba[3] & 0xf0) | uint8(lba>>24)&0x0f
+}
+
+func (cf *CompactFlash) execute(cmd uint8) {
+	cf.errReg = 0
+	cf.status = CfStatusDRDY | CfStatusDSC
+	cf.command = 0
+
+	switch cmd {
+	case CfCmdReadSector, CfCmdReadSectorNR:
+		// a sector count of 0 means 256, which the wrap-around of remaining takes care of
+		cf.command = cmd
+		cf.remaining = cf.count
+		cf.loadSector()
+	case CfCmdWriteSector, CfCmdWriteSectorNR:
+		if cf.currentLBA() >= cf.sectors {
+			cf.fail(CfErrorIDNF)
+			return
+		}
+		if cf.mode == ReadOnly {
+			cf.fail(CfErrorABRT)
+			return
+		}
+		cf.command = cmd
+		cf.remaining = cf.count
+		cf.index = 0
+		cf.status |= CfStatusDRQ
+	case CfCmdIdentify:
+		cf.identify()
+		cf.command = cmd
+		cf.remaining = 1
+		cf.index = 0
+		cf.status |= CfStatusDRQ
+	case CfCmdSetFeatures, CfCmdInitParameters, CfCmdRecalibrate, CfCmdIdle,
+		CfCmdCheckPowerMode, CfCmdFlushCache:
+		// nothing to do, these all complete immediately
+	case CfCmdExecDiagnostics:
+		cf.errReg = 0x01 // no error detected
+	default:
+		log.Printf("CF: Unsupported command %#02x", cmd)
+		cf.fail(CfErrorABRT)
+	}
+}
+
+// fail aborts the current command and reports the specified error bits
+func (cf *CompactFlash) fail(errBits uint8) {
+	cf.command = 0
+	cf.errReg = errBits
+	cf.status = CfStatusDRDY | CfStatusDSC | CfStatusERR
+}
+
+// loadSector fills the buffer with the sector at the current LBA for a read command
+func (cf *CompactFlash) loadSector() {
+	if err := cf.ReadSector(cf.currentLBA(), cf.buffer[:]); err != nil {
+		if errors.Is(err, ErrLBAOutOfRange) {
+			cf.fail(CfErrorIDNF)
+		} else {
+			log.Printf("CF: %v", err)
+			cf.fail(CfErrorABRT)
+		}
+		return
+	}
+	cf.index = 0
+	cf.status |= CfStatusDRQ
+}
+
+func (cf *CompactFlash) readData() uint8 {
+	if cf.status&CfStatusDRQ == 0 {
+		return 0xff
+	}
+
+	val := cf.buffer[cf.index]
+	cf.index++
+	if cf.index < SectorSize {
+		return val
+	}
+
+	// the whole sector has been transferred
+	cf.status &^= CfStatusDRQ
+	cf.remaining--
+	if cf.command == CfCmdIdentify || cf.remaining == 0 {
+		cf.command = 0
+		return val
+	}
+	cf.setLBA(cf.currentLBA() + 1)
+	cf.loadSector()
+	return val
+}
+
+func (cf *CompactFlash) writeData(val uint8) {
+	if cf.status&CfStatusDRQ == 0 || (cf.command != CfCmdWriteSector && cf.command != CfCmdWriteSectorNR) {
+		return
+	}
+
+	cf.buffer[cf.index] = val
+	cf.index++
+	if cf.index < SectorSize {
+		return
+	}
+
+	// the whole sector has been received
+	cf.status &^= CfStatusDRQ
+	if err := cf.WriteSector(cf.currentLBA(), cf.buffer[:]); err != nil {
+		if errors.Is(err, ErrLBAOutOfRange) {
+			cf.fail(CfErrorIDNF)
+		} else {
+			cf.fail(CfErrorABRT)
+		}
+		return
+	}
+
+	cf.remaining--
+	if cf.remaining == 0 {
+		cf.command = 0
+		return
+	}
+	cf.setLBA(cf.currentLBA() + 1)
+	if cf.currentLBA() >= cf.sectors {
+		cf.fail(CfErrorIDNF)
+		return
+	}
+	cf.index = 0
+	cf.status |= CfStatusDRQ
+}
+
+// identify fills the buffer with the IDENTIFY DEVICE response
+func (cf *CompactFlash) identify() {
+	var words [SectorSize / 2]uint16
+
+	// geometry reported using the traditional 16 heads, 63 sectors per track translation
+	cylinders := cf.sectors / (16 * 63)
+	if cylinders > 0xffff {
+		cylinders = 0xffff
+	}
+	words[0] = 0x848a // CompactFlash signature, removable
+	words[1] = uint16(cylinders)
+	words[3] = 16
+	words[6] = 63
+	words[7] = uint16(cf.sectors >> 16) // number of sectors per card
+	words[8] = uint16(cf.sectors)
+	words[47] = 0x0001             // max sectors per READ/WRITE MULTIPLE
+	words[49] = 1 << 9             // LBA supported
+	words[60] = uint16(cf.sectors) // total addressable sectors in LBA mode
+	words[61] = uint16(cf.sectors >> 16)
+
+	// strings are stored with the two bytes in each word swapped
+	putString := func(start, length int, s string) {
+		for i := 0; i < length*2; i++ {
+			c := uint8(' ')
+			if i < len(s) {
+				c = s[i]
+			}
+			if i%2 == 0 {
+				words[start+i/2] |= uint16(c) << 8
+			} else {
+				words[start+i/2] |= uint16(c)
+			}
+		}
+	}
+	putString(10, 10, "Z80EMU0001")
+	putString(23, 4, "1.0")
+	putString(27, 20, "Z80 Emulator CF Image")
+
+	for i, w := range words {
+		cf.buffer[2*i] = uint8(w)
+		cf.buffer[2*i+1] = uint8(w >> 8)
+	}
+}
+
+// cfState is the saved state of the task file registers and the transfer in progress, which is
+// followed by the sectors written in copy-on-write mode
+type cfState struct {
+	Features, Count, Status, ErrReg uint8
+	LBA                             [4]uint8
+	Command, Remaining              uint8
+	Buffer                          [SectorSize]uint8
+	Index                           int32
+	Overlay                         uint32
+}
+
+// SaveState writes the registers, the transfer in progress and the sectors written in copy-on-write
+// mode. The image file is not included.
+func (cf *CompactFlash) SaveState(w io.Writer) error {
+	st := cfState{
+		Features: cf.features, Count: cf.count, Status: cf.status, ErrReg: cf.errReg, LBA: cf.lba,
+		Command: cf.command, Remaining: cf.remaining, Buffer: cf.buffer, Index: int32(cf.index),
+		Overlay: uint32(len(cf.overlay)),
+	}
+	if err := binary.Write(w, binary.LittleEndian, &st); err != nil {
+		return err
+	}
+	lbas := make([]uint32, 0, len(cf.overlay))
+	for lba := range cf.overlay {
+		lbas = append(lbas, lba)
+	}
+	sort.Slice(lbas, func(i, j int) bool { return lbas[i] < lbas[j] })
+	for _, lba := range lbas {
+		if err := binary.Write(w, binary.LittleEndian, lba); err != nil {
+			return err
+		}
+		if _, err := w.Write(cf.overlay[lba]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LoadState restores a state written by SaveState, for the same image
+func (cf *CompactFlash) LoadState(r io.Reader) error {
+	var st cfState
+	if err := binary.Read(r, binary.LittleEndian, &st); err != nil {
+		return err
+	}
+	// the index is at the end of the buffer after a transfer, but not while data is requested
+	if st.Index < 0 || st.Index > SectorSize || st.Index == SectorSize && st.Status&CfStatusDRQ != 0 {
+		return fmt.Errorf("compactflash: invalid buffer index %d", st.Index)
+	}
+	overlay := make(map[uint32][]uint8)
+	for i := uint32(0); i < st.Overlay; i++ {
+		var lba uint32
+		if err := binary.Read(r, binary.LittleEndian, &lba); err != nil {
+			return err
+		}
+		data := make([]uint8, SectorSize)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return err
+		}
+		overlay[lba] = data
+	}
+	cf.features, cf.count, cf.status, cf.errReg, cf.lba = st.Features, st.Count, st.Status, st.ErrReg, st.LBA
+	cf.command, cf.remaining, cf.buffer, cf.index = st.Command, st.Remaining, st.Buffer, int(st.Index)
+	cf.overlay = overlay
+	return nil
+}
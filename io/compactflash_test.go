@@ -0,0 +1,145 @@
+package io
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testCfBase = 0x10
+
+// newTestCF creates an image with the specified number of sectors where each byte of a sector
+// contains the sector number, and attaches it as a CompactFlash device. The returned function
+// removes the image again.
+func newTestCF(t *testing.T, sectors int, mode DiskMode) (*CompactFlash, func()) {
+	data := make([]uint8, sectors*SectorSize)
+	for i := range data {
+		data[i] = uint8(i / SectorSize)
+	}
+	dir, err := ioutil.TempDir("", "cftest")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "disk.img")
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	cf, err := NewCompactFlash(path, testCfBase, mode)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return cf, func() {
+		cf.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func selectLBA(cf *CompactFlash, lba uint32, count uint8) {
+	cf.Write(testCfBase+cfCount, count)
+	cf.Write(testCfBase+cfLBA0, uint8(lba))
+	cf.Write(testCfBase+cfLBA1, uint8(lba>>8))
+	cf.Write(testCfBase+cfLBA2, uint8(lba>>16))
+	cf.Write(testCfBase+cfLBA3, 0xE0|uint8(lba>>24)&0x0f)
+}
+
+func TestCompactFlashRead(t *testing.T) {
+	cf, cleanup := newTestCF(t, 4, ReadOnly)
+	defer cleanup()
+
+	selectLBA(cf, 2, 2)
+	cf.Write(testCfBase+cfStatus, CfCmdReadSector)
+
+	for sector := 2; sector <= 3; sector++ {
+		if status := cf.Read(testCfBase + cfStatus); status&CfStatusDRQ == 0 || status&CfStatusERR != 0 {
+			t.Fatalf("Sector %d: expected DRQ without ERR, got status %#02x", sector, status)
+		}
+		for i := 0; i < SectorSize; i++ {
+			if val := cf.Read(testCfBase + cfData); val != uint8(sector) {
+				t.Fatalf("Sector %d byte %d: got %#02x, want %#02x", sector, i, val, sector)
+			}
+		}
+	}
+
+	if status := cf.Read(testCfBase + cfStatus); status&CfStatusDRQ != 0 {
+		t.Errorf("Expected DRQ to be cleared after transfer, got status %#02x", status)
+	}
+}
+
+func TestCompactFlashOutOfRange(t *testing.T) {
+	cf, cleanup := newTestCF(t, 4, CopyOnWrite)
+	defer cleanup()
+
+	selectLBA(cf, 4, 1)
+	cf.Write(testCfBase+cfStatus, CfCmdReadSector)
+	if status := cf.Read(testCfBase + cfStatus); status&CfStatusERR == 0 {
+		t.Errorf("Expected ERR for out of range read, got status %#02x", status)
+	}
+	if e := cf.Read(testCfBase + cfError); e != CfErrorIDNF {
+		t.Errorf("Expected IDNF error, got %#02x", e)
+	}
+
+	buf := make([]uint8, SectorSize)
+	if err := cf.ReadSector(100, buf); !errors.Is(err, ErrLBAOutOfRange) {
+		t.Errorf("Expected ErrLBAOutOfRange, got %v", err)
+	}
+}
+
+func TestCompactFlashWrite(t *testing.T) {
+	ro, cleanupRO := newTestCF(t, 2, ReadOnly)
+	defer cleanupRO()
+	selectLBA(ro, 1, 1)
+	ro.Write(testCfBase+cfStatus, CfCmdWriteSector)
+	if status := ro.Read(testCfBase + cfStatus); status&CfStatusERR == 0 {
+		t.Errorf("Expected ERR when writing to read-only image, got status %#02x", status)
+	}
+
+	cow, cleanupCOW := newTestCF(t, 2, CopyOnWrite)
+	defer cleanupCOW()
+	selectLBA(cow, 1, 1)
+	cow.Write(testCfBase+cfStatus, CfCmdWriteSector)
+	for i := 0; i < SectorSize; i++ {
+		cow.Write(testCfBase+cfData, 0xAA)
+	}
+	if status := cow.Read(testCfBase + cfStatus); status&(CfStatusDRQ|CfStatusERR) != 0 {
+		t.Fatalf("Expected write to complete, got status %#02x", status)
+	}
+
+	buf := make([]uint8, SectorSize)
+	if err := cow.ReadSector(1, buf); err != nil {
+		t.Fatal(err)
+	}
+	if buf[0] != 0xAA || buf[SectorSize-1] != 0xAA {
+		t.Errorf("Written sector was not read back, got %#02x", buf[0])
+	}
+
+	// the image file itself must be untouched
+	orig := make([]uint8, SectorSize)
+	if _, err := cow.image.ReadAt(orig, SectorSize); err != nil {
+		t.Fatal(err)
+	}
+	if orig[0] != 0x01 {
+		t.Errorf("Image file was modified, got %#02x", orig[0])
+	}
+}
+
+func TestCompactFlashIdentify(t *testing.T) {
+	cf, cleanup := newTestCF(t, 3, ReadOnly)
+	defer cleanup()
+	cf.Write(testCfBase+cfStatus, CfCmdIdentify)
+
+	var data [SectorSize]uint8
+	for i := range data {
+		data[i] = cf.Read(testCfBase + cfData)
+	}
+
+	// words 60-61 hold the number of LBA sectors
+	if sectors := uint32(data[120]) | uint32(data[121])<<8 | uint32(data[122])<<16 | uint32(data[123])<<24; sectors != 3 {
+		t.Errorf("Identify reported %d sectors, want 3", sectors)
+	}
+}
@@ -5,7 +5,8 @@ import "log"
 // DebugDevice implements a Device that simply prints writes to stdin
 type debugDevice struct{}
 
-// NewDebugDevice returns a new IO device that can be used for debugging
+// NewDebugDevice returns a new IO device that can be used for debugging. NewPortLogger logs selected
+// accesses to any device instead.
 func NewDebugDevice() debugDevice {
 	return debugDevice{}
 }
@@ -0,0 +1,409 @@
+package io
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+// Density describes the recording method used for a track
+type Density int
+
+const (
+	// FM is single density
+	FM Density = iota
+	// MFM is double density
+	MFM
+)
+
+func (d Density) String() string {
+	if d == MFM {
+		return "MFM"
+	}
+	return "FM"
+}
+
+// TrackFormat describes the sectors on a single track
+type TrackFormat struct {
+	Density     Density
+	Sectors     int // number of sectors per track
+	SectorSize  int // size of each sector in bytes
+	FirstSector int // the ID of the first sector, usually 0 or 1
+}
+
+// Geometry describes the layout of a disk format. Multi-density formats, where the first track
+// uses a different format than the rest of the disk, set Track0.
+type Geometry struct {
+	Name        string
+	Description string
+	Cylinders   int
+	Heads       int
+	Format      TrackFormat
+
+	// Track0 optionally describes cylinder 0, head 0 if it differs from the rest of the disk
+	Track0 *TrackFormat
+}
+
+// TrackFormat returns the format of the specified track
+func (g Geometry) TrackFormat(cyl, head int) TrackFormat {
+	if cyl == 0 && head == 0 && g.Track0 != nil {
+		return *g.Track0
+	}
+	return g.Format
+}
+
+// Size returns the size in bytes of a raw image in this format
+func (g Geometry) Size() int {
+	size := 0
+	for cyl := 0; cyl < g.Cylinders; cyl++ {
+		for head := 0; head < g.Heads; head++ {
+			f := g.TrackFormat(cyl, head)
+			size += f.Sectors * f.SectorSize
+		}
+	}
+	return size
+}
+
+// ibmTrack0 is the single density first track used by the 8" IBM 3740 based formats
+var ibmTrack0 = &TrackFormat{Density: FM, Sectors: 26, SectorSize: 128, FirstSector: 1}
+
+// Geometries is a table of well-known disk formats. When guessing the format from the size of a raw
+// image the first matching entry is used.
+var Geometries = []Geometry{
+	{Name: "ibm-8-sssd", Description: "8\" IBM 3740 single sided single density (standard CP/M 2.2)",
+		Cylinders: 77, Heads: 1, Format: TrackFormat{FM, 26, 128, 1}},
+	{Name: "ibm-8-ssdd", Description: "8\" single sided double density with a single density track 0",
+		Cylinders: 77, Heads: 1, Format: TrackFormat{MFM, 26, 256, 1}, Track0: ibmTrack0},
+	{Name: "ibm-8-dsdd", Description: "8\" double sided double density with a single density track 0",
+		Cylinders: 77, Heads: 2, Format: TrackFormat{MFM, 26, 256, 1}, Track0: ibmTrack0},
+	{Name: "kaypro2", Description: "Kaypro II 5.25\" single sided double density",
+		Cylinders: 40, Heads: 1, Format: TrackFormat{MFM, 10, 512, 0}},
+	{Name: "osborne1-dd", Description: "Osborne 1 5.25\" single sided double density",
+		Cylinders: 40, Heads: 1, Format: TrackFormat{MFM, 5, 1024, 1}},
+	{Name: "osborne1-sd", Description: "Osborne 1 5.25\" single sided single density",
+		Cylinders: 40, Heads: 1, Format: TrackFormat{FM, 10, 256, 1}},
+	{Name: "amstrad-data", Description: "Amstrad CPC/PCW 3\" data format",
+		Cylinders: 40, Heads: 1, Format: TrackFormat{MFM, 9, 512, 0xC1}},
+	{Name: "pc-360k", Description: "5.25\" double sided double density, 9 sectors of 512 bytes",
+		Cylinders: 40, Heads: 2, Format: TrackFormat{MFM, 9, 512, 1}},
+	{Name: "pc-720k", Description: "3.5\" double sided double density, 9 sectors of 512 bytes",
+		Cylinders: 80, Heads: 2, Format: TrackFormat{MFM, 9, 512, 1}},
+}
+
+// LookupGeometry returns the geometry with the specified name
+func LookupGeometry(name string) (Geometry, bool) {
+	for _, g := range Geometries {
+		if g.Name == name {
+			return g, true
+		}
+	}
+	return Geometry{}, false
+}
+
+// GeometryForSize returns the first geometry whose raw image has the specified size
+func GeometryForSize(size int) (Geometry, bool) {
+	for _, g := range Geometries {
+		if g.Size() == size {
+			return g, true
+		}
+	}
+	return Geometry{}, false
+}
+
+// Sector represents a single sector on a track, with the contents of its ID field and data
+type Sector struct {
+	Cylinder, Head, ID, SizeCode uint8
+	Data                         []uint8
+
+	// Deleted is set if the sector was written with a deleted data address mark
+	Deleted bool
+	// CRCError is set if reading the data field should report a CRC error
+	CRCError bool
+}
+
+// Track holds the sectors of a single track in the order they appear on the disk
+type Track struct {
+	Density Density
+	Sectors []*Sector
+}
+
+// Find returns the sector with the specified ID field, or nil if there is none.
+// The head is only compared if compareHead is true.
+func (t *Track) Find(cyl, head, id uint8, compareHead bool) *Sector {
+	for _, s := range t.Sectors {
+		if s.Cylinder == cyl && s.ID == id && (!compareHead || s.Head == head) {
+			return s
+		}
+	}
+	return nil
+}
+
+// Disk represents a floppy disk inserted into a drive
+type Disk struct {
+	Cylinders, Heads int
+	WriteProtected   bool
+
+	// the tracks, indexed by cylinder*Heads + head
+	tracks []*Track
+}
+
+// sizeCode returns the sector size code N used in ID fields, where the size is 128 << N
+func sizeCode(size int) uint8 {
+	code := uint8(0)
+	for 128<<code < size {
+		code++
+	}
+	return code
+}
+
+// NewDisk returns a new disk formatted according to the geometry, with all sectors filled with 0xE5
+func NewDisk(g Geometry) *Disk {
+	d := &Disk{Cylinders: g.Cylinders, Heads: g.Heads, tracks: make([]*Track, g.Cylinders*g.Heads)}
+	for cyl := 0; cyl < g.Cylinders; cyl++ {
+		for head := 0; head < g.Heads; head++ {
+			f := g.TrackFormat(cyl, head)
+			t := &Track{Density: f.Density}
+			for i := 0; i < f.Sectors; i++ {
+				data := bytes.Repeat([]uint8{0xE5}, f.SectorSize)
+				t.Sectors = append(t.Sectors, &Sector{
+					Cylinder: uint8(cyl), Head: uint8(head), ID: uint8(f.FirstSector + i),
+					SizeCode: sizeCode(f.SectorSize), Data: data,
+				})
+			}
+			d.tracks[cyl*g.Heads+head] = t
+		}
+	}
+	return d
+}
+
+// Track returns the specified track, or nil if it does not exist on the disk
+func (d *Disk) Track(cyl, head int) *Track {
+	if cyl < 0 || cyl >= d.Cylinders || head < 0 || head >= d.Heads {
+		return nil
+	}
+	return d.tracks[cyl*d.Heads+head]
+}
+
+// SetTrack replaces the specified track, used when formatting
+func (d *Disk) SetTrack(cyl, head int, t *Track) {
+	if cyl >= 0 && cyl < d.Cylinders && head >= 0 && head < d.Heads {
+		d.tracks[cyl*d.Heads+head] = t
+	}
+}
+
+// LoadRawDisk loads a raw sector image, where all sectors are stored in order of cylinder, head and
+// sector ID. The geometry is guessed from the file size if g is nil.
+func LoadRawDisk(path string, g *Geometry) (*Disk, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if g == nil {
+		guess, ok := GeometryForSize(len(data))
+		if !ok {
+			return nil, fmt.Errorf("%v: unable to guess disk geometry from size %d", path, len(data))
+		}
+		g = &guess
+	}
+	if len(data) != g.Size() {
+		return nil, fmt.Errorf("%v: image size %d does not match geometry %v (%d bytes)", path, len(data), g.Name, g.Size())
+	}
+
+	d := NewDisk(*g)
+	offset := 0
+	for _, t := range d.tracks {
+		for _, s := range t.Sectors {
+			copy(s.Data, data[offset:])
+			offset += len(s.Data)
+		}
+	}
+	return d, nil
+}
+
+// WriteRaw writes the disk as a raw sector image, with the sectors of each track ordered by ID
+func (d *Disk) WriteRaw(w io.Writer) error {
+	for _, t := range d.tracks {
+		if t == nil {
+			continue
+		}
+		sectors := append([]*Sector(nil), t.Sectors...)
+		for i := 1; i < len(sectors); i++ {
+			for j := i; j > 0 && sectors[j].ID < sectors[j-1].ID; j-- {
+				sectors[j], sectors[j-1] = sectors[j-1], sectors[j]
+			}
+		}
+		for _, s := range sectors {
+			if _, err := w.Write(s.Data); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ErrInvalidIMD is returned when an ImageDisk file can not be parsed
+var ErrInvalidIMD = errors.New("invalid IMD image")
+
+// LoadIMD loads an ImageDisk (.IMD) image.
+// The format is described in http://dunfield.classiccmp.org/img/index.htm
+func LoadIMD(path string) (*Disk, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	d, err := ReadIMD(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("%v: %w", path, err)
+	}
+	return d, nil
+}
+
+// ReadIMD reads an ImageDisk image from r
+func ReadIMD(r io.Reader) (*Disk, error) {
+	br := bufio.NewReader(r)
+
+	// the header is an ASCII comment terminated by 0x1A
+	header, err := br.ReadBytes(0x1A)
+	if err != nil || !bytes.HasPrefix(header, []uint8("IMD ")) {
+		return nil, fmt.Errorf("%w: missing header", ErrInvalidIMD)
+	}
+
+	type trackEntry struct {
+		cyl, head int
+		track     *Track
+	}
+	var entries []trackEntry
+	cylinders, heads := 0, 0
+
+	readN := func(n int) ([]uint8, error) {
+		buf := make([]uint8, n)
+		if _, err := io.ReadFull(br, buf); err != nil {
+			return nil, fmt.Errorf("%w: truncated track data", ErrInvalidIMD)
+		}
+		return buf, nil
+	}
+
+	for {
+		hdr := make([]uint8, 5)
+		if n, err := io.ReadFull(br, hdr); err == io.EOF && n == 0 {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("%w: truncated track header", ErrInvalidIMD)
+		}
+
+		mode, cyl, head, nsec, size := hdr[0], hdr[1], hdr[2], int(hdr[3]), hdr[4]
+		if size > 6 {
+			return nil, fmt.Errorf("%w: unsupported sector size code %d", ErrInvalidIMD, size)
+		}
+
+		// modes 0-2 are FM at different data rates, modes 3-5 are MFM
+		t := &Track{Density: FM}
+		if mode >= 3 {
+			t.Density = MFM
+		}
+
+		numbering, err := readN(nsec)
+		if err != nil {
+			return nil, err
+		}
+		cylMap, headMap := []uint8(nil), []uint8(nil)
+		if head&0x80 != 0 {
+			if cylMap, err = readN(nsec); err != nil {
+				return nil, err
+			}
+		}
+		if head&0x40 != 0 {
+			if headMap, err = readN(nsec); err != nil {
+				return nil, err
+			}
+		}
+		head &= 0x0f
+
+		sectorSize := 128 << size
+		for i := 0; i < nsec; i++ {
+			s := &Sector{Cylinder: cyl, Head: head, ID: numbering[i], SizeCode: size}
+			if cylMap != nil {
+				s.Cylinder = cylMap[i]
+			}
+			if headMap != nil {
+				s.Head = headMap[i]
+			}
+
+			kind, err := br.ReadByte()
+			if err != nil {
+				return nil, fmt.Errorf("%w: truncated sector record", ErrInvalidIMD)
+			}
+			switch {
+			case kind == 0: // data could not be read
+				s.Data = make([]uint8, sectorSize)
+				s.CRCError = true
+			case kind <= 8:
+				// odd types contain the full data, even types a single fill byte
+				if kind%2 == 1 {
+					if s.Data, err = readN(sectorSize); err != nil {
+						return nil, err
+					}
+				} else {
+					fill, err := br.ReadByte()
+					if err != nil {
+						return nil, fmt.Errorf("%w: truncated sector record", ErrInvalidIMD)
+					}
+					s.Data = bytes.Repeat([]uint8{fill}, sectorSize)
+				}
+				s.Deleted = kind == 3 || kind == 4 || kind == 7 || kind == 8
+				s.CRCError = kind >= 5
+			default:
+				return nil, fmt.Errorf("%w: unknown sector record type %d", ErrInvalidIMD, kind)
+			}
+			t.Sectors = append(t.Sectors, s)
+		}
+
+		entries = append(entries, trackEntry{int(cyl), int(head), t})
+		if int(cyl)+1 > cylinders {
+			cylinders = int(cyl) + 1
+		}
+		if int(head)+1 > heads {
+			heads = int(head) + 1
+		}
+	}
+
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("%w: no tracks", ErrInvalidIMD)
+	}
+
+	d := &Disk{Cylinders: cylinders, Heads: heads, tracks: make([]*Track, cylinders*heads)}
+	for _, e := range entries {
+		d.SetTrack(e.cyl, e.head, e.track)
+	}
+	// tracks missing from the image are unformatted
+	for i := range d.tracks {
+		if d.tracks[i] == nil {
+			d.tracks[i] = &Track{}
+		}
+	}
+	return d, nil
+}
+
+// LoadDisk loads a disk image, choosing the loader from the file extension. ImageDisk images use the
+// .imd extension, everything else is treated as a raw sector image in the named format. An empty
+// format name guesses the format from the image size.
+func LoadDisk(path, format string) (*Disk, error) {
+	if strings.EqualFold(filepath.Ext(path), ".imd") {
+		return LoadIMD(path)
+	}
+
+	if format == "" {
+		return LoadRawDisk(path, nil)
+	}
+	g, ok := LookupGeometry(format)
+	if !ok {
+		return nil, fmt.Errorf("unknown disk format %q", format)
+	}
+	return LoadRawDisk(path, &g)
+}
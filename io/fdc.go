@@ -0,0 +1,814 @@
+package io
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+)
+
+// FDC implements the Device and Clocked interfaces and represents a WD1793/WD2793 family floppy disk
+// controller with up to four drives. Timing of stepping, index pulses and data transfers is derived
+// from the CPU clock cycles passed to Tick.
+type FDC struct {
+	base uint8
+
+	// RPM is the rotational speed of the drives, 300 for 5.25" and 360 for 8" drives
+	RPM int
+
+	clockHz uint64
+	drives  [4]*Disk
+	heads   [4]int // the physical head position of each drive
+
+	// the drive control latch
+	drive, side   int
+	doubleDensity bool
+
+	// the internal registers
+	track, sector, data, command uint8
+	errBits                      uint8
+	cmdType                      int
+	busy, drq, intrq, headLoaded bool
+	stepDirection                int
+	stepped                      bool
+
+	// the current state of the command state machine and cycles until its next event
+	phase fdcPhase
+	delay int64
+
+	// position within the current revolution in cycles, used for the index pulse
+	rotation  uint64
+	indexIntr bool
+
+	// the data being transferred
+	buf      []uint8
+	bufIndex int
+	current  *Sector
+}
+
+type fdcPhase int
+
+const (
+	fdcIdle fdcPhase = iota
+	fdcStep
+	fdcVerify
+	fdcSearch
+	fdcRead
+	fdcWrite
+	fdcReadAddress
+	fdcReadTrack
+	fdcWriteTrack
+)
+
+// offsets of the registers from the port base
+const (
+	fdcStatus  = 0 // read: status, write: command
+	fdcTrack   = 1
+	fdcSector  = 2
+	fdcData    = 3
+	fdcControl = 4 // the drive control latch, not part of the WD1793 itself
+	fdcPorts   = 5
+)
+
+// bits in the status register
+const (
+	FdcStatusNotReady     = 1 << 7
+	FdcStatusWriteProtect = 1 << 6
+	FdcStatusHeadLoaded   = 1 << 5 // type I
+	FdcStatusRecordType   = 1 << 5 // type II and III, set when a deleted data mark was read
+	FdcStatusSeekError    = 1 << 4 // type I
+	FdcStatusRNF          = 1 << 4 // type II and III, record not found
+	FdcStatusCRCError     = 1 << 3
+	FdcStatusTrack0       = 1 << 2 // type I
+	FdcStatusLostData     = 1 << 2 // type II and III
+	FdcStatusIndex        = 1 << 1 // type I
+	FdcStatusDRQ          = 1 << 1 // type II and III
+	FdcStatusBusy         = 1 << 0
+)
+
+// bits in the drive control latch. Reading the latch returns INTRQ and DRQ in the top bits.
+const (
+	FdcCtrlDriveMask     = 0x03
+	FdcCtrlSide          = 1 << 4
+	FdcCtrlDoubleDensity = 1 << 5
+	FdcCtrlDRQ           = 1 << 6
+	FdcCtrlINTRQ         = 1 << 7
+)
+
+// timing parameters in milliseconds, for a controller clocked at 1 MHz
+var fdcStepRates = [4]int{6, 12, 20, 30}
+
+const (
+	fdcSettleMs     = 30
+	fdcIndexMs      = 4
+	fdcMaxCylinder  = 83
+	fdcRNFRevs      = 5
+	fdcWriteGap     = 11 // number of bytes between the ID field and the first requested data byte
+	fdcFMByteUs     = 64
+	fdcMFMByteUs    = 32
+	fdcTrackGapByte = 0x4E
+)
+
+// NewFDC returns a new floppy disk controller with its registers starting at port base.
+// clockHz is the CPU clock frequency used to convert cycles to time, and must not be 0.
+func NewFDC(base uint8, clockHz uint64) *FDC {
+	return &FDC{base: base, RPM: 300, clockHz: clockHz, stepDirection: 1}
+}
+
+// Ports returns the number of consecutive ports used by the device, starting at its base
+func (f *FDC) Ports() int {
+	return fdcPorts
+}
+
+// InsertDisk inserts a disk into the specified drive (0-3). A nil disk ejects it.
+func (f *FDC) InsertDisk(drive int, d *Disk) {
+	f.drives[drive&FdcCtrlDriveMask] = d
+}
+
+// Interrupt returns the state of the INTRQ output
+func (f *FDC) Interrupt() bool {
+	return f.intrq
+}
+
+// DataRequest returns the state of the DRQ output
+func (f *FDC) DataRequest() bool {
+	return f.drq
+}
+
+func (f *FDC) Write(port, val uint8) {
+	switch port - f.base {
+	case fdcStatus:
+		f.execute(val)
+	case fdcTrack:
+		if !f.busy {
+			f.track = val
+		}
+	case fdcSector:
+		if !f.busy {
+			f.sector = val
+		}
+	case fdcData:
+		f.data = val
+		f.drq = false
+	case fdcControl:
+		f.drive = int(val & FdcCtrlDriveMask)
+		f.side = 0
+		if val&FdcCtrlSide != 0 {
+			f.side = 1
+		}
+		f.doubleDensity = val&FdcCtrlDoubleDensity != 0
+	}
+}
+
+func (f *FDC) Read(port uint8) uint8 {
+	switch port - f.base {
+	case fdcStatus:
+		f.intrq = false
+		return f.statusRegister()
+	case fdcTrack:
+		return f.track
+	case fdcSector:
+		return f.sector
+	case fdcData:
+		f.drq = false
+		return f.data
+	case fdcControl:
+		val := uint8(0)
+		if f.intrq {
+			val |= FdcCtrlINTRQ
+		}
+		if f.drq {
+			val |= FdcCtrlDRQ
+		}
+		return val
+	}
+	return 0xff
+}
+
+// cycles converts a time in microseconds to CPU clock cycles
+func (f *FDC) cycles(us int) int64 {
+	return int64(f.clockHz) * int64(us) / 1000000
+}
+
+// revolution returns the number of cycles for a full revolution of the disk
+func (f *FDC) revolution() int64 {
+	return f.cycles(60 * 1000000 / f.RPM)
+}
+
+// byteCycles returns the number of cycles it takes to transfer one byte at the current density
+func (f *FDC) byteCycles() int64 {
+	if f.doubleDensity {
+		return f.cycles(fdcMFMByteUs)
+	}
+	return f.cycles(fdcFMByteUs)
+}
+
+func (f *FDC) disk() *Disk {
+	return f.drives[f.drive]
+}
+
+// currentTrack returns the track under the head of the selected drive, or nil
+func (f *FDC) currentTrack() *Track {
+	d := f.disk()
+	if d == nil {
+		return nil
+	}
+	return d.Track(f.heads[f.drive], f.side)
+}
+
+// readable reports whether the track can be read with the selected density
+func (f *FDC) readable(t *Track) bool {
+	return t != nil && len(t.Sectors) > 0 && (t.Density == MFM) == f.doubleDensity
+}
+
+func (f *FDC) statusRegister() uint8 {
+	status := f.errBits
+	if f.disk() == nil {
+		status |= FdcStatusNotReady
+	}
+	if f.busy {
+		status |= FdcStatusBusy
+	}
+
+	if f.cmdType == 1 {
+		if f.headLoaded {
+			status |= FdcStatusHeadLoaded
+		}
+		if f.heads[f.drive] == 0 {
+			status |= FdcStatusTrack0
+		}
+		if f.disk() != nil && f.rotation < uint64(f.cycles(fdcIndexMs*1000)) {
+			status |= FdcStatusIndex
+		}
+		if f.disk() != nil && f.disk().WriteProtected {
+			status |= FdcStatusWriteProtect
+		}
+	} else if f.drq {
+		status |= FdcStatusDRQ
+	}
+	return status
+}
+
+// Tick advances the rotation of the disk and any running command
+func (f *FDC) Tick(cycles uint64) {
+	rev := uint64(f.revolution())
+	before := f.rotation
+	f.rotation = (f.rotation + cycles) % rev
+	if f.rotation < before || cycles >= rev {
+		// passed the index hole
+		if f.indexIntr {
+			f.intrq = true
+		}
+	}
+
+	if !f.busy {
+		return
+	}
+	f.delay -= int64(cycles)
+	for f.busy && f.delay <= 0 {
+		f.event()
+	}
+}
+
+func (f *FDC) execute(cmd uint8) {
+	f.intrq = false
+
+	// type IV: force interrupt
+	if cmd&0xF0 == 0xD0 {
+		if !f.busy {
+			f.cmdType = 1
+			f.errBits = 0
+		}
+		f.busy = false
+		f.drq = false
+		f.phase = fdcIdle
+		f.indexIntr = cmd&0x04 != 0
+		if cmd&0x08 != 0 {
+			f.intrq = true
+		}
+		return
+	}
+
+	if f.busy {
+		log.Printf("FDC: Command %#02x ignored, controller busy", cmd)
+		return
+	}
+
+	f.command = cmd
+	f.errBits = 0
+	f.busy = true
+	f.drq = false
+	f.indexIntr = false
+	f.delay = 0
+	f.stepped = false
+	f.buf = nil
+
+	switch {
+	case cmd&0x80 == 0: // type I: restore, seek, step, step in and step out
+		f.cmdType = 1
+		f.headLoaded = cmd&0x08 != 0
+		switch cmd >> 5 {
+		case 0:
+			if cmd&0x10 == 0 { // restore
+				f.track = 0xff
+				f.data = 0
+			}
+		case 2: // step in
+			f.stepDirection = 1
+		case 3: // step out
+			f.stepDirection = -1
+		}
+		f.phase = fdcStep
+	case cmd&0xC0 == 0x80: // type II: read and write sector
+		f.cmdType = 2
+		if !f.typeIIIIReady(cmd&0x20 != 0) {
+			return
+		}
+		f.beginSearch()
+		if cmd&0x04 != 0 {
+			f.delay += f.cycles(fdcSettleMs * 1000)
+		}
+	default: // type III: read address, read track and write track
+		f.cmdType = 3
+		if !f.typeIIIIReady(cmd&0x30 == 0x30) {
+			return
+		}
+		switch cmd & 0xF0 {
+		case 0xC0:
+			f.phase = fdcReadAddress
+			f.delay += f.untilNextSector()
+		case 0xE0, 0xF0:
+			// both wait for the index pulse
+			if cmd&0xF0 == 0xE0 {
+				f.phase = fdcReadTrack
+			} else {
+				f.phase = fdcWriteTrack
+				f.drq = true
+			}
+			f.delay += f.revolution() - int64(f.rotation)
+		}
+		if cmd&0x04 != 0 {
+			f.delay += f.cycles(fdcSettleMs * 1000)
+		}
+	}
+}
+
+// typeIIIIReady checks that the drive is ready (and writable, if write is true) for a type II or III
+// command, and terminates the command otherwise
+func (f *FDC) typeIIIIReady(write bool) bool {
+	d := f.disk()
+	if d == nil {
+		f.finish(0)
+		return false
+	}
+	if write && d.WriteProtected {
+		f.finish(FdcStatusWriteProtect)
+		return false
+	}
+	return true
+}
+
+// finish terminates the current command with the specified error bits and raises INTRQ
+func (f *FDC) finish(errBits uint8) {
+	f.errBits |= errBits
+	f.busy = false
+	f.phase = fdcIdle
+	f.intrq = true
+}
+
+// untilNextSector returns the number of cycles until the next ID field passes under the head
+func (f *FDC) untilNextSector() int64 {
+	t := f.currentTrack()
+	if t == nil || len(t.Sectors) == 0 {
+		return f.byteCycles()
+	}
+	spacing := f.revolution() / int64(len(t.Sectors))
+	return spacing - int64(f.rotation)%spacing
+}
+
+// untilSector returns the number of cycles until the sector at index i on the track passes under the head
+func (f *FDC) untilSector(t *Track, i int) int64 {
+	rev := f.revolution()
+	pos := rev * int64(i) / int64(len(t.Sectors))
+	return ((pos-int64(f.rotation))%rev + rev) % rev
+}
+
+// beginSearch starts searching for the sector in the sector register
+func (f *FDC) beginSearch() {
+	f.phase = fdcSearch
+
+	t := f.currentTrack()
+	if f.readable(t) {
+		compareHead := f.command&0x02 != 0
+		head := (f.command >> 3) & 1
+		for i, s := range t.Sectors {
+			if s.Cylinder == f.track && s.ID == f.sector && (!compareHead || s.Head == head) {
+				f.current = s
+				f.delay += f.untilSector(t, i)
+				return
+			}
+		}
+	}
+
+	// the record does not exist, give up after a number of revolutions
+	f.current = nil
+	f.delay += fdcRNFRevs * f.revolution()
+}
+
+func (f *FDC) event() {
+	switch f.phase {
+	case fdcStep:
+		f.stepEvent()
+	case fdcVerify:
+		t := f.currentTrack()
+		if !f.readable(t) || !f.trackHasCylinder(t) {
+			f.finish(FdcStatusSeekError)
+			return
+		}
+		f.finish(0)
+	case fdcSearch:
+		if f.current == nil {
+			f.finish(FdcStatusRNF)
+			return
+		}
+		f.bufIndex = 0
+		if f.command&0x20 == 0 {
+			f.phase = fdcRead
+			f.buf = f.current.Data
+			f.delay += f.byteCycles()
+		} else {
+			f.phase = fdcWrite
+			f.buf = make([]uint8, len(f.current.Data))
+			f.drq = true
+			f.delay += fdcWriteGap * f.byteCycles()
+		}
+	case fdcRead, fdcReadAddress, fdcReadTrack:
+		f.readEvent()
+	case fdcWrite:
+		f.writeEvent()
+	case fdcWriteTrack:
+		f.writeTrackEvent()
+	default:
+		f.busy = false
+	}
+}
+
+func (f *FDC) trackHasCylinder(t *Track) bool {
+	for _, s := range t.Sectors {
+		if s.Cylinder == f.track {
+			return true
+		}
+	}
+	return false
+}
+
+// stepEvent performs a single step of a type I command
+func (f *FDC) stepEvent() {
+	if f.command>>5 == 0 { // restore and seek
+		if f.command&0x10 == 0 && f.heads[f.drive] == 0 {
+			// restore reached track 0
+			f.track = 0
+			f.endTypeI()
+			return
+		}
+		if f.track == f.data {
+			f.endTypeI()
+			return
+		}
+		f.stepDirection = 1
+		if f.data < f.track {
+			f.stepDirection = -1
+		}
+		f.track += uint8(f.stepDirection)
+	} else { // step, step in and step out only step once
+		if f.stepped {
+			f.endTypeI()
+			return
+		}
+		f.stepped = true
+		if f.command&0x10 != 0 {
+			f.track += uint8(f.stepDirection)
+		}
+	}
+
+	head := f.heads[f.drive] + f.stepDirection
+	if head < 0 {
+		head = 0
+	} else if head > fdcMaxCylinder {
+		head = fdcMaxCylinder
+	}
+	f.heads[f.drive] = head
+	f.delay += f.cycles(fdcStepRates[f.command&0x03] * 1000)
+}
+
+// endTypeI completes a type I command, verifying the track if requested
+func (f *FDC) endTypeI() {
+	if f.command&0x04 == 0 {
+		f.finish(0)
+		return
+	}
+	f.phase = fdcVerify
+	f.delay += f.cycles(fdcSettleMs * 1000)
+}
+
+func (f *FDC) readEvent() {
+	if f.bufIndex == 0 && f.buf == nil {
+		// starting a read address or read track command
+		if f.phase == fdcReadAddress {
+			t := f.currentTrack()
+			if !f.readable(t) {
+				f.delay += fdcRNFRevs * f.revolution()
+				f.buf = []uint8{}
+				f.current = nil
+				return
+			}
+			s := t.Sectors[f.nextSectorIndex(t)]
+			f.current = s
+			f.buf = []uint8{s.Cylinder, s.Head, s.ID, s.SizeCode, 0, 0}
+			crc := crc16(append([]uint8{0xFE}, f.buf[:4]...))
+			f.buf[4], f.buf[5] = uint8(crc>>8), uint8(crc)
+		} else {
+			f.buf = f.rawTrack()
+		}
+		f.bufIndex = 0
+		f.delay += f.byteCycles()
+		return
+	}
+
+	if f.bufIndex < len(f.buf) {
+		if f.drq {
+			f.errBits |= FdcStatusLostData
+		}
+		f.data = f.buf[f.bufIndex]
+		f.bufIndex++
+		f.drq = true
+		f.delay += f.byteCycles()
+		return
+	}
+
+	// the whole record has been transferred
+	f.buf = nil
+	switch f.phase {
+	case fdcReadAddress:
+		if f.current == nil {
+			f.finish(FdcStatusRNF)
+			return
+		}
+		f.sector = f.current.Cylinder
+		f.finish(0)
+	case fdcReadTrack:
+		f.finish(0)
+	default:
+		if f.current.Deleted {
+			f.errBits |= FdcStatusRecordType
+		}
+		if f.current.CRCError {
+			f.finish(FdcStatusCRCError)
+			return
+		}
+		f.nextRecord()
+	}
+}
+
+func (f *FDC) writeEvent() {
+	if f.drq {
+		// the CPU did not provide the data in time
+		f.drq = false
+		f.finish(FdcStatusLostData)
+		return
+	}
+
+	f.buf[f.bufIndex] = f.data
+	f.bufIndex++
+	if f.bufIndex < len(f.buf) {
+		f.drq = true
+		f.delay += f.byteCycles()
+		return
+	}
+
+	f.current.Data = f.buf
+	f.current.Deleted = f.command&0x01 != 0
+	f.current.CRCError = false
+	f.buf = nil
+	f.nextRecord()
+}
+
+// nextRecord finishes a type II command, or continues with the next sector for multiple record commands
+func (f *FDC) nextRecord() {
+	if f.command&0x10 == 0 {
+		f.finish(0)
+		return
+	}
+	f.sector++
+	f.beginSearch()
+	if f.current == nil {
+		// multiple record commands end without error when running out of sectors
+		f.finish(0)
+	}
+}
+
+// nextSectorIndex returns the index of the sector whose ID field passes under the head next
+func (f *FDC) nextSectorIndex(t *Track) int {
+	rev := f.revolution()
+	return int((int64(f.rotation) * int64(len(t.Sectors)) / rev) % int64(len(t.Sectors)))
+}
+
+// rawTrack generates the byte stream of the current track as returned by the read track command
+func (f *FDC) rawTrack() []uint8 {
+	t := f.currentTrack()
+	var out []uint8
+	gap := func(n int, val uint8) {
+		for i := 0; i < n; i++ {
+			out = append(out, val)
+		}
+	}
+
+	gap(40, fdcTrackGapByte)
+	if !f.readable(t) {
+		return out
+	}
+	for _, s := range t.Sectors {
+		gap(12, 0x00)
+		id := []uint8{0xFE, s.Cylinder, s.Head, s.ID, s.SizeCode}
+		crc := crc16(id)
+		out = append(out, id...)
+		out = append(out, uint8(crc>>8), uint8(crc))
+		gap(22, fdcTrackGapByte)
+		gap(12, 0x00)
+		mark := uint8(0xFB)
+		if s.Deleted {
+			mark = 0xF8
+		}
+		crc = crc16(append([]uint8{mark}, s.Data...))
+		out = append(out, mark)
+		out = append(out, s.Data...)
+		out = append(out, uint8(crc>>8), uint8(crc))
+		gap(24, fdcTrackGapByte)
+	}
+	return out
+}
+
+func (f *FDC) writeTrackEvent() {
+	if f.buf == nil {
+		// the index pulse has been reached, start writing
+		if f.drq {
+			f.drq = false
+			f.finish(FdcStatusLostData)
+			return
+		}
+		f.buf = []uint8{f.data}
+		f.drq = true
+		f.delay += f.byteCycles()
+		return
+	}
+
+	if f.drq {
+		// data not provided in time, the controller writes zeroes
+		f.errBits |= FdcStatusLostData
+		f.data = 0
+	}
+	f.buf = append(f.buf, f.data)
+
+	if int64(len(f.buf))*f.byteCycles() < f.revolution() {
+		f.drq = true
+		f.delay += f.byteCycles()
+		return
+	}
+
+	// a full revolution has been written, decode the sectors from the stream
+	f.drq = false
+	d := f.disk()
+	density := FM
+	if f.doubleDensity {
+		density = MFM
+	}
+	d.SetTrack(f.heads[f.drive], f.side, parseTrackStream(f.buf, density))
+	f.buf = nil
+	f.finish(0)
+}
+
+// parseTrackStream decodes the sectors from a byte stream written with the write track command
+func parseTrackStream(stream []uint8, density Density) *Track {
+	t := &Track{Density: density}
+	for i := 0; i < len(stream); i++ {
+		// look for an ID address mark followed by the ID field and the CRC write marker
+		if stream[i] != 0xFE || i+5 >= len(stream) || stream[i+5] != 0xF7 {
+			continue
+		}
+		s := &Sector{Cylinder: stream[i+1], Head: stream[i+2], ID: stream[i+3], SizeCode: stream[i+4] & 0x03}
+		size := 128 << s.SizeCode
+		i += 6
+
+		// then the data address mark
+		for ; i < len(stream) && stream[i] != 0xFB && stream[i] != 0xF8; i++ {
+		}
+		if i+size >= len(stream) {
+			break
+		}
+		s.Deleted = stream[i] == 0xF8
+		s.Data = append([]uint8(nil), stream[i+1:i+1+size]...)
+		t.Sectors = append(t.Sectors, s)
+		i += size
+	}
+	return t
+}
+
+// crc16 calculates the CRC-CCITT used for ID and data fields, including the preceding address marks
+func crc16(data []uint8) uint16 {
+	crc := uint16(0xffff)
+	for _, b := range data {
+		crc ^= uint16(b) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// fdcState is the saved state of the controller, which is followed by the data being transferred
+type fdcState struct {
+	RPM                                   int32
+	Heads                                 [4]int32
+	Drive, Side                           int32
+	DoubleDensity                         bool
+	Track, Sector, Data, Command, ErrBits uint8
+	CmdType                               int32
+	Busy, DRQ, INTRQ, HeadLoaded          bool
+	StepDirection                         int32
+	Stepped                               bool
+	Phase                                 int32
+	Delay                                 int64
+	Rotation                              uint64
+	IndexIntr                             bool
+
+	// HasBuf is set if a transfer is in progress, and Current is the index of its sector in the
+	// current track or -1
+	HasBuf   bool
+	BufIndex int32
+	Current  int32
+}
+
+// SaveState writes the registers, the head positions and the command in progress. The disks are not
+// included, so the same disks must be inserted before the state is loaded.
+func (f *FDC) SaveState(w io.Writer) error {
+	st := fdcState{
+		RPM: int32(f.RPM), Drive: int32(f.drive), Side: int32(f.side), DoubleDensity: f.doubleDensity,
+		Track: f.track, Sector: f.sector, Data: f.data, Command: f.command, ErrBits: f.errBits,
+		CmdType: int32(f.cmdType), Busy: f.busy, DRQ: f.drq, INTRQ: f.intrq, HeadLoaded: f.headLoaded,
+		StepDirection: int32(f.stepDirection), Stepped: f.stepped,
+		Phase: int32(f.phase), Delay: f.delay, Rotation: f.rotation, IndexIntr: f.indexIntr,
+		HasBuf: f.buf != nil, BufIndex: int32(f.bufIndex), Current: -1,
+	}
+	for i, h := range f.heads {
+		st.Heads[i] = int32(h)
+	}
+	if t := f.currentTrack(); t != nil && f.current != nil {
+		for i, sec := range t.Sectors {
+			if sec == f.current {
+				st.Current = int32(i)
+			}
+		}
+	}
+	if err := binary.Write(w, binary.LittleEndian, &st); err != nil {
+		return err
+	}
+	return writeBlock(w, f.buf)
+}
+
+// LoadState restores a state written by SaveState, with the same disks inserted
+func (f *FDC) LoadState(r io.Reader) error {
+	var st fdcState
+	if err := binary.Read(r, binary.LittleEndian, &st); err != nil {
+		return err
+	}
+	buf, err := readBlock(r)
+	if err != nil {
+		return err
+	}
+	if st.Drive < 0 || int(st.Drive) >= len(f.drives) {
+		return fmt.Errorf("fdc: invalid drive %d", st.Drive)
+	}
+	f.RPM, f.drive, f.side, f.doubleDensity = int(st.RPM), int(st.Drive), int(st.Side), st.DoubleDensity
+	f.track, f.sector, f.data, f.command, f.errBits = st.Track, st.Sector, st.Data, st.Command, st.ErrBits
+	f.cmdType, f.busy, f.drq, f.intrq, f.headLoaded = int(st.CmdType), st.Busy, st.DRQ, st.INTRQ, st.HeadLoaded
+	f.stepDirection, f.stepped = int(st.StepDirection), st.Stepped
+	f.phase, f.delay, f.rotation, f.indexIntr = fdcPhase(st.Phase), st.Delay, st.Rotation, st.IndexIntr
+	for i, h := range st.Heads {
+		f.heads[i] = int(h)
+	}
+	f.buf, f.bufIndex, f.current = nil, int(st.BufIndex), nil
+	if st.HasBuf {
+		f.buf = buf
+	}
+	if t := f.currentTrack(); t != nil && st.Current >= 0 {
+		if int(st.Current) >= len(t.Sectors) {
+			return fmt.Errorf("fdc: the current track has no sector %d, is the same disk inserted?", st.Current)
+		}
+		f.current = t.Sectors[st.Current]
+	}
+	return nil
+}
@@ -0,0 +1,189 @@
+package io
+
+import (
+	"bytes"
+	"testing"
+)
+
+const (
+	testFdcBase  = 0x30
+	testFdcClock = 4000000
+)
+
+// newTestFDC returns a controller with a single density 8" disk in drive 0, where each data byte
+// contains the cylinder number xor the sector ID
+func newTestFDC() (*FDC, *Disk) {
+	g, _ := LookupGeometry("ibm-8-sssd")
+	d := NewDisk(g)
+	for cyl := 0; cyl < d.Cylinders; cyl++ {
+		for _, s := range d.Track(cyl, 0).Sectors {
+			for i := range s.Data {
+				s.Data[i] = s.Cylinder ^ s.ID
+			}
+		}
+	}
+
+	f := NewFDC(testFdcBase, testFdcClock)
+	f.RPM = 360
+	f.InsertDisk(0, d)
+	f.Write(testFdcBase+fdcControl, 0)
+	return f, d
+}
+
+// runCommand issues a command and ticks the controller until it is done. Any data requests are
+// served by reading from or writing to data.
+func runCommand(t *testing.T, f *FDC, cmd uint8, data []uint8, write bool) (uint8, int) {
+	f.Write(testFdcBase+fdcStatus, cmd)
+	transferred := 0
+	for i := 0; f.busy; i++ {
+		if i > 10000000 {
+			t.Fatalf("Command %#02x did not complete", cmd)
+		}
+		f.Tick(8)
+		if f.DataRequest() && transferred < len(data) {
+			if write {
+				f.Write(testFdcBase+fdcData, data[transferred])
+			} else {
+				data[transferred] = f.Read(testFdcBase + fdcData)
+			}
+			transferred++
+		}
+	}
+	if !f.Interrupt() {
+		t.Errorf("Command %#02x completed without INTRQ", cmd)
+	}
+	return f.Read(testFdcBase + fdcStatus), transferred
+}
+
+func TestFDCSeekAndRead(t *testing.T) {
+	f, _ := newTestFDC()
+
+	// seek to track 5 with verify
+	f.Write(testFdcBase+fdcData, 5)
+	status, _ := runCommand(t, f, 0x1C, nil, false)
+	if status&(FdcStatusSeekError|FdcStatusCRCError) != 0 {
+		t.Fatalf("Seek failed with status %#02x", status)
+	}
+	if f.track != 5 || f.heads[0] != 5 {
+		t.Fatalf("Expected track 5, got register %d and head %d", f.track, f.heads[0])
+	}
+
+	f.Write(testFdcBase+fdcSector, 3)
+	data := make([]uint8, 128)
+	status, n := runCommand(t, f, 0x80, data, false)
+	if status&(FdcStatusRNF|FdcStatusLostData|FdcStatusCRCError) != 0 || n != 128 {
+		t.Fatalf("Read failed with status %#02x after %d bytes", status, n)
+	}
+	if !bytes.Equal(data, bytes.Repeat([]uint8{5 ^ 3}, 128)) {
+		t.Errorf("Read wrong data, got %v", data[:8])
+	}
+
+	// restore should step back to track 0
+	status, _ = runCommand(t, f, 0x00, nil, false)
+	if status&FdcStatusTrack0 == 0 || f.track != 0 {
+		t.Errorf("Restore failed with status %#02x, track %d", status, f.track)
+	}
+}
+
+func TestFDCWriteSector(t *testing.T) {
+	f, d := newTestFDC()
+
+	f.Write(testFdcBase+fdcSector, 7)
+	data := bytes.Repeat([]uint8{0x42}, 128)
+	status, n := runCommand(t, f, 0xA0, data, true)
+	if status&(FdcStatusRNF|FdcStatusLostData|FdcStatusWriteProtect) != 0 || n != 128 {
+		t.Fatalf("Write failed with status %#02x after %d bytes", status, n)
+	}
+	if s := d.Track(0, 0).Find(0, 0, 7, false); !bytes.Equal(s.Data, data) {
+		t.Errorf("Sector was not written, got %v", s.Data[:8])
+	}
+
+	d.WriteProtected = true
+	status, _ = runCommand(t, f, 0xA0, data, true)
+	if status&FdcStatusWriteProtect == 0 {
+		t.Errorf("Expected write protect error, got status %#02x", status)
+	}
+}
+
+func TestFDCErrors(t *testing.T) {
+	f, _ := newTestFDC()
+
+	// sector 30 does not exist on the track
+	f.Write(testFdcBase+fdcSector, 30)
+	if status, _ := runCommand(t, f, 0x80, make([]uint8, 128), false); status&FdcStatusRNF == 0 {
+		t.Errorf("Expected record not found, got status %#02x", status)
+	}
+
+	// reading a single density track in double density mode fails
+	f.Write(testFdcBase+fdcControl, FdcCtrlDoubleDensity)
+	f.Write(testFdcBase+fdcSector, 1)
+	if status, _ := runCommand(t, f, 0x80, make([]uint8, 128), false); status&FdcStatusRNF == 0 {
+		t.Errorf("Expected record not found for wrong density, got status %#02x", status)
+	}
+
+	// not reading the data in time loses data
+	f.Write(testFdcBase+fdcControl, 0)
+	if status, _ := runCommand(t, f, 0x80, nil, false); status&FdcStatusLostData == 0 {
+		t.Errorf("Expected lost data, got status %#02x", status)
+	}
+}
+
+func TestFDCReadAddress(t *testing.T) {
+	f, _ := newTestFDC()
+	id := make([]uint8, 6)
+	status, n := runCommand(t, f, 0xC0, id, false)
+	if status&FdcStatusRNF != 0 || n != 6 {
+		t.Fatalf("Read address failed with status %#02x after %d bytes", status, n)
+	}
+	if id[0] != 0 || id[2] < 1 || id[2] > 26 || id[3] != 0 {
+		t.Errorf("Unexpected ID field %v", id)
+	}
+}
+
+func TestReadIMD(t *testing.T) {
+	var img bytes.Buffer
+	img.WriteString("IMD 1.18: test image\r\n\x1a")
+
+	// cylinder 0, head 0, two FM sectors of 128 bytes, numbered 2 and 1
+	img.Write([]uint8{0x00, 0, 0, 2, 0, 2, 1})
+	img.WriteByte(1)
+	img.Write(bytes.Repeat([]uint8{0xAA}, 128))
+	img.Write([]uint8{2, 0x55}) // compressed
+
+	// cylinder 1, head 0, one MFM sector of 256 bytes with a cylinder map, deleted and compressed
+	img.Write([]uint8{0x03, 1, 0x80, 1, 1, 1, 9, 4, 0x11})
+
+	d, err := ReadIMD(&img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Cylinders != 2 || d.Heads != 1 {
+		t.Fatalf("Expected 2 cylinders and 1 head, got %d and %d", d.Cylinders, d.Heads)
+	}
+
+	t0 := d.Track(0, 0)
+	if t0.Density != FM || len(t0.Sectors) != 2 || t0.Sectors[0].ID != 2 {
+		t.Fatalf("Unexpected track 0: %+v", t0)
+	}
+	if s := t0.Find(0, 0, 1, true); s == nil || s.Data[127] != 0x55 {
+		t.Errorf("Compressed sector not expanded correctly")
+	}
+
+	t1 := d.Track(1, 0)
+	if t1.Density != MFM || len(t1.Sectors) != 1 {
+		t.Fatalf("Unexpected track 1: %+v", t1)
+	}
+	if s := t1.Sectors[0]; s.Cylinder != 9 || !s.Deleted || len(s.Data) != 256 || s.Data[0] != 0x11 {
+		t.Errorf("Unexpected sector on track 1: %+v", s)
+	}
+}
+
+func TestGeometrySize(t *testing.T) {
+	g, _ := LookupGeometry("ibm-8-ssdd")
+	if g.Size() != 26*128+76*26*256 {
+		t.Errorf("Unexpected size %d for multi-density format", g.Size())
+	}
+	if guess, ok := GeometryForSize(256256); !ok || guess.Name != "ibm-8-sssd" {
+		t.Errorf("Expected ibm-8-sssd for 256256 bytes, got %v", guess.Name)
+	}
+}
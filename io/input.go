@@ -0,0 +1,85 @@
+package io
+
+import (
+	"bufio"
+	"io"
+	"sync/atomic"
+)
+
+// Input reads from a reader in the background, so that devices can poll for input without blocking.
+// It is also a reader that returns at most one line per Read, so that it can be shared between a
+// device and a line based reader such as the debugger prompt without either reading ahead.
+type Input struct {
+	ch chan byte
+
+	// ended is set when the reader has ended
+	ended int32
+}
+
+// NewInput starts reading from r in the background
+func NewInput(r io.Reader) *Input {
+	in := &Input{ch: make(chan byte, 256)}
+	go func(r *bufio.Reader, ch chan byte) {
+		for {
+			c, err := r.ReadByte()
+			if err != nil {
+				atomic.StoreInt32(&in.ended, 1)
+				close(ch)
+				return
+			}
+			ch <- c
+		}
+	}(bufio.NewReader(r), in.ch)
+	return in
+}
+
+// Ready returns true if a byte can be read without blocking
+func (in *Input) Ready() bool {
+	return len(in.ch) > 0
+}
+
+// Ended returns true if the input has ended and all bytes have been read
+func (in *Input) Ended() bool {
+	return atomic.LoadInt32(&in.ended) != 0 && len(in.ch) == 0
+}
+
+// Poll returns the next byte if one is available, without blocking
+func (in *Input) Poll() (byte, bool) {
+	select {
+	case c, ok := <-in.ch:
+		return c, ok
+	default:
+		return 0, false
+	}
+}
+
+// ReadByte blocks until a byte is available, returning io.EOF at the end of the input
+func (in *Input) ReadByte() (byte, error) {
+	c, ok := <-in.ch
+	if !ok {
+		return 0, io.EOF
+	}
+	return c, nil
+}
+
+// Read blocks until a byte is available, and then reads the available bytes up to the end of a line
+func (in *Input) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	c, err := in.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	p[0] = c
+	n := 1
+	for n < len(p) && c != '\n' {
+		var ok bool
+		if c, ok = in.Poll(); !ok {
+			break
+		}
+		p[n] = c
+		n++
+	}
+	return n, nil
+}
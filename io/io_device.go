@@ -8,3 +8,10 @@ type Device interface {
 	// Read reads a single byte from the specified port
 	Read(port uint8) uint8
 }
+
+// Clocked is implemented by devices whose behaviour depends on the passing of time,
+// such as timers and disk controllers. The CPU calls Tick after each instruction.
+type Clocked interface {
+	// Tick advances the device by the specified number of CPU clock cycles
+	Tick(cycles uint64)
+}
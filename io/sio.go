@@ -5,10 +5,14 @@ import (
 	"log"
 )
 
-// SIO implements the IODevice interface and represents the Z80 Serial Input/Output device
+// SIO implements the IODevice interface and represents the Z80 Serial Input/Output device. Channel A
+// is connected to a console, and channel B is not implemented.
 type SIO struct {
-	reader *io.Reader
-	writer *io.Writer
+	input  *Input
+	writer io.Writer
+
+	// rx holds received bytes restored from a saved state, which are read before the input
+	rx []uint8
 }
 
 // constants defining the address used
@@ -20,16 +24,30 @@ const (
 	SioBCtrl = SioBase + 1 + 2
 )
 
-// NewSIO returns a new SIO/2 serial input output device tied to the console
-func NewSIO(r *io.Reader, w *io.Writer) *SIO {
-	return &SIO{reader: r, writer: w}
+// status bits of read register 0
+const (
+	sioRxAvailable = 1 << 0
+	sioTxEmpty     = 1 << 2
+)
+
+// NewSIO returns a new SIO/2 serial input output device with channel A tied to the console. The
+// input is read in the background unless it already is an Input, and either may be nil.
+func NewSIO(r io.Reader, w io.Writer) *SIO {
+	s := &SIO{writer: w}
+	if in, ok := r.(*Input); ok {
+		s.input = in
+	} else if r != nil {
+		s.input = NewInput(r)
+	}
+	return s
 }
 
 func (s *SIO) Write(port, val uint8) {
 	switch port {
 	case SioAData:
-		// TODO: Implement real writing
-		log.Printf("SIO: Write %#02x (%v, '%v') ", val, val, string(val))
+		if s.writer != nil {
+			s.writer.Write([]byte{val})
+		}
 	case SioACtrl:
 		// TODO: Handle Control bits
 	default:
@@ -40,12 +58,40 @@ func (s *SIO) Write(port, val uint8) {
 func (s *SIO) Read(port uint8) uint8 {
 	switch port {
 	case SioAData:
-		// TODO implement serial console read here
-		return 0
+		var c uint8
+		if len(s.rx) > 0 {
+			c, s.rx = s.rx[0], s.rx[1:]
+		} else if s.input != nil {
+			c, _ = s.input.Poll()
+		}
+		// the enter key of a serial terminal sends a carriage return
+		if c == '\n' {
+			c = '\r'
+		}
+		return c
 	case SioACtrl:
-		return (1 << 2) | (1 << 0) // bit 2 = tx ready, bit 0 = 1 if buffer has data
+		if len(s.rx) > 0 || s.input != nil && s.input.Ready() {
+			return sioTxEmpty | sioRxAvailable
+		}
+		return sioTxEmpty
 	default:
 		log.Printf("SIO: Port B read not implemented yet!")
 	}
 	return 0
 }
+
+// SaveState writes the received bytes that the program has not read yet. Bytes still in the input
+// are not part of the state, since the input is shared with the debugger prompt.
+func (s *SIO) SaveState(w io.Writer) error {
+	return writeBlock(w, s.rx)
+}
+
+// LoadState replaces the received bytes with the saved ones
+func (s *SIO) LoadState(r io.Reader) error {
+	rx, err := readBlock(r)
+	if err != nil {
+		return err
+	}
+	s.rx = rx
+	return nil
+}
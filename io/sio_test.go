@@ -0,0 +1,64 @@
+package io
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+// waitReady waits for the background reader of an input to catch up
+func waitReady(in *Input) bool {
+	for i := 0; i < 100 && !in.Ready(); i++ {
+		time.Sleep(time.Millisecond)
+	}
+	return in.Ready()
+}
+
+func TestSIOConsole(t *testing.T) {
+	out := &bytes.Buffer{}
+	in := NewInput(strings.NewReader("hi\n"))
+	sio := NewSIO(in, out)
+
+	for _, c := range "ok\r\n" {
+		sio.Write(SioAData, uint8(c))
+	}
+	if out.String() != "ok\r\n" {
+		t.Errorf("Expected the output on the console, got %q", out.String())
+	}
+
+	var got []uint8
+	for waitReady(in) {
+		if sio.Read(SioACtrl)&sioRxAvailable == 0 {
+			t.Fatalf("Expected the receive bit to be set")
+		}
+		got = append(got, sio.Read(SioAData))
+	}
+	if string(got) != "hi\r" {
+		t.Errorf("Expected the input with a carriage return, got %q", got)
+	}
+	if !in.Ended() {
+		t.Errorf("Expected the input to have ended")
+	}
+	if status := sio.Read(SioACtrl); status != sioTxEmpty {
+		t.Errorf("Expected an empty receive buffer, got status %#02x", status)
+	}
+}
+
+func TestInputLines(t *testing.T) {
+	in := NewInput(strings.NewReader("first\nsecond\n"))
+	r := bufio.NewReader(in)
+	line, err := r.ReadString('\n')
+	if err != nil || line != "first\n" {
+		t.Fatalf("Expected the first line, got %q: %v", line, err)
+	}
+
+	// the rest of the input is left for others, such as a device
+	if !waitReady(in) {
+		t.Fatalf("Expected the second line to be left")
+	}
+	if c, ok := in.Poll(); !ok || c != 's' {
+		t.Errorf("Expected the second line to be left, got %q", c)
+	}
+}
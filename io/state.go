@@ -0,0 +1,113 @@
+package io
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Stateful is implemented by devices whose state is saved in machine state snapshots, such as
+// buffered input and the registers of a controller. Host resources such as image files are not part
+// of the state, and must be attached again before the state is loaded.
+type Stateful interface {
+	// SaveState writes the state of the device
+	SaveState(w io.Writer) error
+
+	// LoadState restores a state written by SaveState
+	LoadState(r io.Reader) error
+}
+
+// writeBlock writes data prefixed with its length as a little-endian uint32
+func writeBlock(w io.Writer, data []uint8) error {
+	if err := binary.Write(w, binary.LittleEndian, uint32(len(data))); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+// readBlock reads data written by writeBlock
+func readBlock(r io.Reader) ([]uint8, error) {
+	var size uint32
+	if err := binary.Read(r, binary.LittleEndian, &size); err != nil {
+		return nil, err
+	}
+	data := make([]uint8, size)
+	_, err := io.ReadFull(r, data)
+	return data, err
+}
+
+// statefulDevices returns the attached devices that implement Stateful with the first port of each,
+// in the order of the ports
+func (b *Bus) statefulDevices() ([]Stateful, []uint8) {
+	var devices []Stateful
+	var ports []uint8
+	for port, dev := range b.ports {
+		s, ok := dev.(Stateful)
+		if !ok || port > 0 && b.ports[port-1] == dev {
+			continue
+		}
+		devices = append(devices, s)
+		ports = append(ports, uint8(port))
+	}
+	return devices, ports
+}
+
+// SaveState writes the state of the attached devices that implement Stateful, each with its first
+// port so that it is restored to the device at the same port
+func (b *Bus) SaveState(w io.Writer) error {
+	devices, ports := b.statefulDevices()
+	for i, s := range devices {
+		var buf bytes.Buffer
+		if err := s.SaveState(&buf); err != nil {
+			return fmt.Errorf("port $%02X: %w", ports[i], err)
+		}
+		if _, err := w.Write([]uint8{ports[i]}); err != nil {
+			return err
+		}
+		if err := writeBlock(w, buf.Bytes()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LoadState restores the states of the devices written by SaveState
+func (b *Bus) LoadState(r io.Reader) error {
+	for {
+		var port [1]uint8
+		if _, err := io.ReadFull(r, port[:]); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		data, err := readBlock(r)
+		if err != nil {
+			return fmt.Errorf("port $%02X: %w", port[0], err)
+		}
+		s, ok := b.ports[port[0]].(Stateful)
+		if !ok {
+			return fmt.Errorf("port $%02X: no device to restore the state of", port[0])
+		}
+		if err := s.LoadState(bytes.NewReader(data)); err != nil {
+			return fmt.Errorf("port $%02X: %w", port[0], err)
+		}
+	}
+}
+
+// SaveState writes the state of the device if it implements Stateful, and nothing otherwise
+func (t *Tap) SaveState(w io.Writer) error {
+	if s, ok := t.dev.(Stateful); ok {
+		return s.SaveState(w)
+	}
+	return nil
+}
+
+// LoadState restores the state of the device if it implements Stateful
+func (t *Tap) LoadState(r io.Reader) error {
+	if s, ok := t.dev.(Stateful); ok {
+		return s.LoadState(r)
+	}
+	return nil
+}
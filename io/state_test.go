@@ -0,0 +1,119 @@
+package io
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestBusState(t *testing.T) {
+	cf, cleanup := newTestCF(t, 4, CopyOnWrite)
+	defer cleanup()
+	sio := NewSIO(nil, nil)
+	sio.rx = []uint8("hi")
+	bus := NewBus()
+	bus.Attach(SioBase, 4, sio)
+	bus.Attach(testCfBase, cf.Ports(), cf)
+
+	// write a sector, and start reading another one
+	selectLBA(cf, 1, 1)
+	bus.Write(testCfBase+cfStatus, CfCmdWriteSector)
+	for i := 0; i < SectorSize; i++ {
+		bus.Write(testCfBase+cfData, 0xAA)
+	}
+	selectLBA(cf, 3, 1)
+	bus.Write(testCfBase+cfStatus, CfCmdReadSector)
+	bus.Read(testCfBase + cfData)
+
+	var state bytes.Buffer
+	if err := bus.SaveState(&state); err != nil {
+		t.Fatal(err)
+	}
+
+	// restore the state into new devices on the same image
+	cf2, err := NewCompactFlash(cf.image.Name(), testCfBase, CopyOnWrite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cf2.Close()
+	sio2 := NewSIO(nil, nil)
+	bus2 := NewBus()
+	bus2.Attach(SioBase, 4, sio2)
+	bus2.Attach(testCfBase, cf2.Ports(), cf2)
+	if err := bus2.LoadState(&state); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := []uint8{bus2.Read(SioAData), bus2.Read(SioAData)}; string(got) != "hi" || bus2.Read(SioACtrl)&sioRxAvailable != 0 {
+		t.Errorf("Expected to read the saved input \"hi\", got %q", got)
+	}
+	if got := bus2.Read(testCfBase + cfData); got != 3 {
+		t.Errorf("Expected to continue reading sector 3, got %#02x", got)
+	}
+	buf := make([]uint8, SectorSize)
+	if err := cf2.ReadSector(1, buf); err != nil || buf[0] != 0xAA {
+		t.Errorf("Expected the written sector to be restored, got %#02x and %v", buf[0], err)
+	}
+
+	// a state for a device that is not attached
+	state.Reset()
+	bus.SaveState(&state)
+	if err := NewBus().LoadState(&state); err == nil {
+		t.Errorf("Expected an error restoring devices that are not attached")
+	}
+}
+
+func TestSIOStateKeepsInput(t *testing.T) {
+	in := NewInput(strings.NewReader("reg\n"))
+	sio := NewSIO(in, nil)
+	if !waitReady(in) {
+		t.Fatal("Expected the input to be ready")
+	}
+
+	var state bytes.Buffer
+	if err := sio.SaveState(&state); err != nil {
+		t.Fatal(err)
+	}
+	sio2 := NewSIO(nil, nil)
+	if err := sio2.LoadState(&state); err != nil {
+		t.Fatal(err)
+	}
+	if sio2.Read(SioACtrl)&sioRxAvailable != 0 {
+		t.Errorf("Expected the pending input not to be saved")
+	}
+	if c, err := in.ReadByte(); err != nil || c != 'r' {
+		t.Errorf("Expected the input to be left for the debugger, got %q and %v", c, err)
+	}
+}
+
+func TestCFStateIndex(t *testing.T) {
+	cf, cleanup := newTestCF(t, 4, CopyOnWrite)
+	defer cleanup()
+	selectLBA(cf, 0, 1)
+	cf.Write(testCfBase+cfStatus, CfCmdReadSector)
+
+	tables := []struct {
+		index int32
+		ok    bool
+	}{
+		{0, true}, {SectorSize - 1, true}, {SectorSize, false}, {-1, false},
+	}
+	for _, table := range tables {
+		cf.index = int(table.index)
+		var state bytes.Buffer
+		if err := cf.SaveState(&state); err != nil {
+			t.Fatal(err)
+		}
+		if err := cf.LoadState(&state); (err == nil) != table.ok {
+			t.Errorf("Expected loading index %d while data is requested to succeed %v, got %v", table.index, table.ok, err)
+		}
+	}
+
+	// the index is at the end after the whole sector has been read
+	cf.index, cf.status = SectorSize, cf.status&^CfStatusDRQ
+	var state bytes.Buffer
+	cf.SaveState(&state)
+	if err := cf.LoadState(&state); err != nil {
+		t.Errorf("Expected the index at the end of a finished transfer to load, got %v", err)
+	}
+}
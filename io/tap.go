@@ -0,0 +1,108 @@
+package io
+
+import (
+	"fmt"
+	"io"
+)
+
+// PortAccess is an IN or OUT operation on a port
+type PortAccess struct {
+	Out   bool
+	Port  uint8
+	Value uint8
+}
+
+func (a PortAccess) String() string {
+	if a.Out {
+		return fmt.Sprintf("OUT $%02X to port $%02X", a.Value, a.Port)
+	}
+	return fmt.Sprintf("IN $%02X from port $%02X", a.Value, a.Port)
+}
+
+// PortFilter selects port accesses by direction, a range of ports and optionally the value
+type PortFilter struct {
+	In, Out     bool
+	First, Last uint8
+
+	// Value is only compared if HasValue is set
+	HasValue bool
+	Value    uint8
+}
+
+// Matches returns true if the filter selects the access
+func (f PortFilter) Matches(a PortAccess) bool {
+	return (a.Out && f.Out || !a.Out && f.In) && a.Port >= f.First && a.Port <= f.Last && (!f.HasValue || a.Value == f.Value)
+}
+
+func (f PortFilter) String() string {
+	dir := "IN/OUT"
+	if !f.In {
+		dir = "OUT"
+	} else if !f.Out {
+		dir = "IN"
+	}
+	s := fmt.Sprintf("%v port $%02X", dir, f.First)
+	if f.Last != f.First {
+		s = fmt.Sprintf("%v ports $%02X-$%02X", dir, f.First, f.Last)
+	}
+	if f.HasValue {
+		s += fmt.Sprintf(" value $%02X", f.Value)
+	}
+	return s
+}
+
+// Tap is a Device that passes the IN and OUT operations on to another device and reports them, so
+// that they can be logged or stop a debugger. Without a device ports read as 0xff like on the Bus.
+type Tap struct {
+	dev    Device
+	report func(a PortAccess)
+}
+
+// NewTap returns a Tap around a device that calls report after each operation
+func NewTap(dev Device, report func(a PortAccess)) *Tap {
+	return &Tap{dev: dev, report: report}
+}
+
+// Device returns the device the tap passes the operations to
+func (t *Tap) Device() Device {
+	return t.dev
+}
+
+func (t *Tap) Write(port, val uint8) {
+	if t.dev != nil {
+		t.dev.Write(port, val)
+	}
+	t.report(PortAccess{Out: true, Port: port, Value: val})
+}
+
+func (t *Tap) Read(port uint8) uint8 {
+	val := uint8(0xff)
+	if t.dev != nil {
+		val = t.dev.Read(port)
+	}
+	t.report(PortAccess{Port: port, Value: val})
+	return val
+}
+
+// Tick forwards the clock cycles to the device if it is clocked
+func (t *Tap) Tick(cycles uint64) {
+	if c, ok := t.dev.(Clocked); ok {
+		c.Tick(cycles)
+	}
+}
+
+// NewPortLogger returns a Tap around a device that writes the accesses selected by any of the filters
+// to w, or all accesses without filters
+func NewPortLogger(dev Device, w io.Writer, filters ...PortFilter) *Tap {
+	return NewTap(dev, func(a PortAccess) {
+		for _, f := range filters {
+			if f.Matches(a) {
+				fmt.Fprintln(w, a)
+				return
+			}
+		}
+		if len(filters) == 0 {
+			fmt.Fprintln(w, a)
+		}
+	})
+}
@@ -0,0 +1,66 @@
+package io
+
+import (
+	"bytes"
+	"testing"
+)
+
+// clockedDevice counts the clock cycles and reads the port number
+type clockedDevice struct {
+	cycles uint64
+}
+
+func (c *clockedDevice) Write(port, val uint8) {}
+func (c *clockedDevice) Read(port uint8) uint8 { return port }
+func (c *clockedDevice) Tick(cycles uint64)    { c.cycles += cycles }
+
+func TestPortFilter(t *testing.T) {
+	out := PortFilter{Out: true, First: 0x22, Last: 0x22, HasValue: true, Value: 0x18}
+	in := PortFilter{In: true, First: 0x20, Last: 0x23}
+	for _, test := range []struct {
+		filter PortFilter
+		access PortAccess
+		match  bool
+	}{
+		{out, PortAccess{true, 0x22, 0x18}, true},
+		{out, PortAccess{true, 0x22, 0x19}, false},
+		{out, PortAccess{false, 0x22, 0x18}, false},
+		{in, PortAccess{false, 0x20, 0x00}, true},
+		{in, PortAccess{false, 0x23, 0xFF}, true},
+		{in, PortAccess{false, 0x24, 0x00}, false},
+		{in, PortAccess{true, 0x21, 0x00}, false},
+	} {
+		if test.filter.Matches(test.access) != test.match {
+			t.Errorf("Expected %v to match %v: %v", test.filter, test.access, test.match)
+		}
+	}
+	if out.String() != "OUT port $22 value $18" || in.String() != "IN ports $20-$23" {
+		t.Errorf("Unexpected filters %q and %q", out, in)
+	}
+}
+
+func TestPortLogger(t *testing.T) {
+	dev := &clockedDevice{}
+	var log bytes.Buffer
+	tap := NewPortLogger(dev, &log, PortFilter{In: true, First: 0x10, Last: 0x1F}, PortFilter{Out: true, First: 0x80, Last: 0x80})
+	tap.Write(0x10, 1)
+	tap.Write(0x80, 2)
+	if tap.Read(0x11) != 0x11 || tap.Read(0x80) != 0x80 {
+		t.Errorf("Expected the reads to reach the device")
+	}
+	tap.Tick(7)
+	if dev.cycles != 7 {
+		t.Errorf("Expected the clock cycles to reach the device")
+	}
+	if log.String() != "OUT $02 to port $80\nIN $11 from port $11\n" {
+		t.Errorf("Unexpected log %q", log.String())
+	}
+
+	// without a device the ports read as 0xff, and everything is logged without filters
+	log.Reset()
+	tap = NewPortLogger(nil, &log)
+	tap.Tick(1)
+	if tap.Read(0x01) != 0xff || log.String() != "IN $FF from port $01\n" {
+		t.Errorf("Unexpected read or log %q", log.String())
+	}
+}
@@ -0,0 +1,153 @@
+// Package loader reads program files in the supported formats into memory images
+package loader
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/antbern/z80-emulator/core"
+)
+
+// Format is a file format that can be read into a memory image. Origin is the address of a binary
+// file, and is added to the addresses of the records of formats that contain addresses.
+type Format struct {
+	Name       string
+	Extensions []string
+	Read       func(r io.Reader, origin uint32) (*core.Image, error)
+}
+
+// Formats is the table of supported file formats. The last one is used for unknown extensions.
+var Formats = []Format{
+	{Name: "ihex", Extensions: []string{".hex", ".ihx", ".ihex"}, Read: readIntelHex},
+	{Name: "srec", Extensions: []string{".s19", ".s28", ".s37", ".srec", ".mot"}, Read: ReadSRecord},
+	{Name: "bin", Extensions: []string{".bin", ".com", ".rom"}, Read: readBinary},
+}
+
+// LookupFormat returns the format with the specified name
+func LookupFormat(name string) (Format, bool) {
+	for _, f := range Formats {
+		if f.Name == name {
+			return f, true
+		}
+	}
+	return Format{}, false
+}
+
+// FormatForFile returns the format of a file from its extension, defaulting to binary
+func FormatForFile(path string) Format {
+	ext := strings.ToLower(filepath.Ext(path))
+	for _, f := range Formats {
+		for _, e := range f.Extensions {
+			if e == ext {
+				return f
+			}
+		}
+	}
+	return Formats[len(Formats)-1]
+}
+
+func readBinary(r io.Reader, origin uint32) (*core.Image, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return &core.Image{Segments: []core.Segment{{Addr: origin, Data: data}}}, nil
+}
+
+func readIntelHex(r io.Reader, origin uint32) (*core.Image, error) {
+	img, err := core.ReadIntelHex(r)
+	if err != nil {
+		return nil, err
+	}
+	relocate(img, origin)
+	return img, nil
+}
+
+// relocate adds offset to the addresses of the segments and the start address of an image
+func relocate(img *core.Image, offset uint32) {
+	for i := range img.Segments {
+		img.Segments[i].Addr += offset
+	}
+	if img.HasStart {
+		img.Start += offset
+	}
+}
+
+// LoadFile reads a file in the named format, or the format given by its extension if format is empty
+func LoadFile(path, format string, origin uint32) (*core.Image, error) {
+	f := FormatForFile(path)
+	if format != "" {
+		var ok bool
+		if f, ok = LookupFormat(format); !ok {
+			return nil, fmt.Errorf("unknown file format %q", format)
+		}
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	img, err := f.Read(bytes.NewReader(data), origin)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %w", path, err)
+	}
+	return img, nil
+}
+
+// Spec is a file to load and its origin, parsed from the form file@addr
+type Spec struct {
+	Path   string
+	Origin uint32
+}
+
+// ParseSpec parses a file name with an optional origin address, such as rom.bin@0x8000
+func ParseSpec(s string) (Spec, error) {
+	i := strings.LastIndex(s, "@")
+	if i < 0 {
+		return Spec{Path: s}, nil
+	}
+	origin, err := strconv.ParseUint(s[i+1:], 0, 32)
+	if err != nil {
+		return Spec{}, fmt.Errorf("invalid origin in %q: %w", s, err)
+	}
+	return Spec{Path: s[:i], Origin: uint32(origin)}, nil
+}
+
+func (s Spec) String() string {
+	return fmt.Sprintf("%v@%#04x", s.Path, s.Origin)
+}
+
+// Merge combines images into one. The start address is taken from the first image that has one.
+func Merge(imgs ...*core.Image) *core.Image {
+	merged := &core.Image{}
+	for _, img := range imgs {
+		merged.Segments = append(merged.Segments, img.Segments...)
+		if img.HasStart && !merged.HasStart {
+			merged.Start, merged.HasStart = img.Start, true
+		}
+	}
+	return merged
+}
+
+// LoadAll loads all files and merges them. Without a start address in any of the files, the image
+// starts at the origin of the first file.
+func LoadAll(specs []Spec, format string) (*core.Image, error) {
+	var imgs []*core.Image
+	for _, s := range specs {
+		img, err := LoadFile(s.Path, format, s.Origin)
+		if err != nil {
+			return nil, err
+		}
+		imgs = append(imgs, img)
+	}
+	merged := Merge(imgs...)
+	if !merged.HasStart && len(specs) > 0 {
+		merged.Start, merged.HasStart = specs[0].Origin, true
+	}
+	return merged, nil
+}
@@ -0,0 +1,130 @@
+package loader
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/antbern/z80-emulator/core"
+)
+
+const testSRecord = `S00B0000686578616D706C65A0
+S1070000213400C9DA
+S105010076C9BA
+S206000000AABB94
+S5030003F9
+S9030100FB
+`
+
+func TestReadSRecord(t *testing.T) {
+	img, err := ReadSRecord(strings.NewReader(testSRecord), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(img.Segments) != 3 {
+		t.Fatalf("Expected 3 segments, got %d", len(img.Segments))
+	}
+	if s := img.Segments[1]; s.Addr != 0x0100 || len(s.Data) != 2 || s.Data[0] != 0x76 {
+		t.Errorf("Unexpected second segment %#v", s)
+	}
+	if s := img.Segments[2]; s.Addr != 0 || s.Data[1] != 0xBB {
+		t.Errorf("Unexpected S2 segment %#v", s)
+	}
+	if !img.HasStart || img.Start != 0x0100 {
+		t.Errorf("Expected start address 0x0100, got %#x", img.Start)
+	}
+
+	// relocated to an origin
+	img, err = ReadSRecord(strings.NewReader(testSRecord), 0x8000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Segments[0].Addr != 0x8000 || img.Start != 0x8100 {
+		t.Errorf("Origin not applied, got segment at %#x and start %#x", img.Segments[0].Addr, img.Start)
+	}
+}
+
+func TestReadSRecordErrors(t *testing.T) {
+	tables := []struct {
+		input string
+		line  int
+	}{
+		{"S1070000213400C9DB\n", 1},
+		{"S1070000213400C9DA\nS5030002FA\n", 2},
+		{"S1070000213400C9DA\n\nS4030000FC\n", 3},
+		{"S1070000\n", 1},
+		{"X107000000213400C9DA\n", 1},
+	}
+	for _, table := range tables {
+		_, err := ReadSRecord(strings.NewReader(table.input), 0)
+		var lineErr *core.LineError
+		if !errors.As(err, &lineErr) || lineErr.Line != table.line {
+			t.Errorf("Expected an error on line %d for %q, got %v", table.line, table.input, err)
+		}
+	}
+}
+
+func TestParseSpec(t *testing.T) {
+	tables := []struct {
+		spec   string
+		path   string
+		origin uint32
+		ok     bool
+	}{
+		{"rom.bin", "rom.bin", 0, true},
+		{"rom.bin@0x8000", "rom.bin", 0x8000, true},
+		{"dir@home/data.bin@256", "dir@home/data.bin", 256, true},
+		{"rom.bin@zero", "", 0, false},
+	}
+	for _, table := range tables {
+		s, err := ParseSpec(table.spec)
+		if (err == nil) != table.ok || s.Path != table.path || s.Origin != table.origin {
+			t.Errorf("ParseSpec(%q) = %v, %v", table.spec, s, err)
+		}
+	}
+}
+
+func TestLoadAll(t *testing.T) {
+	dir, err := ioutil.TempDir("", "loadertest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rom := filepath.Join(dir, "rom.bin")
+	hex := filepath.Join(dir, "data.hex")
+	srec := filepath.Join(dir, "code.dat")
+	ioutil.WriteFile(rom, []byte{1, 2, 3}, 0644)
+	ioutil.WriteFile(hex, []byte(":0300300002337A1E\n:00000001FF\n"), 0644)
+	ioutil.WriteFile(srec, []byte(testSRecord), 0644)
+
+	img, err := LoadAll([]Spec{{rom, 0x4000}, {hex, 0x1000}}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(img.Segments) != 2 || img.Segments[0].Addr != 0x4000 || img.Segments[1].Addr != 0x1030 {
+		t.Errorf("Unexpected segments %#v", img.Segments)
+	}
+	if !img.HasStart || img.Start != 0x4000 {
+		t.Errorf("Expected to start at the first origin, got %#x", img.Start)
+	}
+
+	// the format flag overrides the extension, and the start address of the file is used
+	if _, err := LoadAll([]Spec{{rom, 0x4000}, {srec, 0}}, "srec"); err == nil {
+		t.Errorf("Expected an error reading a binary file as S-records")
+	}
+	img, err = LoadAll([]Spec{{srec, 0}}, "srec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Start != 0x0100 {
+		t.Errorf("Expected the start address of the S-record file, got %#x", img.Start)
+	}
+
+	if _, err := LoadFile(rom, "elf", 0); err == nil {
+		t.Errorf("Expected an error for an unknown format")
+	}
+}
@@ -0,0 +1,93 @@
+package loader
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/antbern/z80-emulator/core"
+)
+
+// ReadSRecord parses a Motorola S-record file (S19, S28 or S37). Data records S1 to S3 become
+// segments at their address plus origin, and the start address is taken from S7 to S9 records.
+// The header and record count records are checked but otherwise ignored.
+func ReadSRecord(r io.Reader, origin uint32) (*core.Image, error) {
+	img := &core.Image{}
+	scanner := bufio.NewScanner(r)
+	line, dataRecords := 0, 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		fail := func(format string, args ...interface{}) (*core.Image, error) {
+			return nil, &core.LineError{Line: line, Err: fmt.Errorf(format, args...)}
+		}
+
+		if len(text) < 4 || text[0] != 'S' {
+			return fail("record does not start with 'S'")
+		}
+		rec, err := hex.DecodeString(text[2:])
+		if err != nil {
+			return fail("invalid hex digits: %v", err)
+		}
+		if len(rec) < 3 || len(rec) != int(rec[0])+1 {
+			return fail("record length does not match its byte count")
+		}
+		var sum uint8
+		for _, b := range rec {
+			sum += b
+		}
+		if sum != 0xFF {
+			return nil, &core.LineError{Line: line, Err: core.ErrChecksum}
+		}
+
+		// the size of the address field depends on the record type
+		addrSize := 0
+		switch text[1] {
+		case '0', '1', '5', '9':
+			addrSize = 2
+		case '2', '6', '8':
+			addrSize = 3
+		case '3', '7':
+			addrSize = 4
+		default:
+			return fail("unsupported record type S%c", text[1])
+		}
+		if len(rec) < addrSize+2 {
+			return fail("record too short for its address")
+		}
+		var addr uint32
+		for _, b := range rec[1 : 1+addrSize] {
+			addr = addr<<8 | uint32(b)
+		}
+		data := rec[1+addrSize : len(rec)-1]
+
+		switch text[1] {
+		case '1', '2', '3':
+			dataRecords++
+			if len(data) > 0 {
+				img.Segments = append(img.Segments, core.Segment{Addr: addr + origin, Data: data})
+			}
+		case '5', '6':
+			if int(addr) != dataRecords {
+				return fail("record count %d does not match the %d data records", addr, dataRecords)
+			}
+		case '7', '8', '9':
+			img.Start, img.HasStart = addr+origin, true
+			return img, nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(img.Segments) == 0 {
+		return nil, &core.LineError{Line: line, Err: errors.New("no data records")}
+	}
+	// the termination record is optional
+	return img, nil
+}
@@ -9,86 +9,460 @@ Decoding instructions: http://www.z80.info/decoding.htm
 */
 
 import (
-	"bufio"
 	"encoding/hex"
 	"flag"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"strconv"
 	"strings"
 
 	"github.com/antbern/z80-emulator/core"
+	"github.com/antbern/z80-emulator/debugger"
 	"github.com/antbern/z80-emulator/io"
+	"github.com/antbern/z80-emulator/loader"
+	"github.com/antbern/z80-emulator/spectrum"
+	"github.com/antbern/z80-emulator/symbols"
+	"github.com/antbern/z80-emulator/trace"
 )
 
 func main() {
+	// subcommands
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "cpm":
+			os.Exit(runCPM(os.Args[2:]))
+		case "boot":
+			os.Exit(runBoot(os.Args[2:]))
+		case "disasm":
+			os.Exit(runDisasm(os.Args[2:]))
+		case "asm":
+			os.Exit(runAsm(os.Args[2:]))
+		case "tracediff":
+			os.Exit(runTraceDiff(os.Args[2:]))
+		}
+	}
+	os.Exit(runEmulator())
+}
 
-	fileName := flag.String("i", "input/monitor.bin", "The binary input file to load")
-	origin := flag.String("o", "0x0000", "The origin/base address of the code. Decides where the loaded file will be placed in memory")
+// runEmulator runs a program with the flags of the command line, returning the exit status
+func runEmulator() int {
+	var loads loadFlags
+	flag.Var(&loads, "load", "A file to load at an origin address, e.g. rom.bin@0x0000 (repeatable). Execution starts at the start address of a HEX or S-record file, or at the first origin. Defaults to input/monitor.bin@0")
+	var symFiles listFlags
+	flag.Var(&symFiles, "sym", "A listing or symbol file (.lst, .sym, .map or .noi) with labels for the program (repeatable). Listings beside the loaded files are used by default")
+	format := flag.String("format", "", "The format of the loaded files (bin, ihex or srec), chosen by file extension if empty")
+	cfImage := flag.String("cf", "", "A raw disk image to attach as a CompactFlash card")
+	cfBase := flag.String("cf-base", "0x10", "The base port of the CompactFlash task file registers")
+	cfCOW := flag.Bool("cf-cow", false, "Allow writes to the CompactFlash card, keeping them in memory only (copy-on-write)")
+	diskImage := flag.String("disk", "", "A floppy disk image (raw or .imd) to insert into drive 0 of the floppy disk controller")
+	diskFormat := flag.String("disk-format", "", "The format of a raw floppy disk image, guessed from its size if empty")
+	fdcBase := flag.String("fdc-base", "0x30", "The base port of the floppy disk controller registers")
+	clock := flag.Uint64("clock", 4000000, "The CPU clock frequency in Hz, used for device timing")
+	bdos := flag.Bool("bdos", false, "Handle CALL 5 as a CP/M BDOS call")
+	var drives driveFlags
+	flag.Var(&drives, "drive", "Map a CP/M drive to a host directory for the BDOS file functions, e.g. A=./disk (repeatable)")
+	verbose := flag.Bool("v", false, "Log emulator debug output to stderr")
+	loadState := flag.String("load-state", "", "Restore the registers, memory and device state from a file saved with -save-state or the save command, or a ZX Spectrum .sna or .z80 snapshot, after loading the files")
+	saveState := flag.String("save-state", "", "Save the registers, memory and device state to a file when the emulator exits, as a ZX Spectrum snapshot if the file ends with .sna or .z80")
+	var tracing traceFlags
+	tracing.register(flag.CommandLine)
+	record := flag.Int("record", 0, "Record the last N instructions from the start, so that the debugger can run backwards with rs, rc and seek")
+	var trig triggerFlags
+	flag.BoolVar(&trig.interactive, "break", false, "Enter interactive mode before the first instruction instead of running freely")
+	flag.Var(trig.kind("break-pc", "pc"), "break-pc", "Enter interactive mode when the PC reaches an address or label, optionally with a condition such as \"putc if A == 13\". It stays a breakpoint (repeatable)")
+	flag.Var(trig.kind("break-after", "after"), "break-after", "Enter interactive mode after N instructions, or N clock cycles with a c suffix such as 4000000c")
+	flag.Var(trig.kind("break-op", "op"), "break-op", "Enter interactive mode before an instruction with opcode bytes such as \"ED B0\" or a mnemonic such as HALT (repeatable)")
+	flag.Var(trig.kind("break-reg", "reg"), "break-reg", "Enter interactive mode when a register holds a value, e.g. A=0x42 (repeatable)")
+	flag.Var(trig.kind("watch", "watch"), "watch", "Enter interactive mode after an access to memory, given as the kinds r, w (the default) and x for fetches and an address range, e.g. \"rw buf buf+15\". It stays a watchpoint (repeatable)")
+	flag.Var(trig.kind("break-if", "if"), "break-if", "Enter interactive mode when a condition over registers, flags and memory is true, e.g. \"SP < 0xF000 && (HL) == 0x0D\" (repeatable)")
+	flag.Var(trig.kind("break-port", "port"), "break-port", "Enter interactive mode after an access to an I/O port, given as in or out, a port or port range and a value, e.g. \"out SIO_A_CTRL=$18\". It stays a port breakpoint (repeatable)")
+	flag.Var(trig.kind("log-port", "plog"), "log-port", "Log accesses to I/O ports while running, given as for -break-port, e.g. \"in $20 $23\" (repeatable)")
 	flag.Parse()
 
-	// parse the origin base address
-	baseAddr, err := strconv.ParseUint(*origin, 0, 16)
+	if len(loads.specs) == 0 {
+		loads.specs = []loader.Spec{{Path: "input/monitor.bin"}}
+	}
 
+	// read the contents of the files into a memory image
+	for _, spec := range loads.specs {
+		log.Println("Loading file", spec)
+	}
+	img, err := loader.LoadAll(loads.specs, *format)
 	if err != nil {
-		log.Printf("Error parsing origin argument %v: %v\n", *origin, err)
-		return
+		log.Println("Error loading file: ", err)
+		return 1
+	}
+	for _, s := range img.Segments {
+		n := len(s.Data)
+		if n > 64 {
+			n = 64
+		}
+		if n > 0 {
+			log.Printf("\n%s", hex.Dump(s.Data[:n]))
+		}
 	}
 
-	// read the contents of the binary into a byte slice
-	log.Println("Loading file", *fileName)
-	data, err := ioutil.ReadFile(*fileName)
+	// read the labels of the program
+	syms, sources, err := loadSymbols(symFiles, loads.specs)
 	if err != nil {
-		log.Println("Error loading file: ", err)
-		return
+		log.Println("Error loading symbols: ", err)
+		return 1
 	}
 
-	log.Printf("\n%s", hex.Dump(data[:64]))
+	// set up the IO devices, with the console shared by the SIO and the debugger
+	console := io.NewInput(os.Stdin)
+	bus := io.NewBus()
+	bus.Attach(io.SioBase, 4, io.NewSIO(console, os.Stdout))
+
+	if *cfImage != "" {
+		base, err := strconv.ParseUint(*cfBase, 0, 8)
+		if err != nil {
+			log.Printf("Error parsing CompactFlash base port %v: %v\n", *cfBase, err)
+			return 2
+		}
+		mode := io.ReadOnly
+		if *cfCOW {
+			mode = io.CopyOnWrite
+		}
+		cf, err := io.NewCompactFlash(*cfImage, uint8(base), mode)
+		if err != nil {
+			log.Println("Error opening CompactFlash image: ", err)
+			return 1
+		}
+		defer cf.Close()
+		log.Printf("Attached CompactFlash image %v (%v sectors) at port %#02x", *cfImage, cf.Sectors(), base)
+		bus.Attach(uint8(base), cf.Ports(), cf)
+	}
 
-	mainLoop(data, uint16(baseAddr))
+	if *diskImage != "" {
+		base, err := strconv.ParseUint(*fdcBase, 0, 8)
+		if err != nil {
+			log.Printf("Error parsing floppy disk controller base port %v: %v\n", *fdcBase, err)
+			return 2
+		}
+		if *clock == 0 {
+			log.Println("Error: the floppy disk controller needs a -clock frequency above 0")
+			return 2
+		}
+		disk, err := io.LoadDisk(*diskImage, *diskFormat)
+		if err != nil {
+			log.Println("Error loading disk image: ", err)
+			return 1
+		}
+		fdc := io.NewFDC(uint8(base), *clock)
+		fdc.InsertDisk(0, disk)
+		log.Printf("Inserted disk image %v (%v cylinders, %v heads) into drive 0 at port %#02x", *diskImage, disk.Cylinders, disk.Heads, base)
+		bus.Attach(uint8(base), fdc.Ports(), fdc)
+	}
+
+	var bdosState *core.BDOS
+	if *bdos {
+		bdosState = core.NewBDOS(console, os.Stdout)
+		bdosState.Drives = drives.dirs
+		defer bdosState.Close()
+	}
+
+	tracer, err := tracing.open(syms)
+	if err != nil {
+		log.Println("Error opening trace: ", err)
+		return 1
+	}
+	if tracer != nil {
+		defer tracing.close(tracer)
+	}
+
+	return mainLoop(mainConfig{
+		img: img, syms: syms, sources: sources, dev: bus, bdos: bdosState, console: console, trig: &trig,
+		tracer: tracer, loadState: *loadState, saveState: *saveState, record: *record, verbose: *verbose,
+	})
 }
 
-func mainLoop(code []byte, origin uint16) {
+// traceFlags are the flags that write a trace of the executed instructions
+type traceFlags struct {
+	file, format string
+	ranges       listFlags
+	f            *os.File
+}
 
-	cpu := core.NewZ80()
-	cpu.IO = io.NewSIO(nil, nil)
-
-	log.Printf("Writing loaded file (%v bytes) into memory at base address %#04x", len(code), origin)
-	cpu.Mem.Write(origin, &code)
-
-	// for the CP/M to know where the stack can start (used for zexdoc exerciser)
-	// cpu.Mem.Write(0x0006, &[]byte{0xff, 0x00})
-	// cpu.EnableBDOS = true
-
-	// start with PC at the origin for now since the rest is just zeroes
-	*cpu.PC = origin
-
-	// infinite loop for procesing operands
-	reader := bufio.NewReader(os.Stdin)
-	for {
-		// read a single character from stdin that decides what to do
-		print(">")
-		text, _ := reader.ReadBytes('\n')
-		switch strings.TrimSpace(string(text)) {
-		case "", "n":
-			cpu.Step()
-		case "nt":
-			for i := 1; i <= 100; i++ {
-				cpu.Step()
+// register adds the flags to a flag set
+func (t *traceFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&t.file, "trace", "", "Write a line per executed instruction to a file, with the registers after it")
+	fs.StringVar(&t.format, "trace-format", trace.Formats[0].Name, "The format of the trace: "+trace.FormatNames())
+	fs.Var(&t.ranges, "trace-range", "Only trace the instructions in a routine given by its label, or in a range of addresses such as \"0x100 0x1FF\" (repeatable)")
+}
+
+// open creates the trace file, returning nil if no trace is written
+func (t *traceFlags) open(syms *symbols.Table) (*trace.Writer, error) {
+	if t.file == "" {
+		return nil, nil
+	}
+	format, err := lookupTraceFormat(t.format)
+	if err != nil {
+		return nil, err
+	}
+	var ranges []trace.Range
+	for _, spec := range t.ranges {
+		r, err := trace.ParseRange(syms, spec)
+		if err != nil {
+			return nil, err
+		}
+		ranges = append(ranges, r)
+	}
+	f, err := os.Create(t.file)
+	if err != nil {
+		return nil, err
+	}
+	t.f = f
+	w := trace.NewWriter(f, format)
+	w.Ranges = ranges
+	if syms != nil {
+		w.Names = func(addr uint16) string {
+			name, _ := syms.Name(addr)
+			return name
+		}
+	}
+	return w, nil
+}
+
+// close writes the rest of the trace and closes the file
+func (t *traceFlags) close(w *trace.Writer) {
+	if err := w.Flush(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error writing trace: %v\n", err)
+	}
+	t.f.Close()
+}
+
+// loadSymbols reads the labels of the program from listings and symbol files, using the listings
+// beside the loaded files if no files are given
+func loadSymbols(files []string, specs []loader.Spec) (*symbols.Table, *symbols.Sources, error) {
+	if len(files) == 0 {
+		for _, spec := range specs {
+			lst := strings.TrimSuffix(spec.Path, filepath.Ext(spec.Path)) + ".lst"
+			if _, err := os.Stat(lst); err == nil {
+				files = append(files, lst)
 			}
-		case "q":
-			goto outside
-		case "o":
-			for {
-				cpu.Step()
-				if *cpu.PC == 0x04EC {
-					break
-				}
+		}
+	}
+	syms := symbols.NewTable()
+	sources := &symbols.Sources{}
+	for _, file := range files {
+		var t *symbols.Table
+		if strings.EqualFold(filepath.Ext(file), ".lst") {
+			l, err := symbols.LoadListing(file)
+			if err != nil {
+				return nil, nil, err
+			}
+			t = l.Symbols()
+			sources.Add(l)
+		} else {
+			var err error
+			if t, err = symbols.Load(file); err != nil {
+				return nil, nil, err
 			}
 		}
+		log.Printf("Loaded %v symbols from %v", t.Len(), file)
+		syms.Merge(t)
+	}
+	return syms, sources, nil
+}
+
+// loadStateFile restores a state saved with -save-state, or a Spectrum snapshot
+func loadStateFile(cpu *core.Z80, path string) error {
+	if spectrum.IsSnapshot(path) {
+		return spectrum.LoadFile(cpu, path)
+	}
+	return cpu.LoadStateFile(path)
+}
+
+// saveStateFile saves the state, or a Spectrum snapshot for files with the extension of one
+func saveStateFile(cpu *core.Z80, path string) error {
+	if spectrum.IsSnapshot(path) {
+		return spectrum.SaveFile(cpu, path)
+	}
+	return cpu.SaveStateFile(path)
+}
 
-		println(cpu.String())
+// triggerFlags collects the -break flags that enter interactive mode
+type triggerFlags struct {
+	interactive bool
+	specs       []triggerSpec
+}
+
+// triggerSpec is a trigger given on the command line
+type triggerSpec struct {
+	flag, kind, value string
+}
+
+// kind returns a flag value for the flag with the name, which adds triggers of a kind
+func (t *triggerFlags) kind(name, kind string) flag.Value {
+	return &triggerFlag{t, name, kind}
+}
+
+// triggerFlag is a flag.Value for one kind of trigger
+type triggerFlag struct {
+	flags      *triggerFlags
+	name, kind string
+}
+
+func (f *triggerFlag) String() string {
+	if f.flags == nil {
+		return ""
+	}
+	var parts []string
+	for _, s := range f.flags.specs {
+		if s.flag == f.name {
+			parts = append(parts, s.value)
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+func (f *triggerFlag) Set(value string) error {
+	f.flags.specs = append(f.flags.specs, triggerSpec{f.name, f.kind, value})
+	return nil
+}
+
+// driveFlags collects the -drive flags mapping CP/M drives to host directories
+type driveFlags struct {
+	dirs [16]string
+}
+
+func (d *driveFlags) String() string {
+	var parts []string
+	for i, dir := range d.dirs {
+		if dir != "" {
+			parts = append(parts, fmt.Sprintf("%c=%v", 'A'+i, dir))
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+func (d *driveFlags) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	drive := strings.ToUpper(strings.TrimSuffix(parts[0], ":"))
+	if len(parts) != 2 || len(drive) != 1 || drive[0] < 'A' || drive[0] > 'P' {
+		return fmt.Errorf("expected a drive mapping such as A=dir, got %q", value)
+	}
+	d.dirs[drive[0]-'A'] = parts[1]
+	return nil
+}
+
+// loadFlags collects the -load flags
+type loadFlags struct {
+	specs []loader.Spec
+}
+
+func (l *loadFlags) String() string {
+	var parts []string
+	for _, s := range l.specs {
+		parts = append(parts, s.String())
+	}
+	return strings.Join(parts, ",")
+}
+
+func (l *loadFlags) Set(value string) error {
+	spec, err := loader.ParseSpec(value)
+	if err != nil {
+		return err
+	}
+	l.specs = append(l.specs, spec)
+	return nil
+}
+
+// listFlags collects the values of a repeatable flag
+type listFlags []string
+
+func (l *listFlags) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlags) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// mainConfig is the program, devices and debugger settings run by mainLoop
+type mainConfig struct {
+	img     *core.Image
+	syms    *symbols.Table
+	sources *symbols.Sources
+	dev     io.Device
+	bdos    *core.BDOS
+	console *io.Input
+	trig    *triggerFlags
+	tracer  *trace.Writer
+
+	// the files to restore the state from before running and save it to after, if not empty
+	loadState, saveState string
+
+	record  int
+	verbose bool
+}
+
+// mainLoop runs the program until it halts or the debugger quits, returning the exit status
+func mainLoop(cfg mainConfig) int {
+	cpu := core.NewZ80()
+	cpu.IO = cfg.dev
+	cpu.BDOS = cfg.bdos
+	cpu.EnableBDOS = cfg.bdos != nil
+	cpu.Symbols = cfg.syms
+	if cfg.tracer != nil {
+		cpu.Tracer = cfg.tracer
+	}
+
+	img := cfg.img
+	for _, s := range img.Segments {
+		log.Printf("Writing %v bytes into memory at address %#04x", len(s.Data), s.Addr)
+	}
+	if err := cpu.LoadImage(img); err != nil {
+		log.Println("Error loading file: ", err)
+		return 1
+	}
+	if cfg.loadState != "" {
+		if err := loadStateFile(&cpu, cfg.loadState); err != nil {
+			log.Println("Error loading state: ", err)
+			return 1
+		}
+		log.Printf("Restored the state at instruction %v from %v", cpu.Instructions, cfg.loadState)
+	}
+	if !cfg.verbose {
+		log.SetOutput(ioutil.Discard)
+	}
+
+	d := debugger.New(&cpu, cfg.console, os.Stderr)
+	d.Symbols = cfg.syms
+	d.Sources = cfg.sources
+	if cfg.record > 0 {
+		d.Record(cfg.record)
+	}
+	for _, spec := range cfg.trig.specs {
+		if err := d.AddTrigger(spec.kind, spec.value); err != nil {
+			fmt.Fprintf(os.Stderr, "Error in -%v %v: %v\n", spec.flag, spec.value, err)
+			return 2
+		}
+	}
+
+	// Ctrl-C stops the running program and enters interactive mode instead of quitting
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt)
+	defer signal.Stop(interrupts)
+	go func() {
+		for range interrupts {
+			d.Interrupt()
+		}
+	}()
+
+	d.Start(cfg.trig.interactive)
+
+	if cfg.saveState != "" {
+		if err := saveStateFile(&cpu, cfg.saveState); err != nil {
+			fmt.Fprintf(os.Stderr, "Error saving state: %v\n", err)
+			return 1
+		}
 	}
-outside:
+	return 0
 }
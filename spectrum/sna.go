@@ -0,0 +1,99 @@
+package spectrum
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// The 48K .SNA format is a 27 byte header followed by the RAM. The header has the registers as
+// little-endian words, and PC is pushed on the stack in RAM like when an interrupt was accepted.
+//
+//	 0     I
+//	 1-8   HL', DE', BC', AF'
+//	 9-18  HL, DE, BC, IY, IX
+//	19     bit 2 is IFF2, which is also used for IFF1
+//	20     R
+//	21-24  AF, SP
+//	25     the interrupt mode
+//	26     the border colour
+const snaHeaderSize = 27
+
+// ReadSNA reads a 48K .SNA snapshot, popping PC from the stack
+func ReadSNA(r io.Reader) (*Snapshot, error) {
+	var header [snaHeaderSize]uint8
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, fmt.Errorf("reading the SNA header: %w", err)
+	}
+	s := &Snapshot{}
+	if _, err := io.ReadFull(r, s.RAM[:]); err != nil {
+		return nil, fmt.Errorf("reading the SNA memory: %w", err)
+	}
+	if n, _ := r.Read(make([]uint8, 1)); n > 0 {
+		return nil, errors.New("the SNA file is longer than a 48K snapshot, 128K snapshots are not supported")
+	}
+
+	word := func(i int) uint16 {
+		return binary.LittleEndian.Uint16(header[i:])
+	}
+	regs := &s.Registers
+	regs.I = header[0]
+	regs.HLa, regs.DEa, regs.BCa, regs.AFa = word(1), word(3), word(5), word(7)
+	regs.HL, regs.DE, regs.BC, regs.IY, regs.IX = word(9), word(11), word(13), word(15), word(17)
+	regs.IFF2 = header[19]&0x04 != 0
+	regs.InterruptEnabled = regs.IFF2
+	regs.R = header[20]
+	regs.AF, regs.SP = word(21), word(23)
+	regs.IM = header[25] & 0x03
+	s.Border = header[26] & 0x07
+
+	// pop PC like RETN does
+	if regs.SP < ramStart || regs.SP == 0xFFFF {
+		return nil, fmt.Errorf("the stack pointer %#04x is not in RAM, so PC cannot be popped", regs.SP)
+	}
+	regs.PC = uint16(s.RAM[regs.SP-ramStart]) | uint16(s.RAM[regs.SP-ramStart+1])<<8
+	regs.SP += 2
+	return s, nil
+}
+
+// WriteSNA writes a 48K .SNA snapshot, pushing PC on the stack in the written RAM. The snapshot
+// itself is not changed.
+func WriteSNA(w io.Writer, s *Snapshot) error {
+	regs := s.Registers
+	sp := regs.SP - 2
+	if sp < ramStart || sp == 0xFFFF {
+		return fmt.Errorf("the stack pointer %#04x is not in RAM, so PC cannot be pushed", regs.SP)
+	}
+
+	var header [snaHeaderSize]uint8
+	put := func(i int, v uint16) {
+		binary.LittleEndian.PutUint16(header[i:], v)
+	}
+	header[0] = regs.I
+	put(1, regs.HLa)
+	put(3, regs.DEa)
+	put(5, regs.BCa)
+	put(7, regs.AFa)
+	put(9, regs.HL)
+	put(11, regs.DE)
+	put(13, regs.BC)
+	put(15, regs.IY)
+	put(17, regs.IX)
+	if regs.IFF2 {
+		header[19] = 0x04
+	}
+	header[20] = regs.R
+	put(21, regs.AF)
+	put(23, sp)
+	header[25] = regs.IM
+	header[26] = s.Border
+
+	ram := s.RAM
+	ram[sp-ramStart], ram[sp-ramStart+1] = uint8(regs.PC), uint8(regs.PC>>8)
+	if _, err := w.Write(header[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(ram[:])
+	return err
+}
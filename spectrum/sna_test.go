@@ -0,0 +1,68 @@
+package spectrum
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/antbern/z80-emulator/core"
+)
+
+// testSnapshot returns a snapshot with all the registers set and a pattern in the RAM
+func testSnapshot() *Snapshot {
+	s := &Snapshot{Border: 2}
+	s.Registers = core.Registers{
+		AF: 0x1234, BC: 0x2345, DE: 0x3456, HL: 0x4567, IX: 0x5678, IY: 0x6789,
+		AFa: 0x789A, BCa: 0x89AB, DEa: 0x9ABC, HLa: 0xABCD,
+		SP: 0xFF00, PC: 0x8123,
+		InterruptEnabled: true, IFF2: true,
+		I: 0x3F, R: 0x85, IM: 1,
+	}
+	for i := range s.RAM {
+		s.RAM[i] = uint8(i / 7)
+	}
+	return s
+}
+
+func TestSNA(t *testing.T) {
+	s := testSnapshot()
+	var buf bytes.Buffer
+	if err := WriteSNA(&buf, s); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	if len(data) != snaHeaderSize+RAMSize {
+		t.Fatalf("Expected %d bytes, got %d", snaHeaderSize+RAMSize, len(data))
+	}
+	if sp := uint16(data[23]) | uint16(data[24])<<8; sp != 0xFEFE {
+		t.Errorf("Expected SP 0xFEFE with PC pushed, got %#04x", sp)
+	}
+	if s.RAM[0xFEFE-ramStart] == 0x23 {
+		t.Errorf("Expected the snapshot to be unchanged by pushing PC")
+	}
+
+	got, err := ReadSNA(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Registers != s.Registers || got.Border != s.Border {
+		t.Errorf("Expected the registers %+v, got %+v", s.Registers, got.Registers)
+	}
+	if got.RAM[0xFEFE-ramStart] != 0x23 || got.RAM[0xFEFF-ramStart] != 0x81 {
+		t.Errorf("Expected PC in RAM below SP")
+	}
+	got.RAM[0xFEFE-ramStart], got.RAM[0xFEFF-ramStart] = s.RAM[0xFEFE-ramStart], s.RAM[0xFEFF-ramStart]
+	if got.RAM != s.RAM {
+		t.Errorf("Expected the RAM to be read back")
+	}
+
+	s.Registers.SP = 0x4001
+	if err := WriteSNA(&buf, s); err == nil {
+		t.Errorf("Expected an error pushing PC to ROM")
+	}
+	if _, err := ReadSNA(bytes.NewReader(data[:100])); err == nil {
+		t.Errorf("Expected an error for a truncated file")
+	}
+	if _, err := ReadSNA(bytes.NewReader(append(data, make([]uint8, 4)...))); err == nil {
+		t.Errorf("Expected an error for a 128K file")
+	}
+}
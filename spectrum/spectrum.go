@@ -0,0 +1,134 @@
+// Package spectrum reads and writes ZX Spectrum 48K snapshots in the .SNA and .Z80 formats, so that
+// the state of Spectrum programs can be loaded into the emulator and debugged. The snapshots hold the
+// registers and the 48 KB of RAM from $4000, and the 16 KB ROM must be loaded separately, for example
+// with -load 48.rom@0.
+package spectrum
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/antbern/z80-emulator/core"
+)
+
+// the memory of a 48K Spectrum, where RAM starts after the ROM
+const (
+	ramStart = 0x4000
+
+	// RAMSize is the size of the RAM in a snapshot
+	RAMSize = 0x10000 - ramStart
+)
+
+// Snapshot is the state of a 48K Spectrum in a snapshot file
+type Snapshot struct {
+	// Registers are the registers of the CPU, where the cycle and instruction counters are not saved
+	Registers core.Registers
+
+	// RAM is the memory from $4000 to $FFFF
+	RAM [RAMSize]uint8
+
+	// Border is the border colour, which is kept for writing the snapshot again since the emulator has
+	// no screen
+	Border uint8
+}
+
+// Capture returns a snapshot of the registers and RAM of the CPU with a white border
+func Capture(z *core.Z80) *Snapshot {
+	s := &Snapshot{Registers: z.Registers(), Border: 7}
+	for i := range s.RAM {
+		s.RAM[i] = z.Mem.Peek(uint16(ramStart + i))
+	}
+	return s
+}
+
+// Apply sets the registers and RAM of the CPU to the snapshot, leaving the ROM as it is. The call
+// stack is cleared, and a history starts over.
+func (s *Snapshot) Apply(z *core.Z80) {
+	z.SetRegisters(s.Registers)
+	ram := s.RAM[:]
+	z.Mem.Write(ramStart, &ram)
+	if z.Calls != nil {
+		z.Calls.Reset()
+	}
+	if z.History != nil {
+		z.Record(z.History)
+	}
+}
+
+// Format is a snapshot file format
+type Format struct {
+	Name       string
+	Extensions []string
+	Read       func(r io.Reader) (*Snapshot, error)
+	Write      func(w io.Writer, s *Snapshot) error
+}
+
+// Formats is the table of supported snapshot formats
+var Formats = []Format{
+	{Name: "sna", Extensions: []string{".sna"}, Read: ReadSNA, Write: WriteSNA},
+	{Name: "z80", Extensions: []string{".z80"}, Read: ReadZ80, Write: WriteZ80},
+}
+
+// formatOf returns the format of a file by its extension
+func formatOf(path string) (Format, bool) {
+	ext := strings.ToLower(filepath.Ext(path))
+	for _, f := range Formats {
+		for _, e := range f.Extensions {
+			if e == ext {
+				return f, true
+			}
+		}
+	}
+	return Format{}, false
+}
+
+// IsSnapshot reports whether a file is a snapshot by its extension
+func IsSnapshot(path string) bool {
+	_, ok := formatOf(path)
+	return ok
+}
+
+// LoadFile reads a snapshot file chosen by its extension and applies it to the CPU
+func LoadFile(z *core.Z80, path string) error {
+	format, ok := formatOf(path)
+	if !ok {
+		return fmt.Errorf("%v: unknown snapshot format", path)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	s, err := format.Read(bufio.NewReader(f))
+	if err != nil {
+		return fmt.Errorf("%v: %w", path, err)
+	}
+	s.Apply(z)
+	return nil
+}
+
+// SaveFile writes the state of the CPU to a snapshot file in the format chosen by its extension
+func SaveFile(z *core.Z80, path string) error {
+	format, ok := formatOf(path)
+	if !ok {
+		return fmt.Errorf("%v: unknown snapshot format", path)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	if err := format.Write(w, Capture(z)); err != nil {
+		f.Close()
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,48 @@
+package spectrum
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/antbern/z80-emulator/core"
+)
+
+func TestFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spectrum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	z := core.NewZ80()
+	z.SetRegisters(testSnapshot().Registers)
+	z.Mem.Poke(0x0000, 0xF3) // the ROM is not part of a snapshot
+	z.Mem.Poke(0x4000, 0xAA)
+	z.Mem.Poke(0xFFFF, 0x55)
+
+	for _, name := range []string{"test.sna", "TEST.Z80"} {
+		path := filepath.Join(dir, name)
+		if !IsSnapshot(path) {
+			t.Errorf("Expected %v to be a snapshot", name)
+		}
+		if err := SaveFile(&z, path); err != nil {
+			t.Fatal(err)
+		}
+		z2 := core.NewZ80()
+		z2.Calls = &core.CallStack{Frames: []core.Frame{{}}}
+		if err := LoadFile(&z2, path); err != nil {
+			t.Fatal(err)
+		}
+		if z2.Registers() != z.Registers() || z2.Calls.Depth() != 0 {
+			t.Errorf("%v: expected the registers %+v, got %+v", name, z.Registers(), z2.Registers())
+		}
+		if z2.Mem.Peek(0x0000) != 0 || z2.Mem.Peek(0x4000) != 0xAA || z2.Mem.Peek(0xFFFF) != 0x55 {
+			t.Errorf("%v: expected the RAM to be loaded and the ROM to be left", name)
+		}
+	}
+	if IsSnapshot("state.bin") {
+		t.Errorf("Expected state.bin not to be a snapshot")
+	}
+}
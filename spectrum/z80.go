@@ -0,0 +1,250 @@
+package spectrum
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// The .Z80 format starts with a 30 byte header. A and F, and A' and F', are stored as separate
+// bytes, and the other registers as little-endian words.
+//
+//	 0-1   A, F
+//	 2-9   BC, HL, PC, SP
+//	10-11  I, R
+//	12     bit 0 is bit 7 of R, bits 1-3 the border colour and bit 5 set if the memory is compressed
+//	13-20  DE, BC', DE', HL'
+//	21-22  A', F'
+//	23-26  IY, IX
+//	27-28  IFF1, IFF2
+//	29     bits 0-1 are the interrupt mode
+//
+// Version 1 is followed by the 48 KB of memory, which ends with 00 ED ED 00 if it is compressed.
+// Versions 2 and 3 have 0 for PC in the header, followed by the length of an additional header, which
+// has PC and the hardware mode, and the memory in pages of 16 KB. Each page has the length of its
+// data, which is 0xFFFF for an uncompressed page, and the number of the page.
+//
+// Compressed memory has runs of 5 or more bytes, and of 2 or more $ED bytes, encoded as ED ED, the
+// length and the byte. A byte following a single $ED is never encoded in a run.
+const (
+	z80HeaderSize = 30
+
+	// the lengths of the additional header of versions 2 and 3
+	z80ExtraV2 = 23
+	z80ExtraV3 = 54
+
+	// pageSize is the size of a memory page
+	pageSize = 0x4000
+
+	// z80Uncompressed is the length of a page that is not compressed
+	z80Uncompressed = 0xFFFF
+)
+
+// z80Pages are the numbers of the pages of a 48K snapshot, with the address of each page
+var z80Pages = map[uint8]uint16{8: 0x4000, 4: 0x8000, 5: 0xC000}
+
+// ReadZ80 reads a 48K .Z80 snapshot of version 1, 2 or 3. Snapshots of other machines, such as the
+// 128K Spectrum, are not supported.
+func ReadZ80(r io.Reader) (*Snapshot, error) {
+	var header [z80HeaderSize]uint8
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, fmt.Errorf("reading the Z80 header: %w", err)
+	}
+	word := func(b []uint8, i int) uint16 {
+		return binary.LittleEndian.Uint16(b[i:])
+	}
+	flags := header[12]
+	if flags == 0xFF {
+		// some programs write 255, which means 1 for compatibility
+		flags = 1
+	}
+
+	s := &Snapshot{}
+	regs := &s.Registers
+	regs.AF = uint16(header[0])<<8 | uint16(header[1])
+	regs.BC, regs.HL, regs.PC, regs.SP = word(header[:], 2), word(header[:], 4), word(header[:], 6), word(header[:], 8)
+	regs.I = header[10]
+	regs.R = header[11]&0x7F | flags<<7
+	s.Border = flags >> 1 & 0x07
+	regs.DE, regs.BCa, regs.DEa, regs.HLa = word(header[:], 13), word(header[:], 15), word(header[:], 17), word(header[:], 19)
+	regs.AFa = uint16(header[21])<<8 | uint16(header[22])
+	regs.IY, regs.IX = word(header[:], 23), word(header[:], 25)
+	regs.InterruptEnabled, regs.IFF2 = header[27] != 0, header[28] != 0
+	regs.IM = header[29] & 0x03
+
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("reading the Z80 memory: %w", err)
+	}
+	if regs.PC != 0 {
+		// version 1
+		var ram []uint8
+		if flags&0x20 != 0 {
+			if ram, err = decompress(data, RAMSize); err != nil {
+				return nil, err
+			}
+		} else if len(data) < RAMSize {
+			return nil, fmt.Errorf("the memory has %d bytes, expected %d", len(data), RAMSize)
+		} else {
+			ram = data
+		}
+		copy(s.RAM[:], ram)
+		return s, nil
+	}
+
+	// versions 2 and 3
+	if len(data) < 2 {
+		return nil, errors.New("the additional Z80 header is missing")
+	}
+	size := int(word(data, 0))
+	if size != z80ExtraV2 && size != z80ExtraV3 && size != z80ExtraV3+1 {
+		return nil, fmt.Errorf("unknown Z80 version with an additional header of %d bytes", size)
+	}
+	if len(data) < 2+size {
+		return nil, errors.New("the additional Z80 header is truncated")
+	}
+	extra := data[2 : 2+size]
+	regs.PC = word(extra, 0)
+	if mode := extra[2]; mode != 0 && mode != 1 && (size == z80ExtraV2 || mode != 3) {
+		return nil, fmt.Errorf("unsupported hardware mode %d, only 48K snapshots are supported", mode)
+	}
+	if extra[5]&0x80 != 0 {
+		return nil, errors.New("the hardware is modified to a 16K Spectrum, only 48K snapshots are supported")
+	}
+
+	loaded := make(map[uint8]bool)
+	for data = data[2+size:]; len(data) > 0; {
+		if len(data) < 3 {
+			return nil, errors.New("a Z80 memory page header is truncated")
+		}
+		length, page := int(word(data, 0)), data[2]
+		data = data[3:]
+		var mem []uint8
+		if length == z80Uncompressed {
+			if len(data) < pageSize {
+				return nil, fmt.Errorf("page %d is truncated", page)
+			}
+			mem, data = data[:pageSize], data[pageSize:]
+		} else {
+			if len(data) < length {
+				return nil, fmt.Errorf("page %d is truncated", page)
+			}
+			if mem, err = decompress(data[:length], pageSize); err != nil {
+				return nil, fmt.Errorf("page %d: %w", page, err)
+			}
+			data = data[length:]
+		}
+		// other pages, such as a ROM, are ignored
+		if addr, ok := z80Pages[page]; ok {
+			copy(s.RAM[addr-ramStart:], mem)
+			loaded[page] = true
+		}
+	}
+	if len(loaded) != len(z80Pages) {
+		return nil, fmt.Errorf("the snapshot has %d of the %d memory pages of a 48K Spectrum", len(loaded), len(z80Pages))
+	}
+	return s, nil
+}
+
+// WriteZ80 writes a 48K .Z80 snapshot of version 3 with compressed memory
+func WriteZ80(w io.Writer, s *Snapshot) error {
+	regs := s.Registers
+	var header [z80HeaderSize + 2 + z80ExtraV3]uint8
+	put := func(i int, v uint16) {
+		binary.LittleEndian.PutUint16(header[i:], v)
+	}
+	header[0], header[1] = uint8(regs.AF>>8), uint8(regs.AF)
+	put(2, regs.BC)
+	put(4, regs.HL)
+	put(8, regs.SP)
+	header[10], header[11] = regs.I, regs.R&0x7F
+	header[12] = regs.R>>7 | (s.Border&0x07)<<1
+	put(13, regs.DE)
+	put(15, regs.BCa)
+	put(17, regs.DEa)
+	put(19, regs.HLa)
+	header[21], header[22] = uint8(regs.AFa>>8), uint8(regs.AFa)
+	put(23, regs.IY)
+	put(25, regs.IX)
+	if regs.InterruptEnabled {
+		header[27] = 1
+	}
+	if regs.IFF2 {
+		header[28] = 1
+	}
+	header[29] = regs.IM & 0x03
+
+	// the additional header, where PC is the only register and the hardware mode 0 is a 48K Spectrum
+	put(z80HeaderSize, z80ExtraV3)
+	put(z80HeaderSize+2, regs.PC)
+
+	var buf bytes.Buffer
+	buf.Write(header[:])
+	for _, page := range []uint8{8, 4, 5} {
+		mem := s.RAM[z80Pages[page]-ramStart:][:pageSize]
+		length := uint16(z80Uncompressed)
+		if data := compress(mem); len(data) < pageSize {
+			length, mem = uint16(len(data)), data
+		}
+		buf.Write([]uint8{uint8(length), uint8(length >> 8), page})
+		buf.Write(mem)
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// compress encodes memory with the runs of the .Z80 format
+func compress(data []uint8) []uint8 {
+	var out []uint8
+	for i := 0; i < len(data); {
+		b := data[i]
+		n := 1
+		for i+n < len(data) && data[i+n] == b && n < 255 {
+			n++
+		}
+		if n >= 5 || b == 0xED && n >= 2 {
+			out = append(out, 0xED, 0xED, uint8(n), b)
+			i += n
+			continue
+		}
+		out = append(out, b)
+		i++
+		if b == 0xED && i < len(data) {
+			// the byte after a single ED is never in a run
+			out = append(out, data[i])
+			i++
+		}
+	}
+	return out
+}
+
+// decompress decodes size bytes of memory compressed with compress, ignoring any data after them
+func decompress(data []uint8, size int) ([]uint8, error) {
+	out := make([]uint8, 0, size)
+	i := 0
+	for len(out) < size {
+		if i >= len(data) {
+			return nil, fmt.Errorf("the compressed memory ends after %d of %d bytes", len(out), size)
+		}
+		if data[i] == 0xED && i+1 < len(data) && data[i+1] == 0xED {
+			if i+3 >= len(data) {
+				return nil, errors.New("a compressed run is truncated")
+			}
+			n, b := int(data[i+2]), data[i+3]
+			if len(out)+n > size {
+				return nil, fmt.Errorf("a compressed run goes past the end of the %d bytes", size)
+			}
+			for j := 0; j < n; j++ {
+				out = append(out, b)
+			}
+			i += 4
+			continue
+		}
+		out = append(out, data[i])
+		i++
+	}
+	return out, nil
+}
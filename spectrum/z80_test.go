@@ -0,0 +1,97 @@
+package spectrum
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCompress(t *testing.T) {
+	tests := []struct {
+		data, want []uint8
+	}{
+		{[]uint8{1, 2, 3, 3, 3, 3}, []uint8{1, 2, 3, 3, 3, 3}},
+		{[]uint8{1, 3, 3, 3, 3, 3}, []uint8{1, 0xED, 0xED, 5, 3}},
+		{[]uint8{0xED, 0xED}, []uint8{0xED, 0xED, 2, 0xED}},
+		{[]uint8{0xED, 0, 0, 0, 0, 0, 0}, []uint8{0xED, 0, 0xED, 0xED, 5, 0}},
+	}
+	for _, test := range tests {
+		got := compress(test.data)
+		if !bytes.Equal(got, test.want) {
+			t.Errorf("Expected % X compressed to % X, got % X", test.data, test.want, got)
+		}
+		back, err := decompress(got, len(test.data))
+		if err != nil || !bytes.Equal(back, test.data) {
+			t.Errorf("Expected % X decompressed to % X, got % X and %v", got, test.data, back, err)
+		}
+	}
+	if _, err := decompress([]uint8{0xED, 0xED, 10, 1}, 4); err == nil {
+		t.Errorf("Expected an error for a run past the end")
+	}
+}
+
+func TestZ80(t *testing.T) {
+	s := testSnapshot()
+	var buf bytes.Buffer
+	if err := WriteZ80(&buf, s); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	if len(data) >= z80HeaderSize+RAMSize {
+		t.Errorf("Expected the memory to be compressed, got %d bytes", len(data))
+	}
+	got, err := ReadZ80(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Registers != s.Registers || got.Border != s.Border || got.RAM != s.RAM {
+		t.Errorf("Expected the registers %+v and RAM to be read back, got %+v", s.Registers, got.Registers)
+	}
+
+	// 128K snapshots are not supported
+	data[z80HeaderSize+4] = 4
+	if _, err := ReadZ80(bytes.NewReader(data)); err == nil {
+		t.Errorf("Expected an error for a 128K snapshot")
+	}
+}
+
+func TestZ80Version1(t *testing.T) {
+	header := make([]uint8, z80HeaderSize)
+	header[0], header[1] = 0x12, 0x34 // A, F
+	header[6], header[7] = 0x00, 0x80 // PC
+	header[8], header[9] = 0x00, 0xFF // SP
+	header[11] = 0x05                 // R
+	header[12] = 0x20 | 0x04 | 0x01   // compressed, border 2 and bit 7 of R
+	header[29] = 2                    // IM 2
+
+	// the memory is all zeros except for a run of $42 at $4000, ending with the end marker
+	mem := []uint8{0xED, 0xED, 10, 0x42}
+	for n := RAMSize - 10; n > 0; n -= 255 {
+		run := n
+		if run > 255 {
+			run = 255
+		}
+		mem = append(mem, 0xED, 0xED, uint8(run), 0)
+	}
+	mem = append(mem, 0x00, 0xED, 0xED, 0x00)
+
+	s, err := ReadZ80(bytes.NewReader(append(header, mem...)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := s.Registers
+	if r.AF != 0x1234 || r.PC != 0x8000 || r.SP != 0xFF00 || r.R != 0x85 || r.IM != 2 || s.Border != 2 {
+		t.Errorf("Expected the registers from the header, got %+v and border %d", r, s.Border)
+	}
+	if s.RAM[9] != 0x42 || s.RAM[10] != 0 {
+		t.Errorf("Expected the run of $42 at $4000, got % X", s.RAM[:16])
+	}
+
+	// uncompressed
+	header[12] = 0
+	if _, err := ReadZ80(bytes.NewReader(append(header, make([]uint8, RAMSize)...))); err != nil {
+		t.Error(err)
+	}
+	if _, err := ReadZ80(bytes.NewReader(append(header, 1, 2, 3))); err == nil {
+		t.Errorf("Expected an error for truncated memory")
+	}
+}
@@ -0,0 +1,134 @@
+package symbols
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Load reads the symbols of a file, choosing the format from its extension: .lst for listings,
+// .sym for sjasmplus and z80asm symbol files, .map for SDCC linker maps and .noi for SDCC
+// no$gmb symbol files
+func Load(path string) (*Table, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var t *Table
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".lst":
+		var l *Listing
+		if l, err = ReadListing(f, listingSource(path)); err == nil {
+			t = l.Symbols()
+		}
+	case ".sym":
+		t, err = ReadSym(f)
+	case ".map":
+		t, err = ReadMap(f)
+	case ".noi":
+		t, err = ReadNoi(f)
+	default:
+		return nil, fmt.Errorf("%v: unknown symbol file type %q", path, ext)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%v: %w", path, err)
+	}
+	return t, nil
+}
+
+// LoadListing reads an assembler listing. The main source file is assumed to have the name of the
+// listing with the .asm extension.
+func LoadListing(path string) (*Listing, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	l, err := ReadListing(f, listingSource(path))
+	if err != nil {
+		return nil, fmt.Errorf("%v: %w", path, err)
+	}
+	return l, nil
+}
+
+// listingSource returns the assumed name of the main source file of a listing
+func listingSource(path string) string {
+	base := filepath.Base(path)
+	return strings.TrimSuffix(base, filepath.Ext(base)) + ".asm"
+}
+
+// ReadSym reads a symbol file with lines like "label: EQU 0x1234" (sjasmplus) or
+// "label = $1234, G: module" (z80asm). Symbols defined with EQU are constants, like in listings, so
+// they do not name addresses. The symbols of z80asm are labels unless the comment after them starts
+// with const, as written by the z88dk version.
+func ReadSym(r io.Reader) (*Table, error) {
+	t := NewTable()
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line, comment := scanner.Text(), ""
+		if c := strings.IndexByte(line, ';'); c >= 0 {
+			line, comment = line[:c], line[c+1:]
+		}
+		fields := strings.Fields(strings.Replace(line, ",", " ", -1))
+		if len(fields) < 3 || !constantDirectives[strings.ToUpper(strings.TrimPrefix(fields[1], "."))] {
+			continue
+		}
+		name := strings.TrimRight(fields[0], ":")
+		v, err := ParseNumber(fields[2])
+		if err != nil || !IsIdentifier(name) {
+			continue
+		}
+		kind := Label
+		if fields[1] != "=" || strings.HasPrefix(strings.TrimSpace(comment), "const") {
+			kind = Constant
+		}
+		t.Add(Symbol{Name: name, Value: uint16(v), Kind: kind})
+	}
+	return t, scanner.Err()
+}
+
+// ReadMap reads the global symbols of an SDCC linker map, listed in lines like
+// "00000200  _main    main". The lengths of areas (l__ symbols) are left out.
+func ReadMap(r io.Reader) (*Table, error) {
+	t := NewTable()
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		// older versions prefix the value with the area type, like "C:"
+		if len(fields) > 0 && len(fields[0]) == 2 && fields[0][1] == ':' {
+			fields = fields[1:]
+		}
+		if len(fields) < 2 || len(fields[0]) < 4 || len(fields[0]) > 8 || strings.HasPrefix(fields[1], "l__") {
+			continue
+		}
+		v, err := ParseNumber("0x" + fields[0])
+		if err != nil || !IsIdentifier(fields[1]) {
+			continue
+		}
+		t.Add(Symbol{Name: fields[1], Value: uint16(v), Kind: Label})
+	}
+	return t, scanner.Err()
+}
+
+// ReadNoi reads an SDCC .noi file with lines like "DEF _main 0x200"
+func ReadNoi(r io.Reader) (*Table, error) {
+	t := NewTable()
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 3 || fields[0] != "DEF" || strings.HasPrefix(fields[1], "l__") {
+			continue
+		}
+		v, err := ParseNumber(fields[2])
+		if err != nil {
+			continue
+		}
+		t.Add(Symbol{Name: fields[1], Value: uint16(v), Kind: Label})
+	}
+	return t, scanner.Err()
+}
@@ -0,0 +1,229 @@
+package symbols
+
+import (
+	"bufio"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Line is a line of an assembler listing that has an address
+type Line struct {
+	// File is the source file of the line, and Number is the line number in that file
+	File   string
+	Number int
+
+	// Depth is the include nesting level, with 0 for the main file
+	Depth int
+
+	Addr   uint16
+	Bytes  []uint8
+	Source string
+
+	// Skipped is set for lines in a false conditional block, which were not assembled
+	Skipped bool
+}
+
+// Listing is an assembler listing, which maps the addresses of the program to source lines
+type Listing struct {
+	// Name is the name of the main source file
+	Name  string
+	Lines []Line
+}
+
+// listingLine matches the start of a listing line with a line number, optional include markers
+// (as written by TASM) and an address, like "0012+  04EC D3 20    out (SIO_A_DATA), a". TASM marks
+// the addresses of lines that were not assembled with a ~.
+var listingLine = regexp.MustCompile(`^\s*(\d+)(\+*)\s+([0-9A-Fa-f]{4})([:~]?)(\s.*)?$`)
+
+// gluedLine matches a listing line appended to the previous one, which TASM writes when an include
+// file does not end with a newline
+var gluedLine = regexp.MustCompile(`\d{4}\+* +[0-9A-Fa-f]{4}[:~]?(\s|$)`)
+
+// ReadListing parses a listing as written by z80asm, zasm and TASM, where each line starts with the
+// line number and address followed by the generated bytes and the source. Lines without an address,
+// such as page headers, are ignored. Name is the name of the main source file, and the names of
+// included files are taken from the include directives.
+func ReadListing(r io.Reader, name string) (*Listing, error) {
+	l := &Listing{Name: name}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		text := strings.TrimRight(scanner.Text(), "\r")
+		for text != "" {
+			m := listingLine.FindStringSubmatch(text)
+			if m == nil {
+				break
+			}
+			text = ""
+			number, _ := strconv.Atoi(m[1])
+			addr, _ := strconv.ParseUint(m[3], 16, 16)
+			data, source := splitBytes(m[5])
+			line := Line{Number: number, Depth: len(m[2]), Addr: uint16(addr), Bytes: data, Source: source, Skipped: m[4] == "~"}
+
+			// split off a line of an including file
+			if loc := gluedLine.FindStringIndex(source); loc != nil {
+				if g := listingLine.FindStringSubmatch(source[loc[0]:]); g != nil && len(g[2]) < line.Depth {
+					line.Source = strings.TrimSpace(source[:loc[0]])
+					text = source[loc[0]:]
+				}
+			}
+			l.Lines = append(l.Lines, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	l.resolveFiles()
+	return l, nil
+}
+
+// includeFile returns the file name of an include directive, or an empty string for other lines
+func includeFile(source string) string {
+	fields := strings.Fields(source)
+	if len(fields) < 2 || !strings.EqualFold(strings.TrimLeft(fields[0], "#."), "INCLUDE") {
+		return ""
+	}
+	return strings.Trim(fields[1], "\"'<>")
+}
+
+// resolveFiles sets the file of each line by following the include directives. TASM marks included
+// lines with a + per nesting level. For other assemblers an include is detected by the line numbers
+// starting over at 1 after an include directive, and the end of it by the line numbers jumping back
+// to the line after the directive.
+func (l *Listing) resolveFiles() {
+	markers := false
+	for _, line := range l.Lines {
+		markers = markers || line.Depth > 0
+	}
+
+	type include struct {
+		file   string
+		parent int // line number of the include directive in the including file
+	}
+	stack := []include{{file: l.Name}}
+	pending, pendingLine, last := "", 0, 0
+	for i := range l.Lines {
+		line := &l.Lines[i]
+		if markers {
+			for len(stack)-1 < line.Depth {
+				stack = append(stack, include{pending, pendingLine})
+				pending = ""
+			}
+			for len(stack)-1 > line.Depth {
+				stack = stack[:len(stack)-1]
+			}
+		} else {
+			switch {
+			case pending != "" && line.Number == 1:
+				stack = append(stack, include{pending, pendingLine})
+			case len(stack) > 1 && line.Number == stack[len(stack)-1].parent+1 && line.Number != last+1:
+				stack = stack[:len(stack)-1]
+			}
+			line.Depth = len(stack) - 1
+			pending, last = "", line.Number
+		}
+		line.File = stack[len(stack)-1].file
+
+		if f := includeFile(line.Source); f != "" && !line.Skipped {
+			pending, pendingLine = f, line.Number
+		}
+	}
+}
+
+// splitBytes splits the part of a listing line after the address into the generated bytes and the
+// source. The bytes are hex pairs separated by single spaces, and the source follows after a wider gap.
+func splitBytes(s string) ([]uint8, string) {
+	var data []uint8
+	i := 0
+	for i < 2 && i < len(s) && s[i] == ' ' {
+		i++
+	}
+	for i+1 < len(s) && IsHexDigit(s[i]) && IsHexDigit(s[i+1]) && (i+2 == len(s) || s[i+2] == ' ') {
+		b, _ := strconv.ParseUint(s[i:i+2], 16, 8)
+		data = append(data, uint8(b))
+		i += 2
+		if i+1 >= len(s) || s[i+1] == ' ' || s[i+1] == '\t' {
+			break
+		}
+		i++
+	}
+	if i > len(s) {
+		i = len(s)
+	}
+	return data, strings.TrimSpace(s[i:])
+}
+
+// directives that reserve or initialize memory, and directives that define constants
+var (
+	storageDirectives  = map[string]bool{"DB": true, "DW": true, "DS": true, "DEFB": true, "DEFW": true, "DEFS": true, "DEFM": true, "BLOCK": true, "BYTE": true, "WORD": true, "TEXT": true, "ORG": true}
+	constantDirectives = map[string]bool{"EQU": true, "=": true, "SET": true, "DEFL": true}
+)
+
+// IsData returns true if the line defines data with a directive such as DB or DS, rather than
+// assembling an instruction
+func (l *Line) IsData() bool {
+	source := l.Source
+	if c := strings.IndexByte(source, ';'); c >= 0 {
+		source = source[:c]
+	}
+	fields := strings.Fields(source)
+	for i := 0; i < len(fields) && i < 2; i++ {
+		if storageDirectives[strings.ToUpper(strings.TrimPrefix(fields[i], "."))] {
+			return true
+		}
+	}
+	return false
+}
+
+// Symbols returns the labels and simple constants defined in the listing. Constants defined by
+// expressions other than numbers and other symbols are left out.
+func (l *Listing) Symbols() *Table {
+	t := NewTable()
+	for _, line := range l.Lines {
+		if line.Skipped {
+			continue
+		}
+		source := line.Source
+		if c := strings.IndexByte(source, ';'); c >= 0 {
+			source = source[:c]
+		}
+		fields := strings.Fields(source)
+		if len(fields) == 0 {
+			continue
+		}
+
+		// DEFC name = value, as used by z80asm
+		if strings.EqualFold(fields[0], "DEFC") {
+			def := strings.SplitN(strings.Join(fields[1:], ""), "=", 2)
+			if len(def) == 2 && IsIdentifier(def[0]) {
+				if v, err := t.ParseAddress(def[1]); err == nil {
+					t.Add(Symbol{Name: def[0], Value: v, Kind: Constant})
+				}
+			}
+			continue
+		}
+
+		name := strings.TrimRight(fields[0], ":")
+		colon := name != fields[0]
+		if !IsIdentifier(name) {
+			continue
+		}
+		directive := ""
+		if len(fields) > 1 {
+			directive = strings.ToUpper(strings.TrimPrefix(fields[1], "."))
+		}
+
+		switch {
+		case constantDirectives[directive]:
+			if len(fields) == 3 {
+				if v, err := t.ParseAddress(fields[2]); err == nil {
+					t.Add(Symbol{Name: name, Value: v, Kind: Constant})
+				}
+			}
+		case colon || storageDirectives[directive]:
+			t.Add(Symbol{Name: name, Value: line.Addr, Kind: Label})
+		}
+	}
+	return t
+}
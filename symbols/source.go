@@ -0,0 +1,147 @@
+package symbols
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// Sources maps addresses to source lines using the listings of the loaded programs
+type Sources struct {
+	listings []*Listing
+
+	// lines by address, built when needed
+	byAddr map[uint16]*Line
+}
+
+// Add adds a listing. Addresses already mapped by earlier listings keep their lines.
+func (s *Sources) Add(l *Listing) {
+	s.listings = append(s.listings, l)
+	s.byAddr = nil
+}
+
+// Len returns the number of listings
+func (s *Sources) Len() int {
+	return len(s.listings)
+}
+
+// index maps the address of every generated byte to the line that generated it. Continuation lines,
+// which hold the remaining bytes of a long line, map to the line with the source.
+func (s *Sources) index() map[uint16]*Line {
+	if s.byAddr != nil {
+		return s.byAddr
+	}
+	s.byAddr = make(map[uint16]*Line)
+	for _, l := range s.listings {
+		var head *Line
+		for i := range l.Lines {
+			line := &l.Lines[i]
+			if line.Skipped {
+				continue
+			}
+			if head == nil || head.File != line.File || head.Number != line.Number {
+				head = line
+			}
+			for j := range line.Bytes {
+				addr := line.Addr + uint16(j)
+				if _, ok := s.byAddr[addr]; !ok {
+					s.byAddr[addr] = head
+				}
+			}
+		}
+	}
+	return s.byAddr
+}
+
+// Locate returns the source line that generated the byte at the address
+func (s *Sources) Locate(addr uint16) (*Line, bool) {
+	line, ok := s.index()[addr]
+	return line, ok
+}
+
+// sameFile compares file names ignoring directories and case. An empty name matches the main file
+// of the listing.
+func sameFile(l *Listing, name, file string) bool {
+	if name == "" {
+		name = l.Name
+	}
+	return strings.EqualFold(filepath.Base(name), filepath.Base(file))
+}
+
+// Address returns the address of the first line with code at or after line number in the file. An
+// empty file name means the main file of the first listing.
+func (s *Sources) Address(file string, number int) (uint16, error) {
+	var found *Line
+	for _, l := range s.listings {
+		for i := range l.Lines {
+			line := &l.Lines[i]
+			if line.Skipped || len(line.Bytes) == 0 || line.Number < number || !sameFile(l, file, line.File) {
+				continue
+			}
+			if found == nil || line.Number < found.Number {
+				found = line
+			}
+		}
+		if file == "" {
+			break
+		}
+	}
+	if found == nil {
+		if file == "" && len(s.listings) > 0 {
+			file = s.listings[0].Name
+		}
+		return 0, fmt.Errorf("no code at or after line %d of %v", number, file)
+	}
+	return found.Addr, nil
+}
+
+// Context returns the lines of the same source file around a line, with line numbers from before
+// lines before it to after lines after it. Lines of included files are left out.
+func (s *Sources) Context(line *Line, before, after int) []*Line {
+	for _, l := range s.listings {
+		for i := range l.Lines {
+			if &l.Lines[i] == line {
+				return l.context(i, before, after)
+			}
+		}
+	}
+	return []*Line{line}
+}
+
+func (l *Listing) context(index, before, after int) []*Line {
+	center := &l.Lines[index]
+	var lines []*Line
+	last := center.Number
+	for i := index - 1; i >= 0 && last > center.Number-before; i-- {
+		line := &l.Lines[i]
+		if line.File != center.File || line.Depth != center.Depth {
+			continue
+		}
+		if line.Number >= last {
+			if line.Number > center.Number {
+				break // a different inclusion of the same file
+			}
+			continue
+		}
+		lines = append([]*Line{line}, lines...)
+		last = line.Number
+	}
+
+	lines = append(lines, center)
+	last = center.Number
+	for i := index + 1; i < len(l.Lines) && last < center.Number+after; i++ {
+		line := &l.Lines[i]
+		if line.File != center.File || line.Depth != center.Depth {
+			continue
+		}
+		if line.Number <= last {
+			if line.Number < center.Number {
+				break
+			}
+			continue
+		}
+		lines = append(lines, line)
+		last = line.Number
+	}
+	return lines
+}
@@ -0,0 +1,80 @@
+package symbols
+
+import (
+	"strings"
+	"testing"
+)
+
+// a TASM listing with an include file that does not end with a newline
+const testIncludeListing = `0001   0000 3E 01       	ld a, 1
+0002   0002             #INCLUDE	"lib.asm"
+0001+  0002             putc:
+0002+  0002 D3 00       	out (0), a
+0003+  0004 C9          	ret0003   0005 CD 02 00    	call putc
+0004   0008 21 00 00 11 	.DB 21h, 0, 0, 11h, 22h
+0004   000C 22 
+0005   000D 76          	halt
+`
+
+// a listing without include markers, where the line numbers start over in the included file
+const testPlainIncludeListing = `1     0000  3E 01       	ld a, 1
+2     0002              include "lib.asm"
+1     0002              putc:
+2     0002  D3 00       	out (0), a
+3     0004  C9          	ret
+3     0005  CD 02 00    	call putc
+`
+
+func TestSources(t *testing.T) {
+	for _, input := range []string{testIncludeListing, testPlainIncludeListing} {
+		l, err := ReadListing(strings.NewReader(input), "main.asm")
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := &Sources{}
+		s.Add(l)
+
+		line, ok := s.Locate(0x0003)
+		if !ok || line.File != "lib.asm" || line.Number != 2 || line.Addr != 2 {
+			t.Errorf("Expected line 2 of lib.asm at 0x0003, got %+v", line)
+		}
+		line, ok = s.Locate(0x0005)
+		if !ok || line.File != "main.asm" || line.Number != 3 || line.Source != "call putc" {
+			t.Errorf("Expected line 3 of main.asm at 0x0005, got %+v", line)
+		}
+
+		if addr, err := s.Address("LIB.ASM", 1); err != nil || addr != 2 {
+			t.Errorf("Expected line 1 of lib.asm to run to 0x0002, got %#04x %v", addr, err)
+		}
+		if addr, err := s.Address("", 2); err != nil || addr != 5 {
+			t.Errorf("Expected line 2 of main.asm to run to 0x0005, got %#04x %v", addr, err)
+		}
+		if _, err := s.Address("main.asm", 100); err == nil {
+			t.Errorf("Expected an error for a line without code")
+		}
+
+		line, _ = s.Locate(0x0000)
+		var numbers []int
+		for _, c := range s.Context(line, 2, 2) {
+			numbers = append(numbers, c.Number)
+		}
+		if len(numbers) != 3 || numbers[0] != 1 || numbers[2] != 3 {
+			t.Errorf("Expected context lines 1 to 3 of main.asm, got %v", numbers)
+		}
+	}
+}
+
+func TestSourcesContinuation(t *testing.T) {
+	l, err := ReadListing(strings.NewReader(testIncludeListing), "main.asm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Sources{}
+	s.Add(l)
+	if line, ok := s.Locate(0x000C); !ok || line.Number != 4 || line.Addr != 8 {
+		t.Errorf("Expected the continuation byte to map to line 4, got %+v", line)
+	}
+	if line, ok := s.Locate(0x000D); !ok || line.Number != 5 {
+		t.Errorf("Expected line 5 at 0x000D, got %+v", line)
+	}
+}
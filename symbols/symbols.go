@@ -0,0 +1,245 @@
+// Package symbols reads the labels and constants of assembled programs from assembler listings and
+// symbol files, and translates between addresses and names
+package symbols
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Kind tells whether a symbol is an address in the program or a constant
+type Kind int
+
+const (
+	// Label is an address in the program, such as a jump target or a variable
+	Label Kind = iota
+	// Constant is a value defined with EQU or similar, which is not used to name addresses
+	Constant
+)
+
+// Symbol is a named value
+type Symbol struct {
+	Name  string
+	Value uint16
+	Kind  Kind
+}
+
+// Table holds symbols and looks them up by name or address
+type Table struct {
+	symbols []Symbol
+	byName  map[string]int
+
+	// labels sorted by address, built when needed
+	sorted []Symbol
+}
+
+// NewTable returns an empty symbol table
+func NewTable() *Table {
+	return &Table{byName: make(map[string]int)}
+}
+
+// Add adds a symbol, replacing any symbol with the same name
+func (t *Table) Add(s Symbol) {
+	if i, ok := t.byName[s.Name]; ok {
+		t.symbols[i] = s
+	} else {
+		t.byName[s.Name] = len(t.symbols)
+		t.symbols = append(t.symbols, s)
+	}
+	t.sorted = nil
+}
+
+// Merge adds all symbols of another table
+func (t *Table) Merge(o *Table) {
+	for _, s := range o.symbols {
+		t.Add(s)
+	}
+}
+
+// Symbols returns all symbols in the order they were added
+func (t *Table) Symbols() []Symbol {
+	return t.symbols
+}
+
+// Len returns the number of symbols
+func (t *Table) Len() int {
+	return len(t.symbols)
+}
+
+// Lookup returns the value of a symbol. Names are first matched exactly and then ignoring case,
+// since many assemblers are case insensitive.
+func (t *Table) Lookup(name string) (uint16, bool) {
+	if i, ok := t.byName[name]; ok {
+		return t.symbols[i].Value, true
+	}
+	for _, s := range t.symbols {
+		if strings.EqualFold(s.Name, name) {
+			return s.Value, true
+		}
+	}
+	return 0, false
+}
+
+// labels returns the labels sorted by address, with the first added label first for equal addresses
+func (t *Table) labels() []Symbol {
+	if t.sorted == nil {
+		t.sorted = []Symbol{}
+		for _, s := range t.symbols {
+			if s.Kind == Label {
+				t.sorted = append(t.sorted, s)
+			}
+		}
+		sort.SliceStable(t.sorted, func(i, j int) bool {
+			return t.sorted[i].Value < t.sorted[j].Value
+		})
+	}
+	return t.sorted
+}
+
+// Name returns the first label at exactly the address
+func (t *Table) Name(addr uint16) (string, bool) {
+	labels := t.labels()
+	i := sort.Search(len(labels), func(i int) bool { return labels[i].Value >= addr })
+	if i < len(labels) && labels[i].Value == addr {
+		return labels[i].Name, true
+	}
+	return "", false
+}
+
+// Nearest returns the closest label at or below the address and the offset from it
+func (t *Table) Nearest(addr uint16) (string, uint16, bool) {
+	labels := t.labels()
+	i := sort.Search(len(labels), func(i int) bool { return labels[i].Value > addr })
+	if i == 0 {
+		return "", 0, false
+	}
+	// use the first of several labels at the same address
+	l := labels[i-1]
+	for i > 1 && labels[i-2].Value == l.Value {
+		i--
+		l = labels[i-1]
+	}
+	return l.Name, addr - l.Value, true
+}
+
+// Extent returns the addresses covered by a label, from the label up to before the next label at a
+// higher address or to the end of memory, such as the instructions of a routine
+func (t *Table) Extent(name string) (uint16, uint16, bool) {
+	start, ok := t.Lookup(name)
+	if !ok {
+		return 0, 0, false
+	}
+	labels := t.labels()
+	i := sort.Search(len(labels), func(i int) bool { return labels[i].Value > start })
+	if i == len(labels) {
+		return start, 0xFFFF, true
+	}
+	return start, labels[i].Value - 1, true
+}
+
+// Symbolize returns the address as a label, such as "loop" or "loop+3", or an empty string if
+// there is no label at or below it
+func (t *Table) Symbolize(addr uint16) string {
+	name, offset, ok := t.Nearest(addr)
+	switch {
+	case !ok:
+		return ""
+	case offset == 0:
+		return name
+	}
+	return fmt.Sprintf("%s+%d", name, offset)
+}
+
+// ParseAddress parses a number, a symbol name, or a symbol name with an offset such as "loop+3".
+// The table may be nil, in which case only numbers are accepted.
+func (t *Table) ParseAddress(s string) (uint16, error) {
+	s = strings.TrimSpace(s)
+	if v, err := ParseNumber(s); err == nil {
+		if v > 0xFFFF {
+			return 0, fmt.Errorf("address %q is out of range", s)
+		}
+		return uint16(v), nil
+	}
+	if t == nil {
+		return 0, fmt.Errorf("invalid address %q", s)
+	}
+
+	name, offset := s, ""
+	if i := strings.LastIndexAny(s, "+-"); i > 0 {
+		name, offset = strings.TrimSpace(s[:i]), s[i:]
+	}
+	addr, ok := t.Lookup(name)
+	if !ok {
+		return 0, fmt.Errorf("unknown symbol %q", name)
+	}
+	if offset != "" {
+		v, err := ParseNumber(strings.TrimSpace(offset[1:]))
+		if err != nil {
+			return 0, fmt.Errorf("invalid offset in %q", s)
+		}
+		if offset[0] == '-' {
+			addr -= uint16(v)
+		} else {
+			addr += uint16(v)
+		}
+	}
+	return addr, nil
+}
+
+// ParseNumber parses a number in the notations used by Z80 assemblers: 0x1F, $1F, 1FH, 0b101,
+// %101, 101B and decimal numbers
+func ParseNumber(s string) (uint64, error) {
+	lower := strings.ToLower(s)
+	base := 10
+	switch {
+	case lower == "":
+		return 0, fmt.Errorf("empty number")
+	case strings.HasPrefix(lower, "0x"):
+		lower, base = lower[2:], 16
+	case lower[0] == '$' || lower[0] == '#':
+		lower, base = lower[1:], 16
+	case strings.HasSuffix(lower, "h") && lower[0] >= '0' && lower[0] <= '9':
+		lower, base = lower[:len(lower)-1], 16
+	case strings.HasPrefix(lower, "0b"):
+		lower, base = lower[2:], 2
+	case lower[0] == '%':
+		lower, base = lower[1:], 2
+	case strings.HasSuffix(lower, "b") && strings.Trim(lower[:len(lower)-1], "01") == "" && len(lower) > 1:
+		lower, base = lower[:len(lower)-1], 2
+	}
+	v, err := strconv.ParseUint(lower, base, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid number %q", s)
+	}
+	return v, nil
+}
+
+// IsHexDigit returns true for the characters 0-9, A-F and a-f
+func IsHexDigit(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'A' && c <= 'F' || c >= 'a' && c <= 'f'
+}
+
+// IsIdentStart returns true for the characters that can start a symbol name
+func IsIdentStart(c byte) bool {
+	return c == '_' || c == '.' || c == '@' || c == '?' || c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z'
+}
+
+// IsIdentChar returns true for the characters of a symbol name
+func IsIdentChar(c byte) bool {
+	return IsIdentStart(c) || c >= '0' && c <= '9'
+}
+
+// IsIdentifier returns true if s is a valid symbol name
+func IsIdentifier(s string) bool {
+	if s == "" || !IsIdentStart(s[0]) {
+		return false
+	}
+	for i := 1; i < len(s); i++ {
+		if !IsIdentChar(s[i]) {
+			return false
+		}
+	}
+	return true
+}
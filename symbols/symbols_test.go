@@ -0,0 +1,207 @@
+package symbols
+
+import (
+	"strings"
+	"testing"
+)
+
+const testListing = `Z80 Module Assembler 2.8.2, (c) InterLogic 1993-2009, Paulo Custodio 2011-2015
+Page 001                                                           'main.lst'
+
+4     0000              DEFC OUT_PORT 		= $00
+12    0000              ORG $0000
+13    0000  31 00 F0    	ld sp, $f000
+15    0003              loop:
+16    0003  D3 00       	out (OUT_PORT), a	;	output A on port
+21    0006  C3 03 00    	jp loop
+`
+
+const testTASMListing = `0005   0000             LED_PORT		.EQU	$00
+0012   0000             #INCLUDE	"constants.asm"
+0004+  0000             CR					.EQU	$0d		; Carriage Return (ENTER)
+0013   0000 C3 33 00    start:	jp	init
+0248   06A2 65 20 2D 20 
+0264   06A6 00          boot_flag:		.DB		0
+0266   06A7             argc			.BLOCK	1
+0272   06BC             stack:		.ORG	$+20
+`
+
+func TestReadListing(t *testing.T) {
+	l, err := ReadListing(strings.NewReader(testListing), "main.asm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(l.Lines) != 6 {
+		t.Fatalf("Expected 6 lines, got %d", len(l.Lines))
+	}
+	line := l.Lines[2]
+	if line.Number != 13 || line.Addr != 0 || len(line.Bytes) != 3 || line.Bytes[2] != 0xF0 || line.Source != "ld sp, $f000" {
+		t.Errorf("Unexpected line %+v", line)
+	}
+
+	syms := l.Symbols()
+	if v, ok := syms.Lookup("loop"); !ok || v != 3 {
+		t.Errorf("Expected loop at 3, got %v %v", v, ok)
+	}
+	if v, ok := syms.Lookup("OUT_PORT"); !ok || v != 0 {
+		t.Errorf("Expected the constant OUT_PORT, got %v %v", v, ok)
+	}
+	if name, ok := syms.Name(0); ok {
+		t.Errorf("Constants should not name addresses, got %q", name)
+	}
+}
+
+func TestReadTASMListing(t *testing.T) {
+	l, err := ReadListing(strings.NewReader(testTASMListing), "monitor.asm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.Lines[2].Depth != 1 || l.Lines[2].Number != 4 {
+		t.Errorf("Expected an included line, got %+v", l.Lines[2])
+	}
+	if len(l.Lines[4].Bytes) != 4 || l.Lines[4].Source != "" {
+		t.Errorf("Unexpected continuation line %+v", l.Lines[4])
+	}
+
+	syms := l.Symbols()
+	tables := []struct {
+		name  string
+		value uint16
+	}{
+		{"LED_PORT", 0}, {"CR", 0x0d}, {"start", 0}, {"boot_flag", 0x06A6}, {"argc", 0x06A7}, {"stack", 0x06BC},
+	}
+	for _, table := range tables {
+		if v, ok := syms.Lookup(table.name); !ok || v != table.value {
+			t.Errorf("Expected %v = %#04x, got %#04x %v", table.name, table.value, v, ok)
+		}
+	}
+	if _, ok := syms.Lookup("jp"); ok {
+		t.Errorf("Instructions should not be symbols")
+	}
+}
+
+func TestLineIsData(t *testing.T) {
+	tables := []struct {
+		source string
+		data   bool
+	}{
+		{"boot_flag:		.DB		0", true},
+		{"str_cmd_help	.db		\"help\", EOS", true},
+		{"	defw loop ; table", true},
+		{"start:	jp	init", false},
+		{"	ld a, b	; db", false},
+		{"loop:", false},
+	}
+	for _, table := range tables {
+		l := Line{Source: table.source}
+		if data := l.IsData(); data != table.data {
+			t.Errorf("IsData of %q = %v, want %v", table.source, data, table.data)
+		}
+	}
+}
+
+func TestSymbolFiles(t *testing.T) {
+	sym, err := ReadSym(strings.NewReader("; sjasmplus\nSIO_BASE: EQU 0x00000020\nmain                            = $0100, G: main\nloop = $0103 ; addr, local, , main, , main.asm:5\nEOS = $0000 ; const, local, , main, , main.asm:1\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sym.Symbolize(0x0102) != "main+2" || sym.Symbolize(0x0103) != "loop" || sym.Symbolize(0x0020) != "" {
+		t.Errorf("Unexpected symbols from .sym file: %v", sym.Symbols())
+	}
+	if v, ok := sym.Lookup("SIO_BASE"); !ok || v != 0x20 {
+		t.Errorf("Expected the constant SIO_BASE, got %v %v", v, ok)
+	}
+	if _, ok := sym.Lookup("EOS"); !ok || sym.Len() != 4 {
+		t.Errorf("Expected the constant EOS, got %v", sym.Symbols())
+	}
+
+	m, err := ReadMap(strings.NewReader(`Area                                    Addr        Size        Decimal Bytes (Attributes)
+_CODE                               00000200    00000123 =         291. bytes (REL,CON)
+
+      Value  Global                              Global Defined In Module
+     00000200  _main                              main
+     00000123  l__CODE
+  C:   00000210  _putchar                           putchar
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Len() != 2 {
+		t.Errorf("Expected 2 symbols from .map file, got %v", m.Symbols())
+	}
+	if v, _ := m.Lookup("_putchar"); v != 0x0210 {
+		t.Errorf("Expected _putchar at 0x0210, got %#04x", v)
+	}
+
+	noi, err := ReadNoi(strings.NewReader("DEF _main 0x200\nDEF l__DATA 0x10\nLOAD main.ihx\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name, ok := noi.Name(0x200); !ok || name != "_main" || noi.Len() != 1 {
+		t.Errorf("Unexpected symbols from .noi file: %v", noi.Symbols())
+	}
+}
+
+func TestParseAddress(t *testing.T) {
+	syms := NewTable()
+	syms.Add(Symbol{Name: "putc", Value: 0x04E9})
+	syms.Add(Symbol{Name: "SIO_BASE", Value: 0x20, Kind: Constant})
+
+	tables := []struct {
+		s     string
+		value uint16
+		ok    bool
+	}{
+		{"0x04EC", 0x04EC, true}, {"$04ec", 0x04EC, true}, {"04ECh", 0x04EC, true}, {"1260", 1260, true},
+		{"%101", 5, true}, {"0FFH", 0xFF, true}, {"putc", 0x04E9, true}, {"PUTC+3", 0x04EC, true},
+		{"putc-0x09", 0x04E0, true}, {"sio_base", 0x20, true}, {"getc", 0, false}, {"0x10000", 0, false},
+	}
+	for _, table := range tables {
+		v, err := syms.ParseAddress(table.s)
+		if (err == nil) != table.ok || v != table.value {
+			t.Errorf("ParseAddress(%q) = %#04x, %v", table.s, v, err)
+		}
+	}
+
+	if s := syms.Symbolize(0x04EC); s != "putc+3" {
+		t.Errorf("Expected putc+3, got %q", s)
+	}
+	if s := syms.Symbolize(0x0020); s != "" {
+		t.Errorf("Expected no label below putc, got %q", s)
+	}
+}
+
+func TestExtent(t *testing.T) {
+	syms := NewTable()
+	syms.Add(Symbol{Name: "putc", Value: 0x04E9})
+	syms.Add(Symbol{Name: "getc", Value: 0x0500})
+	syms.Add(Symbol{Name: "SIO_BASE", Value: 0x04F0, Kind: Constant})
+
+	if start, end, ok := syms.Extent("putc"); !ok || start != 0x04E9 || end != 0x04FF {
+		t.Errorf("Expected putc to cover 0x04e9 to 0x04ff, got %#04x to %#04x", start, end)
+	}
+	if start, end, ok := syms.Extent("getc"); !ok || start != 0x0500 || end != 0xFFFF {
+		t.Errorf("Expected getc to cover 0x0500 to the end of memory, got %#04x to %#04x", start, end)
+	}
+	if _, _, ok := syms.Extent("puts"); ok {
+		t.Errorf("Expected no extent for an unknown label")
+	}
+}
+
+func TestIsIdentifier(t *testing.T) {
+	tables := []struct {
+		s  string
+		ok bool
+	}{
+		{"loop", true}, {"_main", true}, {".local", true}, {"@@1", true}, {"?tmp", true}, {"str_cmd2", true},
+		{"", false}, {"2nd", false}, {"a-b", false}, {"AF'", false}, {"$", false},
+	}
+	for _, table := range tables {
+		if ok := IsIdentifier(table.s); ok != table.ok {
+			t.Errorf("IsIdentifier(%q) = %v, want %v", table.s, ok, table.ok)
+		}
+	}
+	if !IsHexDigit('f') || !IsHexDigit('A') || IsHexDigit('g') {
+		t.Errorf("Unexpected hex digits")
+	}
+}
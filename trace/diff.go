@@ -0,0 +1,53 @@
+package trace
+
+import "strings"
+
+// undocumentedFlags are the bits 3 and 5 of F, which are copies of bits of results that many
+// emulators do not emulate
+const undocumentedFlags = 0x28
+
+// Ignore is a set of fields by upper case name that are left out when comparing lines. The name XY
+// ignores the undocumented flags in AF and AF'.
+type Ignore map[string]bool
+
+// ParseIgnore parses a comma separated list of field names, such as "R,XY"
+func ParseIgnore(s string) Ignore {
+	ignore := make(Ignore)
+	for _, name := range strings.Split(s, ",") {
+		if name = strings.ToUpper(strings.TrimSpace(name)); name != "" {
+			ignore[name] = true
+		}
+	}
+	return ignore
+}
+
+// Difference is a field with different values in two lines
+type Difference struct {
+	Name      string
+	Want, Got string
+}
+
+// Compare returns the fields of want that have different values in got. Fields that are ignored or
+// missing from got are not compared, since traces of other emulators may not have all registers.
+func (ig Ignore) Compare(want, got []Field) []Difference {
+	var diffs []Difference
+	for _, w := range want {
+		name := strings.ToUpper(w.Name)
+		if ig[name] {
+			continue
+		}
+		var mask uint64 = ^uint64(0)
+		if ig["XY"] && (name == "AF" || name == "AF'") {
+			mask = ^uint64(undocumentedFlags)
+		}
+		for _, g := range got {
+			if strings.ToUpper(g.Name) == name {
+				if w.Value&mask != g.Value&mask {
+					diffs = append(diffs, Difference{w.Name, w.Text, g.Text})
+				}
+				break
+			}
+		}
+	}
+	return diffs
+}
@@ -0,0 +1,24 @@
+package trace
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCompare(t *testing.T) {
+	want := []Field{{"PC", 0x0100, "0100"}, {"AF", 0x4228, "4228"}, {"R", 0x12, "12"}, {"IM", 1, "1"}}
+	got := []Field{{"PC", 0x0100, "0100"}, {"AF", 0x4200, "4200"}, {"R", 0x00, "00"}}
+
+	diffs := ParseIgnore("").Compare(want, got)
+	expected := []Difference{{"AF", "4228", "4200"}, {"R", "12", "00"}}
+	if !reflect.DeepEqual(diffs, expected) {
+		t.Errorf("Expected the differences %v, got %v", expected, diffs)
+	}
+	if diffs := ParseIgnore(" r, xy").Compare(want, got); len(diffs) != 0 {
+		t.Errorf("Expected R and the undocumented flags to be ignored, got %v", diffs)
+	}
+	got[1].Value = 0x4300
+	if diffs := ParseIgnore("R,XY").Compare(want, got); len(diffs) != 1 || diffs[0].Name != "AF" {
+		t.Errorf("Expected A to be compared when ignoring the undocumented flags, got %v", diffs)
+	}
+}
@@ -0,0 +1,170 @@
+package trace
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Field is a named value in a line of a trace, such as a register or the clock cycles, which are
+// named CYC in all formats
+type Field struct {
+	Name  string
+	Value uint64
+
+	// Text is the value as written in the line
+	Text string
+}
+
+// parseText parses a line of the text format, where the opcode bytes and disassembly are skipped
+func parseText(s string) ([]Field, error) {
+	words := strings.Fields(s)
+	if len(words) < 2 {
+		return nil, errors.New("expected the clock cycles and the PC")
+	}
+	cycles, err := strconv.ParseUint(words[0], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid clock cycles %q", words[0])
+	}
+	pc, err := strconv.ParseUint(words[1], 16, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid PC %q", words[1])
+	}
+	fields := []Field{{"CYC", cycles, words[0]}, {"PC", pc, words[1]}}
+	for _, w := range words[2:] {
+		i := strings.IndexByte(w, '=')
+		if i <= 0 {
+			continue
+		}
+		v, err := strconv.ParseUint(w[i+1:], 16, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value in %q", w)
+		}
+		fields = append(fields, Field{w[:i], v, w[i+1:]})
+	}
+	if len(fields) == 2 {
+		return nil, errors.New("expected registers such as AF=0044")
+	}
+	return fields, nil
+}
+
+// parseRef parses a line of the ref format, where the bytes at the PC are skipped
+func parseRef(s string) ([]Field, error) {
+	regs, rest := s, ""
+	if i := strings.IndexByte(s, '('); i >= 0 {
+		regs, rest = s[:i], s[i:]
+	}
+	var fields []Field
+	for _, part := range strings.Split(regs, ",") {
+		if part = strings.TrimSpace(part); part == "" {
+			continue
+		}
+		i := strings.IndexByte(part, ':')
+		if i <= 0 {
+			return nil, fmt.Errorf("expected a register such as \"AF: 0044\", got %q", part)
+		}
+		text := strings.TrimSpace(part[i+1:])
+		v, err := strconv.ParseUint(text, 16, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value in %q", part)
+		}
+		fields = append(fields, Field{strings.TrimSpace(part[:i]), v, text})
+	}
+	if len(fields) == 0 || fields[0].Name != "PC" {
+		return nil, errors.New("expected the PC first")
+	}
+	if i := strings.Index(rest, "cyc:"); i >= 0 {
+		text := strings.TrimSpace(rest[i+len("cyc:"):])
+		v, err := strconv.ParseUint(text, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid clock cycles %q", text)
+		}
+		fields = append(fields, Field{"CYC", v, text})
+	}
+	return fields, nil
+}
+
+// DetectFormat returns the first format that can parse a line
+func DetectFormat(s string) (Format, bool) {
+	for _, f := range Formats {
+		if _, err := f.parse(s); err == nil {
+			return f, true
+		}
+	}
+	return Format{}, false
+}
+
+// maxLine is the longest line read from a trace
+const maxLine = 1 << 20
+
+// Reader reads the lines of a trace one at a time like a bufio.Scanner, so that traces larger than
+// the memory can be compared. Blank lines are skipped.
+type Reader struct {
+	// Format is the format of the trace, which is detected from the first line if it is not set
+	Format Format
+
+	scanner *bufio.Scanner
+	line    int
+	text    string
+	fields  []Field
+	err     error
+}
+
+// NewReader returns a reader of a trace
+func NewReader(r io.Reader) *Reader {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]uint8, 64*1024), maxLine)
+	return &Reader{scanner: scanner}
+}
+
+// Scan reads the next line, returning false at the end of the trace or on an error
+func (r *Reader) Scan() bool {
+	if r.err != nil {
+		return false
+	}
+	for r.scanner.Scan() {
+		r.line++
+		r.text = strings.TrimRight(r.scanner.Text(), "\r")
+		if strings.TrimSpace(r.text) == "" {
+			continue
+		}
+		if r.Format.parse == nil {
+			f, ok := DetectFormat(r.text)
+			if !ok {
+				r.err = fmt.Errorf("line %d: unknown trace format, expected one of %v", r.line, FormatNames())
+				return false
+			}
+			r.Format = f
+		}
+		if r.fields, r.err = r.Format.parse(r.text); r.err != nil {
+			r.err = fmt.Errorf("line %d: %w", r.line, r.err)
+			return false
+		}
+		return true
+	}
+	r.err = r.scanner.Err()
+	return false
+}
+
+// Line returns the number of the current line, starting at 1
+func (r *Reader) Line() int {
+	return r.line
+}
+
+// Text returns the current line
+func (r *Reader) Text() string {
+	return r.text
+}
+
+// Fields returns the fields of the current line
+func (r *Reader) Fields() []Field {
+	return r.fields
+}
+
+// Err returns the first error reading the trace
+func (r *Reader) Err() error {
+	return r.err
+}
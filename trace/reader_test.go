@@ -0,0 +1,57 @@
+package trace
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	for _, format := range Formats {
+		z := testCPU()
+		var out bytes.Buffer
+		w := NewWriter(&out, format)
+		z.Tracer = w
+		z.Step()
+		z.Step()
+		w.Flush()
+
+		line := strings.SplitN(out.String(), "\n", 2)[1]
+		fields, err := format.Parse(line)
+		if err != nil {
+			t.Fatalf("%v: %v", format.Name, err)
+		}
+		values := make(map[string]uint64)
+		for _, f := range fields {
+			values[f.Name] = f.Value
+		}
+		if format.After && (values["PC"] != 0x0003 || values["SP"] != 0x7FFE || values["CYC"] != 27) {
+			t.Errorf("%v: expected the registers after CALL at 0x0003, got %+v", format.Name, fields)
+		}
+		if !format.After && (values["PC"] != 0x0003 || values["SP"] != 0x8000 || values["CYC"] != 10) {
+			t.Errorf("%v: expected the registers before CALL at 0x0003, got %+v", format.Name, fields)
+		}
+		if f, ok := DetectFormat(line); !ok || f.Name != format.Name {
+			t.Errorf("Expected the format %v to be detected, got %v", format.Name, f.Name)
+		}
+	}
+	if _, ok := DetectFormat("Z80 Monitor"); ok {
+		t.Errorf("Expected no format for a line that is not a trace")
+	}
+}
+
+func TestReader(t *testing.T) {
+	r := NewReader(strings.NewReader("PC: 0000, AF: 0000, SP: 0000\t(F3 00 00 00), cyc: 0\n\n" +
+		"PC: 0001, AF: 0000, SP: 0000\t(18 30 00 00), cyc: 4\r\n" +
+		"PC: 0033, AF: 00XX, SP: 0000\n"))
+	var pcs []uint64
+	for r.Scan() {
+		pcs = append(pcs, r.Fields()[0].Value)
+	}
+	if r.Format.Name != "ref" || len(pcs) != 2 || pcs[1] != 1 || r.Line() != 4 {
+		t.Errorf("Expected two lines of the ref format before the error, got %v in the format %q", pcs, r.Format.Name)
+	}
+	if err := r.Err(); err == nil || !strings.HasPrefix(err.Error(), "line 4:") {
+		t.Errorf("Expected an error on line 4, got %v", err)
+	}
+}
@@ -0,0 +1,184 @@
+// Package trace writes a line per instruction executed by the CPU, with the registers in a format
+// that can be compared line by line with the traces of other runs and emulators
+package trace
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/antbern/z80-emulator/core"
+	"github.com/antbern/z80-emulator/disasm"
+	"github.com/antbern/z80-emulator/symbols"
+)
+
+// Line is an executed instruction
+type Line struct {
+	Instruction disasm.Instruction
+
+	// Before and After are the registers before and after the instruction
+	Before, After core.Registers
+
+	// Memory are the four bytes at the address of the instruction
+	Memory [4]uint8
+}
+
+// Format writes the lines of a trace, and parses them into fields for comparing traces
+type Format struct {
+	Name, Help string
+
+	// After is set for formats with the registers after each instruction rather than before it
+	After bool
+
+	write func(w *bufio.Writer, l *Line)
+	parse func(s string) ([]Field, error)
+}
+
+// Formats is the table of trace formats, where the first one is the default
+var Formats = []Format{
+	{Name: "text", Help: "the clock cycles, PC, opcode bytes and disassembly of each instruction, followed by all registers after it", After: true, write: writeText, parse: parseText},
+	{Name: "ref", Help: "the debug output of reference emulators such as superzazu/z80, with the registers before each instruction and the four bytes at the PC", write: writeRef, parse: parseRef},
+}
+
+// Parse returns the fields of a line
+func (f Format) Parse(s string) ([]Field, error) {
+	return f.parse(s)
+}
+
+// LookupFormat returns the format with the specified name
+func LookupFormat(name string) (Format, bool) {
+	for _, f := range Formats {
+		if f.Name == name {
+			return f, true
+		}
+	}
+	return Format{}, false
+}
+
+// FormatNames returns the names of the formats for flag help
+func FormatNames() string {
+	var names []string
+	for _, f := range Formats {
+		names = append(names, f.Name)
+	}
+	return strings.Join(names, ", ")
+}
+
+// writeText writes a line like
+//
+//	125  0008  3E 42        LD A,$42          AF=4244 BC=0300 ... I=00 R=00 IM=1 IFF=11
+func writeText(w *bufio.Writer, l *Line) {
+	in, r := l.Instruction, l.After
+	bytes := make([]string, len(in.Bytes))
+	for i, b := range in.Bytes {
+		bytes[i] = fmt.Sprintf("%02X", b)
+	}
+	fmt.Fprintf(w, "%10d  %04X  %-11s  %-18s  ", r.Cycles, in.Addr, strings.Join(bytes, " "), in.String())
+	fmt.Fprintf(w, "AF=%04X BC=%04X DE=%04X HL=%04X IX=%04X IY=%04X SP=%04X AF'=%04X BC'=%04X DE'=%04X HL'=%04X I=%02X R=%02X IM=%d IFF=%d%d\n",
+		r.AF, r.BC, r.DE, r.HL, r.IX, r.IY, r.SP, r.AFa, r.BCa, r.DEa, r.HLa, r.I, r.R, r.IM, bit(r.InterruptEnabled), bit(r.IFF2))
+}
+
+// writeRef writes a line like
+//
+//	PC: 0008, AF: 0044, BC: 0300, DE: 0000, HL: 0000, SP: 8000, IX: 0000, IY: 0000, I: 00, R: 00	(3E 42 06 03), cyc: 118
+func writeRef(w *bufio.Writer, l *Line) {
+	r, m := l.Before, l.Memory
+	fmt.Fprintf(w, "PC: %04X, AF: %04X, BC: %04X, DE: %04X, HL: %04X, SP: %04X, IX: %04X, IY: %04X, I: %02X, R: %02X\t(%02X %02X %02X %02X), cyc: %d\n",
+		r.PC, r.AF, r.BC, r.DE, r.HL, r.SP, r.IX, r.IY, r.I, r.R, m[0], m[1], m[2], m[3], r.Cycles)
+}
+
+// bit returns 1 for true and 0 for false
+func bit(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// Range is a range of addresses including End
+type Range struct {
+	Start, End uint16
+}
+
+// Contains returns true if the address is in the range
+func (r Range) Contains(addr uint16) bool {
+	return addr >= r.Start && addr <= r.End
+}
+
+// ParseRange parses a range given as a start and end address separated by a space, such as
+// "0x100 0x1FF" or "buf buf+15", or as a single label, which covers the addresses up to the next
+// label, or a single address. The table may be nil, in which case only numbers are accepted.
+func ParseRange(syms *symbols.Table, s string) (Range, error) {
+	fields := strings.Fields(s)
+	switch len(fields) {
+	case 1:
+		if syms != nil {
+			if start, end, ok := syms.Extent(fields[0]); ok {
+				return Range{start, end}, nil
+			}
+		}
+		addr, err := syms.ParseAddress(fields[0])
+		return Range{addr, addr}, err
+	case 2:
+		start, err := syms.ParseAddress(fields[0])
+		if err != nil {
+			return Range{}, err
+		}
+		end, err := syms.ParseAddress(fields[1])
+		if err != nil {
+			return Range{}, err
+		}
+		if end < start {
+			return Range{}, fmt.Errorf("the range %q ends before it starts", s)
+		}
+		return Range{start, end}, nil
+	}
+	return Range{}, fmt.Errorf("expected a label, an address or a start and end address, got %q", s)
+}
+
+// Writer writes a line per instruction executed by the CPU that it is the Tracer of. Errors are kept
+// until Flush is called.
+type Writer struct {
+	// Ranges limit the trace to the instructions at addresses in them, or all instructions if empty
+	Ranges []Range
+
+	// Names returns the name of an address used by an instruction, or an empty string to print it
+	// as a number
+	Names func(addr uint16) string
+
+	w      *bufio.Writer
+	format Format
+}
+
+// NewWriter returns a writer of a trace in a format
+func NewWriter(w io.Writer, format Format) *Writer {
+	return &Writer{w: bufio.NewWriter(w), format: format}
+}
+
+// Trace writes the line of the instruction that was executed, if it is in the ranges
+func (t *Writer) Trace(z *core.Z80, before core.Registers) {
+	if len(t.Ranges) > 0 {
+		in := false
+		for _, r := range t.Ranges {
+			if r.Contains(before.PC) {
+				in = true
+				break
+			}
+		}
+		if !in {
+			return
+		}
+	}
+	d := &disasm.Decoder{Label: t.Names}
+	l := Line{Instruction: d.Decode(z.Mem, before.PC), Before: before, After: z.Registers()}
+	for i := range l.Memory {
+		l.Memory[i] = z.Mem.Peek(before.PC + uint16(i))
+	}
+	t.format.write(t.w, &l)
+}
+
+// Flush writes any buffered lines, returning the first error writing the trace
+func (t *Writer) Flush() error {
+	return t.w.Flush()
+}
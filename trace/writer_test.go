@@ -0,0 +1,101 @@
+package trace
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/antbern/z80-emulator/asm"
+	"github.com/antbern/z80-emulator/core"
+	"github.com/antbern/z80-emulator/symbols"
+)
+
+// testCPU returns a CPU with a program that calls a routine at $0008
+func testCPU() *core.Z80 {
+	z := core.NewZ80()
+	code := asm.MustAssemble(0,
+		"LD SP,$8000", // 0000
+		"CALL $0008",  // 0003
+		"HALT",        // 0006
+		"NOP",         // 0007
+		"LD A,$42",    // 0008
+		"RET",         // 000A
+	)
+	z.Mem.Write(0, &code)
+	return &z
+}
+
+func TestWriter(t *testing.T) {
+	z := testCPU()
+	format, _ := LookupFormat("text")
+	var out bytes.Buffer
+	w := NewWriter(&out, format)
+	w.Names = func(addr uint16) string {
+		if addr == 0x0008 {
+			return "sub"
+		}
+		return ""
+	}
+	z.Tracer = w
+	for i := 0; i < 4; i++ {
+		z.Step()
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("Expected 4 lines, got:\n%v", out.String())
+	}
+	want := "        27  0003  CD 08 00     CALL sub            AF=0000 BC=0000 DE=0000 HL=0000 IX=0000 IY=0000 SP=7FFE AF'=0000 BC'=0000 DE'=0000 HL'=0000 I=00 R=02 IM=0 IFF=00"
+	if lines[1] != want {
+		t.Errorf("Expected the line\n%q, got\n%q", want, lines[1])
+	}
+	if !strings.Contains(lines[2], "0008  3E 42        LD A,$42") || !strings.Contains(lines[2], "AF=4200") {
+		t.Errorf("Expected the registers after LD A,$42, got\n%v", lines[2])
+	}
+}
+
+func TestRefFormat(t *testing.T) {
+	z := testCPU()
+	format, _ := LookupFormat("ref")
+	var out bytes.Buffer
+	w := NewWriter(&out, format)
+	w.Ranges = []Range{{0x0008, 0x000A}}
+	z.Tracer = w
+	for i := 0; i < 5; i++ {
+		z.Step()
+	}
+	w.Flush()
+	want := "PC: 0008, AF: 0000, BC: 0000, DE: 0000, HL: 0000, SP: 7FFE, IX: 0000, IY: 0000, I: 00, R: 02\t(3E 42 C9 00), cyc: 27\n" +
+		"PC: 000A, AF: 4200, BC: 0000, DE: 0000, HL: 0000, SP: 7FFE, IX: 0000, IY: 0000, I: 00, R: 03\t(C9 00 00 00), cyc: 34\n"
+	if out.String() != want {
+		t.Errorf("Expected the instructions of the routine\n%v, got\n%v", want, out.String())
+	}
+}
+
+func TestParseRange(t *testing.T) {
+	syms := symbols.NewTable()
+	syms.Add(symbols.Symbol{Name: "putc", Value: 0x0100})
+	syms.Add(symbols.Symbol{Name: "getc", Value: 0x0120})
+
+	tests := []struct {
+		s  string
+		r  Range
+		ok bool
+	}{
+		{"putc", Range{0x0100, 0x011F}, true},
+		{"0x100 0x1FF", Range{0x0100, 0x01FF}, true},
+		{"putc putc+3", Range{0x0100, 0x0103}, true},
+		{"$0200", Range{0x0200, 0x0200}, true},
+		{"getc putc", Range{}, false},
+		{"puts", Range{}, false},
+		{"1 2 3", Range{}, false},
+	}
+	for _, test := range tests {
+		r, err := ParseRange(syms, test.s)
+		if (err == nil) != test.ok || r != test.r {
+			t.Errorf("ParseRange(%q) = %+v, %v", test.s, r, err)
+		}
+	}
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+
+	"github.com/antbern/z80-emulator/core"
+	"github.com/antbern/z80-emulator/debugger"
+	"github.com/antbern/z80-emulator/io"
+	"github.com/antbern/z80-emulator/loader"
+	"github.com/antbern/z80-emulator/symbols"
+	"github.com/antbern/z80-emulator/trace"
+)
+
+// runTraceDiff implements the tracediff subcommand, which runs a program alongside a recorded trace
+// and reports the first instruction where the registers differ. It returns 0 if the traces match, 1
+// if they differ and 2 on errors.
+func runTraceDiff(args []string) int {
+	fs := flag.NewFlagSet("tracediff", flag.ExitOnError)
+	format := fs.String("format", "", "The format of the program files (bin, ihex or srec), chosen by file extension if empty")
+	traceFormat := fs.String("trace-format", "", "The format of the recorded trace ("+trace.FormatNames()+"), detected from its first line if empty")
+	var symFiles listFlags
+	fs.Var(&symFiles, "sym", "A listing or symbol file with labels for the program (repeatable). Listings beside the loaded files are used by default")
+	loadState := fs.String("load-state", "", "Start from a state saved with -save-state, or a ZX Spectrum .sna or .z80 snapshot, after loading the files")
+	bdos := fs.Bool("bdos", false, "Handle CALL 5 as a CP/M BDOS call")
+	ignore := fs.String("ignore", "", "The fields that are not compared, separated by commas, such as R, CYC, or XY for the undocumented flags in AF")
+	var ranges listFlags
+	fs.Var(&ranges, "range", "Only compare the instructions in a routine or address range, for traces written with -trace-range (repeatable)")
+	context := fs.Int("context", 5, "The number of matching lines shown before the first difference")
+	limit := fs.Uint64("limit", 0, "Stop after executing this many instructions, 0 for no limit")
+	maxGap := fs.Uint64("max-gap", 10000000, "Stop when this many instructions in a row are not traced, such as after leaving the -range for good, 0 for no limit")
+	debug := fs.Bool("debug", false, "Run the program again up to the first difference and enter the debugger there")
+	verbose := fs.Bool("v", false, "Log emulator debug output to stderr")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s tracediff [flags] trace.txt file[@addr]...\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() < 2 && *loadState == "" || fs.NArg() < 1 {
+		fs.Usage()
+		return 2
+	}
+	tracePath := fs.Arg(0)
+	if !*verbose {
+		log.SetOutput(ioutil.Discard)
+	}
+
+	var specs []loader.Spec
+	for _, arg := range fs.Args()[1:] {
+		spec, err := loader.ParseSpec(arg)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+		specs = append(specs, spec)
+	}
+	img, err := loader.LoadAll(specs, *format)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error loading file:", err)
+		return 2
+	}
+	syms, sources, err := loadSymbols(symFiles, specs)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error loading symbols:", err)
+		return 2
+	}
+	var traceRanges []trace.Range
+	for _, spec := range ranges {
+		r, err := trace.ParseRange(syms, spec)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error in -range:", err)
+			return 2
+		}
+		traceRanges = append(traceRanges, r)
+	}
+
+	// the machine is set up the same way for the comparison and the debugger, where the output of the
+	// program is only shown in the debugger
+	console := io.NewInput(os.Stdin)
+	newCPU := func(showOutput bool) (*core.Z80, error) {
+		output := ioutil.Discard
+		if showOutput {
+			output = os.Stdout
+		}
+		cpu := core.NewZ80()
+		bus := io.NewBus()
+		bus.Attach(io.SioBase, 4, io.NewSIO(console, output))
+		cpu.IO = bus
+		cpu.Symbols = syms
+		if *bdos {
+			cpu.BDOS = core.NewBDOS(console, output)
+			cpu.EnableBDOS = true
+		}
+		if err := cpu.LoadImage(img); err != nil {
+			return nil, err
+		}
+		if *loadState != "" {
+			if err := loadStateFile(&cpu, *loadState); err != nil {
+				return nil, err
+			}
+		}
+		return &cpu, nil
+	}
+
+	f, err := os.Open(tracePath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	defer f.Close()
+	recorded := trace.NewReader(f)
+	if *traceFormat != "" {
+		if recorded.Format, err = lookupTraceFormat(*traceFormat); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+	}
+
+	cpu, err := newCPU(false)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error loading file:", err)
+		return 2
+	}
+	if cpu.BDOS != nil {
+		defer cpu.BDOS.Close()
+	}
+
+	// the lines of the emulator are written to a buffer and parsed like the recorded ones, with the
+	// format known after reading the first recorded line
+	var lines bytes.Buffer
+	var w *trace.Writer
+
+	// the recent matching lines for the context, and the instruction counts where the last two traced
+	// instructions started
+	type match struct {
+		line int
+		text string
+	}
+	var recent []match
+	var steps, start, previous uint64
+	ignored := trace.ParseIgnore(*ignore)
+	for recorded.Scan() {
+		if w == nil {
+			w = trace.NewWriter(&lines, recorded.Format)
+			w.Ranges = traceRanges
+			w.Names = func(addr uint16) string {
+				name, _ := syms.Name(addr)
+				return name
+			}
+			cpu.Tracer = w
+		}
+
+		// run until the next traced instruction, which never comes once the CPU has halted outside
+		// the traced ranges, since nothing interrupts it here
+		previous = start
+		for gap := uint64(0); lines.Len() == 0; gap++ {
+			if *limit > 0 && steps >= *limit {
+				fmt.Printf("Stopped after %d instructions at line %d of %v without a difference\n", steps, recorded.Line(), tracePath)
+				return 0
+			}
+			if cpu.Halted && gap > 0 || *maxGap > 0 && gap >= *maxGap {
+				fmt.Printf("No more traced instructions after %d instructions, but the trace goes on at line %d of %v:\n", steps, recorded.Line(), tracePath)
+				fmt.Printf("- %8d  %v\n", recorded.Line(), recorded.Text())
+				return 1
+			}
+			start = steps
+			cpu.Step()
+			steps++
+			w.Flush()
+		}
+		ours := strings.TrimSuffix(lines.String(), "\n")
+		lines.Reset()
+		fields, err := recorded.Format.Parse(ours)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error parsing the trace of the emulator:", err)
+			return 2
+		}
+
+		diffs := ignored.Compare(recorded.Fields(), fields)
+		if len(diffs) == 0 {
+			recent = append(recent, match{recorded.Line(), recorded.Text()})
+			if len(recent) > *context {
+				recent = recent[1:]
+			}
+			continue
+		}
+
+		fmt.Printf("The first difference is at line %d of %v, after %d instructions:\n", recorded.Line(), tracePath, start)
+		for _, m := range recent {
+			fmt.Printf("  %8d  %v\n", m.line, m.text)
+		}
+		fmt.Printf("- %8d  %v\n", recorded.Line(), recorded.Text())
+		fmt.Printf("+ %8s  %v\n", "", ours)
+		for _, d := range diffs {
+			fmt.Printf("%v is %v in the trace and %v in the emulator\n", d.Name, d.Want, d.Got)
+		}
+
+		if *debug {
+			// the registers before an instruction were set by the instruction traced before it
+			stop := start
+			if !recorded.Format.After {
+				stop = previous
+			}
+			fmt.Printf("Running again to the state before instruction %d\n", stop)
+			if err := debugTo(newCPU, stop, syms, sources, console); err != nil {
+				fmt.Fprintln(os.Stderr, "Error loading file:", err)
+				return 2
+			}
+		}
+		return 1
+	}
+	if err := recorded.Err(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading %v: %v\n", tracePath, err)
+		return 2
+	}
+	fmt.Printf("No differences in the %d lines of %v\n", recorded.Line(), tracePath)
+	return 0
+}
+
+// lookupTraceFormat returns the trace format with a name
+func lookupTraceFormat(name string) (trace.Format, error) {
+	f, ok := trace.LookupFormat(name)
+	if !ok {
+		return f, fmt.Errorf("unknown trace format %q, expected one of %v", name, trace.FormatNames())
+	}
+	return f, nil
+}
+
+// debugTo runs a new machine for a number of instructions and enters the debugger
+func debugTo(newCPU func(showOutput bool) (*core.Z80, error), instructions uint64, syms *symbols.Table, sources *symbols.Sources, console *io.Input) error {
+	cpu, err := newCPU(true)
+	if err != nil {
+		return err
+	}
+	if cpu.BDOS != nil {
+		defer cpu.BDOS.Close()
+	}
+	d := debugger.New(cpu, console, os.Stderr)
+	d.Symbols = syms
+	d.Sources = sources
+	if instructions == 0 {
+		d.Start(true)
+		return nil
+	}
+	if err := d.AddTrigger("after", strconv.FormatUint(instructions, 10)); err != nil {
+		return err
+	}
+
+	// Ctrl-C stops the running program and enters interactive mode instead of quitting
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt)
+	defer signal.Stop(interrupts)
+	go func() {
+		for range interrupts {
+			d.Interrupt()
+		}
+	}()
+
+	d.Start(false)
+	return nil
+}
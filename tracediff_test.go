@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/antbern/z80-emulator/asm"
+	"github.com/antbern/z80-emulator/core"
+	"github.com/antbern/z80-emulator/trace"
+)
+
+// TestTraceDiffRangeNotReentered checks that a trace with more lines in a range than the program runs
+// is reported as a difference, both when the program halts and when it loops outside the range
+func TestTraceDiffRangeNotReentered(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tracediff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the program ends at 0006 with a HALT and a NOP or a JR to itself, both two bytes
+	for _, end := range [][]string{{"HALT", "NOP"}, {"JR $"}} {
+		lines := append([]string{"LD SP,$8000", "CALL $0008"}, end...)
+		code := asm.MustAssemble(0, append(lines, "LD A,$42", "RET")...)
+		program := filepath.Join(dir, "program.bin")
+		if err := ioutil.WriteFile(program, code, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		// the routine is called once, but the recorded trace has it twice
+		z := core.NewZ80()
+		z.Mem.Write(0, &code)
+		format, _ := trace.LookupFormat("ref")
+		var recorded bytes.Buffer
+		w := trace.NewWriter(&recorded, format)
+		w.Ranges = []trace.Range{{Start: 0x0008, End: 0x000A}}
+		z.Tracer = w
+		for i := 0; i < 4; i++ {
+			z.Step()
+		}
+		w.Flush()
+		recorded.Write(recorded.Bytes())
+		tracePath := filepath.Join(dir, "trace.txt")
+		if err := ioutil.WriteFile(tracePath, recorded.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		result := make(chan int, 1)
+		go func() {
+			result <- runTraceDiff([]string{"-range", "0x0008 0x000A", "-max-gap", "1000", tracePath, program + "@0"})
+		}()
+		select {
+		case got := <-result:
+			if got != 1 {
+				t.Errorf("Expected the extra lines to be a difference with %v, got the result %d", end, got)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("Expected tracediff to stop with %v after the range is left for good", end)
+		}
+	}
+}